@@ -0,0 +1,268 @@
+package duplo
+
+import (
+	"encoding/gob"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"sort"
+)
+
+var (
+	// KeyframeDistance is the minimum hamming distance between the dHash bit
+	// vectors of a frame and of the previous keyframe for the frame to become
+	// a keyframe itself (see CreateHashesFromFrames()). The first frame is
+	// always a keyframe.
+	KeyframeDistance = 10
+
+	// MaxKeyframes is the maximum number of keyframes hashed per animation. If
+	// more frames qualify as keyframes, they are thinned out evenly.
+	MaxKeyframes = 16
+)
+
+// FrameHash is the hash of a keyframe of an animated image.
+type FrameHash struct {
+	// The index of the frame in the animation, starting at 0.
+	Index int
+
+	// The hash of the frame.
+	Hash Hash
+}
+
+// AnimatedHash contains the hashes of an animated image (see
+// CreateHashesFromFrames()).
+type AnimatedHash struct {
+	// The hashes of the animation's keyframes, in the order of the frames.
+	Keyframes []FrameHash
+
+	// The hash of the average of the keyframes, which represents the
+	// animation as a whole.
+	Aggregate Hash
+}
+
+// FrameID is the ID under which a keyframe of an animated image is added to
+// a store by Store.AddAnimated(). Parent is the ID of the animated image
+// itself, Frame is the index of the keyframe in the animation.
+type FrameID struct {
+	Parent interface{}
+	Frame  int
+}
+
+// ParentID returns the ID of the animated image of which the image with the
+// given ID is a keyframe (see FrameID). For all other IDs, the ID itself is
+// returned.
+func ParentID(id interface{}) interface{} {
+	if frame, ok := id.(FrameID); ok {
+		return frame.Parent
+	}
+	return id
+}
+
+// CreateHashesFromFrames hashes the keyframes of an animation, given as its
+// fully composited frames, with the given options applied (see
+// CreateHashOpts()). A frame is a keyframe if it differs sufficiently from the
+// previous keyframe (see KeyframeDistance and MaxKeyframes). Frames which
+// cannot be hashed, e.g. empty frames, are skipped. The aggregate hash is the
+// hash of the keyframes' average, taken at the size of the first keyframe. An
+// error is returned if no frame could be hashed.
+//
+// This works for any multi-frame format, e.g. GIF (see
+// CreateHashesFromGIF()), APNG, or WebP, if a decoder provides its frames. A
+// still image is treated as an animation with one frame.
+func CreateHashesFromFrames(frames []image.Image, options ...HashOption) (AnimatedHash, error) {
+	var (
+		animated AnimatedHash
+		images   []image.Image
+	)
+	for index, frame := range frames {
+		if frame == nil {
+			continue
+		}
+		hash, _, err := CreateHashOpts(frame, options...)
+		if err != nil {
+			continue
+		}
+		if len(animated.Keyframes) > 0 {
+			previous := animated.Keyframes[len(animated.Keyframes)-1].Hash
+			if HammingDistance(previous.DHash[0], hash.DHash[0])+HammingDistance(previous.DHash[1], hash.DHash[1]) < KeyframeDistance {
+				continue
+			}
+		}
+		animated.Keyframes = append(animated.Keyframes, FrameHash{Index: index, Hash: hash})
+		images = append(images, frame)
+	}
+	if len(animated.Keyframes) == 0 {
+		return AnimatedHash{}, errors.New("Unable to hash animation without frames")
+	}
+
+	// Thin out the keyframes.
+	if MaxKeyframes > 0 && len(animated.Keyframes) > MaxKeyframes {
+		keyframes := make([]FrameHash, MaxKeyframes)
+		thinned := make([]image.Image, MaxKeyframes)
+		for index := range keyframes {
+			source := index * len(animated.Keyframes) / MaxKeyframes
+			keyframes[index], thinned[index] = animated.Keyframes[source], images[source]
+		}
+		animated.Keyframes, images = keyframes, thinned
+	}
+
+	// Hash the average keyframe.
+	if len(images) == 1 {
+		animated.Aggregate = animated.Keyframes[0].Hash
+		return animated, nil
+	}
+	var err error
+	animated.Aggregate, _, err = CreateHashOpts(averageImage(images), options...)
+	if err != nil {
+		return AnimatedHash{}, err
+	}
+
+	return animated, nil
+}
+
+// averageImage returns the per-pixel average of the given images, which must
+// not be empty, at the size of the first image. The other images are resized
+// to that size if necessary.
+func averageImage(images []image.Image) *image.RGBA {
+	bounds := images[0].Bounds()
+	rect := image.Rect(0, 0, bounds.Dx(), bounds.Dy())
+	sums := make([]uint32, 4*rect.Dx()*rect.Dy())
+	frame := image.NewRGBA(rect)
+	for _, img := range images {
+		if img.Bounds().Size() != rect.Size() {
+			img = DefaultScaler.Resize(uint(rect.Dx()), uint(rect.Dy()), img)
+		}
+		draw.Draw(frame, rect, img, img.Bounds().Min, draw.Src)
+		for index, value := range frame.Pix {
+			sums[index] += uint32(value)
+		}
+	}
+	for index, sum := range sums {
+		frame.Pix[index] = uint8(sum / uint32(len(images)))
+	}
+	return frame
+}
+
+// CreateHashesFromGIF hashes the keyframes of the given GIF animation, like
+// CreateHashesFromFrames(). The GIF's frames are composited according to their
+// disposal methods first.
+func CreateHashesFromGIF(g *gif.GIF, options ...HashOption) (AnimatedHash, error) {
+	if g == nil {
+		return AnimatedHash{}, errors.New("Unable to hash nil GIF")
+	}
+	return CreateHashesFromFrames(gifFrames(g), options...)
+}
+
+// gifFrames returns the fully composited frames of the given GIF animation.
+func gifFrames(g *gif.GIF) []image.Image {
+	// Determine the canvas size.
+	rect := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if rect.Empty() {
+		for _, frame := range g.Image {
+			rect = rect.Union(frame.Bounds())
+		}
+	}
+
+	canvas := image.NewRGBA(rect)
+	frames := make([]image.Image, 0, len(g.Image))
+	for index, frame := range g.Image {
+		var disposal byte
+		if index < len(g.Disposal) {
+			disposal = g.Disposal[index]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(rect)
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		composited := image.NewRGBA(rect)
+		copy(composited.Pix, canvas.Pix)
+		frames = append(frames, composited)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames
+}
+
+// AddAnimated adds an animated image (see CreateHashesFromFrames()) to the
+// store: The aggregate hash is added under the given ID and each keyframe
+// under a FrameID with the given ID as its parent. Still images can therefore
+// be matched against individual frames, and animations against other
+// animations. Use ParentID() to map query results to the animated images or
+// QueryAnimated() to query with an animation. Delete the image with
+// DeleteAnimated().
+func (store *Store) AddAnimated(id interface{}, animated AnimatedHash) {
+	gob.Register(id) // The frame IDs contain it.
+	store.Add(id, animated.Aggregate)
+	for _, keyframe := range animated.Keyframes {
+		store.Add(FrameID{Parent: id, Frame: keyframe.Index}, keyframe.Hash)
+	}
+}
+
+// DeleteAnimated removes an animated image which was added with
+// AddAnimated(), i.e. the image with the given ID and all keyframes with the
+// given ID as their parent. The number of removed images is returned.
+func (store *Store) DeleteAnimated(id interface{}) int {
+	var ids []interface{}
+	for _, other := range store.IDs() {
+		if other == id || ParentID(other) == id {
+			ids = append(ids, other)
+		}
+	}
+	return store.DeleteMany(ids)
+}
+
+// QueryAnimated performs a similarity search (see QueryWithOptions()) for the
+// aggregate hash and each keyframe of the given animation and returns, for
+// each matched image, the best match. Keyframes of the same animated image
+// (see AddAnimated()) are reported as one image: Only the best match with the
+// same ParentID() is returned, with the ID of the matched keyframe or
+// aggregate. A still image is found if it matches any keyframe. If
+// options.MaxResults is not 0, the best MaxResults matches are returned,
+// sorted by their score.
+func (store *Store) QueryAnimated(animated AnimatedHash, options *QueryOptions) Matches {
+	if options != nil && options.DHashPrescreen && options.MaxDHashDistance != 0 {
+		store.rLockDHashes()
+	} else {
+		store.RLock()
+	}
+	defer store.RUnlock()
+
+	best := make(map[interface{}]*Match)
+	hashes := []Hash{animated.Aggregate}
+	for _, keyframe := range animated.Keyframes {
+		hashes = append(hashes, keyframe.Hash)
+	}
+	for _, hash := range hashes {
+		for _, match := range store.queryWithOptions(hash, options) {
+			if match == nil {
+				continue
+			}
+			parent := ParentID(match.ID)
+			if other, ok := best[parent]; ok && other.Score <= match.Score {
+				continue
+			}
+			best[parent] = match
+		}
+	}
+
+	matches := make(Matches, 0, len(best))
+	for _, match := range best {
+		matches = append(matches, match)
+	}
+	if options != nil && options.MaxResults > 0 {
+		sort.Sort(matches)
+		if len(matches) > options.MaxResults {
+			matches = matches[:options.MaxResults]
+		}
+	}
+	return matches
+}
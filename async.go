@@ -0,0 +1,99 @@
+package duplo
+
+import (
+	"bufio"
+	"fmt"
+
+	"github.com/rivo/duplo/haar"
+)
+
+// LoadFileAsync loads a store saved with Store.SaveFile() from the file at the
+// given path, like LoadFile(), but returns as soon as the images' IDs have
+// been read. The index buckets and the remaining data are then decoded in the
+// background. This shortens the startup time of applications with large
+// stores, e.g. so they can start accepting requests right away.
+//
+// Note that the file is neither memory-mapped nor are the index buckets
+// decoded on demand: The whole store is decoded into memory eagerly, just not
+// before this function returns. A copy of the ID set is kept while loading so
+// memory usage peaks slightly higher than with LoadFile().
+//
+// While the store is loading, Has() and IDs() return immediately. All other
+// methods, e.g. Query() or Add(), block until loading has finished. Use
+// WaitLoaded() to wait for it explicitly and to learn whether it succeeded. If
+// loading fails, e.g. because the file is corrupted, the store is empty.
+func LoadFileAsync(path string, options ...Option) (*Store, error) {
+	file, err := openStoreFile(path)
+	if err != nil {
+		return nil, err
+	}
+	store := New(options...)
+	store.loaded = make(chan struct{})
+
+	// Decode in the background.
+	decoded := make(chan error, 1)
+	go func() {
+		store.lockBuckets()
+		var announced bool
+		_, err := store.readFrom(bufio.NewReader(file), func() {
+			// Publish a copy because store.ids is written to as soon as
+			// loading has finished, while readers may still use it.
+			ids := make(map[interface{}]uint64, len(store.ids))
+			for id, index := range store.ids {
+				ids[id] = index
+			}
+			store.loadingIDs.Store(&ids)
+			announced = true
+			decoded <- nil
+		})
+		file.Close()
+		if err != nil {
+			err = fmt.Errorf("Unable to load %s: %w", path, err)
+			store.clear()
+		}
+		store.loadErr = err
+		store.modified = false
+		store.loadingIDs.Store(nil)
+		close(store.loaded)
+		store.unlockBuckets()
+		if !announced {
+			decoded <- err // Failed before the IDs were available.
+		}
+	}()
+
+	// Wait for the IDs.
+	if err := <-decoded; err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// WaitLoaded waits until a store returned by LoadFileAsync() has been loaded
+// completely and returns the error which occurred during loading, if any. For
+// all other stores, it returns nil immediately.
+func (store *Store) WaitLoaded() error {
+	if store.loaded == nil {
+		return nil
+	}
+	<-store.loaded
+	return store.loadErr
+}
+
+// clear removes all images from the store. The store must be locked with
+// lockBuckets() when calling this function.
+func (store *Store) clear() {
+	store.candidates = nil
+	store.ids = make(map[interface{}]uint64)
+	store.free = nil
+	store.indices = make([]postings, 2*ImageScale*ImageScale*haar.ColourChannels)
+	store.dHashes = nil
+	store.negatives, store.negativeIDs, store.keyCounts = nil, nil, nil
+	store.suppressed = nil
+	store.interned = nil
+	store.setWeights(DefaultWeights)
+	store.scoreWeights = defaultScoreWeights
+	store.topCoefs = 0
+	store.generation = 0
+	store.legacyHashes = false
+}
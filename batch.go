@@ -0,0 +1,103 @@
+package duplo
+
+import (
+	"encoding/gob"
+	"reflect"
+	"runtime"
+	"sync"
+)
+
+// IDHash is an image ID together with the image's hash, used to add images in
+// bulk (see AddAll()).
+type IDHash struct {
+	ID   interface{}
+	Hash Hash
+}
+
+// AddAll adds the given images to the store, like calling Add() for each of
+// them, and returns the number of images which were added. Images whose ID is
+// already contained in the store, or which occur more than once, are only
+// added once. The bucket locations are calculated in parallel and the write
+// lock is only taken once, which makes this function considerably faster than
+// individual Add() calls when importing many images.
+func (store *Store) AddAll(images []IDHash) int {
+	// Calculate the bucket locations outside of the write lock.
+	locations := make([]SignificanceMap, len(images))
+	store.RLock()
+	parallelize(len(images), func(index int) {
+		hash := images[index].Hash
+		hash.Thresholds = store.thresholds(hash)
+		locations[index] = hash.SignificanceMap()
+	})
+	store.RUnlock()
+
+	// Add the candidates.
+	var added []int
+	store.Lock()
+	for index, image := range images {
+		candidate, err := store.reserve(image.ID, image.Hash, locations[index])
+		if err != nil {
+			continue
+		}
+		store.distribute(candidate, locations[index])
+		added = append(added, index)
+	}
+	store.Unlock()
+
+	// We need this for when we serialize the store.
+	registered := make(map[reflect.Type]bool)
+	for _, index := range added {
+		if t := reflect.TypeOf(images[index].ID); !registered[t] {
+			gob.Register(images[index].ID)
+			registered[t] = true
+		}
+	}
+
+	for _, index := range added {
+		store.notifyAdded(images[index].ID, images[index].Hash)
+	}
+
+	return len(added)
+}
+
+// QueryAll performs a similarity search (see Query()) for each of the given
+// hashes and returns their matches, in the order of the hashes. The read lock
+// is only taken once and the queries are distributed over multiple goroutines
+// (GOMAXPROCS).
+func (store *Store) QueryAll(hashes []Hash) []Matches {
+	store.RLock()
+	defer store.RUnlock()
+
+	results := make([]Matches, len(hashes))
+	parallelize(len(hashes), func(index int) {
+		results[index] = store.query(hashes[index])
+	})
+	return results
+}
+
+// parallelize calls "task" for each index from 0 to n-1, distributing the
+// calls over GOMAXPROCS goroutines. It returns when all calls are finished.
+func parallelize(n int, task func(index int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for index := 0; index < n; index++ {
+			task(index)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for index := worker; index < n; index += workers {
+				task(index)
+			}
+		}(worker)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,135 @@
+package duplo
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/rivo/duplo/haar"
+)
+
+// hashFormatVersion is the version of the binary hash format produced by
+// Hash.MarshalBinary().
+const hashFormatVersion = 1
+
+// foreignHashVersion is the version of the algorithms which compute the
+// foreign hashes (see ComputeBlockhash() and ComputeWHash()). Because these
+// hashes are optional (see WithForeignHashes()), it is not part of HashVersion
+// but stored in the binary hash format along with them, or 0 if a hash has no
+// foreign hashes. Foreign hashes of other versions are dropped when decoding.
+const foreignHashVersion = 1
+
+// maxHashCoefs is the maximum number of coefficients accepted when decoding a
+// hash. It protects against allocating huge amounts of memory for corrupt
+// data.
+const maxHashCoefs = 1 << 20
+
+// ErrHashVersion is returned by Hash.UnmarshalBinary() when the encoded hash
+// was created with a different version of the hashing algorithm (see
+// HashVersion). Such hashes cannot be compared to hashes created with the
+// current version. The original image needs to be hashed again.
+var ErrHashVersion = errors.New("Hash was created with a different hash version")
+
+// MarshalBinary implements encoding.BinaryMarshaler. The format is stable
+// across releases: The first byte is the format version, followed by a
+// deflate-compressed little-endian encoding of HashVersion, the matrix
+// dimensions, the coefficients, and the remaining hash fields. No information
+// is lost, i.e. a decoded hash is identical to the original.
+func (hash Hash) MarshalBinary() ([]byte, error) {
+	if uint(len(hash.Coefs)) != hash.Width*hash.Height {
+		return nil, fmt.Errorf("Number of coefficients (%d) does not match matrix dimensions %dx%d", len(hash.Coefs), hash.Width, hash.Height)
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteByte(hashFormatVersion)
+	compressor, err := flate.NewWriter(&buffer, flate.BestCompression)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create compressor: %s", err)
+	}
+
+	header := [3]uint32{HashVersion, uint32(hash.Width), uint32(hash.Height)}
+	values := []interface{}{header, hash.Coefs, hash.Thresholds, hash.Ratio, hash.DHash, hash.Histogram, hash.HistoMax}
+	if hash.Blockhash != [4]uint64{} || hash.WHash != 0 {
+		values = append(values, uint8(foreignHashVersion), hash.Blockhash, hash.WHash)
+	} else {
+		values = append(values, uint8(0))
+	}
+	values = append(values, hash.HistogramCounts, hash.Padded)
+	for _, value := range values {
+		if err := binary.Write(compressor, binary.LittleEndian, value); err != nil {
+			return nil, fmt.Errorf("Unable to encode hash: %s", err)
+		}
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, fmt.Errorf("Unable to compress hash: %s", err)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It decodes hashes
+// encoded with Hash.MarshalBinary(). If the hash was created with a different
+// HashVersion, ErrHashVersion is returned.
+func (hash *Hash) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("Unable to decode empty hash")
+	}
+	if data[0] != hashFormatVersion {
+		return fmt.Errorf("Unknown hash format version %d", data[0])
+	}
+	decompressor := flate.NewReader(bytes.NewReader(data[1:]))
+	defer decompressor.Close()
+
+	var header [3]uint32
+	if err := binary.Read(decompressor, binary.LittleEndian, &header); err != nil {
+		return fmt.Errorf("Unable to decode hash header: %s", err)
+	}
+	if header[0] != HashVersion {
+		return ErrHashVersion
+	}
+	if uint64(header[1])*uint64(header[2]) > maxHashCoefs {
+		return fmt.Errorf("Invalid matrix dimensions %dx%d", header[1], header[2])
+	}
+
+	var decoded Hash
+	decoded.Width = uint(header[1])
+	decoded.Height = uint(header[2])
+	decoded.Coefs = make([]haar.Coef, decoded.Width*decoded.Height)
+	read := func(values ...interface{}) error {
+		for _, value := range values {
+			if err := binary.Read(decompressor, binary.LittleEndian, value); err != nil {
+				return fmt.Errorf("Unable to decode hash: %s", err)
+			}
+		}
+		return nil
+	}
+	if err := read(decoded.Coefs, &decoded.Thresholds, &decoded.Ratio, &decoded.DHash, &decoded.Histogram, &decoded.HistoMax); err != nil {
+		return err
+	}
+
+	// The foreign hashes.
+	var foreign uint8
+	if err := read(&foreign); err != nil {
+		return err
+	}
+	if foreign != 0 {
+		if err := read(&decoded.Blockhash, &decoded.WHash); err != nil {
+			return err
+		}
+		if foreign != foreignHashVersion {
+			decoded.Blockhash, decoded.WHash = [4]uint64{}, 0
+		}
+	}
+
+	if err := read(&decoded.HistogramCounts, &decoded.Padded); err != nil {
+		return err
+	}
+	if n, _ := decompressor.Read(make([]byte, 1)); n > 0 {
+		return errors.New("Unexpected data after hash")
+	}
+
+	*hash = decoded
+	return nil
+}
@@ -0,0 +1,108 @@
+package duplo
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Shot is a photo taken at a specific point in time. Shots are used to detect
+// bursts, i.e. series of photos taken in quick succession.
+type Shot struct {
+	// ID is the unique ID that identifies the photo.
+	ID interface{}
+
+	// Hash is the visual hash of the photo.
+	Hash Hash
+
+	// Time is the time the photo was taken (e.g. from the EXIF data).
+	Time time.Time
+}
+
+// BurstOptions control which shots are considered to belong to the same
+// burst.
+type BurstOptions struct {
+	// MaxInterval is the maximum time between two consecutive shots of a
+	// burst.
+	MaxInterval time.Duration
+
+	// MaxDHashDistance is the maximum hamming distance between the dHash bit
+	// vectors of two consecutive shots of a burst.
+	MaxDHashDistance int
+
+	// MaxHistogramDistance is the maximum hamming distance between the
+	// histogram bit vectors of two consecutive shots of a burst.
+	MaxHistogramDistance int
+
+	// MaxRatioDiff is the maximum absolute difference between the image
+	// ratios' log values of two consecutive shots of a burst.
+	MaxRatioDiff float64
+}
+
+// DefaultBurstOptions are burst options which work well for typical camera
+// burst modes.
+var DefaultBurstOptions = BurstOptions{
+	MaxInterval:          2 * time.Second,
+	MaxDHashDistance:     12,
+	MaxHistogramDistance: 12,
+	MaxRatioDiff:         0.01,
+}
+
+// GroupBursts groups the given shots into bursts. A burst is a series of at
+// least two shots where each shot was taken no later than
+// options.MaxInterval after the previous one and where the two shots are
+// visually almost identical.
+//
+// The IDs of each burst are returned in the order the shots were taken. The
+// IDs of all shots which are not part of any burst are returned in "others".
+// These may then be checked for general duplicates. Users typically want to
+// keep bursts while deleting true duplicates.
+func GroupBursts(shots []Shot, options BurstOptions) (bursts [][]interface{}, others []interface{}) {
+	// Process shots in chronological order.
+	sorted := make([]Shot, len(shots))
+	copy(sorted, shots)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time.Before(sorted[j].Time)
+	})
+
+	// Close a group of shots.
+	var group []interface{}
+	flush := func() {
+		if len(group) > 1 {
+			bursts = append(bursts, group)
+		} else if len(group) == 1 {
+			others = append(others, group[0])
+		}
+		group = nil
+	}
+
+	for index, shot := range sorted {
+		if index > 0 && !continuesBurst(sorted[index-1], shot, options) {
+			flush()
+		}
+		group = append(group, shot.ID)
+	}
+	flush()
+
+	return
+}
+
+// continuesBurst returns whether the shot "next" continues a burst whose last
+// shot is "previous".
+func continuesBurst(previous, next Shot, options BurstOptions) bool {
+	if next.Time.Sub(previous.Time) > options.MaxInterval {
+		return false
+	}
+	if previous.Hash.Ratio <= 0 || next.Hash.Ratio <= 0 {
+		return false // Not a valid hash, e.g. a zero Hash.
+	}
+	if math.Abs(math.Log(previous.Hash.Ratio)-math.Log(next.Hash.Ratio)) > options.MaxRatioDiff {
+		return false
+	}
+	dHashDistance := HammingDistance(previous.Hash.DHash[0], next.Hash.DHash[0]) +
+		HammingDistance(previous.Hash.DHash[1], next.Hash.DHash[1])
+	if dHashDistance > options.MaxDHashDistance {
+		return false
+	}
+	return HammingDistance(previous.Hash.Histogram, next.Hash.Histogram) <= options.MaxHistogramDistance
+}
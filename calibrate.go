@@ -0,0 +1,158 @@
+package duplo
+
+import (
+	"math"
+
+	"github.com/rivo/duplo/haar"
+)
+
+// LabeledPair is a pair of image hashes which is known to be a duplicate or
+// not, used to calibrate the weights of the scoring function (see
+// Calibrate()).
+type LabeledPair struct {
+	A, B      Hash
+	Duplicate bool
+}
+
+// Calibration parameters: The number of gradient descent iterations, the
+// learning rate, and the strength of the L2 regularization.
+var (
+	calibrationIterations   = 2000
+	calibrationLearningRate = 0.5
+	calibrationL2           = 1e-4
+)
+
+// Calibrate determines weights of the scoring function (see Weights) which
+// separate the given duplicate pairs from the non-duplicate pairs, e.g. to
+// tune a store for a specific kind of content such as screenshots or scanned
+// documents. Apply the result with Store.SetWeights(). The pairs should be
+// representative of the images and the modifications expected in the store.
+// Their hashes must have been created by CreateHash() or a related function.
+//
+// The Haar score of a pair is linear in the weights: Bin 0 weighs the
+// difference of the scaling function coefficients, per colour channel, while
+// bins 1 to 5 are subtracted for each shared significant coefficient in that
+// bin. Queries only use the totals of bins 1 to 5 over all colour channels so
+// these totals are learned and distributed over the colour channels in the
+// proportions of DefaultWeights. The weights are fitted with a logistic
+// regression, constrained to be non-negative, and then scaled so that their
+// sum equals that of DefaultWeights, which keeps scores in a familiar range.
+//
+// If there are no duplicate pairs or no non-duplicate pairs, DefaultWeights
+// are returned.
+func Calibrate(pairs []LabeledPair) Weights {
+	// Extract the features. The score of a pair is the dot product of its
+	// features and the parameters.
+	const numFeatures = haar.ColourChannels + 5
+	features := make([][numFeatures]float64, len(pairs))
+	var duplicates int
+	for index, pair := range pairs {
+		if pair.Duplicate {
+			duplicates++
+		}
+		for channel := 0; channel < haar.ColourChannels; channel++ {
+			features[index][channel] = math.Abs(pair.A.Coefs[0][channel] - pair.B.Coefs[0][channel])
+		}
+		a, b := pair.A.SignificanceMap(), pair.B.SignificanceMap()
+		for i, j := 0, 0; i < len(a) && j < len(b); {
+			switch {
+			case a[i] < b[j]:
+				i++
+			case a[i] > b[j]:
+				j++
+			default:
+				features[index][haar.ColourChannels+locationBin(a[i])-1]--
+				i++
+				j++
+			}
+		}
+	}
+	if duplicates == 0 || duplicates == len(pairs) {
+		return DefaultWeights
+	}
+
+	// Standardize the features so one learning rate fits all of them.
+	var scales [numFeatures]float64
+	for _, feature := range features {
+		for index, value := range feature {
+			scales[index] += math.Abs(value)
+		}
+	}
+	for index := range scales {
+		scales[index] /= float64(len(features))
+		if scales[index] == 0 {
+			scales[index] = 1
+		}
+	}
+
+	// Logistic regression: The probability of a duplicate is
+	// sigmoid(bias - score). Duplicates and non-duplicates are weighted
+	// equally, regardless of their numbers.
+	var (
+		params [numFeatures]float64
+		bias   float64
+	)
+	for index := range params {
+		params[index] = 1
+	}
+	classWeights := [2]float64{
+		0.5 / float64(len(pairs)-duplicates),
+		0.5 / float64(duplicates),
+	}
+	for iteration := 0; iteration < calibrationIterations; iteration++ {
+		var (
+			gradient     [numFeatures]float64
+			biasGradient float64
+		)
+		for index, feature := range features {
+			score := 0.0
+			for f, value := range feature {
+				score += params[f] * value / scales[f]
+			}
+			var label, classWeight float64
+			if pairs[index].Duplicate {
+				label, classWeight = 1, classWeights[1]
+			} else {
+				classWeight = classWeights[0]
+			}
+			residual := classWeight * (1/(1+math.Exp(score-bias)) - label)
+			biasGradient += residual
+			for f, value := range feature {
+				gradient[f] -= residual * value / scales[f]
+			}
+		}
+		bias -= calibrationLearningRate * biasGradient
+		for f := range params {
+			params[f] -= calibrationLearningRate * (gradient[f] + calibrationL2*params[f])
+			if params[f] < 0 {
+				params[f] = 0
+			}
+		}
+	}
+
+	// Convert the parameters into weights.
+	defaultSums := DefaultWeights.sums()
+	var weights Weights
+	var total, defaultTotal float64
+	for channel := range weights {
+		weights[channel][0] = params[channel] / scales[channel]
+		total += weights[channel][0]
+		defaultTotal += DefaultWeights[channel][0]
+		for bin := 1; bin < 6; bin++ {
+			weight := params[haar.ColourChannels+bin-1] / scales[haar.ColourChannels+bin-1]
+			weights[channel][bin] = weight * DefaultWeights[channel][bin] / defaultSums[bin]
+			total += weights[channel][bin]
+			defaultTotal += DefaultWeights[channel][bin]
+		}
+	}
+	if total == 0 {
+		return DefaultWeights // The pairs cannot be separated.
+	}
+	for channel := range weights {
+		for bin := range weights[channel] {
+			weights[channel][bin] *= defaultTotal / total
+		}
+	}
+
+	return weights
+}
@@ -1,6 +1,11 @@
 package duplo
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
 	"github.com/rivo/duplo/haar"
 )
 
@@ -25,4 +30,157 @@ type candidate struct {
 
 	// The histogram maximum (see Hash for more information).
 	histoMax [3]float32
+
+	// The quantized histogram counts (see Hash for more information) or nil
+	// if they are not retained (see RetainHistogramCounts).
+	histogramCounts *[64]uint8
+
+	// The Blockhash bit vector (see Hash for more information).
+	blockhash [4]uint64
+
+	// The wavelet hash bit vector (see Hash for more information).
+	wHash uint64
+
+	// locations contains the index bucket locations (see Store.indices) this
+	// image was added to, in ascending order.
+	locations SignificanceMap
+
+	// added is the time the image was added to the store, in nanoseconds
+	// since the Unix epoch.
+	added int64
+
+	// generation is the store generation in which the image was added.
+	generation uint64
+
+	// padded indicates that the image's hash was created with padding (see
+	// Hash.Padded).
+	padded bool
+}
+
+// The tags of the candidate fields in the serialized candidate record (see
+// encodeFields()). Tags must never be reused.
+const (
+	tagScaleCoef = iota + 1
+	tagRatio
+	tagDHash
+	tagHistogram
+	tagHistoMax
+	tagHistogramCounts
+	tagBlockhash
+	tagWHash
+	tagAdded
+	tagGeneration
+	tagPadded
+)
+
+// encodeFields serializes the candidate's fields (except for its ID and its
+// locations, which are restored from the index) into a tag-length-value
+// record: For each field, its tag and the length of its value are written as
+// unsigned varints, followed by the little-endian encoded value. This allows
+// new fields to be added without breaking older readers which simply skip
+// unknown tags.
+func (c *candidate) encodeFields() []byte {
+	record := make([]byte, 0, 128)
+	field := func(tag uint64, values ...uint64) {
+		record = binary.AppendUvarint(record, tag)
+		record = binary.AppendUvarint(record, uint64(len(values)*8))
+		for _, value := range values {
+			record = binary.LittleEndian.AppendUint64(record, value)
+		}
+	}
+
+	field(tagScaleCoef, math.Float64bits(c.scaleCoef[0]), math.Float64bits(c.scaleCoef[1]), math.Float64bits(c.scaleCoef[2]))
+	field(tagRatio, math.Float64bits(c.ratio))
+	field(tagDHash, c.dHash[0], c.dHash[1])
+	field(tagHistogram, c.histogram)
+	field(tagHistoMax, uint64(math.Float32bits(c.histoMax[0])), uint64(math.Float32bits(c.histoMax[1])), uint64(math.Float32bits(c.histoMax[2])))
+	if c.histogramCounts != nil {
+		record = binary.AppendUvarint(record, tagHistogramCounts)
+		record = binary.AppendUvarint(record, uint64(len(c.histogramCounts)))
+		record = append(record, c.histogramCounts[:]...)
+	}
+	field(tagBlockhash, c.blockhash[:]...)
+	field(tagWHash, c.wHash)
+	field(tagAdded, uint64(c.added))
+	field(tagGeneration, c.generation)
+	if c.padded {
+		field(tagPadded, 1)
+	}
+
+	return record
+}
+
+// decodeFields restores the candidate's fields from a record created with
+// encodeFields(). Unknown tags are skipped.
+func (c *candidate) decodeFields(record []byte) error {
+	for len(record) > 0 {
+		tag, n := binary.Uvarint(record)
+		if n <= 0 {
+			return errors.New("Invalid candidate field tag")
+		}
+		record = record[n:]
+		length, n := binary.Uvarint(record)
+		if n <= 0 || uint64(len(record)-n) < length {
+			return fmt.Errorf("Invalid length of candidate field %d", tag)
+		}
+		value := record[n : n+int(length)]
+		record = record[n+int(length):]
+
+		// Decode fixed-size fields.
+		var words []uint64
+		switch tag {
+		case tagScaleCoef, tagHistoMax:
+			words = make([]uint64, 3)
+		case tagDHash:
+			words = make([]uint64, 2)
+		case tagBlockhash:
+			words = make([]uint64, 4)
+		case tagRatio, tagHistogram, tagWHash, tagAdded, tagGeneration, tagPadded:
+			words = make([]uint64, 1)
+		case tagHistogramCounts:
+			if len(value) != len(c.histogramCounts) {
+				return errors.New("Invalid length of histogram counts")
+			}
+			c.histogramCounts = new([64]uint8)
+			copy(c.histogramCounts[:], value)
+			continue
+		default:
+			continue // Unknown field. Skip.
+		}
+		if len(value) != len(words)*8 {
+			return fmt.Errorf("Invalid length of candidate field %d", tag)
+		}
+		for index := range words {
+			words[index] = binary.LittleEndian.Uint64(value[index*8:])
+		}
+
+		switch tag {
+		case tagScaleCoef:
+			for index := range c.scaleCoef {
+				c.scaleCoef[index] = math.Float64frombits(words[index])
+			}
+		case tagRatio:
+			c.ratio = math.Float64frombits(words[0])
+		case tagDHash:
+			copy(c.dHash[:], words)
+		case tagHistogram:
+			c.histogram = words[0]
+		case tagHistoMax:
+			for index := range c.histoMax {
+				c.histoMax[index] = math.Float32frombits(uint32(words[index]))
+			}
+		case tagBlockhash:
+			copy(c.blockhash[:], words)
+		case tagWHash:
+			c.wHash = words[0]
+		case tagAdded:
+			c.added = int64(words[0])
+		case tagGeneration:
+			c.generation = words[0]
+		case tagPadded:
+			c.padded = words[0] != 0
+		}
+	}
+
+	return nil
 }
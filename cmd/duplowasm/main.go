@@ -0,0 +1,99 @@
+//go:build js && wasm
+
+/*
+Command duplowasm exposes duplo's hashing to JavaScript when compiled to
+WebAssembly, so that browsers can perform pre-upload duplicate checks with the
+exact same hashing as a Go backend. Build it with:
+
+	GOOS=js GOARCH=wasm go build -o duplo.wasm github.com/rivo/duplo/cmd/duplowasm
+
+and load it with the wasm_exec.js file shipped with Go. It defines a global
+"duplo" object with the following functions:
+
+	duplo.createHash(data)
+
+Decodes the image (JPEG, PNG, GIF, or WebP) contained in the Uint8Array "data"
+and returns its hash as a Uint8Array. The hash may be sent to the backend and
+decoded there with duplo.Hash.UnmarshalBinary().
+
+	duplo.compare(hashA, hashB)
+
+Compares two hashes created with duplo.createHash() and returns an object with
+the fields "score", "ratioDiff", "dHashDistance", "histogramDistance",
+"blockhashDistance", "wHashDistance", and "similarity" (see duplo.Compare()).
+
+Both functions return an object with an "error" field if something goes wrong.
+*/
+package main
+
+import (
+	"bytes"
+	"syscall/js"
+
+	"github.com/rivo/duplo"
+)
+
+func main() {
+	js.Global().Set("duplo", js.ValueOf(map[string]interface{}{
+		"createHash": js.FuncOf(createHash),
+		"compare":    js.FuncOf(compare),
+	}))
+
+	// Keep the functions available.
+	select {}
+}
+
+// createHash implements duplo.createHash().
+func createHash(this js.Value, args []js.Value) interface{} {
+	if len(args) != 1 {
+		return failure("createHash expects one argument")
+	}
+	data := make([]byte, args[0].Get("length").Int())
+	js.CopyBytesToGo(data, args[0])
+
+	hash, _, err := duplo.CreateHashFromReader(bytes.NewReader(data))
+	if err != nil {
+		return failure(err.Error())
+	}
+
+	encoded, err := hash.MarshalBinary()
+	if err != nil {
+		return failure("Unable to encode hash: " + err.Error())
+	}
+	result := js.Global().Get("Uint8Array").New(len(encoded))
+	js.CopyBytesToJS(result, encoded)
+
+	return result
+}
+
+// compare implements duplo.compare().
+func compare(this js.Value, args []js.Value) interface{} {
+	if len(args) != 2 {
+		return failure("compare expects two arguments")
+	}
+	var hashes [2]duplo.Hash
+	for index := range hashes {
+		data := make([]byte, args[index].Get("length").Int())
+		js.CopyBytesToGo(data, args[index])
+		if err := hashes[index].UnmarshalBinary(data); err != nil {
+			return failure("Unable to decode hash: " + err.Error())
+		}
+	}
+
+	match := duplo.Compare(hashes[0], hashes[1])
+
+	return map[string]interface{}{
+		"score":             match.Score,
+		"ratioDiff":         match.RatioDiff,
+		"dHashDistance":     match.DHashDistance,
+		"histogramDistance": match.HistogramDistance,
+		"blockhashDistance": match.BlockhashDistance,
+		"wHashDistance":     match.WHashDistance,
+		"similarity":        match.Similarity,
+	}
+}
+
+// failure returns an object containing the given error message.
+func failure(message string) interface{} {
+	return map[string]interface{}{"error": message}
+}
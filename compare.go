@@ -0,0 +1,53 @@
+package duplo
+
+import (
+	"math"
+)
+
+// Compare compares two image hashes directly, without the need for a store.
+// The resulting match contains the same score and metrics as the match
+// returned by Query() on a store which only contains "a", when queried with
+// "b" (except that the score is also calculated if the images don't share any
+// significant coefficients). The match's ID is nil. The default weights are
+// used for scoring. Hashes created in different padding modes (see
+// Hash.Padded) are never matched: Their score is positive infinity and their
+// similarity is zero.
+func Compare(a, b Hash) Match {
+	weightSums := DefaultWeights.sums()
+
+	// The initial score is based on the scaling function coefficients.
+	var match Match
+	if len(a.Coefs) > 0 && len(b.Coefs) > 0 {
+		for colour := range a.Coefs[0] {
+			match.Score += DefaultWeights[colour][0] * math.Abs(a.Coefs[0][colour]-b.Coefs[0][colour])
+		}
+	}
+
+	// Subtract the weights of shared coefficients.
+	mapA, mapB := a.SignificanceMap(), b.SignificanceMap()
+	for i, j := 0, 0; i < len(mapA) && j < len(mapB); {
+		switch {
+		case mapA[i] < mapB[j]:
+			i++
+		case mapA[i] > mapB[j]:
+			j++
+		default:
+			match.Score -= weightSums[locationBin(mapA[i])]
+			i++
+			j++
+		}
+	}
+
+	match.HaarScore = match.Score
+	match.setMetrics(&candidate{
+		ratio:     a.Ratio,
+		dHash:     a.DHash,
+		histogram: a.Histogram,
+		blockhash: a.Blockhash,
+		wHash:     a.WHash,
+	}, b, mapScore(mapB, weightSums))
+	if a.Padded != b.Padded {
+		match.Score, match.HaarScore, match.Similarity = math.Inf(1), math.Inf(1), 0
+	}
+	return match
+}
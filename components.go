@@ -0,0 +1,38 @@
+package duplo
+
+import (
+	"math"
+)
+
+// ScoreComponents are the terms which make up a match's Haar score (see
+// Match.HaarScore). Element 0 is the weighted difference between the two
+// images' scaling function coefficients. Elements 1 to 6 are the (negative)
+// weights subtracted for the significant coefficients shared by both images,
+// accumulated per weight bin 0 to 5 (see Weights). Bin 0 only contains the
+// scaling function coefficient which is never shared, so element 1 is always
+// 0. The sum of all components is the Haar score.
+type ScoreComponents [7]float64
+
+// scoreComponents calculates the score components of the given candidate when
+// queried with the given hash and its significance map. The store must be at
+// least read-locked when calling this function.
+func (store *Store) scoreComponents(c *candidate, hash Hash, locations SignificanceMap) *ScoreComponents {
+	components := new(ScoreComponents)
+	for colour := range c.scaleCoef {
+		components[0] += store.weights[colour][0] * math.Abs(c.scaleCoef[colour]-hash.Coefs[0][colour])
+	}
+	var i, j int
+	for i < len(c.locations) && j < len(locations) {
+		switch {
+		case c.locations[i] < locations[j]:
+			i++
+		case c.locations[i] > locations[j]:
+			j++
+		default:
+			components[1+locationBin(locations[j])] -= store.weightSums[locationBin(locations[j])]
+			i++
+			j++
+		}
+	}
+	return components
+}
@@ -0,0 +1,59 @@
+package duplo
+
+import (
+	"math"
+)
+
+// defaultScoreWeights are the default weights of the composite score: The
+// score is the Haar wavelet score only.
+var defaultScoreWeights = [4]float64{1, 0, 0, 0}
+
+// SetScoreWeights configures the composite score of this store's matches
+// (Match.Score), which is then calculated as:
+//
+//	haar*HaarScore + dHash*DHashDistance + histogram*HistogramDistance + ratio*RatioDiff
+//
+// As with the Haar score, the lower the composite score, the better the
+// match. Query results are ranked and filtered (see QueryOptions) by the
+// composite score. The default weights are (1, 0, 0, 0), i.e. the score is the
+// Haar score. Note that Haar scores are typically negative, in the order of
+// -10 to -100 for good matches, while the distances are positive and small.
+func (store *Store) SetScoreWeights(haar, dHash, histogram, ratio float64) {
+	store.Lock()
+	store.scoreWeights = [4]float64{haar, dHash, histogram, ratio}
+	store.markModified()
+	store.Unlock()
+
+	store.persistUnlogged()
+}
+
+// ScoreWeights returns the weights of the composite score (see
+// SetScoreWeights()).
+func (store *Store) ScoreWeights() (haar, dHash, histogram, ratio float64) {
+	store.RLock()
+	defer store.RUnlock()
+
+	return store.scoreWeights[0], store.scoreWeights[1], store.scoreWeights[2], store.scoreWeights[3]
+}
+
+// compositeScore returns the composite score of the given candidate, given its
+// Haar score, when queried with the given hash. The store must be at least
+// read-locked when calling this function.
+func (store *Store) compositeScore(candidate *candidate, haarScore float64, hash Hash) float64 {
+	if store.scoreWeights == defaultScoreWeights {
+		return haarScore
+	}
+	weights := store.scoreWeights
+	score := weights[0] * haarScore
+	if weights[1] != 0 {
+		score += weights[1] * float64(HammingDistance(candidate.dHash[0], hash.DHash[0])+
+			HammingDistance(candidate.dHash[1], hash.DHash[1]))
+	}
+	if weights[2] != 0 {
+		score += weights[2] * float64(HammingDistance(candidate.histogram, hash.Histogram))
+	}
+	if weights[3] != 0 {
+		score += weights[3] * math.Abs(math.Log(candidate.ratio)-math.Log(hash.Ratio))
+	}
+	return score
+}
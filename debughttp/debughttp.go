@@ -0,0 +1,175 @@
+/*
+Package debughttp provides HTTP endpoints which let operators inspect a
+running duplo store without custom tooling. Mount the handler in an existing
+HTTP server:
+
+	http.Handle("/debug/duplo/", debughttp.Handler(store, &debughttp.Options{
+		Prefix: "/debug/duplo/",
+		Authorize: func(r *http.Request) bool {
+			return r.Header.Get("Authorization") == "Bearer "+token
+		},
+	}))
+
+The following endpoints are provided, relative to the prefix:
+
+	stats         The store statistics (see duplo.Store.Stats()) as JSON.
+	metrics       The store statistics in the Prometheus text format.
+	buckets       A PNG heatmap of the index bucket occupancy.
+	buckets.json  The number of entries of each index bucket as JSON.
+	slow          The most recent slow queries as JSON (see
+	              duplo.Store.SetSlowQueryThreshold()).
+	config        The store's configuration as JSON.
+*/
+package debughttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/rivo/duplo"
+	"github.com/rivo/duplo/haar"
+)
+
+// Options configure the debug handler.
+type Options struct {
+	// Prefix is the path under which the handler is mounted, e.g.
+	// "/debug/duplo/". It defaults to "/debug/".
+	Prefix string
+
+	// Authorize is called for every request. If it returns false, the request
+	// is answered with "403 Forbidden". If it is nil, all requests are
+	// allowed, so make sure the handler is not reachable by the public.
+	Authorize func(r *http.Request) bool
+}
+
+// handler serves the debug endpoints of a store.
+type handler struct {
+	store   *duplo.Store
+	options Options
+}
+
+// Handler returns an HTTP handler which serves the debug endpoints of the
+// given store. If options is nil, default options are used.
+func Handler(store *duplo.Store, options *Options) http.Handler {
+	h := &handler{store: store}
+	if options != nil {
+		h.options = *options
+	}
+	if h.options.Prefix == "" {
+		h.options.Prefix = "/debug/"
+	}
+	return h
+}
+
+// ServeHTTP implements http.Handler.
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.options.Authorize != nil && !h.options.Authorize(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, h.options.Prefix) {
+	case "stats":
+		writeJSON(w, h.store.Stats())
+	case "metrics":
+		h.metrics(w)
+	case "buckets":
+		h.heatmap(w)
+	case "buckets.json":
+		writeJSON(w, h.store.BucketSizes())
+	case "slow":
+		writeJSON(w, h.store.SlowQueries())
+	case "config":
+		h.config(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeJSON writes the given value as a JSON response.
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to encode response: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// metrics writes the store statistics in the Prometheus text format.
+func (h *handler) metrics(w http.ResponseWriter) {
+	stats := h.store.Stats()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, metric := range []struct {
+		name, kind, help string
+		value            float64
+	}{
+		{"duplo_images", "gauge", "The number of images in the store.", float64(stats.Images)},
+		{"duplo_slots", "gauge", "The number of candidate slots, including those of deleted images.", float64(stats.Slots)},
+		{"duplo_index_entries", "gauge", "The total number of entries in all index buckets.", float64(stats.IndexEntries)},
+		{"duplo_used_buckets", "gauge", "The number of index buckets which are not empty.", float64(stats.UsedBuckets)},
+		{"duplo_largest_bucket", "gauge", "The number of entries in the largest index bucket.", float64(stats.LargestBucket)},
+		{"duplo_queries_total", "counter", "The number of queries performed on the store.", float64(stats.Queries)},
+		{"duplo_generation", "gauge", "The store generation.", float64(h.store.Generation())},
+		{"duplo_slow_queries", "gauge", "The number of logged slow queries.", float64(len(h.store.SlowQueries()))},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+	}
+}
+
+// heatmap writes a PNG image of the bucket occupancy. The image consists of
+// one ImageScale x ImageScale tile per colour channel (horizontally) and sign
+// (vertically, positive first), each pixel representing the coefficient at
+// that position. Brighter pixels denote fuller buckets, on a logarithmic
+// scale.
+func (h *handler) heatmap(w http.ResponseWriter) {
+	sizes := h.store.BucketSizes()
+	var max int
+	for _, size := range sizes {
+		if size > max {
+			max = size
+		}
+	}
+
+	img := image.NewGray(image.Rect(0, 0, haar.ColourChannels*duplo.ImageScale, 2*duplo.ImageScale))
+	for location, size := range sizes {
+		if size == 0 {
+			continue
+		}
+		sign := location / (duplo.ImageScale * duplo.ImageScale * haar.ColourChannels)
+		coefIndex := location % (duplo.ImageScale * duplo.ImageScale * haar.ColourChannels) / haar.ColourChannels
+		channel := location % haar.ColourChannels
+		x := channel*duplo.ImageScale + coefIndex%duplo.ImageScale
+		y := sign*duplo.ImageScale + coefIndex/duplo.ImageScale
+		img.SetGray(x, y, color.Gray{Y: uint8(math.Round(255 * math.Log1p(float64(size)) / math.Log1p(float64(max))))})
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	if err := png.Encode(w, img); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to encode heatmap: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// config writes the store's configuration.
+func (h *handler) config(w http.ResponseWriter) {
+	haarWeight, dHashWeight, histogramWeight, ratioWeight := h.store.ScoreWeights()
+	writeJSON(w, map[string]interface{}{
+		"imageScale":            duplo.ImageScale,
+		"topCoefs":              duplo.TopCoefs,
+		"thresholdMode":         duplo.ThresholdMode,
+		"retainHistogramCounts": duplo.RetainHistogramCounts,
+		"hashVersion":           duplo.HashVersion,
+		"weights":               h.store.Weights(),
+		"scoreWeights":          []float64{haarWeight, dHashWeight, histogramWeight, ratioWeight},
+	})
+}
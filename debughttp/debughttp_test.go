@@ -0,0 +1,98 @@
+package debughttp
+
+import (
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rivo/duplo"
+	"github.com/rivo/duplo/duplotest"
+)
+
+// Test the debug endpoints.
+func TestHandler(t *testing.T) {
+	store := duplo.New()
+	for _, name := range duplotest.FixtureNames {
+		hash, _ := duplo.CreateHash(duplotest.Fixture(name))
+		store.Add(name, hash)
+	}
+	store.SetSlowQueryThreshold(time.Nanosecond)
+	hash, _ := duplo.CreateHash(duplotest.Fixture(duplotest.FixtureNames[0]))
+	store.Query(hash)
+
+	handler := Handler(store, &Options{
+		Prefix: "/debug/duplo/",
+		Authorize: func(r *http.Request) bool {
+			return r.Header.Get("Authorization") == "secret"
+		},
+	})
+	get := func(path string, authorized bool) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/debug/duplo/"+path, nil)
+		if authorized {
+			request.Header.Set("Authorization", "secret")
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	if response := get("stats", false); response.Code != http.StatusForbidden {
+		t.Errorf("Expected forbidden, got %d", response.Code)
+	}
+	if response := get("unknown", true); response.Code != http.StatusNotFound {
+		t.Errorf("Expected not found, got %d", response.Code)
+	}
+
+	var stats duplo.Stats
+	if err := json.Unmarshal(get("stats", true).Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Images != len(duplotest.FixtureNames) || stats.Queries != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	metrics := get("metrics", true).Body.String()
+	if !strings.Contains(metrics, "# TYPE duplo_queries_total counter\nduplo_queries_total 1\n") {
+		t.Errorf("Unexpected metrics:\n%s", metrics)
+	}
+
+	img, err := png.Decode(get("buckets", true).Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != 3*duplo.ImageScale || size.Y != 2*duplo.ImageScale {
+		t.Errorf("Unexpected heatmap size %s", size)
+	}
+
+	var sizes []int
+	if err := json.Unmarshal(get("buckets.json", true).Body.Bytes(), &sizes); err != nil {
+		t.Fatal(err)
+	}
+	var entries int
+	for _, size := range sizes {
+		entries += size
+	}
+	if entries != stats.IndexEntries {
+		t.Errorf("Expected %d bucket entries, got %d", stats.IndexEntries, entries)
+	}
+
+	var slow []duplo.SlowQuery
+	if err := json.Unmarshal(get("slow", true).Body.Bytes(), &slow); err != nil {
+		t.Fatal(err)
+	}
+	if len(slow) != 1 || slow[0].Matches == 0 {
+		t.Errorf("Unexpected slow queries: %+v", slow)
+	}
+
+	var config map[string]interface{}
+	if err := json.Unmarshal(get("config", true).Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["topCoefs"] != float64(duplo.TopCoefs) {
+		t.Errorf("Unexpected config: %v", config)
+	}
+}
@@ -0,0 +1,153 @@
+package duplo
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"  // Register GIF decoder.
+	_ "image/jpeg" // Register JPEG decoder.
+	_ "image/png"  // Register PNG decoder.
+	"io"
+	"os"
+	"sync"
+
+	_ "golang.org/x/image/webp" // Register WebP decoder.
+)
+
+// Decoder decodes an image from a reader.
+type Decoder func(r io.Reader) (image.Image, error)
+
+// decoderFormat is a decoder registered with RegisterDecoder().
+type decoderFormat struct {
+	name, magic string
+	decode      Decoder
+}
+
+var (
+	// The decoders registered with RegisterDecoder(), in the order of their
+	// registration.
+	decoders      []decoderFormat
+	decodersMutex sync.RWMutex
+)
+
+// RegisterDecoder registers an image decoder for the format with the given
+// name, e.g. for HEIC, AVIF, or JPEG XL images which are not supported by the
+// standard library. "magic" is the prefix which identifies the format's
+// encoding. Each "?" in it matches any one byte. For example, HEIC images may
+// be registered with the magic "????ftypheic".
+//
+// Registered decoders are used by DecodeImage(), and thus by
+// CreateHashFromReader() and CreateHashFromFile(). They take precedence over
+// the decoders registered with the standard library's image package (JPEG,
+// PNG, GIF, and WebP are always available). If multiple registered decoders match,
+// the one registered last is used. This function may be called concurrently,
+// typically from a package's init() function.
+func RegisterDecoder(name, magic string, decode Decoder) {
+	decodersMutex.Lock()
+	defer decodersMutex.Unlock()
+	decoders = append(decoders, decoderFormat{name: name, magic: magic, decode: decode})
+}
+
+// matchMagic returns whether the given header starts with the given magic
+// string, where "?" matches any byte.
+func matchMagic(magic string, header []byte) bool {
+	if len(header) < len(magic) {
+		return false
+	}
+	for index := 0; index < len(magic); index++ {
+		if magic[index] != '?' && magic[index] != header[index] {
+			return false
+		}
+	}
+	return true
+}
+
+// DecodeImage decodes an image from the given reader using the decoders
+// registered with RegisterDecoder() or, if none matches, the image package's
+// decoders. The name of the image format is also returned.
+func DecodeImage(r io.Reader) (image.Image, string, error) {
+	decodersMutex.RLock()
+	formats := decoders
+	decodersMutex.RUnlock()
+
+	// Peek at the header.
+	var maxMagic int
+	for _, format := range formats {
+		if len(format.magic) > maxMagic {
+			maxMagic = len(format.magic)
+		}
+	}
+	reader := bufio.NewReader(r)
+	header, err := reader.Peek(maxMagic)
+	if err != nil && err != io.EOF {
+		return nil, "", fmt.Errorf("Unable to read image: %s", err)
+	}
+
+	// Try the registered decoders first.
+	for index := len(formats) - 1; index >= 0; index-- {
+		format := formats[index]
+		if !matchMagic(format.magic, header) {
+			continue
+		}
+		img, err := format.decode(reader)
+		if err != nil {
+			return nil, format.name, fmt.Errorf("Unable to decode %s image: %s", format.name, err)
+		}
+		if img == nil {
+			return nil, format.name, errors.New("Decoder for " + format.name + " returned no image")
+		}
+		return img, format.name, nil
+	}
+
+	// Fall back to the standard library.
+	img, name, err := image.Decode(reader)
+	if err != nil {
+		return nil, name, fmt.Errorf("Unable to decode image: %s", err)
+	}
+	return img, name, nil
+}
+
+// CreateHashFromReader decodes an image from the given reader (see
+// DecodeImage()) and returns its hash and its resized version, like
+// CreateHashOpts().
+func CreateHashFromReader(r io.Reader, options ...HashOption) (Hash, image.Image, error) {
+	img, _, err := DecodeImage(r)
+	if err != nil {
+		return Hash{}, nil, err
+	}
+	return CreateHashOpts(img, options...)
+}
+
+// CreateHashFromFile decodes the image file with the given path (see
+// DecodeImage()) and returns its hash and its resized version, like
+// CreateHashOpts().
+func CreateHashFromFile(path string, options ...HashOption) (Hash, image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Hash{}, nil, fmt.Errorf("Unable to open image: %s", err)
+	}
+	defer file.Close()
+	return CreateHashFromReader(file, options...)
+}
+
+// HashReader decodes an image from the given reader and returns its hash. It
+// supports JPEG, PNG, GIF, and WebP images as well as all formats registered
+// with RegisterDecoder() (see DecodeImage()). The EXIF orientation of JPEG
+// images is applied before hashing (see CreateHashAutoOrient()). The hash
+// options are applied as in CreateHashOpts().
+func HashReader(r io.Reader, options ...HashOption) (Hash, error) {
+	hash, _, err := CreateHashAutoOrient(r, options...)
+	return hash, err
+}
+
+// HashFile decodes the image file with the given path and returns its hash,
+// like HashReader().
+func HashFile(path string, options ...HashOption) (Hash, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Hash{}, fmt.Errorf("Unable to open image: %s", err)
+	}
+	defer file.Close()
+	return HashReader(file, options...)
+}
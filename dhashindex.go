@@ -0,0 +1,207 @@
+package duplo
+
+import (
+	"context"
+)
+
+const (
+	// dHashChunks is the number of 16 bit chunks into which the 128 bit dHash
+	// is split for the dHash index.
+	dHashChunks = 8
+
+	// maxChunkRadius is the maximum Hamming distance per chunk up to which
+	// the dHash index is used. For larger distances, too many chunk values
+	// need to be looked up and all candidates are examined instead.
+	maxChunkRadius = 3
+)
+
+// dHashIndex is a multi-index hash of the candidates' dHashes. Each of the
+// dHashChunks maps contains the candidate indices for the values of one 16
+// bit chunk of the dHash. If two dHashes are within a Hamming distance of d,
+// at least one of their chunks is within a distance of d/dHashChunks (the
+// pigeonhole principle), so only chunk values within that distance need to be
+// looked up.
+type dHashIndex [dHashChunks]map[uint16][]uint64
+
+// dHashChunk returns the given chunk of a dHash.
+func dHashChunk(dHash [2]uint64, chunk int) uint16 {
+	return uint16(dHash[chunk/4] >> (16 * (chunk % 4)))
+}
+
+// newDHashIndex returns a dHash index of the given candidates. Deleted
+// candidates are skipped.
+func newDHashIndex(candidates []candidate) *dHashIndex {
+	index := new(dHashIndex)
+	for chunk := range index {
+		index[chunk] = make(map[uint16][]uint64)
+	}
+	for i := range candidates {
+		if candidates[i].id != nil {
+			index.add(uint64(i), candidates[i].dHash)
+		}
+	}
+	return index
+}
+
+// add adds the candidate with the given index and dHash to the index.
+func (index *dHashIndex) add(i uint64, dHash [2]uint64) {
+	for chunk := range index {
+		value := dHashChunk(dHash, chunk)
+		index[chunk][value] = append(index[chunk][value], i)
+	}
+}
+
+// remove removes the candidate with the given index and dHash from the index.
+func (index *dHashIndex) remove(i uint64, dHash [2]uint64) {
+	for chunk := range index {
+		value := dHashChunk(dHash, chunk)
+		list := index[chunk][value]
+		for position, other := range list {
+			if other == i {
+				list = append(list[:position], list[position+1:]...)
+				break
+			}
+		}
+		if len(list) == 0 {
+			delete(index[chunk], value)
+		} else {
+			index[chunk][value] = list
+		}
+	}
+}
+
+// neighbours calls visit for all 16 bit values within the given Hamming
+// distance of "value", flipping only bits at positions "from" and above.
+func neighbours(value uint16, distance, from int, visit func(uint16)) {
+	visit(value)
+	if distance == 0 {
+		return
+	}
+	for bit := from; bit < 16; bit++ {
+		neighbours(value^(1<<bit), distance-1, bit+1, visit)
+	}
+}
+
+// QueryDHash returns the images whose dHash (see Hash.DHash) is within the
+// given Hamming distance of the given hash's dHash. This is much faster than
+// a full query if only near-exact duplicates are of interest, i.e. for small
+// distances. The matches' metrics and scores are calculated as for Query().
+// Images on the negative list of the hash (see MarkFalsePositive()),
+// suppressed images, and images hashed in a different padding mode (see
+// Hash.Padded) are not returned. The returned slice will not be sorted.
+//
+// The first call to QueryDHash() builds a secondary index over the dHashes of
+// all images in the store, which is then maintained when images are added or
+// deleted. Distances up to 31 make use of this index.
+func (store *Store) QueryDHash(hash Hash, maxDistance int) Matches {
+	store.rLockDHashes()
+	defer store.RUnlock()
+	store.queries.Add(1)
+
+	// Create matches.
+	hash.Thresholds = store.thresholds(hash)
+	locations := hash.SignificanceMap()
+	bestScore := store.bestScore(hash)
+	negatives := store.negatives[keyOf(hash)]
+	var matches Matches
+	for _, index := range store.dHashCandidates(hash, maxDistance) {
+		candidate := &store.candidates[index]
+		if store.excludes(candidate, hash, negatives) {
+			continue
+		}
+		var score float64
+		for _, component := range store.scoreComponents(candidate, hash, locations) {
+			score += component
+		}
+		matches = append(matches, store.match(index, score, hash, bestScore))
+	}
+
+	return matches
+}
+
+// rLockDHashes read-locks the store, making sure that the dHash index exists.
+// The store must not be locked when calling this function.
+func (store *Store) rLockDHashes() {
+	store.RLock()
+	for store.dHashes == nil {
+		// Build the index first.
+		store.RUnlock()
+		store.Lock()
+		if store.dHashes == nil {
+			store.dHashes = newDHashIndex(store.candidates)
+		}
+		store.Unlock()
+		store.RLock()
+	}
+}
+
+// dHashCandidates returns the indices of the candidates whose dHash is within
+// the given Hamming distance of the given hash's dHash. The dHash index is
+// used if it exists and the distance is small enough. Otherwise, all
+// candidates are examined. The store must be at least read-locked when
+// calling this function.
+func (store *Store) dHashCandidates(hash Hash, maxDistance int) (indices []uint64) {
+	if maxDistance < 0 {
+		return nil
+	}
+	within := func(index uint64) bool {
+		candidate := &store.candidates[index]
+		return candidate.id != nil &&
+			HammingDistance(candidate.dHash[0], hash.DHash[0])+HammingDistance(candidate.dHash[1], hash.DHash[1]) <= maxDistance
+	}
+
+	radius := maxDistance / dHashChunks
+	if store.dHashes == nil || radius > maxChunkRadius {
+		for index := range store.candidates {
+			if within(uint64(index)) {
+				indices = append(indices, uint64(index))
+			}
+		}
+		return
+	}
+
+	seen := make(map[uint64]bool)
+	for chunk := range store.dHashes {
+		neighbours(dHashChunk(hash.DHash, chunk), radius, 0, func(value uint16) {
+			for _, index := range store.dHashes[chunk][value] {
+				if !seen[index] {
+					seen[index] = true
+					if within(index) {
+						indices = append(indices, index)
+					}
+				}
+			}
+		})
+	}
+	return
+}
+
+// prescreen returns the indices and the Haar scores of the candidates whose
+// dHash is within the given Hamming distance of the given hash's dHash and
+// which share at least one index bucket with the hash. This is the first
+// stage of a query with QueryOptions.DHashPrescreen. It stops with the
+// context's error when the given context is done. The store must be at least
+// read-locked when calling this function.
+func (store *Store) prescreen(ctx context.Context, hash Hash, maxDistance int) (indices []uint64, scores []float64, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	hash.Thresholds = store.thresholds(hash)
+	locations := hash.SignificanceMap()
+	for _, index := range store.dHashCandidates(hash, maxDistance) {
+		if err = ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		candidate := &store.candidates[index]
+		if candidate.locations.Overlap(locations) == 0 {
+			continue // A full query would not find this candidate.
+		}
+		var score float64
+		for _, component := range store.scoreComponents(candidate, hash, locations) {
+			score += component
+		}
+		indices = append(indices, index)
+		scores = append(scores, score)
+	}
+	return
+}
@@ -0,0 +1,105 @@
+package duplo
+
+// StoreDiff is the result of comparing two stores with Diff().
+type StoreDiff struct {
+	// The IDs of the images which are only contained in the first store.
+	OnlyA []interface{}
+
+	// The IDs of the images which are only contained in the second store.
+	OnlyB []interface{}
+
+	// The IDs of the images which are contained in both stores but whose
+	// stored hash data differs.
+	Changed []interface{}
+}
+
+// Equal returns true if no differences were found.
+func (d *StoreDiff) Equal() bool {
+	return len(d.OnlyA) == 0 && len(d.OnlyB) == 0 && len(d.Changed) == 0
+}
+
+// Diff compares the images contained in the two stores, e.g. to verify a
+// backup or to synchronize two stores incrementally. The IDs in the result
+// are in the order of the stores' candidate slots. The hash data of an image
+// differs if any of the values derived from its hash differ, i.e. its scaling
+// function coefficient, its ratio, its bit vectors, or its index bucket
+// locations. The time at which the image was added and its generation are
+// ignored. Histogram counts are only compared if both stores retain them (see
+// RetainHistogramCounts). The stores' configurations, e.g. their weights, are
+// not compared.
+//
+// The stores are only locked while snapshots of their states are taken.
+func Diff(a, b *Store) *StoreDiff {
+	candidatesA := a.candidateSnapshot()
+	defer a.releaseSnapshot()
+	candidatesB := b.candidateSnapshot()
+	defer b.releaseSnapshot()
+
+	// Index the second store.
+	indexB := make(map[interface{}]*candidate, len(candidatesB))
+	for index := range candidatesB {
+		if candidatesB[index].id != nil {
+			indexB[candidatesB[index].id] = &candidatesB[index]
+		}
+	}
+
+	// Compare.
+	diff := new(StoreDiff)
+	inA := make(map[interface{}]struct{}, len(candidatesA))
+	for index := range candidatesA {
+		candidateA := &candidatesA[index]
+		if candidateA.id == nil {
+			continue
+		}
+		inA[candidateA.id] = struct{}{}
+		candidateB, ok := indexB[candidateA.id]
+		if !ok {
+			diff.OnlyA = append(diff.OnlyA, candidateA.id)
+		} else if !candidateA.sameHash(candidateB) {
+			diff.Changed = append(diff.Changed, candidateA.id)
+		}
+	}
+	for _, candidate := range candidatesB {
+		if candidate.id == nil {
+			continue
+		}
+		if _, ok := inA[candidate.id]; !ok {
+			diff.OnlyB = append(diff.OnlyB, candidate.id)
+		}
+	}
+
+	return diff
+}
+
+// candidateSnapshot returns the store's current candidates, which may then be
+// read without locking. releaseSnapshot() must be called when they are not
+// used anymore. The store must not be locked when calling this function.
+func (store *Store) candidateSnapshot() []candidate {
+	store.RLock()
+	defer store.RUnlock()
+	store.distributing.Lock() // Wait for concurrent Add() calls to finish.
+	defer store.distributing.Unlock()
+
+	store.snapshots.Add(1)
+	store.candidatesShared.Store(true)
+	return store.candidates
+}
+
+// sameHash returns true if the hash data of the two candidates is the same
+// (see Diff()).
+func (c *candidate) sameHash(other *candidate) bool {
+	if c.scaleCoef != other.scaleCoef || c.ratio != other.ratio || c.dHash != other.dHash ||
+		c.histogram != other.histogram || c.histoMax != other.histoMax || c.blockhash != other.blockhash ||
+		c.wHash != other.wHash || len(c.locations) != len(other.locations) {
+		return false
+	}
+	if c.histogramCounts != nil && other.histogramCounts != nil && *c.histogramCounts != *other.histogramCounts {
+		return false
+	}
+	for index, location := range c.locations {
+		if other.locations[index] != location {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,241 @@
+package duplo
+
+import (
+	"context"
+	"math"
+
+	"github.com/rivo/duplo/haar"
+)
+
+// Progress is a callback which receives the number of processed images out of
+// the total number of images to be processed.
+type Progress func(done, total int)
+
+// FindAllDuplicates groups all images in the store into clusters of
+// duplicates. Two images are considered duplicates if their score (see
+// Match.Score) is lower than the given threshold. Clusters are the connected
+// components of this relation, i.e. an image belongs to a cluster if it is a
+// duplicate of at least one other image of the cluster. Only clusters with at
+// least two images are returned.
+//
+// Instead of querying the store with every image, the index is joined with
+// itself: Each image's buckets are scanned once for the images which follow
+// it in the store. The result is the same as comparing all pairs of images.
+//
+// If progress is not nil, it is called with the number of images processed so
+// far. It is called from the calling goroutine. Updates are dropped while the
+// callback is still busy with a previous one but the last call always reports
+// all images as processed. Store modifications made by the callback block
+// until the join is complete.
+func (store *Store) FindAllDuplicates(threshold float64, progress Progress) [][]interface{} {
+	type result struct {
+		clusters [][]interface{}
+		total    int
+	}
+	updates := make(chan [2]int, 1)
+	results := make(chan result, 1)
+
+	go func() {
+		store.RLock()
+		defer store.RUnlock()
+		defer close(updates)
+
+		clusters := store.selfJoin(threshold, func(done, total int) {
+			select {
+			case updates <- [2]int{done, total}:
+			default:
+				// Caller is not keeping up. Drop the update.
+			}
+		})
+		results <- result{clusters, len(store.candidates)}
+	}()
+
+	last := -1
+	for update := range updates {
+		if progress != nil {
+			progress(update[0], update[1])
+		}
+		last = update[0]
+	}
+	r := <-results
+	if progress != nil && last != r.total {
+		progress(r.total, r.total)
+	}
+
+	return r.clusters
+}
+
+// StreamDuplicatePairs enumerates all pairs of duplicate images in the store,
+// like FindAllDuplicates() but without collecting them. For each pair of images
+// whose score is lower than the given threshold, "pair" is called with the
+// IDs of the two images and the match of the second image when queried with
+// the first one. Each pair is reported once. If "pair" returns false, the
+// enumeration stops.
+//
+// The store is only read-locked while the pairs of one image are determined,
+// so memory usage does not grow with the size of the store and the store may
+// be modified while pairs are streamed, even by "pair" itself. Modifications
+// may or may not be reflected in the reported pairs. The context may be used
+// to cancel the enumeration, in which case the context's error is returned.
+func (store *Store) StreamDuplicatePairs(ctx context.Context, threshold float64, pair func(a, b interface{}, match *Match) bool) error {
+	var (
+		scratch joinScratch
+		matches Matches
+	)
+	for index := 0; ; index++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Determine this image's pairs.
+		store.RLock()
+		if index >= len(store.candidates) {
+			store.RUnlock()
+			return nil
+		}
+		id := store.candidates[index].id
+		bestScore := mapScore(store.candidates[index].locations, store.weightSums)
+		store.joinRow(index, threshold, &scratch, func(other uint64, score float64, hash Hash) {
+			matches = append(matches, store.match(other, score, hash, bestScore))
+		})
+		store.RUnlock()
+
+		// Report them.
+		for _, match := range matches {
+			if !pair(id, match.ID, match) {
+				return nil
+			}
+		}
+		matches = matches[:0]
+	}
+}
+
+// selfJoin calculates the clusters of FindAllDuplicates(), calling progress
+// after each processed image. The store must be at least read-locked when
+// calling this function.
+func (store *Store) selfJoin(threshold float64, progress Progress) [][]interface{} {
+	total := len(store.candidates)
+
+	// Union-find over candidate indices.
+	parents := make([]uint64, total)
+	for index := range parents {
+		parents[index] = uint64(index)
+	}
+	find := func(index uint64) uint64 {
+		for parents[index] != index {
+			parents[index] = parents[parents[index]]
+			index = parents[index]
+		}
+		return index
+	}
+
+	// Join each candidate with the candidates that follow it.
+	var scratch joinScratch
+	for index := 0; index < total; index++ {
+		store.joinRow(index, threshold, &scratch, func(other uint64, score float64, hash Hash) {
+			if rootA, rootB := find(uint64(index)), find(other); rootA != rootB {
+				parents[rootB] = rootA
+			}
+		})
+		progress(index+1, total)
+	}
+
+	// Collect the clusters.
+	members := make(map[uint64][]interface{})
+	var roots []uint64
+	for index := range store.candidates {
+		if store.candidates[index].id == nil {
+			continue
+		}
+		root := find(uint64(index))
+		if _, ok := members[root]; !ok {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], store.candidates[index].id)
+	}
+	var clusters [][]interface{}
+	for _, root := range roots {
+		if len(members[root]) > 1 {
+			clusters = append(clusters, members[root])
+		}
+	}
+
+	return clusters
+}
+
+// joinScratch holds the buffers used by joinRow(), to be reused across calls.
+type joinScratch struct {
+	shared  []float64
+	seen    []bool
+	touched []uint64
+	bucket  []uint64
+}
+
+// joinRow calls "pair" for each candidate which follows the candidate with the
+// given index in the store and whose composite score is lower than the given
+// threshold when compared with it. "pair" receives the other candidate's
+// index, its Haar score, and the hash that stands in for the candidate with
+// the given index as the query (see candidateQuery()). Deleted candidates are
+// skipped. The store must be at least read-locked when calling this function.
+func (store *Store) joinRow(index int, threshold float64, scratch *joinScratch, pair func(other uint64, score float64, hash Hash)) {
+	candidate := &store.candidates[index]
+	if candidate.id == nil {
+		return
+	}
+	if len(scratch.shared) < len(store.candidates) {
+		scratch.shared = make([]float64, len(store.candidates))
+		scratch.seen = make([]bool, len(store.candidates))
+	}
+
+	// Sum up the weights of the shared buckets.
+	for _, location := range candidate.locations {
+		weight := store.weightSums[locationBin(location)]
+		scratch.bucket = store.bucket(int(location), scratch.bucket)
+		for _, other := range scratch.bucket {
+			if int(other) <= index {
+				continue
+			}
+			if !scratch.seen[other] {
+				scratch.seen[other] = true
+				scratch.shared[other] = 0
+				scratch.touched = append(scratch.touched, other)
+			}
+			scratch.shared[other] -= weight
+		}
+	}
+
+	// Compare with all candidates sharing at least one bucket.
+	hash := candidateQuery(candidate)
+	for _, other := range scratch.touched {
+		scratch.seen[other] = false
+		otherCandidate := &store.candidates[other]
+		score := scratch.shared[other]
+		for colour := range candidate.scaleCoef {
+			score += store.weights[colour][0] *
+				math.Abs(otherCandidate.scaleCoef[colour]-candidate.scaleCoef[colour])
+		}
+		if store.compositeScore(otherCandidate, score, hash) < threshold {
+			pair(other, score, hash)
+		}
+	}
+	scratch.touched = scratch.touched[:0]
+}
+
+// candidateQuery returns a hash which can be used in place of the given
+// candidate's hash to calculate the metrics of a match (see Match.setMetrics()).
+// Other than candidateHash(), only the scaling function coefficient is set.
+func candidateQuery(c *candidate) Hash {
+	hash := Hash{
+		Matrix:    haar.Matrix{Coefs: []haar.Coef{c.scaleCoef}},
+		Ratio:     c.ratio,
+		DHash:     c.dHash,
+		Histogram: c.histogram,
+		HistoMax:  c.histoMax,
+		Blockhash: c.blockhash,
+		WHash:     c.wHash,
+	}
+	if c.histogramCounts != nil {
+		hash.HistogramCounts = *c.histogramCounts
+	}
+	return hash
+}
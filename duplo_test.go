@@ -1,19 +1,39 @@
 package duplo
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"image"
 	"image/color"
+	"image/color/palette"
 	"image/draw"
+	"image/gif"
 	"image/jpeg"
+	"io"
+	"io/fs"
 	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unsafe"
 
+	"github.com/nfnt/resize"
 	"github.com/rivo/duplo/haar"
 )
 
@@ -97,6 +117,31 @@ const (
 		"TzRWpmZCVajP86KKtkojbic4p7k7c5NFFIZGCeuTnNTMxwpyc+tFFAC5PrRRRQM/9k="
 )
 
+// testImages returns the decoded test images imgA, imgB, and imgC.
+func testImages(t *testing.T) []image.Image {
+	t.Helper()
+	var images []image.Image
+	for _, data := range []string{imgA, imgB, imgC} {
+		img, err := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, img)
+	}
+	return images
+}
+
+// testHashes returns the hashes of the test images imgA, imgB, and imgC.
+func testHashes(t *testing.T) []Hash {
+	t.Helper()
+	var hashes []Hash
+	for _, img := range testImages(t) {
+		hash, _ := CreateHash(img)
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
 // Test the QuickSelect algorithm.
 func TestQuickSelect(t *testing.T) {
 	coefs := []haar.Coef{
@@ -121,6 +166,22 @@ func TestQuickSelect(t *testing.T) {
 	}
 }
 
+// Test joint thresholds.
+func TestJointThresholds(t *testing.T) {
+	coefs := []haar.Coef{
+		{1, -5, 0.1},
+		{2, 2, 0.2},
+		{3, -7.5, -0.3},
+		{4, 1, 0.2},
+	}
+
+	thresholds := jointCoefThresholds(coefs, 1)
+
+	if thresholds != (haar.Coef{4, 4, 4}) {
+		t.Errorf("Wrong thresholds, should be [4 4 4], is %v", thresholds)
+	}
+}
+
 // Test adding an almost black image to a store.
 func TestAddBasic(t *testing.T) {
 	store := New()
@@ -167,7 +228,7 @@ func TestAddBasic(t *testing.T) {
 			for colourIndex := 0; colourIndex < haar.ColourChannels; colourIndex++ {
 				none := sign > 0 || coefIndex == 0
 				location := sign*ImageScale*ImageScale*haar.ColourChannels + coefIndex*haar.ColourChannels + colourIndex
-				indexList := store.indices[location]
+				indexList := store.indices[location].decode(nil)
 				if none {
 					if len(indexList) != 0 {
 						t.Errorf("Non-empty index list found for sign %d, coefficient %d, colour %d: %v", sign, coefIndex, colourIndex, indexList)
@@ -207,7 +268,7 @@ func TestQuery(t *testing.T) {
 	// Some plausibility checks.
 	coefCount := 0
 	for _, indices := range store.indices {
-		coefCount += len(indices)
+		coefCount += indices.len()
 	}
 	if coefCount != 2*(TopCoefs-1)*3 {
 		t.Errorf("Unexpected number of bucket indices, %d instead of %d", coefCount, 2*TopCoefs*3)
@@ -224,6 +285,431 @@ func TestQuery(t *testing.T) {
 	if matches[0].ID != "imgA" {
 		t.Errorf("Query found %s but should have found imgA", matches[0].ID)
 	}
+
+	// Check similarity values.
+	if matches[0].Similarity <= matches[1].Similarity || matches[0].Similarity > 1 || matches[1].Similarity < 0 {
+		t.Errorf("Implausible similarity values: %v", matches)
+	}
+	matches = store.Query(hashA)
+	sort.Sort(matches)
+	if math.Abs(matches[0].Similarity-1) > 1e-9 {
+		t.Errorf("Identical image has a similarity of %f, expected 1", matches[0].Similarity)
+	}
+
+	// Configured similarity weights.
+	defer func(weights SimilarityWeights) { MatchSimilarityWeights = weights }(MatchSimilarityWeights)
+	MatchSimilarityWeights = SimilarityWeights{DHash: 1}
+	for _, match := range store.Query(queryHash) {
+		if expected := 1 - float64(match.DHashDistance)/64; math.Abs(match.Similarity-expected) > 1e-9 {
+			t.Errorf("Similarity of %v is %f with dHash-only weights, expected %f", match.ID, match.Similarity, expected)
+		}
+	}
+}
+
+// Test comparing two hashes directly.
+func TestCompare(t *testing.T) {
+	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
+	addB, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgB)))
+	query, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgC)))
+	hashA, _ := CreateHash(addA)
+	hashB, _ := CreateHash(addB)
+	queryHash, _ := CreateHash(query)
+
+	for _, hash := range []Hash{hashA, hashB} {
+		store := New()
+		store.Add("img", hash)
+		matches := store.Query(queryHash)
+		if len(matches) != 1 {
+			t.Fatalf("Unexpected number of matches: %d", len(matches))
+		}
+		match := Compare(hash, queryHash)
+		match.ID = "img"
+		if math.Abs(match.Score-matches[0].Score) > 1e-9 || match.RatioDiff != matches[0].RatioDiff ||
+			match.DHashDistance != matches[0].DHashDistance || match.HistogramDistance != matches[0].HistogramDistance ||
+			math.Abs(match.Similarity-matches[0].Similarity) > 1e-9 {
+			t.Errorf("Comparison %v differs from query result %v", &match, matches[0])
+		}
+	}
+}
+
+// Test the report writers.
+func TestReport(t *testing.T) {
+	rows := QueryRows("query", Matches{
+		{ID: "imgA", Score: -10, DHashDistance: 3},
+		{ID: "imgB", Score: -5, DHashDistance: 40},
+	})
+	rows = append(rows, ClusterRows([][]interface{}{{"imgC", "imgD"}})...)
+	thumbnail := ThumbnailColumn("thumbnail", 16, func(id interface{}) (image.Image, error) {
+		return image.NewGray(image.Rect(0, 0, 64, 32)), nil
+	})
+	columns := []ReportColumn{GroupColumn, IDColumn, ScoreColumn, DHashDistanceColumn, thumbnail}
+
+	// CSV.
+	var buffer bytes.Buffer
+	if err := WriteCSV(&buffer, rows, columns[:4]); err != nil {
+		t.Fatal(err)
+	}
+	expected := "group,id,score,dHashDistance\nquery,imgA,-10,3\nquery,imgB,-5,40\n0,imgC,0,0\n0,imgD,0,0\n"
+	if buffer.String() != expected {
+		t.Errorf("Unexpected CSV output:\n%s", buffer.String())
+	}
+
+	// JSON.
+	buffer.Reset()
+	if err := WriteJSON(&buffer, rows, columns); err != nil {
+		t.Fatal(err)
+	}
+	var objects []map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &objects); err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 4 || objects[1]["id"] != "imgB" || objects[1]["dHashDistance"] != 40.0 {
+		t.Errorf("Unexpected JSON output: %v", objects)
+	}
+	if uri, _ := objects[0]["thumbnail"].(string); !strings.HasPrefix(uri, "data:image/png;base64,") {
+		t.Errorf("Unexpected thumbnail: %s", uri)
+	}
+}
+
+// Test deduplication plans.
+func TestPlanner(t *testing.T) {
+	infos := map[interface{}]ImageInfo{
+		"a": {100, 100, time.Unix(300, 0)},
+		"b": {200, 100, time.Unix(200, 0)},
+		"c": {50, 50, time.Unix(100, 0)},
+		"d": {10, 10, time.Unix(0, 0)},
+		"e": {20, 20, time.Unix(0, 0)},
+	}
+	planner := &Planner{Info: func(id interface{}) (ImageInfo, error) {
+		return infos[id], nil
+	}}
+	clusters := [][]interface{}{{"a", "b", "c"}, {"d"}, {"d", "e"}}
+	summarize := func(steps []PlanStep) string {
+		var parts []string
+		for _, step := range steps {
+			parts = append(parts, fmt.Sprintf("%d:%v:%s:%v", step.Cluster, step.ID, step.Action, step.Target))
+		}
+		return strings.Join(parts, " ")
+	}
+
+	steps, err := planner.Plan(clusters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := summarize(steps); s != "0:a:delete:b 0:b:keep:<nil> 0:c:delete:b 2:d:delete:e 2:e:keep:<nil>" {
+		t.Errorf("Unexpected largest plan: %s", s)
+	}
+
+	planner.Policy = KeepEarliest
+	planner.Link = true
+	steps, _ = planner.Plan(clusters)
+	if s := summarize(steps); s != "0:a:link:c 0:b:link:c 0:c:keep:<nil> 2:d:keep:<nil> 2:e:link:d" {
+		t.Errorf("Unexpected earliest plan: %s", s)
+	}
+
+	planner.Pinned = map[interface{}]bool{"a": true, "b": true}
+	steps, _ = planner.Plan(clusters[:1])
+	if s := summarize(steps); s != "0:a:keep:<nil> 0:b:keep:<nil> 0:c:link:a" {
+		t.Errorf("Unexpected pinned plan: %s", s)
+	}
+}
+
+// Test the binary hash format and database values.
+func TestHashBinary(t *testing.T) {
+	img := testImages(t)[0]
+	hash, _ := CreateHash(img)
+
+	data, err := hash.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gobbed bytes.Buffer
+	gob.NewEncoder(&gobbed).Encode(struct{ Coefs []haar.Coef }{hash.Coefs})
+	if len(data) >= gobbed.Len() {
+		t.Errorf("Binary hash (%d bytes) is not smaller than gob-encoded coefficients (%d bytes)", len(data), gobbed.Len())
+	}
+
+	var decoded Hash
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", decoded) != fmt.Sprintf("%v", hash) {
+		t.Error("Decoded hash differs from original hash")
+	}
+
+	// Database values.
+	value, err := hash.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var scanned Hash
+	if err := scanned.Scan(value); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", scanned) != fmt.Sprintf("%v", hash) {
+		t.Error("Scanned hash differs from original hash")
+	}
+	if err := scanned.Scan(nil); err == nil {
+		t.Error("NULL was scanned without error")
+	}
+
+	// Corrupt data.
+	if err := decoded.UnmarshalBinary(data[:len(data)/2]); err == nil {
+		t.Error("Truncated hash was decoded without error")
+	}
+	if err := decoded.UnmarshalBinary(append([]byte{99}, data[1:]...)); err == nil {
+		t.Error("Unknown format version was decoded without error")
+	}
+
+	// Foreign hashes are only encoded if present.
+	foreign, _, err := CreateHashOpts(img, WithForeignHashes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := len(data)
+	if data, err = foreign.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+	if len(data) <= plain {
+		t.Error("Foreign hashes were not encoded")
+	}
+	if err := decoded.UnmarshalBinary(data); err != nil || decoded.Blockhash != foreign.Blockhash || decoded.WHash != foreign.WHash {
+		t.Errorf("Foreign hashes were not decoded (%v)", err)
+	}
+}
+
+// Test the foreign hash adapters.
+func TestForeignHashes(t *testing.T) {
+	// Left half black, right half white.
+	img := image.NewGray(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 32; x < 64; x++ {
+			img.SetGray(x, y, color.Gray{255})
+		}
+	}
+	hash, _ := CreateHash(img)
+	if hash.Blockhash != [4]uint64{} || hash.WHash != 0 {
+		t.Error("Foreign hashes were calculated by default")
+	}
+	hash, _, _ = CreateHashOpts(img, WithForeignHashes())
+	if s := FormatBlockhash(hash.Blockhash); s != strings.Repeat("00ff", 16) {
+		t.Errorf("Unexpected Blockhash: %s", s)
+	}
+	if s := FormatWHash(hash.WHash); s != strings.Repeat("0f", 8) {
+		t.Errorf("Unexpected wHash: %s", s)
+	}
+
+	// Reference values computed with blockhash_quick() of blockhash.io's
+	// blockhash.py on the same pixels.
+	pattern := func(width, height int) image.Image {
+		img := image.NewNRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				pixel := color.NRGBA{uint8((x*7 + y*3) % 256), uint8(x * y % 256), uint8((x ^ y) * 5 % 256), 255}
+				if (x+y)%11 == 0 {
+					pixel.A = 0
+				}
+				img.SetNRGBA(x, y, pixel)
+			}
+		}
+		return img
+	}
+	solid := func(width, height int) image.Image {
+		img := image.NewGray(image.Rect(0, 0, width, height))
+		draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{200}), image.Point{}, draw.Src)
+		return img
+	}
+	for index, test := range []struct {
+		img      image.Image
+		expected string
+	}{
+		{pattern(37, 29), "841f043f08ff08ff104f109f20ff21ff417f42fe82f884f104e708ef08df10ff"},
+		{pattern(64, 48), "05980bbd0fc70ff20fe51b0f324f244f682f581fdc1e780e7c0dfa4cf01cf12c"},
+		{image.NewGray(image.Rect(0, 0, 32, 32)), strings.Repeat("0", 64)},
+		{solid(32, 32), strings.Repeat("f", 64)},
+		{solid(15, 15), strings.Repeat("0", 64)},
+	} {
+		if s := FormatBlockhash(ComputeBlockhash(test.img)); s != test.expected {
+			t.Errorf("Unexpected Blockhash for image %d: %s", index, s)
+		}
+	}
+
+	// Import.
+	blockhash, err := ParseBlockhash(strings.Repeat("00ff", 15) + "00fe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wHash, err := ParseWHash("0f0f0f0f0f0f0f0e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseWHash("0f0f"); err == nil {
+		t.Error("Short wHash was parsed without error")
+	}
+	imported := hash
+	imported.Blockhash, imported.WHash = blockhash, wHash
+	if match := Compare(hash, imported); match.BlockhashDistance != 1 || match.WHashDistance != 1 {
+		t.Errorf("Unexpected distances: %d, %d", match.BlockhashDistance, match.WHashDistance)
+	}
+}
+
+// Test JSON encoding of hashes and matches.
+func TestJSON(t *testing.T) {
+	img := testImages(t)[0]
+	hash, _ := CreateHash(img)
+
+	data, err := json.Marshal(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Hash
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", decoded) != fmt.Sprintf("%v", hash) {
+		t.Error("Decoded hash differs from original hash")
+	}
+	if err := json.Unmarshal([]byte(`{"version":0}`), &decoded); err != ErrHashVersion {
+		t.Errorf("Expected hash version error, got %v", err)
+	}
+
+	// Matches.
+	data, err = json.Marshal(Matches{{ID: "imgA", Score: -3, DHashDistance: 2}, nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"id":"imgA","score":-3,"haarScore":0,"ratioDiff":0,"dHashDistance":2,"histogramDistance":0,"colourDistance":0,"blockhashDistance":0,"wHashDistance":0,"similarity":0}]`
+	if string(data) != expected {
+		t.Errorf("Unexpected matches JSON: %s", data)
+	}
+	var matches Matches
+	if err := json.Unmarshal(data, &matches); err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].ID != "imgA" || matches[0].Score != -3 || matches[0].DHashDistance != 2 {
+		t.Errorf("Unexpected decoded matches: %v", matches)
+	}
+}
+
+// Test hashing with options.
+func TestCreateHashOpts(t *testing.T) {
+	if _, _, err := CreateHashOpts(nil); err == nil {
+		t.Error("Nil image was hashed without error")
+	}
+	if _, _, err := CreateHashOpts(image.NewRGBA(image.Rect(0, 0, 0, 10))); err == nil {
+		t.Error("Empty image was hashed without error")
+	}
+
+	img := testImages(t)[0]
+	full, _ := CreateHash(img)
+	hash, scaled, err := CreateHashOpts(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(hash) != fmt.Sprint(full) || scaled.Bounds().Dx() != ImageScale {
+		t.Error("Hash without options differs from CreateHash()")
+	}
+
+	hash, _, err = CreateHashOpts(img, SkipDHash(), SkipHistogram(), SkipForeignHashes(), WithInterpolation(resize.NearestNeighbor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash.DHash != [2]uint64{} || hash.Histogram != 0 || hash.HistogramCounts != [64]uint8{} || hash.Blockhash != [4]uint64{} || hash.WHash != 0 {
+		t.Error("Skipped parts were calculated")
+	}
+	if hash.Ratio != full.Ratio || len(hash.Coefs) != len(full.Coefs) {
+		t.Error("Hash is incomplete")
+	}
+
+	// Custom scalers.
+	var calls int
+	counting := ScalerFunc(func(width, height uint, img image.Image) image.Image {
+		calls++
+		return DefaultScaler.Resize(width, height, img)
+	})
+	hash, _, err = CreateHashOpts(img, WithScaler(counting))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || fmt.Sprint(hash) != fmt.Sprint(full) {
+		t.Errorf("Custom scaler was not used properly (%d calls)", calls)
+	}
+	nfnt, _, err := CreateHashOpts(img, WithScaler(NfntScaler{Interpolation: resize.Bicubic}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nfnt.Ratio != full.Ratio || Compare(nfnt, full).Similarity < 0.8 {
+		t.Error("Scalers yield very different hashes")
+	}
+}
+
+// Test lightweight queries.
+func TestQueryHits(t *testing.T) {
+	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
+	addB, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgB)))
+	query, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgC)))
+
+	store := New()
+	hashA, _ := CreateHash(addA)
+	hashB, _ := CreateHash(addB)
+	store.Add("imgA", hashA)
+	store.Add("imgB", hashB)
+
+	queryHash, _ := CreateHash(query)
+	hits := store.QueryHits(queryHash)
+	matches := store.Query(queryHash)
+	if len(hits) != len(matches) {
+		t.Fatalf("Got %d hits but %d matches", len(hits), len(matches))
+	}
+
+	// Only hydrate the best hit.
+	best := hits[0]
+	for _, hit := range hits {
+		if hit.Score < best.Score {
+			best = hit
+		}
+	}
+	hydrated := store.Hydrate(queryHash, []Hit{best})
+	sort.Sort(matches)
+	if len(hydrated) != 1 || *hydrated[0] != *matches[0] {
+		t.Errorf("Hydrated match %v differs from query match %v", hydrated, matches[0])
+	}
+
+	// Deleted images are skipped.
+	store.Delete(hydrated[0].ID)
+	if hydrated := store.Hydrate(queryHash, []Hit{best}); len(hydrated) != 0 {
+		t.Errorf("Deleted image was hydrated: %v", hydrated)
+	}
+}
+
+// Test checking query results for staleness.
+func TestStaleMatches(t *testing.T) {
+	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
+	addB, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgB)))
+	query, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgC)))
+
+	store := New()
+	hashA, _ := CreateHash(addA)
+	hashB, _ := CreateHash(addB)
+	store.Add("imgA", hashA)
+	store.Add("imgB", hashB)
+
+	queryHash, _ := CreateHash(query)
+	matches, generation := store.QueryGeneration(queryHash)
+	if generation != store.Generation() {
+		t.Errorf("Query generation is %d, expected %d", generation, store.Generation())
+	}
+	if stale := store.StaleMatches(matches, generation); len(stale) != 0 {
+		t.Errorf("Fresh matches are reported as stale: %v", stale)
+	}
+
+	// Re-adding an image makes its matches stale.
+	store.Delete("imgA")
+	store.Add("imgA", hashA)
+	stale := store.StaleMatches(matches, generation)
+	if len(stale) != 1 || stale[0].ID != "imgA" {
+		t.Errorf("Unexpected stale matches: %v", stale)
+	}
 }
 
 // Test the delete function.
@@ -353,106 +839,3833 @@ func TestExchange(t *testing.T) {
 	}
 }
 
-// Used in the next test.
-type testID struct {
-	Asset  string
-	Number int
-}
+// Test the batch delete functions.
+func TestDeleteOlderThan(t *testing.T) {
+	store := New()
 
-// Test serialization.
-func TestGob(t *testing.T) {
+	// Add some images.
 	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
 	addB, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgB)))
 	addC, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgC)))
-
-	store := New()
 	hashA, _ := CreateHash(addA)
 	hashB, _ := CreateHash(addB)
 	hashC, _ := CreateHash(addC)
-	store.Add(testID{"image", 1}, hashA)
-	store.Add(testID{"image", 2}, hashB)
-	store.Add(testID{"image", 3}, hashC)
+	store.Add("imgA", hashA)
+	store.Add("imgB", hashB)
+	generation := store.Generation()
+	store.Add("imgC", hashC)
+	store.candidates[0].added = time.Now().Add(-time.Hour).UnixNano()
 
-	// Serialize store.
-	var file bytes.Buffer
-	encoder := gob.NewEncoder(&file)
-	if err := encoder.Encode(store); err != nil {
-		t.Errorf("Encoding store failed: %s", err)
-		return
+	// Delete by age.
+	if count := store.DeleteOlderThan(time.Now().Add(-time.Minute)); count != 1 {
+		t.Errorf("DeleteOlderThan removed %d images, expected 1", count)
 	}
-
-	// Unserialize store.
-	var storeReloaded Store
-	decoder := gob.NewDecoder(&file)
-	if err := decoder.Decode(&storeReloaded); err != nil {
-		t.Errorf("Decoding store failed: %s", err)
-		return
+	if store.Has("imgA") || !store.Has("imgB") {
+		t.Error("DeleteOlderThan removed the wrong images")
 	}
 
-	// Are the candidates the same?
-	if len(store.candidates) != len(storeReloaded.candidates) {
-		t.Error("Candidate length not identical")
-		return
+	// Delete by generation.
+	if count := store.DeleteBeforeGeneration(generation + 1); count != 1 {
+		t.Errorf("DeleteBeforeGeneration removed %d images, expected 1", count)
 	}
-	for index, candidate := range store.candidates {
-		if storeReloaded.candidates[index].id.(testID) != candidate.id.(testID) {
-			t.Errorf("Candidate ID not identical: %v vs %v", storeReloaded.candidates[index].id, candidate.id)
-			break
-		}
-		if len(storeReloaded.candidates[index].scaleCoef) != len(candidate.scaleCoef) {
-			t.Errorf("Candidate scaling function coefficient size not identical: %d vs %d", len(storeReloaded.candidates[index].scaleCoef), len(candidate.scaleCoef))
-			break
-		}
-		for i, v := range storeReloaded.candidates[index].scaleCoef {
-			if v != candidate.scaleCoef[i] {
-				t.Errorf("Candidate scaling function coefficient not identical: %v vs %v", storeReloaded.candidates[index].scaleCoef, candidate.scaleCoef)
-				break
-			}
-		}
-		if storeReloaded.candidates[index].ratio != candidate.ratio {
-			t.Errorf("Candidate ratio not identical: %f vs %f", storeReloaded.candidates[index].ratio, candidate.ratio)
-			break
-		}
+	if store.Has("imgB") || !store.Has("imgC") {
+		t.Error("DeleteBeforeGeneration removed the wrong images")
 	}
 
-	// Are the indices the same?
-	if l1, l2 := len(store.indices), len(storeReloaded.indices); l1 != l2 {
-		t.Errorf("Index number of signs not identical: %d vs %d", l1, l2)
-		return
-	}
-	for location, indices := range storeReloaded.indices {
-		if l1, l2 := len(indices), len(store.indices[location]); l1 != l2 {
-			t.Errorf("Reloaded index slice at %d is of length %d, expected %d", location, l1, l2)
-			return
-		}
-		for i, index := range indices {
-			if index != store.indices[location][i] {
-				t.Errorf("Reloaded index at %d[%d] is %d, expected %d", location, i, index, store.indices[location][i])
-				return
+	// Only imgC must remain in the index.
+	for location, list := range store.indices {
+		for _, index := range list.decode(nil) {
+			if index != 2 {
+				t.Fatalf("Bucket %d still contains deleted index %d", location, index)
 			}
 		}
 	}
 }
 
-// Package example.
-func Example() {
-	// Create some example JPEG images.
+// Test diverse sampling.
+func TestSampleDiverse(t *testing.T) {
+	store := New()
 	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
 	addB, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgB)))
-	query, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgC)))
-
-	// Create the store.
-	store := New()
-
-	// Turn two images into hashes and add them to the store.
 	hashA, _ := CreateHash(addA)
 	hashB, _ := CreateHash(addB)
 	store.Add("imgA", hashA)
+	store.Add("imgA2", hashA)
 	store.Add("imgB", hashB)
 
-	// Query the store for our third image (which is most similar to "imgA").
-	queryHash, _ := CreateHash(query)
-	matches := store.Query(queryHash)
-	fmt.Println(matches[0].ID)
-	// Output: imgA
+	if sample := store.SampleDiverse(2); fmt.Sprint(sample) != "[imgA imgB]" {
+		t.Errorf("Unexpected sample: %v", sample)
+	}
+	if sample := store.SampleDiverse(10); len(sample) != 3 {
+		t.Errorf("Expected all 3 images, got %v", sample)
+	}
+	store.Delete("imgA")
+	if sample := store.SampleDiverse(2); fmt.Sprint(sample) != "[imgA2 imgB]" {
+		t.Errorf("Unexpected sample after deletion: %v", sample)
+	}
+	if sample := store.SampleDiverse(0); sample != nil {
+		t.Errorf("Expected empty sample, got %v", sample)
+	}
+}
+
+// Test stores with typed IDs.
+func TestTypedStore(t *testing.T) {
+	type photoID struct {
+		Album  string
+		Number int
+	}
+	store := NewTyped[photoID]()
+	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
+	addB, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgB)))
+	hashA, _ := CreateHash(addA)
+	hashB, _ := CreateHash(addB)
+	store.Add(photoID{"holiday", 1}, hashA)
+	store.Add(photoID{"holiday", 2}, hashB)
+	if !store.Has(photoID{"holiday", 2}) || store.Size() != 2 {
+		t.Error("Images were not added")
+	}
+
+	// Serialize and reload.
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(store); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := NewTyped[photoID]()
+	if err := gob.NewDecoder(&buffer).Decode(reloaded); err != nil {
+		t.Fatal(err)
+	}
+	ids := reloaded.IDs()
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Number < ids[j].Number })
+	if len(ids) != 2 || ids[0] != (photoID{"holiday", 1}) || ids[1] != (photoID{"holiday", 2}) {
+		t.Errorf("Unexpected IDs after reload: %v", ids)
+	}
+	matches := reloaded.Query(hashA)
+	sort.Sort(matches)
+	if len(matches) == 0 || matches[0].ID != (photoID{"holiday", 1}) {
+		t.Errorf("Unexpected matches: %v", matches)
+	}
+	untyped := matches.Untyped()
+	if len(untyped) != len(matches) || untyped[0].ID != matches[0].ID || untyped[0].Score != matches[0].Score {
+		t.Errorf("Unexpected untyped matches: %v", untyped)
+	}
+	data, err := json.Marshal(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"id":{"Album":"holiday","Number":1}`) {
+		t.Errorf("Unexpected JSON encoding: %s", data)
+	}
+
+	// The wrapped store can be serialized directly. Options are forwarded.
+	type scanID struct {
+		Roll, Frame int
+	}
+	scans := NewTyped[scanID](WithLargeIndex())
+	scans.Add(scanID{1, 1}, hashA)
+	if !scans.Store().largeIndex {
+		t.Error("Option was not applied")
+	}
+	buffer.Reset()
+	if _, err := scans.Store().WriteTo(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	read := New()
+	if _, err := read.ReadFrom(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	if !read.Has(scanID{1, 1}) {
+		t.Error("Image was lost when writing the wrapped store")
+	}
+}
+
+// Test concurrent use of the store. Run with -race.
+func TestConcurrency(t *testing.T) {
+	store := New()
+	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
+	hash, _ := CreateHash(addA)
+
+	// Non-blocking variants.
+	store.RLock()
+	if store.TryAdd("locked", hash) || store.TryDelete("locked") {
+		t.Error("Non-blocking call succeeded on a locked store")
+	}
+	store.RUnlock()
+	if !store.TryAdd("unlocked", hash) || !store.Has("unlocked") {
+		t.Error("Non-blocking add failed on an unlocked store")
+	}
+	if !store.TryDelete("unlocked") || store.Has("unlocked") {
+		t.Error("Non-blocking delete failed on an unlocked store")
+	}
+
+	// Modify the store while iterating and querying.
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for index := 0; index < 20; index++ {
+				id := worker*100 + index
+				store.Add(id, hash)
+				for _, existing := range store.IDs() {
+					if existing.(int)%7 == 0 {
+						store.Delete(existing)
+					}
+				}
+				store.Query(hash)
+				store.TryAdd(-id, hash)
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if ids, stats := store.IDs(), store.Stats(); len(ids) != stats.Images {
+		t.Errorf("Inconsistent store: %d IDs but %d images", len(ids), stats.Images)
+	}
+}
+
+// Test composite scores.
+func TestCompositeScore(t *testing.T) {
+	store := New()
+	var queryHash Hash
+	for index, hash := range testHashes(t) {
+		if index == 0 {
+			queryHash = hash
+		}
+		store.Add(index, hash)
+	}
+
+	// By default, the score is the Haar score.
+	for _, match := range store.Query(queryHash) {
+		if match.Score != match.HaarScore {
+			t.Errorf("Default score %f differs from Haar score %f", match.Score, match.HaarScore)
+		}
+	}
+
+	// Blended scores.
+	store.SetScoreWeights(0.5, 2, 1, 10)
+	for _, match := range store.Query(queryHash) {
+		expected := 0.5*match.HaarScore + 2*float64(match.DHashDistance) + float64(match.HistogramDistance) + 10*match.RatioDiff
+		if math.Abs(match.Score-expected) > 1e-9 {
+			t.Errorf("Unexpected composite score %f, expected %f", match.Score, expected)
+		}
+	}
+	matches := store.QueryWithOptions(queryHash, &QueryOptions{MaxResults: 1})
+	all := store.Query(queryHash)
+	sort.Sort(all)
+	if len(matches) != 1 || matches[0].ID != all[0].ID {
+		t.Errorf("Top match %v does not have the best composite score %v", matches, all)
+	}
+
+	// Weights survive serialization.
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(store); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := New()
+	if err := gob.NewDecoder(&buffer).Decode(reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if haar, dHash, histogram, ratio := reloaded.ScoreWeights(); haar != 0.5 || dHash != 2 || histogram != 1 || ratio != 10 {
+		t.Errorf("Unexpected score weights after reload: %f, %f, %f, %f", haar, dHash, histogram, ratio)
+	}
+}
+
+// Test concurrent additions, which distribute into the buckets in parallel.
+func TestConcurrentAdd(t *testing.T) {
+	store := New()
+	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
+	addB, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgB)))
+	hashA, _ := CreateHash(addA)
+	hashB, _ := CreateHash(addB)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for index := 0; index < 25; index++ {
+				hash := hashA
+				if index%2 == 1 {
+					hash = hashB
+				}
+				store.Add(worker*100+index, hash)
+				if index%5 == 0 {
+					store.Delete(worker*100 + index)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	stats := store.Stats()
+	if stats.Images != 8*20 || stats.IndexEntries != stats.Images*(TopCoefs-1)*3 {
+		t.Errorf("Unexpected statistics after concurrent additions: %+v", stats)
+	}
+	for _, match := range store.Query(hashA) {
+		if id := match.ID.(int); id%5 == 0 {
+			t.Errorf("Deleted image %d was returned", id)
+		}
+	}
+}
+
+// Test that queries don't block each other on the bucket locks.
+func TestConcurrentQueries(t *testing.T) {
+	store := New()
+	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
+	hashA, _ := CreateHash(addA)
+	store.Add("imgA", hashA)
+
+	// Simulate a query which is currently reading all buckets.
+	for index := range store.bucketLocks {
+		store.bucketLocks[index].RLock()
+	}
+	done := make(chan Matches)
+	go func() {
+		done <- store.Query(hashA)
+	}()
+	select {
+	case matches := <-done:
+		if len(matches) != 1 {
+			t.Errorf("Expected 1 match, got %d", len(matches))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Query was blocked by a concurrent query")
+	}
+	for index := range store.bucketLocks {
+		store.bucketLocks[index].RUnlock()
+	}
+}
+
+// Test query options which filter and truncate results.
+func TestQueryWithOptions(t *testing.T) {
+	store := New()
+	var queryHash Hash
+	for index, hash := range testHashes(t) {
+		if index == 0 {
+			queryHash = hash
+		}
+		store.Add(index, hash)
+	}
+	all := store.Query(queryHash)
+	sort.Sort(all)
+	if len(all) < 3 {
+		t.Fatalf("Expected at least 3 matches, got %d", len(all))
+	}
+
+	// Maximum results.
+	top := store.QueryWithOptions(queryHash, &QueryOptions{MaxResults: 2})
+	if len(top) != 2 || top[0].ID != all[0].ID || top[1].ID != all[1].ID {
+		t.Errorf("Unexpected top matches: %v (all: %v)", top, all)
+	}
+
+	// Score threshold.
+	threshold := (all[0].Score + all[1].Score) / 2
+	if matches := store.QueryWithOptions(queryHash, &QueryOptions{ScoreThreshold: threshold}); len(matches) != 1 || matches[0].ID != all[0].ID {
+		t.Errorf("Unexpected matches below threshold: %v", matches)
+	}
+
+	// Distance filters.
+	for _, match := range store.QueryWithOptions(queryHash, &QueryOptions{MaxDHashDistance: 1, MaxRatioDiff: 0.001}) {
+		if match.DHashDistance > 1 || match.RatioDiff > 0.001 {
+			t.Errorf("Match was not filtered: %v", match)
+		}
+	}
+}
+
+// Test sign-only queries.
+func TestSignOnlyQuery(t *testing.T) {
+	store := New()
+	var queryHash Hash
+	for index, hash := range testHashes(t) {
+		if index == 0 {
+			queryHash = hash
+		}
+		store.Add(index, hash)
+	}
+
+	matches := store.QueryWithOptions(queryHash, &QueryOptions{SignOnly: true})
+	sort.Sort(matches)
+	if len(matches) == 0 || matches[0].ID != 0 || matches[0].SignAgreement != (TopCoefs-1)*3 {
+		t.Fatalf("Unexpected sign-only matches: %v", matches)
+	}
+	for _, match := range matches {
+		if match.Score != -float64(match.SignAgreement) {
+			t.Errorf("Unexpected score %f for sign agreement %d", match.Score, match.SignAgreement)
+		}
+	}
+	top := store.QueryWithOptions(queryHash, &QueryOptions{SignOnly: true, MaxResults: 1})
+	if len(top) != 1 || top[0].ID != 0 {
+		t.Errorf("Unexpected top sign-only match: %v", top)
+	}
+}
+
+// Test the reuse of deleted slots.
+func TestFreeList(t *testing.T) {
+	hashes := testHashes(t)
+
+	store := New()
+	store.Add("imgA", hashes[0])
+	store.Add("imgB", hashes[1])
+	store.Delete("imgA")
+
+	// The free list survives serialization.
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(store); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := New()
+	if err := gob.NewDecoder(&buffer).Decode(reloaded); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []*Store{store, reloaded} {
+		s.Add("imgC", hashes[2])
+		if stats := s.Stats(); stats.Slots != 2 || stats.Images != 2 {
+			t.Errorf("Expected 2 slots and 2 images, got %d and %d", stats.Slots, stats.Images)
+		}
+		for _, match := range s.Query(hashes[0]) {
+			if match.ID == "imgA" {
+				t.Error("Deleted image was found")
+			}
+		}
+		matches := s.Query(hashes[2])
+		sort.Sort(matches)
+		if len(matches) == 0 || matches[0].ID != "imgC" {
+			t.Errorf("Image in reused slot was not found: %v", matches)
+		}
+	}
+}
+
+// Test query-time histogram metrics.
+func TestHistogramMetrics(t *testing.T) {
+	RetainHistogramCounts = true
+	defer func() { RetainHistogramCounts = false }()
+
+	store := New()
+	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
+	addB, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgB)))
+	hashA, _ := CreateHash(addA)
+	hashB, _ := CreateHash(addB)
+	store.Add("imgA", hashA)
+	store.Add("imgB", hashB)
+
+	for _, metric := range []HistogramMetric{HistogramHamming, HistogramIntersection, HistogramChiSquare} {
+		matches := store.QueryWithOptions(hashA, &QueryOptions{HistogramMetric: metric})
+		distances := make(map[interface{}]float64)
+		for _, match := range matches {
+			distances[match.ID] = match.ColourDistance
+		}
+		if distances["imgA"] > 1e-9 {
+			t.Errorf("Metric %d: Expected identical image to have colour distance 0, got %f", metric, distances["imgA"])
+		}
+		if distance, ok := distances["imgB"]; ok && (distance <= 0 || distance > 1) {
+			t.Errorf("Metric %d: Unexpected colour distance %f", metric, distance)
+		}
+	}
+
+	// Histogram counts survive serialization.
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(store); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := New()
+	if err := gob.NewDecoder(&buffer).Decode(reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if counts := reloaded.candidates[0].histogramCounts; counts == nil || *counts != hashA.HistogramCounts {
+		t.Error("Histogram counts were not restored")
+	}
+}
+
+// Test the tagged candidate records.
+func TestCandidateFields(t *testing.T) {
+	original := candidate{
+		scaleCoef:       haar.Coef{1.5, -2.25, 3},
+		ratio:           1.333,
+		dHash:           [2]uint64{1, 1 << 63},
+		histogram:       42,
+		histoMax:        [3]float32{0.5, 0.25, 0.125},
+		histogramCounts: &[64]uint8{1, 2, 3},
+		blockhash:       [4]uint64{4, 5, 6, 7},
+		wHash:           8,
+		added:           -9,
+		generation:      10,
+	}
+	record := original.encodeFields()
+
+	// Append a field from the future.
+	record = append(record, 99, 3, 'x', 'y', 'z')
+
+	var decoded candidate
+	if err := decoded.decodeFields(record); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.histogramCounts == nil || *decoded.histogramCounts != *original.histogramCounts {
+		t.Errorf("Histogram counts not identical: %v vs %v", decoded.histogramCounts, original.histogramCounts)
+	}
+	decoded.histogramCounts = original.histogramCounts
+	if fmt.Sprint(decoded) != fmt.Sprint(original) {
+		t.Errorf("Decoded candidate not identical: %v vs %v", decoded, original)
+	}
+
+	// Corrupt records.
+	if err := decoded.decodeFields(record[:len(record)-1]); err == nil {
+		t.Error("Truncated record was decoded without error")
+	}
+}
+
+// Test compaction and statistics.
+func TestCompact(t *testing.T) {
+	store := New()
+
+	// Add some images.
+	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
+	addB, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgB)))
+	query, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgC)))
+	hashA, _ := CreateHash(addA)
+	hashB, _ := CreateHash(addB)
+	store.Add("imgA", hashA)
+	store.Add("imgB", hashB)
+	store.Delete("imgA")
+
+	stats := store.Stats()
+	if stats.Images != 1 || stats.Slots != 2 || stats.IndexEntries != (TopCoefs-1)*3 {
+		t.Errorf("Unexpected statistics before compaction: %+v", stats)
+	}
+	if removed := store.Compact(); removed != 1 {
+		t.Errorf("Compaction removed %d slots, expected 1", removed)
+	}
+	stats = store.Stats()
+	if stats.Images != 1 || stats.Slots != 1 || stats.IndexEntries != (TopCoefs-1)*3 {
+		t.Errorf("Unexpected statistics after compaction: %+v", stats)
+	}
+
+	// The remaining image must still be found.
+	queryHash, _ := CreateHash(query)
+	matches := store.Query(queryHash)
+	if len(matches) != 1 || matches[0].ID != "imgB" {
+		t.Errorf("Unexpected matches after compaction: %v", matches)
+	}
+}
+
+// Test the maintenance scheduler.
+func TestMaintenance(t *testing.T) {
+	store := New()
+	maintenance := NewMaintenance(store)
+	maintenance.Interval = time.Millisecond
+	maintenance.CPUBudget = 0.5
+	runs := make(chan Stats, 10)
+	maintenance.Schedule(time.Millisecond, StatsTask(func(stats Stats) {
+		select {
+		case runs <- stats:
+		default:
+		}
+	}))
+	maintenance.Start()
+	defer maintenance.Stop()
+
+	select {
+	case <-runs:
+	case <-time.After(5 * time.Second):
+		t.Error("Maintenance task was not run")
+	}
+}
+
+// Used in the next test.
+type testID struct {
+	Asset  string
+	Number int
+}
+
+// Test serialization.
+func TestGob(t *testing.T) {
+	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
+	addB, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgB)))
+	addC, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgC)))
+
+	store := New()
+	hashA, _ := CreateHash(addA)
+	hashB, _ := CreateHash(addB)
+	hashC, _ := CreateHash(addC)
+	store.Add(testID{"image", 1}, hashA)
+	store.Add(testID{"image", 2}, hashB)
+	store.Add(testID{"image", 3}, hashC)
+
+	// Serialize store.
+	var file bytes.Buffer
+	encoder := gob.NewEncoder(&file)
+	if err := encoder.Encode(store); err != nil {
+		t.Errorf("Encoding store failed: %s", err)
+		return
+	}
+
+	// Unserialize store.
+	var storeReloaded Store
+	decoder := gob.NewDecoder(&file)
+	if err := decoder.Decode(&storeReloaded); err != nil {
+		t.Errorf("Decoding store failed: %s", err)
+		return
+	}
+
+	// Are the candidates the same?
+	if len(store.candidates) != len(storeReloaded.candidates) {
+		t.Error("Candidate length not identical")
+		return
+	}
+	for index, candidate := range store.candidates {
+		if storeReloaded.candidates[index].id.(testID) != candidate.id.(testID) {
+			t.Errorf("Candidate ID not identical: %v vs %v", storeReloaded.candidates[index].id, candidate.id)
+			break
+		}
+		if len(storeReloaded.candidates[index].scaleCoef) != len(candidate.scaleCoef) {
+			t.Errorf("Candidate scaling function coefficient size not identical: %d vs %d", len(storeReloaded.candidates[index].scaleCoef), len(candidate.scaleCoef))
+			break
+		}
+		for i, v := range storeReloaded.candidates[index].scaleCoef {
+			if v != candidate.scaleCoef[i] {
+				t.Errorf("Candidate scaling function coefficient not identical: %v vs %v", storeReloaded.candidates[index].scaleCoef, candidate.scaleCoef)
+				break
+			}
+		}
+		if storeReloaded.candidates[index].ratio != candidate.ratio {
+			t.Errorf("Candidate ratio not identical: %f vs %f", storeReloaded.candidates[index].ratio, candidate.ratio)
+			break
+		}
+		if storeReloaded.candidates[index].blockhash != candidate.blockhash || storeReloaded.candidates[index].wHash != candidate.wHash {
+			t.Errorf("Candidate foreign hashes not identical: %v vs %v", storeReloaded.candidates[index], candidate)
+			break
+		}
+		if storeReloaded.candidates[index].added != candidate.added || storeReloaded.candidates[index].generation != candidate.generation {
+			t.Errorf("Candidate timestamp or generation not identical: %v vs %v", storeReloaded.candidates[index], candidate)
+			break
+		}
+		if overlap := storeReloaded.candidates[index].locations.Overlap(candidate.locations); overlap != len(candidate.locations) {
+			t.Errorf("Candidate significance map not identical: %v vs %v", storeReloaded.candidates[index].locations, candidate.locations)
+			break
+		}
+	}
+
+	if storeReloaded.Generation() != store.Generation() {
+		t.Errorf("Store generation not identical: %d vs %d", storeReloaded.Generation(), store.Generation())
+	}
+
+	// Are the indices the same?
+	if l1, l2 := len(store.indices), len(storeReloaded.indices); l1 != l2 {
+		t.Errorf("Index number of signs not identical: %d vs %d", l1, l2)
+		return
+	}
+	for location, list := range storeReloaded.indices {
+		indices, expected := list.decode(nil), store.indices[location].decode(nil)
+		if l1, l2 := len(indices), len(expected); l1 != l2 {
+			t.Errorf("Reloaded index slice at %d is of length %d, expected %d", location, l1, l2)
+			return
+		}
+		for i, index := range indices {
+			if index != expected[i] {
+				t.Errorf("Reloaded index at %d[%d] is %d, expected %d", location, i, index, expected[i])
+				return
+			}
+		}
+	}
+}
+
+// Test burst grouping.
+func TestGroupBursts(t *testing.T) {
+	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
+	addB, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgB)))
+	hashA, _ := CreateHash(addA)
+	hashB, _ := CreateHash(addB)
+
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	shots := []Shot{
+		{"later", hashA, start.Add(time.Hour)},
+		{"burst1", hashA, start},
+		{"burst2", hashA, start.Add(time.Second)},
+		{"different", hashB, start.Add(1500 * time.Millisecond)},
+	}
+	bursts, others := GroupBursts(shots, DefaultBurstOptions)
+	if len(bursts) != 1 || len(bursts[0]) != 2 || bursts[0][0] != "burst1" || bursts[0][1] != "burst2" {
+		t.Errorf("Unexpected bursts: %v", bursts)
+	}
+	if len(others) != 2 || others[0] != "different" || others[1] != "later" {
+		t.Errorf("Unexpected other shots: %v", others)
+	}
+
+	// Zero hashes never form bursts.
+	bursts, _ = GroupBursts([]Shot{{"zero1", Hash{}, start}, {"zero2", Hash{}, start}}, DefaultBurstOptions)
+	if len(bursts) != 0 {
+		t.Errorf("Zero hashes formed bursts: %v", bursts)
+	}
+}
+
+// Test duplicate event subscriptions.
+func TestSubscribe(t *testing.T) {
+	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
+	addC, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgC)))
+	hashA, _ := CreateHash(addA)
+	hashC, _ := CreateHash(addC)
+
+	store := New()
+	store.Add("imgA", hashA)
+	events := store.Subscribe(0)
+	store.Add("imgC", hashC)
+
+	select {
+	case event := <-events:
+		if event.ID != "imgC" || event.Match.ID != "imgA" {
+			t.Errorf("Unexpected event: %v matched %v", event.ID, event.Match)
+		}
+	default:
+		t.Error("No duplicate event received")
+	}
+
+	// The added image itself and images added after it are not reported.
+	store.AddAll([]IDHash{{"imgA2", hashA}, {"imgA3", hashA}})
+	matched := make(map[[2]interface{}]bool)
+	for len(events) > 0 {
+		event := <-events
+		matched[[2]interface{}{event.ID, event.Match.ID}] = true
+	}
+	if !matched[[2]interface{}{"imgA2", "imgA"}] || !matched[[2]interface{}{"imgA3", "imgA2"}] ||
+		matched[[2]interface{}{"imgA2", "imgA2"}] || matched[[2]interface{}{"imgA2", "imgA3"}] {
+		t.Errorf("Unexpected events: %v", matched)
+	}
+
+	store.Unsubscribe(events)
+	if _, ok := <-events; ok {
+		t.Error("Channel was not closed after unsubscribing")
+	}
+}
+
+// Test significance maps.
+func TestSignificanceMap(t *testing.T) {
+	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
+	addB, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgB)))
+	addC, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgC)))
+	hashA, _ := CreateHash(addA)
+	hashB, _ := CreateHash(addB)
+	hashC, _ := CreateHash(addC)
+
+	store := New()
+	store.Add("imgA", hashA)
+	store.Add("imgB", hashB)
+
+	mapA, ok := store.SignificanceMap("imgA")
+	if !ok {
+		t.Fatal("Significance map of imgA not found")
+	}
+	if len(mapA) != (TopCoefs-1)*3 {
+		t.Errorf("Significance map has %d entries, expected %d", len(mapA), (TopCoefs-1)*3)
+	}
+	if overlap := mapA.Overlap(hashA.SignificanceMap()); overlap != len(mapA) {
+		t.Errorf("Significance map overlaps with own hash by %d, expected %d", overlap, len(mapA))
+	}
+	for i := range mapA {
+		coefIndex, channel, sign := mapA.Position(i)
+		if coef := hashA.Coefs[coefIndex][channel]; coef*float64(sign) < 0 || math.Abs(coef) < hashA.Thresholds[channel] {
+			t.Errorf("Position %d decoded to insignificant coefficient %f", i, coef)
+		}
+	}
+	mapA[0]++
+	if original, _ := store.SignificanceMap("imgA"); original[0] == mapA[0] {
+		t.Error("Modifying a significance map modified the store")
+	}
+	mapA[0]--
+	mapB, _ := store.SignificanceMap("imgB")
+	mapC := hashC.SignificanceMap()
+	if mapA.Overlap(mapC) <= mapB.Overlap(mapC) {
+		t.Errorf("imgC overlaps more with imgB (%d) than with imgA (%d)", mapB.Overlap(mapC), mapA.Overlap(mapC))
+	}
+
+	// Deleted images don't have a map.
+	store.Delete("imgA")
+	if _, ok := store.SignificanceMap("imgA"); ok {
+		t.Error("Significance map of deleted image was found")
+	}
+}
+
+// Test store tuning.
+func TestTune(t *testing.T) {
+	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
+	addB, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgB)))
+	addC, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgC)))
+
+	store := New()
+	report, err := store.Tune([]image.Image{addA, addB, addC}, [][2]int{{0, 2}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Results) != len(DefaultTuneOptions.TopCoefs)*len(DefaultTuneOptions.Weights) {
+		t.Errorf("Unexpected number of results: %d", len(report.Results))
+	}
+	if report.Best.F1 != 1 {
+		t.Errorf("Best configuration did not separate duplicates: %+v", report.Best)
+	}
+	if store.topCoefs != report.Best.TopCoefs || store.weights != report.Best.Weights {
+		t.Error("Best configuration was not applied to the store")
+	}
+
+	// Try hash options, too. A preprocessor which makes all images identical
+	// can't separate the duplicates.
+	blank := PreprocessorFunc(func(img image.Image) image.Image {
+		return image.NewGray(image.Rect(0, 0, 16, 16))
+	})
+	options := TuneOptions{
+		TopCoefs:    []int{40},
+		Weights:     []Weights{DefaultWeights},
+		HashOptions: [][]HashOption{{WithPreprocessors(blank)}, nil},
+	}
+	report, err = New().Tune([]image.Image{addA, addB, addC}, [][2]int{{0, 2}}, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Results) != 2 || len(report.Results[0].HashOptions) != 1 {
+		t.Errorf("Unexpected results %+v", report.Results)
+	}
+	if report.Best.F1 != 1 || report.Best.HashOptions != nil {
+		t.Errorf("Best configuration did not use the best hash options: %+v", report.Best)
+	}
+
+	// Non-empty stores can't be tuned.
+	hashA, _ := CreateHash(addA)
+	store.Add("imgA", hashA)
+	if _, err := store.Tune([]image.Image{addA, addC}, [][2]int{{0, 1}}, nil); err == nil {
+		t.Error("Tuning a non-empty store did not fail")
+	}
+}
+
+// Package example.
+func Example() {
+	// Create some example JPEG images.
+	addA, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgA)))
+	addB, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgB)))
+	query, _ := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgC)))
+
+	// Create the store.
+	store := New()
+
+	// Turn two images into hashes and add them to the store.
+	hashA, _ := CreateHash(addA)
+	hashB, _ := CreateHash(addB)
+	store.Add("imgA", hashA)
+	store.Add("imgB", hashB)
+
+	// Query the store for our third image (which is most similar to "imgA").
+	queryHash, _ := CreateHash(query)
+	matches := store.Query(queryHash)
+	fmt.Println(matches[0].ID)
+	// Output: imgA
+}
+
+// Test the decoder registry.
+func TestDecoderRegistry(t *testing.T) {
+	img := testImages(t)[0]
+	RegisterDecoder("test", "DUPLO?TEST", func(r io.Reader) (image.Image, error) {
+		return img, nil
+	})
+
+	// Registered format.
+	hash, _, err := CreateHashFromReader(strings.NewReader("DUPLO1TEST"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := CreateHash(img)
+	if hash.Coefs[0] != expected.Coefs[0] || hash.DHash != expected.DHash {
+		t.Error("Hash of registered format differs")
+	}
+	if _, name, err := DecodeImage(strings.NewReader("DUPLO2TEST")); err != nil || name != "test" {
+		t.Errorf("Unexpected format %q (%v)", name, err)
+	}
+
+	// Standard format.
+	if _, name, err := DecodeImage(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgB))); err != nil || name != "jpeg" {
+		t.Errorf("Unexpected format %q (%v)", name, err)
+	}
+
+	// Unknown formats.
+	if _, _, err := CreateHashFromReader(strings.NewReader("DUPLO")); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+	if _, _, err := CreateHashFromFile("does-not-exist.jpg"); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+// Test the reconstruction of stored hashes.
+func TestGetHash(t *testing.T) {
+	img := testImages(t)[0]
+	hash, _ := CreateHash(img)
+	store := New()
+	store.Add("imgA", hash)
+
+	if _, ok := store.GetHash("imgB"); ok {
+		t.Error("Found hash of unknown image")
+	}
+	reconstructed, ok := store.GetHash("imgA")
+	if !ok {
+		t.Fatal("Hash not found")
+	}
+	if reconstructed.Coefs[0] != hash.Coefs[0] || reconstructed.Ratio != hash.Ratio ||
+		reconstructed.DHash != hash.DHash || reconstructed.Histogram != hash.Histogram ||
+		reconstructed.Blockhash != hash.Blockhash || reconstructed.WHash != hash.WHash {
+		t.Error("Reconstructed hash differs from original")
+	}
+	locations, _ := store.SignificanceMap("imgA")
+	if fmt.Sprint(reconstructed.SignificanceMap()) != fmt.Sprint(locations) {
+		t.Error("Significance maps differ")
+	}
+
+	// The reconstructed hash finds the original image.
+	matches := store.Query(reconstructed)
+	if len(matches) != 1 || matches[0].ID != "imgA" || matches[0].DHashDistance != 0 {
+		t.Errorf("Unexpected matches: %v", matches)
+	}
+}
+
+// Test warming up a store.
+func TestWarmup(t *testing.T) {
+	store := New()
+	store.Warmup(0) // Empty store.
+	for index, hash := range testHashes(t) {
+		store.Add(index, hash)
+	}
+	generation := store.Generation()
+	for _, parallelism := range []int{1, 4, 100} {
+		store.Warmup(parallelism)
+	}
+	if store.Size() != 3 || store.Generation() != generation {
+		t.Error("Warmup changed the store")
+	}
+}
+
+// Test swapping the scoring weights.
+func TestSetWeights(t *testing.T) {
+	store := New()
+	hashes := testHashes(t)
+	for index, hash := range hashes {
+		store.Add(index, hash)
+	}
+	if store.Weights() != DefaultWeights {
+		t.Error("Expected default weights")
+	}
+	before := store.Query(hashes[0])
+
+	// Doubling all weights doubles all scores.
+	var doubled Weights
+	for channel := range DefaultWeights {
+		for bin := range DefaultWeights[channel] {
+			doubled[channel][bin] = 2 * DefaultWeights[channel][bin]
+		}
+	}
+	store.SetWeights(doubled)
+	if store.Weights() != doubled {
+		t.Error("Weights were not set")
+	}
+	after := store.Query(hashes[0])
+	if len(after) != len(before) {
+		t.Fatalf("Expected %d matches, got %d", len(before), len(after))
+	}
+	scores := make(map[interface{}]float64)
+	for _, match := range before {
+		scores[match.ID] = match.Score
+	}
+	for _, match := range after {
+		if math.Abs(match.Score-2*scores[match.ID]) > 1e-9 {
+			t.Errorf("Expected score %f for %v, got %f", 2*scores[match.ID], match.ID, match.Score)
+		}
+	}
+}
+
+// Test querying by ID.
+func TestQueryID(t *testing.T) {
+	store := New()
+	hashes := testHashes(t)
+	store.Add("imgA", hashes[0])
+	store.Add("imgB", hashes[1])
+	store.Add("imgC", hashes[2])
+
+	if matches := store.QueryID("imgD"); matches != nil {
+		t.Errorf("Expected no matches for unknown ID, got %v", matches)
+	}
+
+	// Results equal a query with the original hash, minus the image itself.
+	expected := make(map[interface{}]float64)
+	for _, match := range store.Query(hashes[0]) {
+		if match.ID != "imgA" {
+			expected[match.ID] = match.Score
+		}
+	}
+	matches := store.QueryID("imgA")
+	if len(matches) != len(expected) {
+		t.Fatalf("Expected %d matches, got %d", len(expected), len(matches))
+	}
+	for _, match := range matches {
+		score, ok := expected[match.ID]
+		if !ok || math.Abs(score-match.Score) > 1e-9 {
+			t.Errorf("Unexpected match %v with score %f (expected %f)", match.ID, match.Score, score)
+		}
+	}
+}
+
+// Test clustering all images of a store.
+func TestFindAllDuplicates(t *testing.T) {
+	store := New()
+	hashes := testHashes(t)
+	store.Add("imgA", hashes[0])
+	store.Add("imgB", hashes[1])
+	store.Add("imgA2", hashes[0])
+	store.Add("imgC", hashes[2])
+	store.Add("deleted", hashes[1])
+	store.Delete("deleted")
+
+	// Determine the threshold between the identical and the other images.
+	var identical, other float64
+	for _, match := range store.QueryID("imgA") {
+		if match.ID == "imgA2" {
+			identical = match.Score
+		} else if match.Score < other {
+			other = match.Score
+		}
+	}
+
+	var calls, lastDone, lastTotal int
+	clusters := store.FindAllDuplicates((identical+other)/2, func(done, total int) {
+		calls++
+		lastDone, lastTotal = done, total
+	})
+	if fmt.Sprint(clusters) != "[[imgA imgA2]]" {
+		t.Errorf("Unexpected clusters: %v", clusters)
+	}
+	if calls == 0 || lastDone != 5 || lastTotal != 5 {
+		t.Errorf("Unexpected progress: %d calls, last %d/%d", calls, lastDone, lastTotal)
+	}
+
+	// A high threshold joins everything that shares buckets.
+	clusters = store.FindAllDuplicates(math.Inf(1), nil)
+	if len(clusters) != 1 || len(clusters[0]) != 4 {
+		t.Errorf("Unexpected clusters: %v", clusters)
+	}
+	if clusters := store.FindAllDuplicates(math.Inf(-1), nil); len(clusters) != 0 {
+		t.Errorf("Unexpected clusters: %v", clusters)
+	}
+}
+
+// Test the breakdown of Haar scores.
+func TestScoreComponents(t *testing.T) {
+	store := New()
+	var queryHash Hash
+	for index, hash := range testHashes(t) {
+		if index == 0 {
+			queryHash = hash
+		}
+		store.Add(index, hash)
+	}
+
+	for _, match := range store.Query(queryHash) {
+		if match.Components != nil {
+			t.Error("Components were not requested")
+		}
+	}
+	matches := store.QueryWithOptions(queryHash, &QueryOptions{ScoreComponents: true})
+	if len(matches) == 0 {
+		t.Fatal("No matches")
+	}
+	for _, match := range matches {
+		if match.Components == nil {
+			t.Fatalf("No components for %v", match.ID)
+		}
+		var sum float64
+		for _, component := range match.Components {
+			sum += component
+		}
+		if math.Abs(sum-match.HaarScore) > 1e-9 {
+			t.Errorf("Components of %v add up to %f, expected %f", match.ID, sum, match.HaarScore)
+		}
+		if match.ID == 0 && match.Components[0] != 0 {
+			t.Errorf("Expected no scaling term for identical image, got %f", match.Components[0])
+		}
+	}
+}
+
+// Test region queries against tiled images.
+func TestQueryRegion(t *testing.T) {
+	img := testImages(t)[0]
+	store := New()
+	count, err := store.AddTiled("imgA", img, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 9 || store.Size() != 9 {
+		t.Fatalf("Expected 9 tiles, got %d", count)
+	}
+	if _, err := store.AddTiled("imgA", img, 0); err == nil {
+		t.Error("Expected error for invalid grid")
+	}
+
+	// Query the centre tile.
+	bounds := img.Bounds()
+	rect := image.Rect(bounds.Dx()/4, bounds.Dy()/4, bounds.Dx()/4+bounds.Dx()/2, bounds.Dy()/4+bounds.Dy()/2).Add(bounds.Min)
+	matches, err := store.QueryRegion(img, rect, &QueryOptions{MaxResults: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].ID != (Tile{ID: "imgA", Rect: rect}) {
+		t.Errorf("Unexpected matches: %v", matches)
+	}
+
+	if _, err := store.QueryRegion(img, image.Rect(-10, -10, -1, -1).Add(bounds.Min), nil); err == nil {
+		t.Error("Expected error for region outside of image")
+	}
+
+	// Tiles survive serialization.
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(store); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := New()
+	if err := gob.NewDecoder(&buffer).Decode(reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.Has(Tile{ID: "imgA", Rect: rect}) {
+		t.Error("Tile not found after reload")
+	}
+}
+
+// Test streaming duplicate pairs.
+func TestStreamDuplicatePairs(t *testing.T) {
+	store := New()
+	hashes := testHashes(t)
+	store.Add("imgA", hashes[0])
+	store.Add("imgB", hashes[1])
+	store.Add("imgA2", hashes[0])
+	store.Add("imgC", hashes[2])
+
+	// All pairs sharing buckets, each reported once.
+	var pairs []string
+	err := store.StreamDuplicatePairs(context.Background(), math.Inf(1), func(a, b interface{}, match *Match) bool {
+		if match.ID != b {
+			t.Errorf("Match %v does not belong to %v", match.ID, b)
+		}
+		pairs = append(pairs, fmt.Sprintf("%v/%v", a, b))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) == 0 || len(pairs) > 6 {
+		t.Errorf("Unexpected pairs: %v", pairs)
+	}
+
+	// Only the identical pair.
+	identical := store.QueryWithOptions(hashes[0], &QueryOptions{MaxResults: 2})[1].Score
+	pairs = nil
+	err = store.StreamDuplicatePairs(context.Background(), identical+1, func(a, b interface{}, match *Match) bool {
+		if match.Similarity < 0.99 {
+			t.Errorf("Expected identical pair, got similarity %f", match.Similarity)
+		}
+		pairs = append(pairs, fmt.Sprintf("%v/%v", a, b))
+		store.SetWeights(store.Weights()) // Modifying the store must not deadlock.
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(pairs) != "[imgA/imgA2]" {
+		t.Errorf("Unexpected pairs: %v", pairs)
+	}
+
+	// Stopping and cancellation.
+	var calls int
+	store.StreamDuplicatePairs(context.Background(), math.Inf(1), func(a, b interface{}, match *Match) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Errorf("Expected one call, got %d", calls)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := store.StreamDuplicatePairs(ctx, math.Inf(1), nil); err != context.Canceled {
+		t.Errorf("Expected cancellation, got %v", err)
+	}
+}
+
+// Test cancelling queries.
+func TestQueryContext(t *testing.T) {
+	store := New()
+	var queryHash Hash
+	for index, hash := range testHashes(t) {
+		if index == 0 {
+			queryHash = hash
+		}
+		store.Add(index, hash)
+	}
+
+	matches, err := store.QueryContext(context.Background(), queryHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != len(store.Query(queryHash)) {
+		t.Errorf("Expected same results as Query(), got %v", matches)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if matches, err := store.QueryContext(ctx, queryHash); err != context.Canceled || matches != nil {
+		t.Errorf("Expected cancellation, got %v, %v", matches, err)
+	}
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := store.QueryContext(ctx, queryHash); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline error, got %v", err)
+	}
+}
+
+// Test adding and querying in bulk.
+func TestBatch(t *testing.T) {
+	var images []IDHash
+	hashes := testHashes(t)
+	for index, hash := range hashes {
+		images = append(images, IDHash{ID: index, Hash: hash})
+	}
+
+	store := New()
+	store.Add(0, hashes[0])
+	if added := store.AddAll(append(images, IDHash{ID: 1, Hash: hashes[1]})); added != 2 {
+		t.Errorf("Expected 2 added images, got %d", added)
+	}
+	if store.Size() != 3 {
+		t.Fatalf("Expected 3 images, got %d", store.Size())
+	}
+
+	results := store.QueryAll(hashes)
+	if len(results) != len(hashes) {
+		t.Fatalf("Expected %d results, got %d", len(hashes), len(results))
+	}
+	for index, matches := range results {
+		expected := store.Query(hashes[index])
+		sort.Sort(matches)
+		sort.Sort(expected)
+		if fmt.Sprint(matches) != fmt.Sprint(expected) {
+			t.Errorf("Query %d: expected %v, got %v", index, expected, matches)
+		}
+		if matches[0].ID != index {
+			t.Errorf("Query %d: unexpected best match %v", index, matches[0].ID)
+		}
+	}
+}
+
+// Test that the ID set is restored from the candidates.
+func TestIDSet(t *testing.T) {
+	img := testImages(t)[0]
+	hash, _ := CreateHash(img)
+	store := New()
+	for _, id := range []string{"/photos/a.jpg", "/photos/b.jpg", "/photos/c.jpg"} {
+		store.Add(id, hash)
+	}
+	store.Delete("/photos/b.jpg")
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(store); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := new(Store)
+	if err := gob.NewDecoder(&buffer).Decode(reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.ids) != 2 || !reloaded.Has("/photos/a.jpg") || !reloaded.Has("/photos/c.jpg") {
+		t.Fatalf("Unexpected ID set: %v", reloaded.ids)
+	}
+	for id, index := range reloaded.ids {
+		if reloaded.candidates[index].id != id {
+			t.Errorf("ID %v points to candidate %v", id, reloaded.candidates[index].id)
+		}
+	}
+}
+
+// Test decoding stores written by earlier versions of this package.
+func TestLegacyStore(t *testing.T) {
+	img := testImages(t)[0]
+	hash, _ := CreateHash(img)
+	original := New()
+	original.Add("a", hash)
+
+	// legacy encodes the original store in format version 3, with the index
+	// bucket at location 0 replaced by the given bucket.
+	legacy := func(bucket []uint64) []byte {
+		var buffer bytes.Buffer
+		compressor := gzip.NewWriter(&buffer)
+		encoder := gob.NewEncoder(compressor)
+		c := original.candidates[0]
+		indices := make([][]uint64, len(original.indices))
+		for location := range indices {
+			indices[location] = original.indices[location].decode(nil)
+		}
+		indices[0] = bucket
+		for _, value := range []interface{}{3, 1, &c.id, c.scaleCoef, c.ratio, c.dHash, c.histogram, c.histoMax, original.ids, indices} {
+			if err := encoder.Encode(value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		compressor.Close()
+		return buffer.Bytes()
+	}
+
+	// Decoding replaces the store's contents.
+	store := New()
+	store.Add("stale", hash)
+	store.Add("a", hash)
+	if err := store.Suppress("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.GobDecode(legacy(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if matches := store.Query(hash); len(matches) != 1 || matches[0].ID != "a" {
+		t.Errorf("Unexpected matches in legacy store: %v", matches)
+	}
+	if store.Has("stale") || len(store.IDs()) != 1 || len(store.Suppressed()) != 0 {
+		t.Errorf("Unexpected IDs after decoding: %v", store.IDs())
+	}
+
+	// Legacy hashes predate HashVersion, also when written again.
+	if store.HashVersion() != 0 {
+		t.Errorf("Legacy store has hash version %d", store.HashVersion())
+	}
+	var written bytes.Buffer
+	if _, err := store.WriteTo(&written); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ReadFrom(&written); err != nil {
+		t.Fatal(err)
+	}
+	if store.HashVersion() != 0 {
+		t.Errorf("Rewritten legacy store has hash version %d", store.HashVersion())
+	}
+	if New().HashVersion() != HashVersion {
+		t.Errorf("New store has hash version %d", New().HashVersion())
+	}
+	if err := New().GobDecode(legacy([]uint64{5})); err == nil {
+		t.Error("Invalid candidate index was decoded without error")
+	}
+
+	// Header-less data with a future version is rejected.
+	var future bytes.Buffer
+	compressor := gzip.NewWriter(&future)
+	if err := gob.NewEncoder(compressor).Encode(storeVersion + 1); err != nil {
+		t.Fatal(err)
+	}
+	compressor.Close()
+	if err := New().GobDecode(future.Bytes()); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("Decoding a future store version returned %v", err)
+	}
+}
+
+// Test the interning of string IDs.
+func TestIDInterning(t *testing.T) {
+	img := testImages(t)[0]
+	hash, _ := CreateHash(img)
+
+	// idBytes returns the number of bytes held by the distinct string IDs of
+	// the store.
+	idBytes := func(store *Store) (size int) {
+		seen := make(map[*byte]bool)
+		count := func(id interface{}) {
+			if s, ok := id.(string); ok && !seen[unsafe.StringData(s)] {
+				seen[unsafe.StringData(s)] = true
+				size += len(s)
+			}
+		}
+		for _, candidate := range store.candidates {
+			count(candidate.id)
+		}
+		for _, ids := range store.negatives {
+			for id := range ids {
+				count(id)
+			}
+		}
+		for id := range store.suppressed {
+			count(id)
+		}
+		return
+	}
+
+	// The paths are sliced from a large file listing.
+	listing := strings.Repeat(" ", 1<<16) + "/photos/a.jpg\n/photos/b.jpg\n/photos/c.jpg"
+	paths := strings.Split(strings.TrimSpace(listing), "\n")
+	for _, interning := range []bool{false, true} {
+		var options []Option
+		if interning {
+			options = append(options, WithIDInterning())
+		}
+		store := New(options...)
+		for _, path := range paths {
+			store.Add(path, hash)
+		}
+		if err := store.MarkFalsePositive(paths[0], paths[1]); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Suppress(paths[2]); err != nil {
+			t.Fatal(err)
+		}
+		if pinned := unsafe.StringData(store.candidates[0].id.(string)) == unsafe.StringData(paths[0]); pinned == interning {
+			t.Errorf("Interning %t: ID shares memory with the listing: %t", interning, pinned)
+		}
+
+		var buffer bytes.Buffer
+		if _, err := store.WriteTo(&buffer); err != nil {
+			t.Fatal(err)
+		}
+		reloaded := New(options...)
+		if _, err := reloaded.ReadFrom(&buffer); err != nil {
+			t.Fatal(err)
+		}
+		expected := 6 * len(paths[0]) // Three candidates, two negatives, one suppressed.
+		if interning {
+			expected = 3 * len(paths[0])
+		}
+		if size := idBytes(reloaded); size != expected {
+			t.Errorf("Interning %t: IDs hold %d bytes, expected %d", interning, size, expected)
+		}
+		if len(reloaded.negatives[keyOf(hash)]) != 2 || len(reloaded.Suppressed()) != 1 {
+			t.Errorf("Interning %t: negatives or suppressed images were lost", interning)
+		}
+
+		// Removed IDs are released.
+		reloaded.Exchange(paths[2], "/photos/d.jpg")
+		for _, id := range []string{paths[0], paths[1], "/photos/d.jpg"} {
+			reloaded.Delete(id)
+		}
+		if len(reloaded.interned) != 0 {
+			t.Errorf("Interning %t: %d IDs were not released", interning, len(reloaded.interned))
+		}
+	}
+
+	// Stores loaded from the same data share their IDs. Measure the heap
+	// growth caused by loading a second copy of a store with long IDs.
+	const count, length = 1000, 1024
+	original := New()
+	for index := 0; index < count; index++ {
+		original.Add(fmt.Sprintf("%0*d", length, index), hash)
+	}
+	var data bytes.Buffer
+	if _, err := original.WriteTo(&data); err != nil {
+		t.Fatal(err)
+	}
+	var growth [2]int64
+	for index, interning := range []bool{false, true} {
+		var options []Option
+		if interning {
+			options = append(options, WithIDInterning())
+		}
+		first := New(options...)
+		if _, err := first.ReadFrom(bytes.NewReader(data.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		second := New(options...)
+		if _, err := second.ReadFrom(bytes.NewReader(data.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		growth[index] = int64(after.HeapAlloc) - int64(before.HeapAlloc)
+		runtime.KeepAlive(first)
+		runtime.KeepAlive(second)
+	}
+	if saved := growth[0] - growth[1]; saved < count*length*9/10 {
+		t.Errorf("Interning saved %d bytes of %d bytes of IDs when loading a store twice", saved, count*length)
+	}
+}
+
+// Test adding images whose IDs already exist.
+func TestPut(t *testing.T) {
+	hashes := testHashes(t)[:2]
+	bestDistance := func(store *Store, hash Hash) interface{} {
+		matches := store.QueryWithOptions(hash, &QueryOptions{MaxResults: 1})
+		if len(matches) == 0 {
+			return nil
+		}
+		return matches[0].DHashDistance
+	}
+
+	store := New()
+	if err := store.Put("file", hashes[0], nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ignore.
+	if err := store.Put("file", hashes[1], IgnoreDuplicates); err != nil {
+		t.Error(err)
+	}
+	if bestDistance(store, hashes[0]) != 0 {
+		t.Error("Image was replaced")
+	}
+
+	// Reject.
+	if err := store.Put("file", hashes[1], RejectDuplicates); err != ErrIDExists {
+		t.Errorf("Expected ErrIDExists, got %v", err)
+	}
+
+	// Replace if changed.
+	var calls int
+	counting := func(id interface{}, stored, added Hash) (bool, error) {
+		calls++
+		return ReplaceChanged(id, stored, added)
+	}
+	if err := store.Put("file", hashes[0], counting); err != nil {
+		t.Error(err)
+	}
+	generation := store.Generation()
+	if err := store.Put("file", hashes[0], ReplaceChanged); err != nil || store.Generation() != generation {
+		t.Errorf("Unchanged image was replaced (%v)", err)
+	}
+	if err := store.Put("file", hashes[1], ReplaceChanged); err != nil {
+		t.Error(err)
+	}
+	if calls != 1 || store.Size() != 1 || bestDistance(store, hashes[1]) != 0 {
+		t.Error("Changed image was not replaced")
+	}
+	if matches := store.Query(hashes[1]); len(matches) != 1 || matches[0].ID != "file" {
+		t.Errorf("Unexpected matches: %v", matches)
+	}
+
+	// Replace always.
+	if err := store.Put("file", hashes[0], ReplaceDuplicates); err != nil {
+		t.Error(err)
+	}
+	if bestDistance(store, hashes[0]) != 0 {
+		t.Error("Image was not replaced")
+	}
+}
+
+// Test hashing images concurrently.
+func TestHashAll(t *testing.T) {
+	images := testImages(t)
+	expected := make(map[interface{}]Hash)
+	jobs := make(chan ImageJob)
+	go func() {
+		for index, img := range images {
+			jobs <- ImageJob{ID: index, Image: img}
+		}
+		jobs <- ImageJob{ID: "missing", Path: "does-not-exist.jpg"}
+		close(jobs)
+	}()
+	for index, hash := range testHashes(t) {
+		expected[index] = hash
+	}
+
+	var count int
+	for result := range HashAll(context.Background(), jobs, 2) {
+		count++
+		if result.ID == "missing" {
+			if result.Err == nil {
+				t.Error("Expected error for missing file")
+			}
+			continue
+		}
+		if result.Err != nil {
+			t.Errorf("Image %v: %s", result.ID, result.Err)
+			continue
+		}
+		if result.Hash.DHash != expected[result.ID].DHash || result.Hash.Coefs[0] != expected[result.ID].Coefs[0] {
+			t.Errorf("Image %v: unexpected hash", result.ID)
+		}
+	}
+	if count != 4 {
+		t.Errorf("Expected 4 results, got %d", count)
+	}
+
+	// Cancellation closes the results channel.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for range HashAll(ctx, make(chan ImageJob), 0) {
+		t.Error("Unexpected result")
+	}
+}
+
+// Test the hash stability report.
+func TestStability(t *testing.T) {
+	img := testImages(t)[0]
+	results, err := Stability(img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(DefaultPerturbations) {
+		t.Fatalf("Expected %d results, got %d", len(DefaultPerturbations), len(results))
+	}
+	for index, result := range results {
+		if result.Perturbation != DefaultPerturbations[index].Name {
+			t.Errorf("Expected perturbation %q, got %q", DefaultPerturbations[index].Name, result.Perturbation)
+		}
+		if result.Match.Similarity <= 0 || result.Match.Similarity > 1 {
+			t.Errorf("%s: unexpected similarity %f", result.Perturbation, result.Match.Similarity)
+		}
+	}
+
+	// The identity perturbation yields a perfect match.
+	identity := Perturbation{Name: "identity", Apply: func(img image.Image) (image.Image, error) {
+		return img, nil
+	}}
+	results, err = Stability(img, []Perturbation{identity})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Perturbation != "identity" || results[0].Match.DHashDistance != 0 || results[0].Match.Similarity < 0.99 {
+		t.Errorf("Unexpected identity result: %+v", results[0])
+	}
+
+	if _, err := Stability(img, []Perturbation{ResizePerturbation(0)}); err == nil {
+		t.Error("Expected error for invalid perturbation")
+	}
+}
+
+// Test the negative list.
+func TestFalsePositives(t *testing.T) {
+	hashes := testHashes(t)
+	store := New()
+	store.Add("imgA", hashes[0])
+	store.Add("imgA2", hashes[0])
+	store.Add("imgB", hashes[1])
+	contains := func(matches Matches, id interface{}) *Match {
+		for _, match := range matches {
+			if match.ID == id {
+				return match
+			}
+		}
+		return nil
+	}
+
+	if err := store.MarkFalsePositive("imgA", "unknown"); err == nil {
+		t.Error("Expected error for unknown ID")
+	}
+	before := contains(store.Query(hashes[1]), "imgA2")
+	if before == nil {
+		t.Fatal("Expected match")
+	}
+	if err := store.MarkFalsePositive("imgB", "imgA2"); err != nil {
+		t.Fatal(err)
+	}
+	if contains(store.Query(hashes[1]), "imgA2") != nil || contains(store.QueryID("imgA2"), "imgB") != nil {
+		t.Error("False positive was returned")
+	}
+	if contains(store.Query(hashes[1]), "imgA") == nil {
+		t.Error("Unrelated pair was suppressed")
+	}
+	penalized := contains(store.QueryWithOptions(hashes[1], &QueryOptions{FalsePositivePenalty: 100}), "imgA2")
+	if penalized == nil || math.Abs(penalized.Score-before.Score-100) > 1e-9 {
+		t.Errorf("Expected penalized match, got %v", penalized)
+	}
+
+	// Hashes of images not in the store.
+	store.MarkFalsePositiveHash(hashes[2], "imgB")
+	if contains(store.Query(hashes[2]), "imgB") != nil {
+		t.Error("False positive hash pairing was returned")
+	}
+
+	// The negative list is saved with the store.
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(store); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := New()
+	if err := gob.NewDecoder(&buffer).Decode(reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if contains(reloaded.Query(hashes[1]), "imgA2") != nil || contains(reloaded.Query(hashes[2]), "imgB") != nil {
+		t.Error("Negative list was not restored")
+	}
+
+	store.UnmarkFalsePositive("imgA2", "imgB")
+	if contains(store.Query(hashes[1]), "imgA2") == nil {
+		t.Error("Unmarked pair was suppressed")
+	}
+	generation := store.Generation()
+	store.UnmarkFalsePositive("imgA2", "imgB")
+	if store.Generation() != generation {
+		t.Error("Unmarking a pair which is not on the negative list modified the store")
+	}
+
+	// Updates move the entries to the new hash.
+	if err := store.MarkFalsePositive("imgB", "imgA2"); err != nil {
+		t.Fatal(err)
+	}
+	store.Update("imgB", hashes[2])
+	if contains(store.QueryID("imgB"), "imgA2") != nil || store.negatives[keyOf(hashes[1])] != nil {
+		t.Errorf("Negative list was not migrated: %v", store.negatives)
+	}
+
+	// Deletions prune the negative list. imgA shares imgA2's key.
+	store.Delete("imgA2")
+	for _, list := range store.negatives {
+		if list["imgA2"] {
+			t.Errorf("Deleted image remains on the negative list: %v", store.negatives)
+		}
+	}
+	if !store.negatives[keyOf(hashes[0])]["imgB"] {
+		t.Error("Negative list of a key still in use was removed")
+	}
+	if store.keyCounts[keyOf(hashes[0])] != 1 || store.negativeIDs["imgA2"] != nil {
+		t.Errorf("Negative list index is out of date: %v, %v", store.keyCounts, store.negativeIDs)
+	}
+	store.DeleteMany([]interface{}{"imgB"})
+	if len(store.negatives) != 0 {
+		t.Errorf("Negative list is %v after deletions, expected it to be empty", store.negatives)
+	}
+	if store.keyCounts != nil || store.negativeIDs != nil {
+		t.Error("Negative list index was not released")
+	}
+}
+
+// Test that modifications don't affect snapshots which are being encoded.
+func TestSnapshot(t *testing.T) {
+	hashes := testHashes(t)
+	store := New()
+	store.Add("imgA", hashes[0])
+	store.Add("imgB", hashes[1])
+	store.Add("imgC", hashes[2])
+
+	// Take a snapshot, then modify the store in every possible way.
+	store.RLock()
+	store.distributing.Lock()
+	snapshot := store.takeSnapshot()
+	store.distributing.Unlock()
+	store.RUnlock()
+	store.Delete("imgB")
+	store.Add("imgD", hashes[1]) // Reuses imgB's slot.
+	if err := store.Exchange("imgA", "imgX"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkFalsePositive("imgX", "imgC"); err != nil {
+		t.Fatal(err)
+	}
+	store.Delete("imgC")
+	store.Compact()
+	store.DeleteOlderThan(time.Now().Add(time.Hour))
+	var data bytes.Buffer
+	err := snapshot.writeTo(&data)
+	store.releaseSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := New()
+	if err := reloaded.GobDecode(data.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	ids := reloaded.IDs()
+	sort.Slice(ids, func(i, j int) bool { return ids[i].(string) < ids[j].(string) })
+	if fmt.Sprint(ids) != "[imgA imgB imgC]" {
+		t.Errorf("Snapshot contains %v, expected imgA, imgB, and imgC", ids)
+	}
+	for index, id := range []string{"imgA", "imgB", "imgC"} {
+		matches := reloaded.Query(hashes[index])
+		sort.Sort(matches)
+		if len(matches) == 0 || matches[0].ID != id {
+			t.Errorf("Expected %s as best match, got %v", id, matches)
+		}
+	}
+	if len(store.IDs()) != 0 {
+		t.Errorf("Store not empty after modifications: %v", store.IDs())
+	}
+
+	// Encode while modifying the store concurrently.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 50; n++ {
+			store.Add(n, hashes[n%3])
+			store.Delete(n - 1)
+		}
+	}()
+	for n := 0; n < 10; n++ {
+		if _, err := store.GobEncode(); err != nil {
+			t.Error(err)
+		}
+	}
+	wg.Wait()
+}
+
+// Test hamming distances.
+func TestHammingDistance(t *testing.T) {
+	for _, test := range []struct {
+		left, right uint64
+		distance    int
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0xff, 0x0f, 4},
+		{0, 0xffffffffffffffff, 64},
+		{0x8000000000000001, 1, 1},
+	} {
+		if distance := HammingDistance(test.left, test.right); distance != test.distance {
+			t.Errorf("Distance between %x and %x is %d, expected %d", test.left, test.right, distance, test.distance)
+		}
+	}
+}
+
+// Test dHash queries.
+func TestQueryDHash(t *testing.T) {
+	hashes := testHashes(t)
+	store := New()
+	store.Add("imgA", hashes[0])
+	store.Add("imgB", hashes[1])
+	modified := hashes[0]
+	modified.DHash[0] ^= 0x0101010101010101
+	modified.DHash[1] ^= 0x3
+	store.Add("modified", modified) // 10 bits differ from imgA.
+
+	// Compare with brute force for all distances.
+	check := func(name string) {
+		t.Helper()
+		for distance := 0; distance <= 128; distance++ {
+			var expected []string
+			for _, match := range store.Query(hashes[0]) {
+				if match.DHashDistance <= distance {
+					expected = append(expected, match.ID.(string))
+				}
+			}
+			var actual []string
+			for _, match := range store.QueryDHash(hashes[0], distance) {
+				actual = append(actual, match.ID.(string))
+			}
+			sort.Strings(expected)
+			sort.Strings(actual)
+			if fmt.Sprint(actual) != fmt.Sprint(expected) {
+				t.Errorf("%s: distance %d: got %v, expected %v", name, distance, actual, expected)
+				return
+			}
+		}
+	}
+	check("initial")
+	matches := store.QueryDHash(hashes[0], 10)
+	sort.Sort(matches)
+	if len(matches) != 2 || matches[0].ID != "imgA" {
+		t.Fatalf("Unexpected matches %v", matches)
+	}
+	full := store.Query(hashes[0])
+	sort.Sort(full)
+	if math.Abs(matches[0].HaarScore-full[0].HaarScore) > 1e-9 || math.Abs(matches[0].Similarity-full[0].Similarity) > 1e-9 {
+		t.Errorf("Metrics differ from full query: %v vs. %v", matches[0], full[0])
+	}
+
+	// The index is maintained.
+	store.Add("imgC", hashes[2])
+	store.Delete("modified")
+	check("modified")
+	store.Compact()
+	store.Add("copy", hashes[0])
+	check("compacted")
+}
+
+// Test the detection and repair of inconsistencies.
+func TestVerify(t *testing.T) {
+	hashes := testHashes(t)
+	store := New()
+	store.Add("imgA", hashes[0])
+	store.Add("imgB", hashes[1])
+	store.Add("imgC", hashes[2])
+	store.Add("deleted", hashes[2])
+	store.Delete("deleted")
+	if errs := store.Verify(); errs != nil {
+		t.Fatalf("Consistent store reported as inconsistent: %v", errs)
+	}
+	if store.Repair() != 0 {
+		t.Error("Consistent store was repaired")
+	}
+
+	// Corrupt the store.
+	locationA := store.candidates[0].locations[0]
+	locationB := store.candidates[1].locations[0]
+	store.indices[locationA].append(0)  // Duplicate.
+	store.indices[locationA].append(17) // Dangling.
+	store.indices[locationB] = store.indices[locationB].filter(func(index uint64) bool {
+		return index != 1 // Missing.
+	}, nil)
+	delete(store.ids, "imgC")
+	store.free = nil
+	errs := store.Verify()
+	if len(errs) != 5 {
+		t.Errorf("Expected 5 inconsistencies, got %d: %v", len(errs), errs)
+	}
+
+	if problems := store.Repair(); problems != len(errs) {
+		t.Errorf("Repair found %d problems, expected %d", problems, len(errs))
+	}
+	if errs := store.Verify(); errs != nil {
+		t.Errorf("Repaired store is inconsistent: %v", errs)
+	}
+	for index, id := range []string{"imgA", "imgB", "imgC"} {
+		matches := store.Query(hashes[index])
+		sort.Sort(matches)
+		if len(matches) == 0 || matches[0].ID != id {
+			t.Errorf("Expected %s as best match after repair, got %v", id, matches)
+		}
+	}
+}
+
+// Test two-stage queries with a dHash prescreen.
+func TestDHashPrescreen(t *testing.T) {
+	store := New()
+	hashes := testHashes(t)
+	for index, hash := range hashes {
+		store.Add(index, hash)
+		hash.DHash[0] ^= 0x0f0f
+		store.Add(fmt.Sprintf("%d modified", index), hash)
+	}
+
+	for _, distance := range []int{1, 4, 8, 20, 40, 128} {
+		for _, hash := range hashes {
+			options := &QueryOptions{MaxDHashDistance: distance}
+			expected := store.QueryWithOptions(hash, options)
+			options.DHashPrescreen = true
+			var actual Matches
+			if distance == 1 {
+				// Without the dHash index.
+				store.RLock()
+				actual = store.queryWithOptions(hash, options)
+				store.RUnlock()
+			} else {
+				actual = store.QueryWithOptions(hash, options)
+			}
+			sort.Sort(expected)
+			sort.Sort(actual)
+			if len(actual) != len(expected) {
+				t.Errorf("Distance %d: got %v, expected %v", distance, actual, expected)
+				continue
+			}
+			for index := range actual {
+				if actual[index].ID != expected[index].ID || math.Abs(actual[index].Score-expected[index].Score) > 1e-9 {
+					t.Errorf("Distance %d: got %v, expected %v", distance, actual[index], expected[index])
+				}
+			}
+		}
+	}
+
+	// Cancelled prescreened queries.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store.RLock()
+	matches, err := store.queryContext(ctx, hashes[0], &QueryOptions{MaxDHashDistance: 20, DHashPrescreen: true})
+	store.RUnlock()
+	if err != context.Canceled || matches != nil {
+		t.Errorf("Cancelled prescreened query returned %v, %v", matches, err)
+	}
+}
+
+// Test the compressed index buckets.
+func TestPostings(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	var (
+		list     postings
+		expected []uint64
+	)
+	for i := 0; i < 1000; i++ {
+		index := uint64(i * 3)
+		if random.Intn(10) == 0 {
+			index = uint64(random.Intn(3000)) // Out of order.
+		}
+		list.append(index)
+		expected = append(expected, index)
+		if list.len() != len(expected) {
+			t.Fatalf("Postings list has %d entries, expected %d", list.len(), len(expected))
+		}
+	}
+	check := func(name string, list postings, expected []uint64) {
+		t.Helper()
+		actual := list.decode(nil)
+		sort.Slice(actual, func(i, j int) bool { return actual[i] < actual[j] })
+		sorted := append([]uint64(nil), expected...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		if fmt.Sprint(actual) != fmt.Sprint(sorted) {
+			t.Errorf("%s: postings list contains %v, expected %v", name, actual, sorted)
+		}
+	}
+	check("Appended", list, expected)
+	if size := len(list.encoded); size > 2*len(expected) {
+		t.Errorf("Encoded postings list is %d bytes for %d entries", size, len(expected))
+	}
+
+	// A copy must not be affected by appends.
+	copied := list
+	list.append(5000)
+	check("Copy", copied, expected)
+	check("Extended", list, append(expected, 5000))
+
+	// Filter and renumber.
+	var even []uint64
+	for _, index := range expected {
+		if index%2 == 0 {
+			even = append(even, index/2)
+		}
+	}
+	filtered := copied.filter(func(index uint64) bool { return index%2 == 0 }, func(index uint64) uint64 { return index / 2 })
+	check("Filtered", filtered, even)
+	check("Original", copied, expected)
+}
+
+// Test the store's size limit.
+func TestLargeIndex(t *testing.T) {
+	hashes := testHashes(t)
+	defer func(capacity uint64) {
+		smallIndexCapacity = capacity
+	}(smallIndexCapacity)
+	smallIndexCapacity = 2
+
+	// A small store is full after two images.
+	store := New()
+	store.Add("imgA", hashes[0])
+	store.Add("imgB", hashes[1])
+	store.Add("imgC", hashes[2])
+	if store.Has("imgC") {
+		t.Error("Image was added to a full store")
+	}
+	store.Delete("imgB")
+	store.Add("imgC", hashes[2])
+	if !store.Has("imgC") {
+		t.Error("Image was not added to the slot of a deleted image")
+	}
+
+	// A large store is not.
+	store = New(WithLargeIndex())
+	store.Add("imgA", hashes[0])
+	store.Add("imgB", hashes[1])
+	store.Add("imgC", hashes[2])
+	if len(store.IDs()) != 3 {
+		t.Errorf("Large store holds %d images, expected 3", len(store.IDs()))
+	}
+
+	// The setting survives serialization.
+	data, err := store.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := New()
+	if err := reloaded.GobDecode(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.largeIndex {
+		t.Error("Decoded store does not have a large index")
+	}
+	if matches := reloaded.Query(hashes[2]); len(matches) != 3 {
+		t.Errorf("Query on decoded store returned %d matches, expected 3", len(matches))
+	}
+}
+
+// Test the sharded store.
+func TestShardedStore(t *testing.T) {
+	store := New()
+	sharded := NewSharded(3)
+	hashes := testHashes(t)
+	for index, hash := range hashes {
+		for n := 0; n < 3; n++ {
+			id := fmt.Sprintf("img%d-%d", index, n)
+			store.Add(id, hash)
+			sharded.Add(id, hash)
+		}
+	}
+
+	// Routing.
+	var used int
+	for index, shard := range sharded.Shards() {
+		for _, id := range shard.IDs() {
+			if sharded.Shard(id) != index {
+				t.Errorf("Image %v found in shard %d, expected %d", id, index, sharded.Shard(id))
+			}
+		}
+		if len(shard.IDs()) > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("Only %d shards were used", used)
+	}
+	if len(sharded.IDs()) != 9 || !sharded.Has("img1-2") || sharded.Has("img3-0") {
+		t.Errorf("Unexpected IDs in sharded store: %v", sharded.IDs())
+	}
+
+	// Queries return the same results as a single store.
+	compare := func(name string, sharded *ShardedStore) {
+		t.Helper()
+		options := &QueryOptions{MaxResults: 4}
+		expected := store.QueryWithOptions(hashes[1], options)
+		actual := sharded.QueryWithOptions(hashes[1], options)
+		if len(actual) != len(expected) {
+			t.Fatalf("%s: got %d matches, expected %d", name, len(actual), len(expected))
+		}
+		for index := range actual {
+			if math.Abs(actual[index].Score-expected[index].Score) > 1e-9 {
+				t.Errorf("%s: match %d is %v, expected %v", name, index, actual[index], expected[index])
+			}
+		}
+		if len(sharded.Query(hashes[1])) != len(store.Query(hashes[1])) {
+			t.Errorf("%s: query results differ", name)
+		}
+	}
+	compare("Sharded", sharded)
+
+	// Per-shard serialization.
+	var shards []*Store
+	for _, shard := range sharded.Shards() {
+		data, err := shard.GobEncode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := New()
+		if err := decoded.GobDecode(data); err != nil {
+			t.Fatal(err)
+		}
+		shards = append(shards, decoded)
+	}
+	reassembled := NewShardedFrom(shards...)
+	compare("Reassembled", reassembled)
+	reassembled.Delete("img1-2")
+	if reassembled.Has("img1-2") || len(reassembled.IDs()) != 8 {
+		t.Error("Image was not deleted from reassembled store")
+	}
+}
+
+// Test frozen stores.
+func TestFreeze(t *testing.T) {
+	store := New()
+	hashes := testHashes(t)
+	for index, hash := range hashes {
+		for n := 0; n < 3; n++ {
+			store.Add(fmt.Sprintf("img%d-%d", index, n), hash)
+		}
+	}
+	store.Delete("img0-1")
+	if err := store.MarkFalsePositive("img1-0", "img2-0"); err != nil {
+		t.Fatal(err)
+	}
+	frozen := store.Freeze()
+
+	// The frozen store is independent of the original store.
+	store.Delete("img2-2")
+	store.Add("img3", hashes[0])
+	if frozen.Size() != 8 || !frozen.Has("img2-2") || frozen.Has("img3") || frozen.Has("img0-1") {
+		t.Errorf("Unexpected IDs in frozen store: %v", frozen.IDs())
+	}
+	if err := frozen.Add("img4", hashes[0]); err != ErrFrozen {
+		t.Errorf("Adding to a frozen store returned %v", err)
+	}
+	store.Add("img2-2", hashes[2])
+	store.Delete("img3")
+
+	// Frozen queries return the same results.
+	compare := func(name string, frozen *FrozenStore) {
+		t.Helper()
+		for _, hash := range hashes {
+			expected := store.Query(hash)
+			actual := frozen.Query(hash)
+			sort.Sort(expected)
+			sort.Sort(actual)
+			if len(actual) != len(expected) {
+				t.Fatalf("%s: got %d matches, expected %d", name, len(actual), len(expected))
+			}
+			for index := range actual {
+				if math.Abs(actual[index].Score-expected[index].Score) > 1e-9 {
+					t.Errorf("%s: match %d is %v, expected %v", name, index, actual[index], expected[index])
+				}
+			}
+		}
+		if len(frozen.QueryID("img1-0")) != len(store.QueryID("img1-0")) {
+			t.Errorf("%s: ID query results differ", name)
+		}
+	}
+	compare("Frozen", frozen)
+
+	// Serialization.
+	data, err := frozen.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := store.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= len(original) {
+		t.Errorf("Frozen store encoding has %d bytes, original store %d bytes", len(data), len(original))
+	}
+	var decoded FrozenStore
+	if err := decoded.GobDecode(data); err != nil {
+		t.Fatal(err)
+	}
+	compare("Decoded", &decoded)
+
+	// Suppressed images remain suppressed after serialization.
+	if err := store.Suppress("img1-1"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = store.Freeze().GobEncode(); err != nil {
+		t.Fatal(err)
+	}
+	decoded = FrozenStore{}
+	if err := decoded.GobDecode(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, match := range decoded.Query(hashes[1]) {
+		if match.ID == "img1-1" {
+			t.Error("Suppressed image was returned after decoding")
+		}
+	}
+	compare("Suppressed", &decoded)
+
+	// Duplicate bucket entries are rejected.
+	var corrupt bytes.Buffer
+	compressor := gzip.NewWriter(&corrupt)
+	encoder := gob.NewEncoder(compressor)
+	var id interface{} = "img"
+	candidate := store.candidates[0]
+	buckets := make([][]byte, 2*ImageScale*ImageScale*haar.ColourChannels)
+	buckets[0] = []byte{0, 0}
+	for _, value := range []interface{}{1, 1, &id, candidate.encodeFields(), buckets, DefaultWeights, 0,
+		defaultScoreWeights, uint64(1), false, 0, []interface{}{}} {
+		if err := encoder.Encode(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compressor.Close()
+	if err := new(FrozenStore).GobDecode(corrupt.Bytes()); err == nil {
+		t.Error("Decoding duplicate bucket entries did not fail")
+	}
+}
+
+// Test public snapshots.
+func TestStoreSnapshot(t *testing.T) {
+	store := New()
+	hashes := testHashes(t)
+	for index, hash := range hashes {
+		store.Add(fmt.Sprintf("img%d", index), hash)
+	}
+	snapshot := store.Snapshot()
+	expected := snapshot.Query(hashes[0])
+	sort.Sort(expected)
+
+	// Modify the store while querying the snapshot.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 0; n < 20; n++ {
+			store.Add(fmt.Sprintf("new%d", n), hashes[n%3])
+		}
+		store.Delete("img0")
+		store.Delete("new1")
+		store.Compact()
+	}()
+	for n := 0; n < 20; n++ {
+		actual := snapshot.Query(hashes[0])
+		sort.Sort(actual)
+		if fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Fatalf("Snapshot query returned %v, expected %v", actual, expected)
+		}
+	}
+	<-done
+
+	if snapshot.Size() != 3 || !snapshot.Has("img0") || snapshot.Has("new0") {
+		t.Errorf("Unexpected IDs in snapshot: %v", snapshot.IDs())
+	}
+	if matches := snapshot.QueryID("img0"); len(matches) != 2 {
+		t.Errorf("Snapshot ID query returned %d matches, expected 2", len(matches))
+	}
+	if matches := snapshot.QueryWithOptions(hashes[0], &QueryOptions{ScoreComponents: true}); len(matches) != 3 || matches[0].Components == nil {
+		t.Errorf("Snapshot query did not return score components: %v", matches)
+	}
+	if store.Has("img0") || len(store.IDs()) != 21 {
+		t.Error("Store was not modified independently of the snapshot")
+	}
+
+	// Sizes count slots, including those of deleted images.
+	store.Delete("new2")
+	after := store.Snapshot()
+	if after.Size() != store.Size() || len(after.IDs()) != store.Size()-1 {
+		t.Errorf("Snapshot size is %d with %d IDs, store size is %d", after.Size(), len(after.IDs()), store.Size())
+	}
+	after.Release()
+	snapshot.Release()
+	snapshot.Release()
+	if n := store.snapshots.Load(); n != 0 {
+		t.Errorf("Store has %d snapshots after release, expected 0", n)
+	}
+}
+
+// Test streaming serialization.
+func TestWriteToReadFrom(t *testing.T) {
+	first, second := New(), New()
+	hashes := testHashes(t)
+	for index, hash := range hashes {
+		first.Add(fmt.Sprintf("first%d", index), hash)
+		if index > 0 {
+			second.Add(fmt.Sprintf("second%d", index), hash)
+		}
+	}
+
+	// Write both stores into the same stream.
+	var buffer bytes.Buffer
+	n1, err := first.WriteTo(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := second.WriteTo(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n1+n2 != int64(buffer.Len()) {
+		t.Errorf("Stores reported %d and %d bytes, %d were written", n1, n2, buffer.Len())
+	}
+	data, err := first.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buffer.Bytes()[:n1]) {
+		t.Error("GobEncode() and WriteTo() results differ")
+	}
+
+	// Read them back.
+	reader := bufio.NewReader(&buffer)
+	for _, expected := range []*Store{first, second} {
+		reloaded := New()
+		if _, err := reloaded.ReadFrom(reader); err != nil {
+			t.Fatal(err)
+		}
+		ids, expectedIDs := reloaded.IDs(), expected.IDs()
+		sort.Slice(ids, func(i, j int) bool { return ids[i].(string) < ids[j].(string) })
+		sort.Slice(expectedIDs, func(i, j int) bool { return expectedIDs[i].(string) < expectedIDs[j].(string) })
+		if fmt.Sprint(ids) != fmt.Sprint(expectedIDs) {
+			t.Errorf("Read store contains %v, expected %v", ids, expectedIDs)
+		}
+		if len(reloaded.Query(hashes[1])) != len(expected.Query(hashes[1])) {
+			t.Error("Query results of read store differ")
+		}
+	}
+}
+
+// Test saving to and loading from files.
+func TestSaveLoadFile(t *testing.T) {
+	store := New()
+	hashes := testHashes(t)
+	for index, hash := range hashes {
+		store.Add(fmt.Sprintf("img%d", index), hash)
+	}
+	path := filepath.Join(t.TempDir(), "store")
+	if _, err := LoadFile(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Loading a missing file returned %v", err)
+	}
+
+	// Save and load.
+	if err := store.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if store.Modified() {
+		t.Error("Store is still modified after saving")
+	}
+	loaded, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Modified() || len(loaded.IDs()) != 3 || len(loaded.Query(hashes[0])) != len(store.Query(hashes[0])) {
+		t.Error("Loaded store differs from saved store")
+	}
+	store.Delete("img0")
+	if err := store.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("Expected one file after saving, found %d", len(entries))
+	}
+
+	// Stores created with different parameters are rejected.
+	TopCoefs++
+	_, err = LoadFile(path)
+	TopCoefs--
+	if err == nil || !strings.Contains(err.Error(), "TopCoefs") {
+		t.Errorf("Loading a store with different parameters returned %v", err)
+	}
+
+	// Corruption is detected.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, corrupt := range [][]byte{
+		append(append([]byte(nil), data[:len(data)/2]...), data[len(data)/2+1:]...),
+		append(append(append([]byte(nil), data[:100]...), data[100]^1), data[101:]...),
+		data[:len(data)-1],
+	} {
+		if err := os.WriteFile(path, corrupt, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadFile(path); err == nil || !strings.Contains(err.Error(), "corrupted") {
+			t.Errorf("Loading a corrupted file returned %v", err)
+		}
+	}
+
+	// The header version must match the payload version, even if the
+	// checksum does.
+	mismatch := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(mismatch[len(storeMagic):], storeVersion-1)
+	binary.BigEndian.PutUint32(mismatch[len(mismatch)-4:], crc32.ChecksumIEEE(mismatch[:int64(len(mismatch))-storeTrailerSize]))
+	if err := os.WriteFile(path, mismatch, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFile(path); err == nil || !strings.Contains(err.Error(), "header version") {
+		t.Errorf("Loading a file with mismatching versions returned %v", err)
+	}
+
+	// Hashes of other hash versions are rejected.
+	mismatch = append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(mismatch[len(storeMagic)+12:], HashVersion+1)
+	binary.BigEndian.PutUint32(mismatch[len(mismatch)-4:], crc32.ChecksumIEEE(mismatch[:int64(len(mismatch))-storeTrailerSize]))
+	if err := os.WriteFile(path, mismatch, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFile(path); !errors.Is(err, ErrHashVersion) {
+		t.Errorf("Loading a file with a different hash version returned %v", err)
+	}
+}
+
+func TestLoadFileAsync(t *testing.T) {
+	store := New()
+	hashes := testHashes(t)
+	for index, hash := range hashes {
+		store.Add(fmt.Sprintf("img%d", index), hash)
+	}
+	path := filepath.Join(t.TempDir(), "store")
+	if err := store.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WaitLoaded(); err != nil {
+		t.Errorf("Regular store returned %v", err)
+	}
+
+	// Load asynchronously.
+	loaded, err := LoadFileAsync(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Has("img1") || loaded.Has("img3") || len(loaded.IDs()) != 3 {
+		t.Error("IDs of asynchronously loaded store are wrong")
+	}
+	if err := loaded.WaitLoaded(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Modified() || len(loaded.Query(hashes[0])) != len(store.Query(hashes[0])) {
+		t.Error("Asynchronously loaded store differs from saved store")
+	}
+
+	// Reading IDs while the store is modified after loading. Run with -race.
+	large := New()
+	for index := 0; index < 2000; index++ {
+		large.Add(index, hashes[index%len(hashes)])
+	}
+	largePath := filepath.Join(t.TempDir(), "large")
+	if err := large.SaveFile(largePath); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = LoadFileAsync(largePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				loaded.IDs()
+				loaded.Has(0)
+			}
+		}
+	}()
+	for index := 2000; index < 2100; index++ {
+		loaded.Add(index, hashes[index%len(hashes)])
+	}
+	close(done)
+	wg.Wait()
+	if len(loaded.IDs()) != 2100 {
+		t.Errorf("Expected 2100 IDs, got %d", len(loaded.IDs()))
+	}
+
+	// A checksum mismatch is only detected at the end. The store is then empty.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = LoadFileAsync(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.WaitLoaded(); err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Errorf("Loading a corrupted file returned %v", err)
+	}
+	if len(loaded.IDs()) != 0 || len(loaded.Query(hashes[0])) != 0 {
+		t.Error("Store is not empty after loading failed")
+	}
+
+	// Errors before the IDs are available are returned directly.
+	if err := os.WriteFile(path, data[:len(storeMagic)+4], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFileAsync(path); err == nil {
+		t.Error("Loading a truncated file did not fail")
+	}
+}
+
+func TestWAL(t *testing.T) {
+	hashes := testHashes(t)
+	path := filepath.Join(t.TempDir(), "store")
+	same := func(a, b *Store) bool {
+		if a.Generation() != b.Generation() || len(a.IDs()) != len(b.IDs()) {
+			return false
+		}
+		for _, id := range a.IDs() {
+			if !b.Has(id) {
+				return false
+			}
+		}
+		for _, hash := range hashes {
+			if len(a.Query(hash)) != len(b.Query(hash)) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Record modifications.
+	store := New()
+	store.Add("img0", hashes[0])
+	wal, err := store.OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.OpenWAL(path); err == nil {
+		t.Error("Opening a second write-ahead log did not fail")
+	}
+	store.Add("img1", hashes[1])
+	store.Add("img2", hashes[2])
+	store.Delete("img0")
+	if err := store.Exchange("img1", "img3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Suppress("img2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Suppress("img3"); err != nil {
+		t.Fatal(err)
+	}
+	store.Unsuppress("img3")
+	if err := store.MarkFalsePositive("img2", "img3"); err != nil {
+		t.Fatal(err)
+	}
+	store.MarkFalsePositiveHash(hashes[0], "img3")
+	store.UnmarkFalsePositive("img3", "img2")
+	if err := store.MarkFalsePositive("img2", "img3"); err != nil {
+		t.Fatal(err)
+	}
+	store.Update("img2", hashes[0])
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := ReplayWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same(store, replayed) || !replayed.Has("img3") || replayed.Has("img0") {
+		t.Error("Replayed store differs from original store")
+	}
+	if len(replayed.Suppressed()) != 1 || replayed.Suppressed()[0] != "img2" {
+		t.Errorf("Replayed store has suppressed images %v, expected img2", replayed.Suppressed())
+	}
+	if len(replayed.negatives) != 2 || !reflect.DeepEqual(replayed.negatives, store.negatives) {
+		t.Errorf("Replayed store has negative list %v, expected %v", replayed.negatives, store.negatives)
+	}
+	store.Add("img4", hashes[0]) // Not recorded anymore.
+	if replayed, err := ReplayWAL(path); err != nil || replayed.Has("img4") {
+		t.Errorf("Modification was recorded after closing the log (%v)", err)
+	}
+
+	// Continue the log and simulate a crash during a write.
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal, err = replayed.OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, err := os.Stat(path); err != nil || !current.ModTime().Equal(info.ModTime()) {
+		t.Error("Snapshot was written when continuing the log")
+	}
+	replayed.Add("img0", hashes[0])
+	if err := wal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	log, err := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Write([]byte{100, 1, 2, 3})
+	log.Close()
+	crashed, err := ReplayWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same(replayed, crashed) {
+		t.Error("Replayed store differs after incomplete record")
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compaction.
+	wal, err = crashed.OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed.Delete("img2")
+	if err := wal.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if wal.records != 0 {
+		t.Errorf("Log contains %d records after compaction", wal.records)
+	}
+	crashed.SetWeights(WeightsLineArt) // Not recorded but compacted.
+	crashed.Exchange("img3", "img1")
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadFile(path); err != nil || loaded.Has("img2") || !loaded.Has("img3") {
+		t.Errorf("Snapshot was not written during compaction (%v)", err)
+	}
+	replayed, err = ReplayWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same(crashed, replayed) || !replayed.Has("img1") {
+		t.Error("Replayed store differs after compaction")
+	}
+	if replayed.Weights() != WeightsLineArt {
+		t.Errorf("Replayed store has weights %v, expected %v", replayed.Weights(), WeightsLineArt)
+	}
+
+	// Automatic compaction.
+	defer func(records int) { WALCompactionRecords = records }(WALCompactionRecords)
+	WALCompactionRecords = 2
+	wal, err = replayed.OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index := 5; index < 10; index++ {
+		replayed.Add(fmt.Sprintf("img%d", index), hashes[index%3])
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if wal.records >= 5 {
+		t.Errorf("Log was not compacted automatically, it contains %d records", wal.records)
+	}
+	final, err := ReplayWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same(replayed, final) {
+		t.Error("Replayed store differs after automatic compaction")
+	}
+}
+
+func TestAutoSave(t *testing.T) {
+	hashes := testHashes(t)
+	path := filepath.Join(t.TempDir(), "store")
+	saved := func(images int) bool {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			if store, err := LoadFile(path); err == nil && len(store.IDs()) == images {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Save at an interval.
+	store := New()
+	saver := store.AutoSave(path, 10*time.Millisecond, 0)
+	store.Add("img0", hashes[0])
+	if !saved(1) {
+		t.Error("Store was not saved at the interval")
+	}
+
+	// Save after a number of changes.
+	if err := saver.Close(); err != nil {
+		t.Fatal(err)
+	}
+	saver = store.AutoSave(path, time.Hour, 2)
+	store.Add("img1", hashes[1])
+	time.Sleep(3 * autoSaveCheck)
+	if loaded, err := LoadFile(path); err != nil || len(loaded.IDs()) != 1 {
+		t.Errorf("Store was saved before enough changes were made (%v)", err)
+	}
+	store.Add("img2", hashes[2])
+	if !saved(3) {
+		t.Error("Store was not saved after enough changes")
+	}
+
+	// Unsaved changes are saved when closing.
+	store.Delete("img0")
+	if err := saver.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadFile(path); err != nil || len(loaded.IDs()) != 2 || store.Modified() {
+		t.Errorf("Store was not saved when closing (%v)", err)
+	}
+}
+
+func TestProto(t *testing.T) {
+	hashes := testHashes(t)
+
+	// Hashes.
+	data, err := hashes[0].MarshalProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != 1<<3 || data[1] != HashVersion {
+		t.Errorf("Hash message starts with %v, expected version field", data[:2])
+	}
+	var decoded Hash
+	if err := decoded.UnmarshalProto(data); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", decoded) != fmt.Sprintf("%v", hashes[0]) {
+		t.Error("Decoded hash differs from original hash")
+	}
+	if err := decoded.UnmarshalProto(append([]byte{1 << 3, HashVersion + 1}, data[2:]...)); err != ErrHashVersion {
+		t.Errorf("Decoding hash with different version returned %v", err)
+	}
+	if err := decoded.UnmarshalProto(data[:len(data)-1]); err == nil {
+		t.Error("Truncated hash was decoded without error")
+	}
+
+	// Stores.
+	store := New()
+	store.Add("a", hashes[0])
+	store.Add(-2, hashes[1])
+	store.Add(uint(3), hashes[2])
+	store.Add("d", hashes[0])
+	store.Delete("d")
+	weights := DefaultWeights
+	weights[0][0] = 1
+	store.SetWeights(weights)
+	if err := store.MarkFalsePositive("a", -2); err != nil {
+		t.Fatal(err)
+	}
+	store.MarkFalsePositiveHash(hashes[2], "e")
+	if err := store.Suppress(uint(3)); err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	if err := store.ExportProto(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	imported := New()
+	imported.Add("x", hashes[0])
+	path := filepath.Join(t.TempDir(), "store")
+	wal, err := imported.OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := imported.ImportProto(bytes.NewReader(buffer.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if replayed, err := ReplayWAL(path); err != nil || replayed.Has("x") || !replayed.Has("a") {
+		t.Errorf("Import was not persisted in the write-ahead log (%v)", err)
+	}
+	if !reflect.DeepEqual(imported.negatives, store.negatives) || !reflect.DeepEqual(imported.keyCounts, store.keyCounts) {
+		t.Errorf("Imported store has negative list %v, expected %v", imported.negatives, store.negatives)
+	}
+	if suppressed := imported.Suppressed(); len(suppressed) != 1 || suppressed[0] != uint(3) {
+		t.Errorf("Imported store has suppressed images %v, expected 3", suppressed)
+	}
+	if len(imported.IDs()) != 3 || !imported.Has("a") || !imported.Has(-2) || !imported.Has(uint(3)) || imported.Has("x") ||
+		imported.Weights() != weights || imported.Generation() != store.Generation() || len(imported.Verify()) > 0 {
+		t.Error("Imported store differs from exported store")
+	}
+	for _, hash := range hashes {
+		original, result := store.Query(hash), imported.Query(hash)
+		sort.Sort(original)
+		sort.Sort(result)
+		if fmt.Sprint(original) != fmt.Sprint(result) {
+			t.Errorf("Query results differ: %v vs. %v", original, result)
+		}
+	}
+	if err := imported.ImportProto(bytes.NewReader(buffer.Bytes()[:buffer.Len()-3])); err == nil {
+		t.Error("Truncated store was imported without error")
+	}
+
+	// Unsupported IDs.
+	store.MarkFalsePositiveHash(hashes[0], struct{ ID int }{6})
+	if err := store.ExportProto(io.Discard); err == nil {
+		t.Error("Store with struct IDs on its negative list was exported without error")
+	}
+	store.Add(struct{ ID int }{5}, hashes[2])
+	if err := store.ExportProto(io.Discard); err == nil {
+		t.Error("Store with struct IDs was exported without error")
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	hashes := testHashes(t)
+	store := New()
+	store.Add("a", hashes[0])
+	store.Add(2, hashes[1])
+	store.Add("c", hashes[2])
+	store.Add("d", hashes[2])
+	store.Delete("d")
+
+	// Export.
+	var buffer bytes.Buffer
+	if err := store.ExportNDJSON(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], `{"id":"a","scaleCoef":[`) || !strings.HasPrefix(lines[1], `{"id":2,`) {
+		t.Errorf("Unexpected export:\n%s", buffer.String())
+	}
+
+	// Import.
+	start := time.Now()
+	imported := New()
+	added, err := imported.ImportNDJSON(bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 3 || !imported.Has("a") || !imported.Has(2) || !imported.Has("c") || len(imported.Verify()) > 0 {
+		t.Errorf("Imported store differs from exported store (%d images added)", added)
+	}
+	if imported.Generation() != 3 || imported.DeleteBeforeGeneration(1) != 0 || imported.DeleteOlderThan(start) != 0 {
+		t.Error("Imported images kept the exporting store's generations or times")
+	}
+	for _, hash := range hashes {
+		original, result := store.Query(hash), imported.Query(hash)
+		sort.Sort(original)
+		sort.Sort(result)
+		if fmt.Sprint(original) != fmt.Sprint(result) {
+			t.Errorf("Query results differ: %v vs. %v", original, result)
+		}
+	}
+	if added, err := imported.ImportNDJSON(bytes.NewReader(buffer.Bytes())); err != nil || added != 0 {
+		t.Errorf("Importing existing images added %d images (%v)", added, err)
+	}
+
+	// Errors.
+	for _, line := range []string{
+		`{"id":1.5}`,
+		`{"id":"x","dHash":"00"}`,
+		strings.Replace(lines[0], `"locations":[`, `"locations":[99999999,`, 1),
+		`{"id":"x"`,
+	} {
+		if _, err := New().ImportNDJSON(strings.NewReader(line)); err == nil {
+			t.Errorf("Invalid line was imported: %s", line)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	hashes := testHashes(t)
+	a, b := New(), New()
+	a.Add("same", hashes[0])
+	b.Add("same", hashes[0])
+	a.Add("changed", hashes[1])
+	b.Add("changed", hashes[2])
+	a.Add("a", hashes[2])
+	b.Add("b", hashes[1])
+	b.Add("deleted", hashes[1])
+	b.Delete("deleted")
+
+	diff := Diff(a, b)
+	if fmt.Sprint(diff.OnlyA) != "[a]" || fmt.Sprint(diff.OnlyB) != "[b]" || fmt.Sprint(diff.Changed) != "[changed]" || diff.Equal() {
+		t.Errorf("Unexpected diff %+v", diff)
+	}
+	if diff := Diff(a, a); !diff.Equal() {
+		t.Errorf("Store differs from itself: %+v", diff)
+	}
+
+	// Modifications after the diff don't affect it.
+	a.Delete("same")
+	if fmt.Sprint(diff.OnlyA) != "[a]" || len(Diff(a, b).OnlyB) != 2 {
+		t.Error("Diff does not reflect modification")
+	}
+}
+
+func TestDeleteBuckets(t *testing.T) {
+	hashes := testHashes(t)
+	store := New()
+	for index := 0; index < 30; index++ {
+		store.Add(index, hashes[index%3])
+	}
+
+	// Delete images and reuse their slots.
+	for index := 0; index < 30; index += 2 {
+		store.Delete(index)
+	}
+	store.Add(30, hashes[0])
+	store.DeleteOlderThan(time.Now().Add(time.Hour)) // Everything.
+	store.Add(31, hashes[1])
+	if errs := store.Verify(); len(errs) > 0 {
+		t.Errorf("Store is inconsistent after deletions: %v", errs)
+	}
+	stats := store.Stats()
+	if matches := store.Query(hashes[1]); len(matches) != 1 || matches[0].ID != 31 || stats.IndexEntries != len(hashes[1].SignificanceMap()) {
+		t.Errorf("Deleted images remain in the index: %v", matches)
+	}
+}
+
+func TestDeleteManySuppress(t *testing.T) {
+	hashes := testHashes(t)
+	store := New()
+	for index := 0; index < 6; index++ {
+		store.Add(index, hashes[index%3])
+	}
+	found := func(store *Store, id interface{}) bool {
+		for _, match := range store.Query(hashes[id.(int)%3]) {
+			if match.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Suppression.
+	if err := store.Suppress(7); err == nil {
+		t.Error("Suppressing an unknown image did not fail")
+	}
+	if err := store.Suppress(0); err != nil {
+		t.Fatal(err)
+	}
+	if found(store, 0) || !found(store, 3) || !store.Has(0) || fmt.Sprint(store.Suppressed()) != "[0]" {
+		t.Error("Image was not suppressed")
+	}
+	data, err := store.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := New()
+	if err := loaded.GobDecode(data); err != nil {
+		t.Fatal(err)
+	}
+	if found(loaded, 0) || len(loaded.Suppressed()) != 1 {
+		t.Error("Suppression was not saved")
+	}
+	store.Unsuppress(0)
+	if !found(store, 0) || len(store.Suppressed()) != 0 {
+		t.Error("Image was not unsuppressed")
+	}
+
+	// Deleting many images.
+	store.Suppress(1)
+	if count := store.DeleteMany([]interface{}{1, 2, 2, 9}); count != 2 {
+		t.Errorf("DeleteMany removed %d images, expected 2", count)
+	}
+	if store.Has(1) || store.Has(2) || found(store, 2) || !found(store, 5) || len(store.Suppressed()) != 0 {
+		t.Error("Images were not removed")
+	}
+	if errs := store.Verify(); len(errs) > 0 {
+		t.Errorf("Store is inconsistent after DeleteMany(): %v", errs)
+	}
+}
+
+// Test replacing the hashes of images in place.
+func TestUpdate(t *testing.T) {
+	hashes := testHashes(t)
+	best := func(store *Store, hash Hash) interface{} {
+		matches := store.QueryWithOptions(hash, &QueryOptions{MaxResults: 1})
+		if len(matches) == 0 || matches[0].DHashDistance != 0 {
+			return nil
+		}
+		return matches[0].ID
+	}
+
+	store := New()
+	store.Add("a", hashes[0])
+	store.Add("b", hashes[1])
+	generation := store.Generation()
+	if !store.Update("a", hashes[2]) {
+		t.Fatal("Image was not updated")
+	}
+	if store.Size() != 2 || store.Generation() != generation+1 {
+		t.Errorf("Update() changed the size to %d and the generation to %d", store.Size(), store.Generation())
+	}
+	if best(store, hashes[2]) != "a" || best(store, hashes[0]) != nil || best(store, hashes[1]) != "b" {
+		t.Error("Queries did not return the updated hash")
+	}
+	if errs := store.Verify(); len(errs) > 0 {
+		t.Errorf("Store is inconsistent after Update(): %v", errs)
+	}
+	if store.Update("c", hashes[0]) || store.Has("c") {
+		t.Error("Missing image was updated")
+	}
+
+	// Upsert.
+	store.Upsert("b", hashes[0])
+	store.Upsert("c", hashes[1])
+	if store.Size() != 3 || best(store, hashes[0]) != "b" || best(store, hashes[1]) != "c" {
+		t.Error("Images were not upserted")
+	}
+	if errs := store.Verify(); len(errs) > 0 {
+		t.Errorf("Store is inconsistent after Upsert(): %v", errs)
+	}
+}
+
+// Test the error-returning variants of Add() and Delete().
+func TestAddDeleteStrict(t *testing.T) {
+	img := testImages(t)[0]
+	hash, _ := CreateHash(img)
+
+	store := New()
+	if err := store.AddStrict("a", hash); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddStrict("a", hash); err != ErrIDExists {
+		t.Errorf("Adding a duplicate returned %v, expected ErrIDExists", err)
+	}
+	if err := store.DeleteStrict("b"); err != ErrIDNotFound {
+		t.Errorf("Deleting a missing image returned %v, expected ErrIDNotFound", err)
+	}
+	if err := store.DeleteStrict("a"); err != nil || store.Has("a") {
+		t.Errorf("Image was not deleted: %v", err)
+	}
+	if err := store.DeleteStrict("a"); err != ErrIDNotFound {
+		t.Errorf("Deleting an image twice returned %v, expected ErrIDNotFound", err)
+	}
+}
+
+// Test iterating over the images of a store.
+func TestForEach(t *testing.T) {
+	hashes := testHashes(t)
+	store := New()
+	for index, hash := range hashes {
+		store.Add(index, hash)
+	}
+	store.Delete(1)
+
+	var ids []interface{}
+	store.ForEach(func(id interface{}, info CandidateInfo) bool {
+		ids = append(ids, id)
+		hash := hashes[id.(int)]
+		if info.Ratio != hash.Ratio || info.DHash != hash.DHash || info.Histogram != hash.Histogram || info.ScaleCoef != hash.Coefs[0] {
+			t.Errorf("Image %v has unexpected values: %+v", id, info)
+		}
+		if info.Generation == 0 || info.Added.IsZero() {
+			t.Errorf("Image %v has no generation or time", id)
+		}
+		store.Delete(id) // Must not deadlock.
+		return true
+	})
+	if fmt.Sprint(ids) != "[0 2]" {
+		t.Errorf("ForEach() returned %v, expected [0 2]", ids)
+	}
+	if len(store.IDs()) != 0 {
+		t.Error("Images were not deleted during the iteration")
+	}
+
+	// Stopping early.
+	store.Add(0, hashes[0])
+	store.Add(1, hashes[1])
+	var count int
+	store.ForEach(func(id interface{}, info CandidateInfo) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Errorf("ForEach() was called %d times, expected 1", count)
+	}
+}
+
+// Test skipping over-popular index buckets.
+func TestMaxBucketFraction(t *testing.T) {
+	hashes := testHashes(t)
+	store := New()
+	store.Add("a1", hashes[0])
+	store.Add("a2", hashes[0])
+	store.Add("b", hashes[1])
+	store.Add("c", hashes[2])
+	contains := func(matches Matches, id interface{}) bool {
+		for _, match := range matches {
+			if match.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	all := store.Query(hashes[0])
+	if matches := store.QueryWithOptions(hashes[0], &QueryOptions{MaxBucketFraction: 1}); len(matches) != len(all) {
+		t.Errorf("Query without stop buckets returned %d matches, expected %d", len(matches), len(all))
+	}
+
+	// All buckets of the first image contain two images.
+	matches := store.QueryWithOptions(hashes[0], &QueryOptions{MaxBucketFraction: 0.25})
+	if contains(matches, "a1") || contains(matches, "a2") {
+		t.Error("Stop buckets were not skipped")
+	}
+	if !contains(store.QueryWithOptions(hashes[0], &QueryOptions{MaxBucketFraction: 0.5}), "a1") {
+		t.Error("Buckets below the cutoff were skipped")
+	}
+
+	// Snapshots use the same cutoff, also after deletions.
+	store.Add("d", hashes[1])
+	store.Delete("d")
+	snapshot := store.Snapshot()
+	defer snapshot.Release()
+	if !contains(snapshot.QueryWithOptions(hashes[0], &QueryOptions{MaxBucketFraction: 0.5}), "a1") {
+		t.Error("Snapshot skipped buckets below the cutoff")
+	}
+	if contains(snapshot.QueryWithOptions(hashes[0], &QueryOptions{MaxBucketFraction: 0.25}), "a1") {
+		t.Error("Snapshot did not skip stop buckets")
+	}
+}
+
+// Test normalizing the scores by the number of significant coefficients.
+func TestNormalizeScores(t *testing.T) {
+	hashes := testHashes(t)
+	store := New()
+	for index, hash := range hashes {
+		store.Add(index, hash)
+	}
+
+	for _, hash := range hashes {
+		raw := store.QueryWithOptions(hash, &QueryOptions{ScoreComponents: true})
+		normalized := store.QueryWithOptions(hash, &QueryOptions{ScoreComponents: true, NormalizeScores: true})
+		sort.Sort(raw)
+		sort.Sort(normalized)
+		if len(raw) != len(normalized) {
+			t.Fatalf("Normalized query returned %d matches, expected %d", len(normalized), len(raw))
+		}
+		divisor := float64(len(hash.SignificanceMap()))
+		for index, match := range normalized {
+			if match.ID != raw[index].ID {
+				t.Errorf("Normalization changed the ranking at position %d", index)
+			}
+			if math.Abs(match.HaarScore*divisor-raw[index].HaarScore) > 1e-9 {
+				t.Errorf("Normalized score %f does not match raw score %f / %f", match.HaarScore, raw[index].HaarScore, divisor)
+			}
+			if math.Abs(match.Similarity-raw[index].Similarity) > 1e-9 {
+				t.Error("Normalization changed the similarity")
+			}
+			var sum float64
+			for _, component := range match.Components {
+				sum += component
+			}
+			if math.Abs(sum-match.HaarScore) > 1e-9 {
+				t.Errorf("Score components add up to %f, expected %f", sum, match.HaarScore)
+			}
+		}
+	}
+}
+
+// Test calibrating the weights of the scoring function.
+func TestCalibrate(t *testing.T) {
+	hashes := testHashes(t)
+
+	// Only one class.
+	if Calibrate([]LabeledPair{{hashes[0], hashes[2], true}}) != DefaultWeights {
+		t.Error("Calibrating with duplicates only did not return the default weights")
+	}
+
+	pairs := []LabeledPair{
+		{hashes[0], hashes[2], true},
+		{hashes[0], hashes[0], true},
+		{hashes[1], hashes[1], true},
+		{hashes[0], hashes[1], false},
+		{hashes[1], hashes[2], false},
+	}
+	weights := Calibrate(pairs)
+	var total, defaultTotal float64
+	for channel := range weights {
+		for bin := range weights[channel] {
+			if weights[channel][bin] < 0 {
+				t.Errorf("Weight %d/%d is negative", channel, bin)
+			}
+			total += weights[channel][bin]
+			defaultTotal += DefaultWeights[channel][bin]
+		}
+	}
+	if math.Abs(total-defaultTotal) > 1e-9 {
+		t.Errorf("Weights add up to %f, expected %f", total, defaultTotal)
+	}
+
+	// The calibrated store must rank the duplicate first.
+	store := New()
+	store.SetWeights(weights)
+	store.Add("b", hashes[1])
+	store.Add("c", hashes[2])
+	matches := store.Query(hashes[0])
+	sort.Sort(matches)
+	if len(matches) == 0 || matches[0].ID != "c" {
+		t.Errorf("Calibrated store did not rank the duplicate first: %v", matches)
+	}
+}
+
+// Test that all weight presets rank a known duplicate first.
+func TestWeightPresets(t *testing.T) {
+	hashes := testHashes(t)
+	for name, weights := range WeightPresets {
+		store := New()
+		store.SetWeights(weights)
+		store.Add("b", hashes[1])
+		store.Add("c", hashes[2])
+		matches := store.Query(hashes[0])
+		sort.Sort(matches)
+		if len(matches) == 0 || matches[0].ID != "c" {
+			t.Errorf("Preset %s did not rank the duplicate first: %v", name, matches)
+		}
+	}
+}
+
+// Test hashing in other colour spaces.
+func TestColorSpaces(t *testing.T) {
+	images := testImages(t)
+	for name, space := range map[string]struct {
+		converter haar.ColorConverter
+		weights   Weights
+	}{
+		"YCbCr": {haar.YCbCr, WeightsYCbCr},
+		"Lab":   {haar.Lab, WeightsLab},
+	} {
+		var hashes []Hash
+		for _, img := range images {
+			hash, _, err := CreateHashOpts(img, WithColorSpace(space.converter))
+			if err != nil {
+				t.Fatal(err)
+			}
+			hashes = append(hashes, hash)
+		}
+		yiq, _ := CreateHash(images[0])
+		if hashes[0].Coefs[0] == yiq.Coefs[0] {
+			t.Errorf("%s hash has the same coefficients as the YIQ hash", name)
+		}
+		store := New()
+		store.SetWeights(space.weights)
+		store.Add("b", hashes[1])
+		store.Add("c", hashes[2])
+		matches := store.Query(hashes[0])
+		sort.Sort(matches)
+		if len(matches) == 0 || matches[0].ID != "c" {
+			t.Errorf("%s store did not rank the duplicate first: %v", name, matches)
+		}
+	}
+}
+
+// Test hashing in linear light.
+func TestLinearLight(t *testing.T) {
+	img := testImages(t)[0]
+
+	// Reduce the exposure of the image.
+	bounds := img.Bounds()
+	darker := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			expose := func(value uint32) uint8 {
+				return uint8(math.Round(delinearize(linearize(float64(value>>8)/0xff)*0.5) * 0xff))
+			}
+			darker.Set(x, y, color.RGBA{expose(r), expose(g), expose(b), 0xff})
+		}
+	}
+
+	// Count the shared significant coefficients.
+	shared := func(options ...HashOption) int {
+		hash1, _, _ := CreateHashOpts(img, options...)
+		hash2, _, _ := CreateHashOpts(darker, options...)
+		map1, map2 := hash1.SignificanceMap(), hash2.SignificanceMap()
+		var count int
+		for i, j := 0, 0; i < len(map1) && j < len(map2); {
+			switch {
+			case map1[i] < map2[j]:
+				i++
+			case map1[i] > map2[j]:
+				j++
+			default:
+				count++
+				i++
+				j++
+			}
+		}
+		return count
+	}
+	gamma, linear := shared(), shared(WithLinearLight())
+	if linear < gamma {
+		t.Errorf("Linear light hashes share %d coefficients, gamma-encoded hashes %d", linear, gamma)
+	}
+
+	// The returned image is in sRGB.
+	hash, scaled, _ := CreateHashOpts(img, WithLinearLight())
+	plain, _ := CreateHash(img)
+	if _, ok := scaled.(*image.RGBA); !ok {
+		t.Errorf("Scaled image is a %T, expected *image.RGBA", scaled)
+	}
+	if hash.Coefs[0] == plain.Coefs[0] {
+		t.Error("Linear light hash equals the gamma-encoded hash")
+	}
+}
+
+// Test applying the EXIF orientation before hashing.
+func TestOrientation(t *testing.T) {
+	img := testImages(t)[0]
+
+	// Transformations and their inverses.
+	for orientation, inverse := range map[int]int{2: 2, 3: 3, 4: 4, 5: 5, 6: 8, 7: 7, 8: 6} {
+		restored := orient(orient(img, orientation), inverse).(*image.RGBA)
+		bounds := img.Bounds()
+		if restored.Bounds().Dx() != bounds.Dx() || restored.Bounds().Dy() != bounds.Dy() {
+			t.Fatalf("Orientation %d changed the image size", orientation)
+		}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y += 7 {
+			for x := bounds.Min.X; x < bounds.Max.X; x += 7 {
+				r1, g1, b1, _ := img.At(x, y).RGBA()
+				r2, g2, b2, _ := restored.At(x-bounds.Min.X, y-bounds.Min.Y).RGBA()
+				if r1>>8 != r2>>8 || g1>>8 != g2>>8 || b1>>8 != b2>>8 {
+					t.Fatalf("Orientation %d was not inverted by %d at %d/%d", orientation, inverse, x, y)
+				}
+			}
+		}
+	}
+
+	// A JPEG file whose pixels are stored rotated.
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, orient(img, OrientationRotate270), &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	for _, order := range []binary.AppendByteOrder{binary.BigEndian, binary.LittleEndian} {
+		tiff := []byte("MM\x00\x2a")
+		if order == binary.LittleEndian {
+			tiff = []byte("II\x2a\x00")
+		}
+		tiff = order.AppendUint32(tiff, 8)
+		tiff = order.AppendUint16(tiff, 1)
+		tiff = order.AppendUint16(tiff, 0x0112)
+		tiff = order.AppendUint16(tiff, 3)
+		tiff = order.AppendUint32(tiff, 1)
+		tiff = order.AppendUint16(tiff, OrientationRotate90)
+		tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+		segment := append([]byte("Exif\x00\x00"), tiff...)
+		data := []byte{0xff, 0xd8, 0xff, 0xe1}
+		data = binary.BigEndian.AppendUint16(data, uint16(len(segment)+2))
+		data = append(data, segment...)
+		data = append(data, encoded.Bytes()[2:]...)
+
+		if orientation := ExifOrientation(data); orientation != OrientationRotate90 {
+			t.Fatalf("EXIF orientation is %d, expected %d", orientation, OrientationRotate90)
+		}
+		hash, _, err := CreateHashAutoOrient(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		original, _ := CreateHash(img)
+		if distance := HammingDistance(hash.DHash[0], original.DHash[0]) + HammingDistance(hash.DHash[1], original.DHash[1]); distance > 10 {
+			t.Errorf("Auto-oriented image has a dHash distance of %d to the original", distance)
+		}
+		if math.Abs(hash.Ratio-original.Ratio) > 1e-9 {
+			t.Errorf("Auto-oriented image has ratio %f, expected %f", hash.Ratio, original.Ratio)
+		}
+	}
+	if ExifOrientation(encoded.Bytes()) != OrientationNormal {
+		t.Error("JPEG file without EXIF data has an orientation")
+	}
+}
+
+// Test matching rotated images.
+func TestQueryVariants(t *testing.T) {
+	images := testImages(t)[:2]
+	store := New()
+	for index, img := range images {
+		hash, _ := CreateHash(img)
+		store.Add(index, hash)
+	}
+
+	rotated := orient(images[0], OrientationRotate90)
+	variants, err := CreateHashVariants(rotated, Rotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(variants) != 4 {
+		t.Fatalf("Got %d variants, expected 4", len(variants))
+	}
+	matches := store.QueryVariants(variants, &QueryOptions{MaxResults: 1})
+	if len(matches) != 1 || matches[0].ID != 0 || matches[0].Rotation != 270 {
+		t.Fatalf("Rotated image was not matched: %v", matches)
+	}
+	if matches[0].DHashDistance > 10 {
+		t.Errorf("Rotated match has a dHash distance of %d", matches[0].DHashDistance)
+	}
+	plain := store.QueryWithOptions(variants[0].Hash, &QueryOptions{MaxResults: 1})
+	if len(plain) > 0 && plain[0].ID == 0 && plain[0].Score <= matches[0].Score {
+		t.Error("Unrotated query scored better than the rotated variant")
+	}
+}
+
+// Test matching mirrored images.
+func TestQueryFlipped(t *testing.T) {
+	img := testImages(t)[0]
+	store := New()
+	hash, _ := CreateHash(img)
+	store.Add("a", hash)
+
+	for orientation, expected := range map[int][2]interface{}{
+		OrientationFlipH:      {0, true},
+		OrientationFlipV:      {180, true},
+		OrientationTransverse: {90, true},
+	} {
+		variants, err := CreateHashVariants(orient(img, orientation), AllOrientations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matches := store.QueryVariants(variants, &QueryOptions{MaxResults: 1})
+		if len(matches) != 1 || matches[0].Rotation != expected[0] || matches[0].Flipped != expected[1] {
+			t.Errorf("Orientation %d was not matched as %v: %v", orientation, expected, matches)
+		}
+	}
+}
+
+// Test trimming uniform borders before hashing.
+func TestTrimBorders(t *testing.T) {
+	img := testImages(t)[0]
+	bounds := img.Bounds()
+
+	for _, border := range []struct {
+		colour               color.Color
+		horizontal, vertical int
+	}{
+		{color.Black, 0, bounds.Dy() / 3},                 // Letterbox.
+		{color.Black, bounds.Dx() / 2, 0},                 // Pillarbox.
+		{color.White, bounds.Dx() / 10, bounds.Dy() / 10}, // Frame.
+	} {
+		framed := image.NewRGBA(image.Rect(0, 0, bounds.Dx()+2*border.horizontal, bounds.Dy()+2*border.vertical))
+		draw.Draw(framed, framed.Bounds(), image.NewUniform(border.colour), image.Point{}, draw.Src)
+		inner := image.Rect(border.horizontal, border.vertical, border.horizontal+bounds.Dx(), border.vertical+bounds.Dy())
+		draw.Draw(framed, inner, img, bounds.Min, draw.Src)
+
+		if trimmed := TrimBorders(framed, 0.05); trimmed.Bounds() != inner {
+			t.Errorf("Trimmed image has bounds %s, expected %s", trimmed.Bounds(), inner)
+		}
+		hash, _, err := CreateHashOpts(framed, WithTrimBorders(0.05))
+		if err != nil {
+			t.Fatal(err)
+		}
+		original, _ := CreateHash(img)
+		if math.Abs(hash.Ratio-original.Ratio) > 1e-9 {
+			t.Errorf("Trimmed hash has ratio %f, expected %f", hash.Ratio, original.Ratio)
+		}
+	}
+
+	// Uniform images are not trimmed.
+	uniform := image.NewUniform(color.Black)
+	plain := image.NewRGBA(image.Rect(0, 0, 50, 40))
+	draw.Draw(plain, plain.Bounds(), uniform, image.Point{}, draw.Src)
+	if TrimBorders(plain, 0.1) != image.Image(plain) {
+		t.Error("Uniform image was trimmed")
+	}
+}
+
+// Test the preprocessing chain.
+func TestPreprocessors(t *testing.T) {
+	img := testImages(t)[0]
+
+	// Preprocessors are applied in order.
+	var order []int
+	step := func(number int) Preprocessor {
+		return PreprocessorFunc(func(img image.Image) image.Image {
+			order = append(order, number)
+			return img
+		})
+	}
+	if _, _, err := CreateHashOpts(img, WithPreprocessors(step(1), step(2)), WithPreprocessors(step(3))); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(order) != "[1 2 3]" {
+		t.Errorf("Preprocessors were applied in order %v", order)
+	}
+
+	// Cropping.
+	hash, _, _ := CreateHashOpts(img, WithPreprocessors(CropPreprocessor(0.5)))
+	bounds := img.Bounds()
+	cropped, _ := cropImage(img, image.Rect(bounds.Min.X+12, bounds.Min.Y+12, bounds.Max.X-12, bounds.Max.Y-12))
+	expected, _ := CreateHash(cropped)
+	if hash.Coefs[0] != expected.Coefs[0] {
+		t.Error("Cropped hash differs from the hash of the cropped image")
+	}
+
+	// Grayscale.
+	hash, _, _ = CreateHashOpts(img, WithPreprocessors(GrayscalePreprocessor()))
+	for _, coef := range hash.Coefs {
+		if math.Abs(coef[1]) > 1e-3 || math.Abs(coef[2]) > 1e-3 {
+			t.Fatalf("Grayscale hash has chrominance coefficients %v", coef)
+		}
+	}
+
+	// Gamma and blur.
+	rgba := image.NewRGBA(bounds)
+	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+	plain, _ := CreateHash(rgba)
+	identity, _, _ := CreateHashOpts(rgba, WithPreprocessors(GammaPreprocessor(1), BlurPreprocessor(0)))
+	if identity.Coefs[0] != plain.Coefs[0] {
+		t.Error("Identity gamma and blur changed the hash")
+	}
+	darker, _, _ := CreateHashOpts(img, WithPreprocessors(GammaPreprocessor(2)))
+	blurred, _, _ := CreateHashOpts(img, WithPreprocessors(BlurPreprocessor(2)))
+	if darker.Coefs[0][0] >= plain.Coefs[0][0] {
+		t.Error("Gamma correction did not darken the image")
+	}
+	if blurred.Coefs[0] == plain.Coefs[0] && blurred.Coefs[len(blurred.Coefs)-1] == plain.Coefs[len(plain.Coefs)-1] {
+		t.Error("Blur did not change the hash")
+	}
+}
+
+// Test blurring the resized image before hashing.
+func TestPreBlur(t *testing.T) {
+	img := testImages(t)[0]
+
+	// A heavily recompressed copy.
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 5}); err != nil {
+		t.Fatal(err)
+	}
+	recompressed, err := jpeg.Decode(&encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	distance := func(options ...HashOption) float64 {
+		hash1, _, _ := CreateHashOpts(img, options...)
+		hash2, _, _ := CreateHashOpts(recompressed, options...)
+		var sum float64
+		for index := range hash1.Coefs {
+			for channel := range hash1.Coefs[index] {
+				sum += math.Abs(hash1.Coefs[index][channel] - hash2.Coefs[index][channel])
+			}
+		}
+		return sum
+	}
+	sharp, blurred := distance(), distance(WithPreBlur(1))
+	if blurred >= sharp {
+		t.Errorf("Pre-blurred hashes differ by %f, sharp hashes by %f", blurred, sharp)
+	}
+
+	plain, _ := CreateHash(img)
+	unblurred, _, _ := CreateHashOpts(img, WithPreBlur(0))
+	if unblurred.Coefs[0] != plain.Coefs[0] || unblurred.DHash != plain.DHash {
+		t.Error("A pre-blur of 0 changed the hash")
+	}
+}
+
+// Test masking caption bars.
+func TestCaptionMask(t *testing.T) {
+	img := testImages(t)[0]
+	bounds := img.Bounds()
+
+	// Two memes with different captions.
+	bar := bounds.Dy() / 4
+	meme := func(seed int64) image.Image {
+		random := rand.New(rand.NewSource(seed))
+		meme := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()+2*bar))
+		draw.Draw(meme, meme.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(meme, image.Rect(0, bar, bounds.Dx(), bar+bounds.Dy()), img, bounds.Min, draw.Src)
+		for y := 0; y < meme.Bounds().Dy(); y++ {
+			if y >= bar && y < bar+bounds.Dy() {
+				continue
+			}
+			for x := 0; x < bounds.Dx(); x++ {
+				if random.Intn(3) == 0 {
+					meme.Set(x, y, color.Black)
+				}
+			}
+		}
+		return meme
+	}
+	meme1, meme2 := meme(1), meme(2)
+
+	distance := func(options ...HashOption) float64 {
+		hash1, _, _ := CreateHashOpts(meme1, options...)
+		hash2, _, _ := CreateHashOpts(meme2, options...)
+		var sum float64
+		for index := range hash1.Coefs {
+			for channel := range hash1.Coefs[index] {
+				sum += math.Abs(hash1.Coefs[index][channel] - hash2.Coefs[index][channel])
+			}
+		}
+		return sum
+	}
+	fraction := float64(bar) / float64(bounds.Dy()+2*bar)
+	plain, masked := distance(), distance(WithCaptionMask(fraction, fraction))
+	if masked >= plain/10 {
+		t.Errorf("Masked memes differ by %f, unmasked memes by %f", masked, plain)
+	}
+}
+
+// Test hashing with a mask.
+func TestCreateHashMasked(t *testing.T) {
+	img := testImages(t)[0]
+	bounds := img.Bounds()
+
+	// Two copies with different watermarks.
+	watermark := image.Rect(bounds.Min.X, bounds.Max.Y-bounds.Dy()/5, bounds.Min.X+bounds.Dx()/2, bounds.Max.Y)
+	marked := func(colour color.Color) image.Image {
+		marked := image.NewRGBA(bounds)
+		draw.Draw(marked, bounds, img, bounds.Min, draw.Src)
+		draw.Draw(marked, watermark, image.NewUniform(colour), image.Point{}, draw.Src)
+		return marked
+	}
+	marked1, marked2 := marked(color.White), marked(color.RGBA{0xff, 0, 0, 0xff})
+	mask := image.NewAlpha(bounds)
+	draw.Draw(mask, bounds, image.Opaque, image.Point{}, draw.Src)
+	draw.Draw(mask, watermark, image.Transparent, image.Point{}, draw.Src)
+
+	plain1, _ := CreateHash(marked1)
+	plain2, _ := CreateHash(marked2)
+	if reflect.DeepEqual(plain1, plain2) {
+		t.Error("Unmasked hashes are identical")
+	}
+	masked1, _, err := CreateHashMasked(marked1, mask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masked2, _, err := CreateHashMasked(marked2, mask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(masked1, masked2) {
+		t.Error("Masked hashes differ")
+	}
+
+	// The histogram only counts unmasked pixels.
+	if masked1.HistogramCounts == plain1.HistogramCounts {
+		t.Error("Masked histogram equals unmasked histogram")
+	}
+
+	// Masking out everything fails.
+	if _, _, err := CreateHashMasked(marked1, image.NewAlpha(bounds)); err == nil {
+		t.Error("Fully masked image was hashed")
+	}
+}
+
+// Test aspect-ratio-preserving resizing.
+func TestPadding(t *testing.T) {
+	img := testImages(t)[0]
+	bounds := img.Bounds()
+
+	// A panorama.
+	panorama := image.NewRGBA(image.Rect(0, 0, 4*bounds.Dx(), bounds.Dy()))
+	for x := 0; x < 4; x++ {
+		draw.Draw(panorama, image.Rect(x*bounds.Dx(), 0, (x+1)*bounds.Dx(), bounds.Dy()), img, bounds.Min, draw.Src)
+	}
+	hash, scaled, err := CreateHashOpts(panorama, WithPadding())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hash.Padded {
+		t.Error("Hash is not marked as padded")
+	}
+	if math.Abs(hash.Ratio-4) > 1e-9 {
+		t.Errorf("Ratio is %f, expected 4", hash.Ratio)
+	}
+	if scaled.Bounds().Dx() != ImageScale || scaled.Bounds().Dy() != ImageScale {
+		t.Errorf("Scaled image has size %s", scaled.Bounds().Size())
+	}
+	top, middle := scaled.At(ImageScale/2, 0), scaled.At(ImageScale/2, ImageScale/2)
+	if top == middle || scaled.At(0, 0) != top || scaled.At(ImageScale-1, ImageScale-1) != top {
+		t.Error("Image was not padded")
+	}
+
+	// The flag survives serialization.
+	for name, codec := range map[string]func(Hash) (Hash, error){
+		"binary": func(hash Hash) (Hash, error) {
+			data, err := hash.MarshalBinary()
+			if err != nil {
+				return Hash{}, err
+			}
+			var decoded Hash
+			err = decoded.UnmarshalBinary(data)
+			return decoded, err
+		},
+		"json": func(hash Hash) (Hash, error) {
+			data, err := hash.MarshalJSON()
+			if err != nil {
+				return Hash{}, err
+			}
+			var decoded Hash
+			err = decoded.UnmarshalJSON(data)
+			return decoded, err
+		},
+		"proto": func(hash Hash) (Hash, error) {
+			data, err := hash.MarshalProto()
+			if err != nil {
+				return Hash{}, err
+			}
+			var decoded Hash
+			err = decoded.UnmarshalProto(data)
+			return decoded, err
+		},
+	} {
+		decoded, err := codec(hash)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !decoded.Padded {
+			t.Errorf("%s: Padding flag was lost", name)
+		}
+	}
+
+	// Padded and stretched hashes are not matched.
+	store := New()
+	store.Add("padded", hash)
+	stretched, _ := CreateHash(panorama)
+	store.Add("stretched", stretched)
+	for _, query := range []Hash{hash, stretched} {
+		matches := store.Query(query)
+		if len(matches) != 1 {
+			t.Fatalf("Expected one match, got %d", len(matches))
+		}
+		expected := map[bool]string{true: "padded", false: "stretched"}[query.Padded]
+		if matches[0].ID != expected {
+			t.Errorf("Expected %s, got %v", expected, matches[0].ID)
+		}
+		if matches := store.QueryDHash(query, 128); len(matches) != 1 || matches[0].ID != expected {
+			t.Errorf("QueryDHash returned %v, expected %s", matches, expected)
+		}
+		hits := store.QueryHits(query)
+		if matches := store.Hydrate(query, hits); len(hits) != 1 || len(matches) != 1 || matches[0].ID != expected {
+			t.Errorf("QueryHits returned %d hits (%v), expected %s", len(hits), matches, expected)
+		}
+	}
+
+	// Hits from the other mode are not hydrated.
+	if matches := store.Hydrate(stretched, store.QueryHits(hash)); len(matches) != 0 {
+		t.Errorf("Hydrate returned %v for a padded hit", matches)
+	}
+	if match := Compare(hash, stretched); !math.IsInf(match.Score, 1) || match.Similarity != 0 {
+		t.Errorf("Compare returned score %f and similarity %f", match.Score, match.Similarity)
+	}
+	if match := Compare(hash, hash); math.IsInf(match.Score, 1) || match.Similarity == 0 {
+		t.Errorf("Compare returned score %f and similarity %f for identical hashes", match.Score, match.Similarity)
+	}
+
+	// Negatives are not returned by QueryHits() nor hydrated.
+	hits := store.QueryHits(hash)
+	store.MarkFalsePositiveHash(hash, "padded")
+	if len(store.QueryHits(hash)) != 0 || len(store.Hydrate(hash, hits)) != 0 {
+		t.Error("False positive was returned")
+	}
+	if restored, _ := store.GetHash("padded"); !restored.Padded {
+		t.Error("Store did not keep the padding flag")
+	}
+}
+
+// Test hashing and querying animated images.
+func TestAnimated(t *testing.T) {
+	decode := func(encoded string) image.Image {
+		img, err := jpeg.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(encoded)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	var frames []*image.Paletted
+	for _, encoded := range []string{imgA, imgA, imgB} {
+		img := decode(encoded)
+		frame := image.NewPaletted(image.Rect(0, 0, 64, 64), palette.Plan9)
+		draw.Draw(frame, frame.Bounds(), resize.Resize(64, 64, img, resize.Bilinear), image.Point{}, draw.Src)
+		frames = append(frames, frame)
+	}
+	animation := &gif.GIF{
+		Image:    frames,
+		Delay:    make([]int, len(frames)),
+		Disposal: make([]byte, len(frames)),
+		Config:   image.Config{Width: 64, Height: 64},
+	}
+	animated, err := CreateHashesFromGIF(animation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(animated.Keyframes) != 2 || animated.Keyframes[0].Index != 0 || animated.Keyframes[1].Index != 2 {
+		t.Fatalf("Unexpected keyframes %d", len(animated.Keyframes))
+	}
+
+	// Add the animation and a still image.
+	store := New()
+	store.AddAnimated("animation", animated)
+	hashB, _ := CreateHash(decode(imgB))
+	store.Add("still", hashB)
+	if store.Size() != 4 {
+		t.Errorf("Store contains %d images, expected 4", store.Size())
+	}
+
+	// A still copy of a frame finds the animation.
+	still, _ := CreateHash(frames[0])
+	matches := store.QueryWithOptions(still, &QueryOptions{MaxResults: 1})
+	if len(matches) != 1 || matches[0].ID != (FrameID{Parent: "animation", Frame: 0}) || ParentID(matches[0].ID) != "animation" {
+		t.Errorf("Unexpected matches %v", matches)
+	}
+
+	// Animations are reported once, still images match keyframes.
+	parents := make(map[interface{}]int)
+	for _, match := range store.QueryAnimated(animated, nil) {
+		parents[ParentID(match.ID)]++
+	}
+	if parents["animation"] != 1 || parents["still"] != 1 {
+		t.Errorf("Unexpected matches %v", parents)
+	}
+
+	if removed := store.DeleteAnimated("animation"); removed != 3 {
+		t.Errorf("Removed %d images, expected 3", removed)
+	}
+}
+
+// Test the hashing of image files.
+func TestHashFile(t *testing.T) {
+	data, err := base64.StdEncoding.DecodeString(imgA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := CreateHash(img)
+
+	hash, err := HashReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hash, expected) {
+		t.Error("Hash of reader differs from hash of image")
+	}
+
+	path := filepath.Join(t.TempDir(), "image.jpg")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if hash, err = HashFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hash, expected) {
+		t.Error("Hash of file differs from hash of image")
+	}
+
+	if _, err := HashFile(filepath.Join(t.TempDir(), "missing.jpg")); err == nil {
+		t.Error("Missing file was hashed")
+	}
+	if _, err := HashReader(strings.NewReader("no image")); err == nil {
+		t.Error("Invalid data was hashed")
+	}
 }
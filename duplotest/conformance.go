@@ -0,0 +1,259 @@
+package duplotest
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/rivo/duplo"
+)
+
+// The conformance vectors of all hash versions, one file per version.
+//
+//go:embed conformance/*.json
+var conformanceFiles embed.FS
+
+// ConformanceVector is a test vector for implementations of duplo's hashing
+// algorithm in other languages, e.g. for hashing images on clients. It
+// consists of an input image and the hash which duplo.CreateHash() returns for
+// it. The vectors of each hash version are published as JSON files in the
+// "conformance" directory of this package (see ConformanceVectors() and
+// WriteConformanceVectors()). An implementation conforms to a hash version if
+// it produces exactly the expected values for all of its vectors.
+type ConformanceVector struct {
+	// The name of the vector.
+	Name string `json:"name"`
+
+	// The hash version (see duplo.HashVersion) of the expected hash.
+	HashVersion int `json:"hashVersion"`
+
+	// The size of the input image.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	// The input image's pixels, row by row, four bytes (red, green, blue,
+	// alpha) per pixel. All pixels are opaque. In JSON, this is encoded in
+	// base64.
+	Pixels []byte `json:"pixels"`
+
+	// The hash expected for the input image.
+	Expected ConformanceHash `json:"expected"`
+}
+
+// ConformanceHash contains all fields of a duplo.Hash in a form which can be
+// compared exactly across languages. Floating-point values are not rounded.
+// 64 bit integers are encoded as 16-digit hexadecimal strings because not all
+// JSON decoders can represent them.
+type ConformanceHash struct {
+	// The width and height of the Haar coefficient matrix.
+	MatrixWidth  uint `json:"matrixWidth"`
+	MatrixHeight uint `json:"matrixHeight"`
+
+	// The hex-encoded SHA-256 digest of all Haar coefficients. They are
+	// digested in matrix order, with the three colour channels of each
+	// coefficient in sequence, each one as a little-endian IEEE 754 64 bit
+	// floating-point value.
+	CoefsSHA256 string `json:"coefsSHA256"`
+
+	// The first Haar coefficient (the scaling function coefficient), also
+	// included in the digest, for easier debugging.
+	ScaleCoef [3]float64 `json:"scaleCoef"`
+
+	// The remaining fields correspond to those of duplo.Hash.
+	Thresholds      [3]float64 `json:"thresholds"`
+	Ratio           float64    `json:"ratio"`
+	DHash           [2]string  `json:"dHash"`
+	Histogram       string     `json:"histogram"`
+	HistoMax        [3]float32 `json:"histoMax"`
+	HistogramCounts [64]uint8  `json:"histogramCounts"`
+	Blockhash       [4]string  `json:"blockhash"`
+	WHash           string     `json:"wHash"`
+}
+
+// conformanceInputs are the names and pixel generators of the conformance
+// vectors' input images. They cover odd sizes, sizes smaller than and larger
+// than duplo.ImageScale, and extreme aspect ratios.
+var conformanceInputs = []struct {
+	name          string
+	width, height int
+	pixel         func(x, y int) (r, g, b uint8)
+}{
+	{"solid", 8, 8, func(x, y int) (r, g, b uint8) {
+		return 200, 100, 50
+	}},
+	{"gradient", 16, 16, func(x, y int) (r, g, b uint8) {
+		return uint8(x * 16), uint8(y * 16), uint8((x + y) * 8)
+	}},
+	{"checker", 32, 24, func(x, y int) (r, g, b uint8) {
+		if (x/4+y/4)%2 == 0 {
+			return 255, 255, 255
+		}
+		return 0, 0, 0
+	}},
+	{"odd", 13, 7, func(x, y int) (r, g, b uint8) {
+		return uint8(x * 19), uint8(255 - y*36), uint8(x * y * 2)
+	}},
+	{"tall", 5, 40, func(x, y int) (r, g, b uint8) {
+		return uint8(y * 6), 128, uint8(x * 60)
+	}},
+	{"large", 130, 129, func(x, y int) (r, g, b uint8) {
+		return uint8(x * y), uint8(x ^ y), uint8((x - y) * 3)
+	}},
+	{"noise", 40, 30, func(x, y int) (r, g, b uint8) {
+		// A hash of the coordinates, independent of the generation order.
+		state := uint32(x)*73856093 ^ uint32(y)*19349663
+		state = state*1664525 + 1013904223
+		return uint8(state >> 24), uint8(state >> 16), uint8(state >> 8)
+	}},
+}
+
+// Image returns the vector's input image.
+func (vector ConformanceVector) Image() image.Image {
+	return &image.NRGBA{
+		Pix:    vector.Pixels,
+		Stride: 4 * vector.Width,
+		Rect:   image.Rect(0, 0, vector.Width, vector.Height),
+	}
+}
+
+// RecordConformance returns the conformance representation of the given hash.
+func RecordConformance(hash duplo.Hash) ConformanceHash {
+	hexUint64 := func(value uint64) string {
+		return fmt.Sprintf("%016x", value)
+	}
+
+	digest := sha256.New()
+	var buffer [8]byte
+	for _, coef := range hash.Coefs {
+		for _, value := range coef {
+			binary.LittleEndian.PutUint64(buffer[:], math.Float64bits(value))
+			digest.Write(buffer[:])
+		}
+	}
+
+	conformance := ConformanceHash{
+		MatrixWidth:     hash.Width,
+		MatrixHeight:    hash.Height,
+		CoefsSHA256:     hex.EncodeToString(digest.Sum(nil)),
+		Thresholds:      hash.Thresholds,
+		Ratio:           hash.Ratio,
+		DHash:           [2]string{hexUint64(hash.DHash[0]), hexUint64(hash.DHash[1])},
+		Histogram:       hexUint64(hash.Histogram),
+		HistoMax:        hash.HistoMax,
+		HistogramCounts: hash.HistogramCounts,
+		WHash:           hexUint64(hash.WHash),
+	}
+	if len(hash.Coefs) > 0 {
+		conformance.ScaleCoef = hash.Coefs[0]
+	}
+	for index, value := range hash.Blockhash {
+		conformance.Blockhash[index] = hexUint64(value)
+	}
+
+	return conformance
+}
+
+// GenerateConformanceVectors returns the conformance vectors of the current
+// hash version, with the expected hashes calculated by duplo.CreateHash().
+func GenerateConformanceVectors() []ConformanceVector {
+	vectors := make([]ConformanceVector, 0, len(conformanceInputs))
+	for _, input := range conformanceInputs {
+		vector := ConformanceVector{
+			Name:        input.name,
+			HashVersion: duplo.HashVersion,
+			Width:       input.width,
+			Height:      input.height,
+			Pixels:      make([]byte, 0, 4*input.width*input.height),
+		}
+		for y := 0; y < input.height; y++ {
+			for x := 0; x < input.width; x++ {
+				r, g, b := input.pixel(x, y)
+				vector.Pixels = append(vector.Pixels, r, g, b, 255)
+			}
+		}
+		hash, _ := duplo.CreateHash(vector.Image())
+		vector.Expected = RecordConformance(hash)
+		vectors = append(vectors, vector)
+	}
+	return vectors
+}
+
+// WriteConformanceVectors writes the conformance vectors of the current hash
+// version to the given writer, as a JSON array. This is how the published
+// files were created.
+func WriteConformanceVectors(writer io.Writer) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "\t")
+	if err := encoder.Encode(GenerateConformanceVectors()); err != nil {
+		return fmt.Errorf("Unable to encode conformance vectors: %s", err)
+	}
+	return nil
+}
+
+// ConformanceVectors returns the published conformance vectors of the given
+// hash version.
+func ConformanceVectors(hashVersion int) ([]ConformanceVector, error) {
+	file, err := conformanceFiles.ReadFile("conformance/v" + strconv.Itoa(hashVersion) + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("No conformance vectors for hash version %d", hashVersion)
+	}
+	var vectors []ConformanceVector
+	if err := json.Unmarshal(file, &vectors); err != nil {
+		return nil, fmt.Errorf("Unable to decode conformance vectors: %s", err)
+	}
+	return vectors, nil
+}
+
+// Verify returns an error describing the first difference between the hash
+// expected by the given vector and the given hash. Nil is returned if the
+// hash conforms to the vector.
+func Verify(vector ConformanceVector, hash duplo.Hash) error {
+	expected, actual := vector.Expected, RecordConformance(hash)
+	for _, field := range []struct {
+		name             string
+		expected, actual interface{}
+	}{
+		{"matrix size", [2]uint{expected.MatrixWidth, expected.MatrixHeight}, [2]uint{actual.MatrixWidth, actual.MatrixHeight}},
+		{"scaling function coefficient", expected.ScaleCoef, actual.ScaleCoef},
+		{"coefficients digest", expected.CoefsSHA256, actual.CoefsSHA256},
+		{"thresholds", expected.Thresholds, actual.Thresholds},
+		{"ratio", expected.Ratio, actual.Ratio},
+		{"dHash", expected.DHash, actual.DHash},
+		{"histogram", expected.Histogram, actual.Histogram},
+		{"histogram maximums", expected.HistoMax, actual.HistoMax},
+		{"histogram counts", expected.HistogramCounts, actual.HistogramCounts},
+		{"blockhash", expected.Blockhash, actual.Blockhash},
+		{"wHash", expected.WHash, actual.WHash},
+	} {
+		if field.expected != field.actual {
+			return fmt.Errorf("Vector %q: %s differs: expected %v, got %v", vector.Name, field.name, field.expected, field.actual)
+		}
+	}
+	return nil
+}
+
+// AssertConformance hashes the input images of the published conformance
+// vectors of the given hash version with duplo.CreateHash() and reports an
+// error for every vector whose hash does not conform.
+func AssertConformance(t testing.TB, hashVersion int) {
+	t.Helper()
+
+	vectors, err := ConformanceVectors(hashVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vector := range vectors {
+		hash, _ := duplo.CreateHash(vector.Image())
+		if err := Verify(vector, hash); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package duplotest
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/rand"
+)
+
+// CorpusNames contains the names of all sample corpora, in alphabetical
+// order.
+var CorpusNames = []string{"scanned-documents", "screenshots"}
+
+// Corpus parameters: The number of groups and the number of images per group.
+const (
+	corpusGroups   = 24
+	corpusVariants = 4
+)
+
+// Corpus returns the images of the sample corpus with the given name, along
+// with their groups: All images of the same group are duplicates of each
+// other. The corpora were used to tune duplo's weight presets for their types
+// of content (e.g. duplo.WeightsScreenshots) and can be used to evaluate other
+// configurations for them. Nil is returned if there is no corpus with the given
+// name.
+//
+// The images are generated deterministically, with pseudo-random content. The
+// "screenshots" corpus contains application windows with a title bar, a
+// sidebar, text, pictures, and buttons. Their duplicates have some of their
+// text replaced, a different accent colour, a different resolution, or a
+// notification on top. The "scanned-documents" corpus contains pages with a
+// heading, paragraphs of text, and a figure. Their duplicates are rescans
+// with different brightness and colour casts, slight rotations and offsets,
+// and noise.
+func Corpus(name string) (images []image.Image, groups []int) {
+	var variant func(group, variant int) image.Image
+	switch name {
+	case "scanned-documents":
+		variant = scannedDocument
+	case "screenshots":
+		variant = screenshot
+	default:
+		return nil, nil
+	}
+	for group := 0; group < corpusGroups; group++ {
+		for index := 0; index < corpusVariants; index++ {
+			images = append(images, variant(group, index))
+			groups = append(groups, group)
+		}
+	}
+	return
+}
+
+// Accent colours of screenshots.
+var accents = []color.RGBA{
+	{0, 120, 215, 255},
+	{220, 60, 50, 255},
+	{40, 160, 70, 255},
+	{130, 60, 180, 255},
+	{240, 150, 0, 255},
+	{0, 150, 160, 255},
+}
+
+// screenshot returns a variant of the screenshot of the given group (see
+// Corpus()). Variant 0 is the original.
+func screenshot(group, variant int) image.Image {
+	const width, height = 320, 200
+	layout := rand.New(rand.NewSource(int64(group)))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	fill := func(x0, y0, x1, y1 int, c color.RGBA) {
+		draw.Draw(img, image.Rect(x0, y0, x1, y1), image.NewUniform(c), image.Point{}, draw.Src)
+	}
+
+	// The window.
+	accent := layout.Intn(len(accents))
+	if variant == 2 {
+		accent = (accent + 1 + group%(len(accents)-1)) % len(accents)
+	}
+	background := color.RGBA{250, 250, 250, 255}
+	if layout.Intn(3) == 0 {
+		background = color.RGBA{236, 238, 242, 255}
+	}
+	fill(0, 0, width, height, background)
+	fill(0, 0, width, 16, accents[accent])
+	sidebar := 50 + layout.Intn(40)
+	fill(0, 16, sidebar, height, color.RGBA{225, 228, 232, 255})
+
+	// Text is drawn as words, i.e. dark bars. Some words of variant 1 are
+	// replaced.
+	edits := rand.New(rand.NewSource(int64(1000 + group)))
+	text := func(x0, y, x1 int, c color.RGBA) {
+		for x := x0; x < x1-6; {
+			length := 6 + layout.Intn(22)
+			if variant == 1 && edits.Intn(3) == 0 {
+				length = 6 + edits.Intn(22)
+			}
+			if x+length > x1 {
+				length = x1 - x
+			}
+			fill(x, y, x+length, y+3, c)
+			x += length + 4
+		}
+	}
+	for y := 26; y < height-12; y += 12 {
+		text(6, y, sidebar-6-layout.Intn(20), color.RGBA{90, 90, 100, 255})
+	}
+
+	// The content: paragraphs, pictures, and buttons.
+	for y := 26; y < height-16; {
+		switch layout.Intn(4) {
+		case 0: // A picture.
+			pictureHeight := 30 + layout.Intn(30)
+			if y+pictureHeight > height-8 {
+				pictureHeight = height - 8 - y
+			}
+			x0 := sidebar + 10 + layout.Intn(40)
+			x1 := x0 + 60 + layout.Intn(80)
+			if x1 > width-10 {
+				x1 = width - 10
+			}
+			base := color.RGBA{uint8(layout.Intn(200)), uint8(layout.Intn(200)), uint8(layout.Intn(200)), 255}
+			for py := y; py < y+pictureHeight; py++ {
+				for px := x0; px < x1; px++ {
+					shade := uint8((px - x0 + py - y) % 56)
+					img.SetRGBA(px, py, color.RGBA{base.R + shade, base.G + shade/2, base.B + shade/3, 255})
+				}
+			}
+			y += pictureHeight + 8
+		case 1: // A button.
+			x0 := sidebar + 10 + layout.Intn(100)
+			fill(x0, y, x0+40+layout.Intn(30), y+12, accents[accent])
+			y += 20
+		default: // A paragraph.
+			lines := 2 + layout.Intn(4)
+			for line := 0; line < lines && y < height-12; line++ {
+				text(sidebar+10, y, width-10-layout.Intn(60), color.RGBA{40, 40, 40, 255})
+				y += 8
+			}
+			y += 6
+		}
+	}
+
+	switch variant {
+	case 3: // A notification at a lower resolution.
+		fill(width-110, height-40, width-6, height-6, color.RGBA{50, 50, 56, 255})
+		fill(width-100, height-30, width-40, height-27, color.RGBA{230, 230, 230, 255})
+		fill(width-100, height-20, width-60, height-17, color.RGBA{180, 180, 180, 255})
+		return resample(img, width*3/4, height*3/4, 0, 0, 0)
+	}
+	return img
+}
+
+// scannedDocument returns a variant of the scanned document of the given
+// group (see Corpus()). Variant 0 is the original.
+func scannedDocument(group, variant int) image.Image {
+	const width, height = 240, 320
+	layout := rand.New(rand.NewSource(int64(group)))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	fill := func(x0, y0, x1, y1 int, c color.RGBA) {
+		draw.Draw(img, image.Rect(x0, y0, x1, y1), image.NewUniform(c), image.Point{}, draw.Src)
+	}
+	ink := color.RGBA{25, 25, 30, 255}
+	fill(0, 0, width, height, color.RGBA{246, 246, 242, 255})
+
+	// The heading.
+	margin := 16 + layout.Intn(10)
+	y := margin + layout.Intn(10)
+	fill(margin, y, margin+60+layout.Intn(100), y+8, ink)
+	y += 20
+
+	// Paragraphs, with a figure somewhere.
+	figure := layout.Intn(4)
+	for paragraph := 0; y < height-margin-8; paragraph++ {
+		if paragraph == figure {
+			figureHeight := 40 + layout.Intn(40)
+			x0 := margin + layout.Intn(60)
+			if y+figureHeight < height-margin {
+				for py := y; py < y+figureHeight; py++ {
+					for px := x0; px < x0+100; px++ {
+						value := uint8(80 + (px-x0)*(py-y)%120)
+						img.SetRGBA(px, py, color.RGBA{value, value, value, 255})
+					}
+				}
+			}
+			y += figureHeight + 10
+			continue
+		}
+		lines := 3 + layout.Intn(6)
+		for line := 0; line < lines && y < height-margin-4; line++ {
+			right := width - margin
+			if line == lines-1 {
+				right = margin + 20 + layout.Intn(width-2*margin-20)
+			}
+			indent := 0
+			if line == 0 {
+				indent = 10
+			}
+			for x := margin + indent; x < right-4; {
+				length := 4 + layout.Intn(20)
+				if x+length > right {
+					length = right - x
+				}
+				fill(x, y, x+length, y+4, ink)
+				x += length + 3
+			}
+			y += 8
+		}
+		y += 6
+	}
+
+	// The rescans.
+	scan := rand.New(rand.NewSource(int64(2000 + 10*group + variant)))
+	switch variant {
+	case 1: // Darker, with a yellow cast.
+		return adjust(img, 0.85, 10, color.RGBA{255, 240, 200, 255}, nil)
+	case 2: // Rotated, brighter, and with noise.
+		rotated := resample(img, width, height, (scan.Float64()-0.5)*0.04, 0, 0)
+		return adjust(rotated, 1.05, -5, color.RGBA{255, 255, 255, 255}, scan)
+	case 3: // Offset, with a grey cast.
+		shifted := resample(img, width, height, 0, 3+scan.Intn(5), 3+scan.Intn(5))
+		return adjust(shifted, 0.9, 0, color.RGBA{230, 232, 236, 255}, nil)
+	}
+	return img
+}
+
+// resample returns the given image scaled to the given size, rotated by the
+// given angle (in radians) around its centre, and shifted by the given offset.
+// Pixels are sampled with the nearest-neighbour method. Areas outside the
+// original image are white.
+func resample(img *image.RGBA, width, height int, angle float64, dx, dy int) *image.RGBA {
+	bounds := img.Bounds()
+	resampled := image.NewRGBA(image.Rect(0, 0, width, height))
+	sin, cos := math.Sincos(angle)
+	scaleX, scaleY := float64(bounds.Dx())/float64(width), float64(bounds.Dy())/float64(height)
+	centerX, centerY := float64(width)/2, float64(height)/2
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			fx, fy := float64(x-dx)-centerX, float64(y-dy)-centerY
+			sx := int((cos*fx-sin*fy+centerX)*scaleX) + bounds.Min.X
+			sy := int((sin*fx+cos*fy+centerY)*scaleY) + bounds.Min.Y
+			if (image.Point{sx, sy}).In(bounds) {
+				resampled.SetRGBA(x, y, img.RGBAAt(sx, sy))
+			} else {
+				resampled.SetRGBA(x, y, color.RGBA{255, 255, 255, 255})
+			}
+		}
+	}
+	return resampled
+}
+
+// adjust returns a copy of the given image with the contrast multiplied by the
+// given factor, the given brightness offset added, and then multiplied by the
+// given tint. If a random number generator is provided, noise is added.
+func adjust(img *image.RGBA, contrast, brightness float64, tint color.RGBA, noise *rand.Rand) *image.RGBA {
+	bounds := img.Bounds()
+	adjusted := image.NewRGBA(bounds)
+	channel := func(value uint8, tint uint8, noise float64) uint8 {
+		v := ((float64(value)-128)*contrast + 128 + brightness + noise) * float64(tint) / 255
+		return uint8(math.Max(0, math.Min(255, v)))
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var n float64
+			if noise != nil {
+				n = noise.NormFloat64() * 8
+			}
+			c := img.RGBAAt(x, y)
+			adjusted.SetRGBA(x, y, color.RGBA{channel(c.R, tint.R, n), channel(c.G, tint.G, n), channel(c.B, tint.B, n), 255})
+		}
+	}
+	return adjusted
+}
@@ -0,0 +1,236 @@
+/*
+Package duplotest provides test support for applications using the duplo
+package. It contains deterministic fixture images, the golden hash values of
+these fixtures for each duplo.HashVersion, and assertion helpers.
+
+Applications can pin duplo's hashing behaviour in their own test suites by
+calling AssertFixtures() with the hash version their stored hashes were
+created with. The test will then fail after a duplo upgrade which changes the
+hashes created from the same images, at which point stored hashes should be
+recreated.
+
+The package also publishes conformance vectors (see ConformanceVector) which
+specify the hashing algorithm exactly, so that implementations in other
+languages can be validated against this one.
+*/
+package duplotest
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/rivo/duplo"
+	"github.com/rivo/duplo/haar"
+)
+
+// goldenPrecision is the maximum absolute difference between golden
+// floating-point values and computed values.
+const goldenPrecision = 1e-6
+
+// round rounds the given value to six decimal places.
+func round(value float64) float64 {
+	return math.Round(value*1e6) / 1e6
+}
+
+// FixtureNames contains the names of all fixture images, in alphabetical
+// order.
+var FixtureNames = []string{"checkerboard", "circles", "gradient", "noise", "portrait", "stripes"}
+
+// Fixture returns the fixture image with the given name. The images are
+// generated deterministically. Each call returns a new image. Nil is returned
+// if there is no fixture with the given name.
+func Fixture(name string) image.Image {
+	switch name {
+	case "checkerboard":
+		return generate(128, 128, func(x, y int) color.RGBA {
+			if (x/16+y/16)%2 == 0 {
+				return color.RGBA{240, 240, 240, 255}
+			}
+			return color.RGBA{20, 20, 120, 255}
+		})
+	case "circles":
+		return generate(160, 160, func(x, y int) color.RGBA {
+			dx, dy := x-80, y-80
+			ring := uint8((dx*dx + dy*dy) / 64 % 256)
+			return color.RGBA{ring, 255 - ring, 128, 255}
+		})
+	case "gradient":
+		return generate(200, 150, func(x, y int) color.RGBA {
+			return color.RGBA{uint8(x * 255 / 199), uint8(y * 255 / 149), 64, 255}
+		})
+	case "noise":
+		state := uint32(1)
+		return generate(100, 100, func(x, y int) color.RGBA {
+			// A linear congruential generator.
+			state = state*1664525 + 1013904223
+			return color.RGBA{uint8(state >> 24), uint8(state >> 16), uint8(state >> 8), 255}
+		})
+	case "portrait":
+		return generate(90, 160, func(x, y int) color.RGBA {
+			if x > 20 && x < 70 && y > 30 && y < 130 {
+				return color.RGBA{200, 150, 110, 255}
+			}
+			return color.RGBA{30, uint8(y), 60, 255}
+		})
+	case "stripes":
+		return generate(128, 96, func(x, y int) color.RGBA {
+			if (x+y)/8%2 == 0 {
+				return color.RGBA{255, 200, 0, 255}
+			}
+			return color.RGBA{0, 100, 200, 255}
+		})
+	}
+	return nil
+}
+
+// generate creates an RGBA image of the given size with the pixel colours
+// returned by the provided function. Pixels are generated row by row.
+func generate(width, height int, pixel func(x, y int) color.RGBA) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, pixel(x, y))
+		}
+	}
+	return img
+}
+
+// GoldenHash contains the parts of a duplo.Hash which are compared against
+// golden values. Floating-point values are rounded to six decimal places.
+type GoldenHash struct {
+	ScaleCoef  haar.Coef
+	Thresholds haar.Coef
+	Ratio      float64
+	DHash      [2]uint64
+	Histogram  uint64
+}
+
+// Golden maps hash versions (see duplo.HashVersion) to the golden hashes of
+// all fixtures (keyed by fixture name).
+var Golden = map[int]map[string]GoldenHash{
+	1: {
+		"checkerboard": {
+			ScaleCoef:  haar.Coef{67.9085, -8.031575, 7.778375},
+			Thresholds: haar.Coef{0, 0, 0},
+			Ratio:      1,
+			DHash:      [2]uint64{0xffffffff, 0x70000007f},
+			Histogram:  0x41800908,
+		},
+		"circles": {
+			ScaleCoef:  haar.Coef{72.667345, -26.847546, -22.502204},
+			Thresholds: haar.Coef{0.126097, 0.382186, 0.3224},
+			Ratio:      1,
+			DHash:      [2]uint64{0x7fffffff, 0xfff00000fff},
+			Histogram:  0xffe1c0,
+		},
+		"gradient": {
+			ScaleCoef:  haar.Coef{59.969614, 10.121039, -9.801968},
+			Thresholds: haar.Coef{0.2935, 0.297858, 0.261296},
+			Ratio:      1.333333,
+			DHash:      [2]uint64{0x3ffffffffffffff, 0xffffff00000001},
+			Histogram:  0xffffff8,
+		},
+		"noise": {
+			ScaleCoef:  haar.Coef{63.752319, -0.288477, -0.023314},
+			Thresholds: haar.Coef{0.545657, 0.637209, 0.542634},
+			Ratio:      1,
+			DHash:      [2]uint64{0x7ffffff, 0x3fff00001fff},
+			Histogram:  0x7ffffe0,
+		},
+		"portrait": {
+			ScaleCoef:  haar.Coef{47.675969, -0.475323, -5.720362},
+			Thresholds: haar.Coef{1.00811, 0.610962, 0.27062},
+			Ratio:      0.5625,
+			DHash:      [2]uint64{0x1ffffff, 0x7ff000000ff},
+			Histogram:  0x7f83ffc,
+		},
+		"stripes": {
+			ScaleCoef:  haar.Coef{68.923414, 1.147362, -10.00485},
+			Thresholds: haar.Coef{1.235838, 2.069927, 0.671372},
+			Ratio:      1.333333,
+			DHash:      [2]uint64{0xfff, 0x1f00000001},
+			Histogram:  0x5d89f36,
+		},
+	},
+}
+
+// Record returns the golden hash values of the given hash.
+func Record(hash duplo.Hash) GoldenHash {
+	roundCoef := func(coef haar.Coef) haar.Coef {
+		for index := range coef {
+			coef[index] = round(coef[index])
+		}
+		return coef
+	}
+	var scaleCoef haar.Coef
+	if len(hash.Coefs) > 0 {
+		scaleCoef = hash.Coefs[0]
+	}
+	return GoldenHash{
+		ScaleCoef:  roundCoef(scaleCoef),
+		Thresholds: roundCoef(hash.Thresholds),
+		Ratio:      round(hash.Ratio),
+		DHash:      hash.DHash,
+		Histogram:  hash.Histogram,
+	}
+}
+
+// Equal returns whether the given hash corresponds to the golden hash.
+func (golden GoldenHash) Equal(hash duplo.Hash) bool {
+	if len(hash.Coefs) == 0 {
+		return false
+	}
+	for index := range golden.ScaleCoef {
+		if math.Abs(golden.ScaleCoef[index]-hash.Coefs[0][index]) > goldenPrecision ||
+			math.Abs(golden.Thresholds[index]-hash.Thresholds[index]) > goldenPrecision {
+			return false
+		}
+	}
+	return math.Abs(golden.Ratio-hash.Ratio) <= goldenPrecision &&
+		golden.DHash == hash.DHash &&
+		golden.Histogram == hash.Histogram
+}
+
+// AssertFixtures hashes all fixture images with duplo.CreateHash() and checks
+// the results against the golden hashes of the given hash version. Errors are
+// reported for every fixture which does not match.
+func AssertFixtures(t testing.TB, hashVersion int) {
+	t.Helper()
+
+	golden, ok := Golden[hashVersion]
+	if !ok {
+		t.Fatalf("No golden hashes for hash version %d", hashVersion)
+	}
+	for _, name := range FixtureNames {
+		hash, _ := duplo.CreateHash(Fixture(name))
+		AssertGolden(t, golden[name], hash)
+	}
+}
+
+// AssertGolden reports an error if the given hash does not correspond to the
+// golden hash.
+func AssertGolden(t testing.TB, golden GoldenHash, hash duplo.Hash) {
+	t.Helper()
+
+	if !golden.Equal(hash) {
+		t.Errorf("Hash differs from golden hash: expected %+v, got %+v", golden, Record(hash))
+	}
+}
+
+// AssertBestMatch sorts the given matches and reports an error if the best
+// match does not have the given ID.
+func AssertBestMatch(t testing.TB, matches duplo.Matches, id interface{}) {
+	t.Helper()
+
+	if len(matches) == 0 {
+		t.Errorf("No matches, expected %v", id)
+		return
+	}
+	sort.Sort(matches)
+	if matches[0].ID != id {
+		t.Errorf("Best match is %v, expected %v", matches[0], id)
+	}
+}
@@ -0,0 +1,114 @@
+package duplotest
+
+import (
+	"flag"
+	"math"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/rivo/duplo"
+	"github.com/rivo/duplo/eval"
+)
+
+// Test the fixtures against the golden hashes of the current hash version.
+func TestFixtures(t *testing.T) {
+	AssertFixtures(t, duplo.HashVersion)
+}
+
+// Test that fixtures are deterministic and distinguishable.
+func TestFixtureMatches(t *testing.T) {
+	store := duplo.New()
+	for _, name := range FixtureNames {
+		hash, _ := duplo.CreateHash(Fixture(name))
+		store.Add(name, hash)
+	}
+	for _, name := range FixtureNames {
+		hash, _ := duplo.CreateHash(Fixture(name))
+		AssertBestMatch(t, store.Query(hash), name)
+	}
+}
+
+// Set this flag to write the conformance vectors of the current hash version.
+var updateConformance = flag.Bool("update-conformance", false, "write the conformance vectors of the current hash version")
+
+// Test the hashes of the conformance vectors of the current hash version.
+func TestConformance(t *testing.T) {
+	if *updateConformance {
+		file, err := os.Create("conformance/v" + strconv.Itoa(duplo.HashVersion) + ".json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if err := WriteConformanceVectors(file); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	AssertConformance(t, duplo.HashVersion)
+
+	// Differences must be detected.
+	vectors, err := ConformanceVectors(duplo.HashVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := duplo.CreateHash(vectors[0].Image())
+	hash.Coefs[len(hash.Coefs)-1][2] += 1e-12
+	if err := Verify(vectors[0], hash); err == nil {
+		t.Error("Modified coefficient was not detected")
+	}
+	if _, err := ConformanceVectors(0); err == nil {
+		t.Error("Expected error for unknown hash version")
+	}
+}
+
+// Test that the weight presets of the sample corpora are the weights
+// calibrated on them and that they rank duplicates better than the default
+// weights.
+func TestWeightPresets(t *testing.T) {
+	for _, name := range CorpusNames {
+		preset, ok := duplo.WeightPresets[name]
+		if !ok {
+			t.Errorf("No weight preset for corpus %s", name)
+			continue
+		}
+		images, groups := Corpus(name)
+		hashes := make([]duplo.Hash, len(images))
+		for index, img := range images {
+			hashes[index], _ = duplo.CreateHash(img)
+		}
+
+		// The preset must be reproducible.
+		var pairs []duplo.LabeledPair
+		for a := range hashes {
+			for b := a + 1; b < len(hashes); b++ {
+				pairs = append(pairs, duplo.LabeledPair{A: hashes[a], B: hashes[b], Duplicate: groups[a] == groups[b]})
+			}
+		}
+		calibrated := duplo.Calibrate(pairs)
+	Compare:
+		for channel := range preset {
+			for bin := range preset[channel] {
+				if math.Abs(preset[channel][bin]-calibrated[channel][bin]) > 0.01 {
+					t.Errorf("Preset %s differs from calibrated weights %.2f", name, calibrated)
+					break Compare
+				}
+			}
+		}
+
+		// The preset must improve the ranking.
+		meanAveragePrecision := func(weights duplo.Weights) float64 {
+			store := duplo.New()
+			store.SetWeights(weights)
+			result, err := eval.EvaluateHashes(store, hashes, groups, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return result.MAP
+		}
+		if defaultMAP, presetMAP := meanAveragePrecision(duplo.DefaultWeights), meanAveragePrecision(preset); presetMAP < 0.55 || presetMAP < defaultMAP+0.2 {
+			t.Errorf("Preset %s has a mAP of %.3f on its corpus, the default weights %.3f", name, presetMAP, defaultMAP)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Package eval loads public near-duplicate image benchmarks and evaluates duplo
+stores against them, so that changes to the hashing or scoring can be
+validated quantitatively. The following directory layouts are supported:
+
+UKBench (https://archive.org/details/ukbench): A flat directory with the files
+"ukbench00000.jpg" to "ukbench10199.jpg", where each group of four consecutive
+images shows the same object.
+
+Copydays (https://thoth.inrialpes.fr/~jegou/data.php.html#copydays): A
+directory tree with files named "NNNNNN.jpg" (six digits), where all images
+with the same number divided by 100 (e.g. 200000.jpg and 200001.jpg) show the
+same scene. Original images and their variants (e.g. in subdirectories for
+JPEG qualities or crops) may be mixed.
+
+A typical evaluation looks like this:
+
+	corpus, err := eval.LoadUKBench("/data/ukbench/full")
+	if err != nil {
+		panic(err)
+	}
+	result, err := corpus.Evaluate(duplo.New(), nil)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("mAP: %.3f, P@4: %.3f\n", result.MAP, result.PrecisionAt[4])
+
+Hashing a corpus is much slower than querying it. When comparing multiple
+store configurations, call Corpus.Hashes() once and EvaluateHashes() for each
+configuration.
+*/
+package eval
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rivo/duplo"
+)
+
+// Image is an image of a benchmark corpus.
+type Image struct {
+	// The path of the image file.
+	Path string
+
+	// The group of the image. All images of the same group are duplicates of
+	// each other.
+	Group int
+}
+
+// Corpus is a benchmark corpus, a list of images sorted by path.
+type Corpus []Image
+
+var (
+	// ukbenchPattern matches UKBench file names.
+	ukbenchPattern = regexp.MustCompile(`^ukbench(\d{5})\.(jpe?g|png)$`)
+
+	// copydaysPattern matches Copydays file names.
+	copydaysPattern = regexp.MustCompile(`^(\d{6})\.(jpe?g|png)$`)
+)
+
+// LoadUKBench loads a corpus with the UKBench layout from the given directory.
+// Files with other names are ignored.
+func LoadUKBench(dir string) (Corpus, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read UKBench directory: %s", err)
+	}
+	var corpus Corpus
+	for _, entry := range entries {
+		match := ukbenchPattern.FindStringSubmatch(strings.ToLower(entry.Name()))
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		number, _ := strconv.Atoi(match[1])
+		corpus = append(corpus, Image{Path: filepath.Join(dir, entry.Name()), Group: number / 4})
+	}
+	return corpus.sorted()
+}
+
+// LoadCopydays loads a corpus with the Copydays layout from the given
+// directory and its subdirectories. Files with other names are ignored.
+func LoadCopydays(dir string) (Corpus, error) {
+	var corpus Corpus
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		match := copydaysPattern.FindStringSubmatch(strings.ToLower(entry.Name()))
+		if entry.IsDir() || match == nil {
+			return nil
+		}
+		number, _ := strconv.Atoi(match[1])
+		corpus = append(corpus, Image{Path: path, Group: number / 100})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read Copydays directory: %s", err)
+	}
+	return corpus.sorted()
+}
+
+// sorted sorts the corpus by path and returns it. An error is returned if it
+// is empty.
+func (corpus Corpus) sorted() (Corpus, error) {
+	if len(corpus) == 0 {
+		return nil, errors.New("No benchmark images found")
+	}
+	sort.Slice(corpus, func(i, j int) bool {
+		return corpus[i].Path < corpus[j].Path
+	})
+	return corpus, nil
+}
+
+// Groups returns the groups of all images, in corpus order.
+func (corpus Corpus) Groups() []int {
+	groups := make([]int, len(corpus))
+	for index, img := range corpus {
+		groups[index] = img.Group
+	}
+	return groups
+}
+
+// Hashes decodes all images of the corpus and returns their hashes, in corpus
+// order.
+func (corpus Corpus) Hashes() ([]duplo.Hash, error) {
+	hashes := make([]duplo.Hash, len(corpus))
+	for index, img := range corpus {
+		var err error
+		hashes[index], _, err = duplo.CreateHashFromFile(img.Path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to hash %s: %s", img.Path, err)
+		}
+	}
+	return hashes, nil
+}
+
+// Evaluate hashes all images of the corpus and evaluates the given store with
+// them (see EvaluateHashes()).
+func (corpus Corpus) Evaluate(store *duplo.Store, ks []int) (*Result, error) {
+	hashes, err := corpus.Hashes()
+	if err != nil {
+		return nil, err
+	}
+	return EvaluateHashes(store, hashes, corpus.Groups(), ks)
+}
@@ -0,0 +1,111 @@
+package eval
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nfnt/resize"
+	"github.com/rivo/duplo"
+	"github.com/rivo/duplo/duplotest"
+)
+
+// variants returns four variants of the given image.
+func variants(img image.Image) []image.Image {
+	bounds := img.Bounds()
+	brighter := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			brighten := func(v uint32) uint8 {
+				if v>>8 > 235 {
+					return 255
+				}
+				return uint8(v>>8) + 20
+			}
+			brighter.Set(x, y, color.RGBA{brighten(r), brighten(g), brighten(b), 255})
+		}
+	}
+	return []image.Image{
+		img,
+		brighter,
+		resize.Resize(uint(bounds.Dx()*3/4), 0, img, resize.Bilinear),
+		resize.Resize(uint(bounds.Dx()*2), 0, img, resize.NearestNeighbor),
+	}
+}
+
+// writeImage writes the image as a PNG file.
+func writeImage(t *testing.T, path string, img image.Image) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test loading and evaluating a UKBench corpus.
+func TestUKBench(t *testing.T) {
+	dir := t.TempDir()
+	number := 0
+	for _, name := range []string{"checkerboard", "circles", "gradient"} {
+		for _, variant := range variants(duplotest.Fixture(name)) {
+			writeImage(t, filepath.Join(dir, fmt.Sprintf("ukbench%05d.png", number)), variant)
+			number++
+		}
+	}
+	writeImage(t, filepath.Join(dir, "other.png"), duplotest.Fixture("noise"))
+
+	corpus, err := LoadUKBench(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corpus) != 12 || corpus[3].Group != 0 || corpus[4].Group != 1 {
+		t.Fatalf("Unexpected corpus: %v", corpus)
+	}
+
+	result, err := corpus.Evaluate(duplo.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Queries != 12 || result.MAP < 0.9 || result.PrecisionAt[1] < 0.9 || result.Recall < 0.9 {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+}
+
+// Test loading a Copydays corpus.
+func TestCopydays(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, filepath.Join(dir, "original", "200000.png"), duplotest.Fixture("circles"))
+	writeImage(t, filepath.Join(dir, "jpeg", "50", "200001.png"), duplotest.Fixture("circles"))
+	writeImage(t, filepath.Join(dir, "original", "200100.png"), duplotest.Fixture("stripes"))
+
+	corpus, err := LoadCopydays(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := make(map[string]int)
+	for _, img := range corpus {
+		groups[filepath.Base(img.Path)] = img.Group
+	}
+	if len(corpus) != 3 || groups["200000.png"] != 2000 || groups["200001.png"] != 2000 || groups["200100.png"] != 2001 {
+		t.Errorf("Unexpected corpus: %v", corpus)
+	}
+
+	result, err := corpus.Evaluate(duplo.New(), []int{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Queries != 2 || result.MAP != 1 || result.PrecisionAt[1] != 1 {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+}
@@ -0,0 +1,110 @@
+package eval
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/rivo/duplo"
+)
+
+// DefaultK contains the cut-off ranks for which the precision is calculated if
+// none are specified.
+var DefaultK = []int{1, 4, 10}
+
+// Result is the result of an evaluation.
+type Result struct {
+	// The number of queries, i.e. images which have at least one duplicate.
+	Queries int
+
+	// MAP is the mean average precision over all queries.
+	MAP float64
+
+	// PrecisionAt maps cut-off ranks k to the mean precision of the first k
+	// results of each query.
+	PrecisionAt map[int]float64
+
+	// Recall is the fraction of all duplicates which were returned by the
+	// queries at all, i.e. which share at least one index bucket with their
+	// query image.
+	Recall float64
+}
+
+// EvaluateHashes adds the given hashes to the store, which must be empty, and
+// queries the store with each hash. The IDs of the images are their indices.
+// The results, excluding the query image itself, are ranked by their score
+// and compared against the given groups (one per hash): Images of the same
+// group are expected to be ranked before all others. Images without
+// duplicates are added to the store but not used as queries. The precision is
+// calculated at each of the given ranks (DefaultK if nil).
+func EvaluateHashes(store *duplo.Store, hashes []duplo.Hash, groups []int, ks []int) (*Result, error) {
+	if len(hashes) != len(groups) {
+		return nil, errors.New("Number of hashes and groups differ")
+	}
+	if store.Size() > 0 {
+		return nil, errors.New("Store is not empty")
+	}
+	if ks == nil {
+		ks = DefaultK
+	}
+
+	// Fill the store.
+	sizes := make(map[int]int)
+	for index, hash := range hashes {
+		store.Add(index, hash)
+		sizes[groups[index]]++
+	}
+
+	// Run the queries.
+	result := &Result{PrecisionAt: make(map[int]float64)}
+	var duplicates, found int
+	for index, hash := range hashes {
+		relevant := sizes[groups[index]] - 1
+		if relevant == 0 {
+			continue
+		}
+		result.Queries++
+		duplicates += relevant
+
+		// Rank the results.
+		matches := store.Query(hash)
+		sort.Sort(matches)
+		var hits int
+		var precisionSum float64
+		precisionAt := make([]int, len(ks))
+		rank := 0
+		for _, match := range matches {
+			if match.ID.(int) == index {
+				continue
+			}
+			rank++
+			if groups[match.ID.(int)] == groups[index] {
+				hits++
+				precisionSum += float64(hits) / float64(rank)
+			}
+			for kIndex, k := range ks {
+				if rank == k {
+					precisionAt[kIndex] = hits
+				}
+			}
+		}
+		for kIndex, k := range ks {
+			if rank < k {
+				precisionAt[kIndex] = hits // Fewer than k results.
+			}
+			result.PrecisionAt[k] += float64(precisionAt[kIndex]) / float64(k)
+		}
+		result.MAP += precisionSum / float64(relevant)
+		found += hits
+	}
+
+	// Average.
+	if result.Queries > 0 {
+		result.MAP /= float64(result.Queries)
+		for k := range result.PrecisionAt {
+			result.PrecisionAt[k] /= float64(result.Queries)
+		}
+		result.Recall = float64(found) / float64(duplicates)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,326 @@
+/*
+Command photodedup finds duplicate images in photo libraries and, if asked to,
+removes them. It is a complete deduplicator built from duplo's components and
+a starting point for custom tools:
+
+	photodedup [flags] directory...
+
+All image files (JPEG, PNG, and GIF) below the given directories are hashed
+(see duplo.HashAll()) and added to a store which is saved in a file (see the
+-store flag), so that subsequent runs only hash new files. Files which no
+longer exist are removed from the store. The store is then searched for
+clusters of duplicates (see duplo.Store.FindAllDuplicates()) and a
+deduplication plan is created (see duplo.Planner) which keeps one image per
+cluster. By default, the plan is only printed (a dry run). With -apply, the
+other images are deleted, or replaced with symbolic links to the kept image if
+-link is also given.
+
+With -report, a JSON report with thumbnails of all clusters is written which
+may be reviewed before the plan is applied.
+*/
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rivo/duplo"
+)
+
+// options are the command line options.
+type options struct {
+	// The directories to scan.
+	dirs []string
+
+	// The file in which the store is kept.
+	storeFile string
+
+	// The score threshold below which images are duplicates.
+	threshold float64
+
+	// The keep policy of the planner.
+	policy duplo.KeepPolicy
+
+	// Whether the plan is applied and whether duplicates are replaced with
+	// links.
+	apply, link bool
+
+	// The file to which a JSON report is written, if any.
+	reportFile string
+
+	// Where progress and the plan are written to.
+	output io.Writer
+}
+
+// extensions are the file extensions of image files, in lower case.
+var extensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true}
+
+func main() {
+	opts := options{output: os.Stdout}
+	var policy string
+	flag.StringVar(&opts.storeFile, "store", "photodedup.store", "the file in which image hashes are kept between runs")
+	flag.Float64Var(&opts.threshold, "threshold", -80, "the score below which two images are duplicates (lower is stricter)")
+	flag.StringVar(&policy, "keep", "largest", `which image of a cluster to keep: "largest" or "earliest"`)
+	flag.BoolVar(&opts.apply, "apply", false, "apply the plan instead of only printing it")
+	flag.BoolVar(&opts.link, "link", false, "replace duplicates with symbolic links instead of deleting them")
+	flag.StringVar(&opts.reportFile, "report", "", "write a JSON report with thumbnails to this file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] directory...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	opts.dirs = flag.Args()
+	switch policy {
+	case "largest":
+		opts.policy = duplo.KeepLargest
+	case "earliest":
+		opts.policy = duplo.KeepEarliest
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown keep policy %q\n", policy)
+		os.Exit(2)
+	}
+	if len(opts.dirs) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run executes the deduplication with the given options.
+func run(opts options) error {
+	// Scan the directories.
+	paths, err := scan(opts.dirs)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(opts.output, "Found %d image files\n", len(paths))
+
+	// Update the store.
+	store, err := loadStore(opts.storeFile)
+	if err != nil {
+		return err
+	}
+	update(store, paths, opts.output)
+	if err := saveStore(store, opts.storeFile); err != nil {
+		return err
+	}
+
+	// Find duplicates.
+	clusters := store.FindAllDuplicates(opts.threshold, func(done, total int) {
+		fmt.Fprintf(opts.output, "\rComparing images: %d/%d", done, total)
+	})
+	fmt.Fprintf(opts.output, "\nFound %d clusters of duplicates\n", len(clusters))
+	for _, cluster := range clusters {
+		// Make the output deterministic.
+		sort.Slice(cluster, func(i, j int) bool { return cluster[i].(string) < cluster[j].(string) })
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i][0].(string) < clusters[j][0].(string) })
+	if opts.reportFile != "" {
+		if err := writeReport(opts.reportFile, clusters); err != nil {
+			return err
+		}
+	}
+
+	// Create the plan.
+	planner := duplo.Planner{
+		Policy: opts.policy,
+		Link:   opts.link,
+		Info:   imageInfo,
+	}
+	steps, err := planner.Plan(clusters)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		if step.Action == duplo.ActionKeep {
+			fmt.Fprintf(opts.output, "%4d %-6s %s\n", step.Cluster, step.Action, step.ID)
+		} else {
+			fmt.Fprintf(opts.output, "%4d %-6s %s (duplicate of %s)\n", step.Cluster, step.Action, step.ID, step.Target)
+		}
+	}
+	if !opts.apply {
+		fmt.Fprintln(opts.output, "Dry run, no files were changed (use -apply to apply the plan)")
+		return nil
+	}
+
+	// Apply the plan.
+	var changed int
+	for _, step := range steps {
+		if step.Action == duplo.ActionKeep {
+			continue
+		}
+		if err := apply(step); err != nil {
+			return err
+		}
+		store.Delete(step.ID)
+		changed++
+	}
+	fmt.Fprintf(opts.output, "Changed %d files\n", changed)
+
+	return saveStore(store, opts.storeFile)
+}
+
+// scan returns the paths of all image files below the given directories, in
+// lexical order. Symbolic links are not followed.
+func scan(dirs []string) ([]string, error) {
+	var paths []string
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.Type().IsRegular() && extensions[strings.ToLower(filepath.Ext(path))] {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to scan %s: %s", dir, err)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// loadStore loads the store from the given file. If the file does not exist,
+// a new store is returned.
+func loadStore(file string) (*duplo.Store, error) {
+	gob.Register("") // IDs are strings.
+	store, err := duplo.LoadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return duplo.New(), nil
+	}
+	return store, err
+}
+
+// saveStore saves the store to the given file if it was modified. The file is
+// replaced atomically.
+func saveStore(store *duplo.Store, file string) error {
+	if !store.Modified() {
+		return nil
+	}
+	return store.SaveFile(file)
+}
+
+// update removes images from the store which are not contained in the given
+// list of paths and hashes and adds those which are not yet in the store.
+// Files which cannot be decoded are reported and skipped.
+func update(store *duplo.Store, paths []string, output io.Writer) {
+	// Remove images which no longer exist.
+	exists := make(map[interface{}]bool, len(paths))
+	for _, path := range paths {
+		exists[path] = true
+	}
+	for _, id := range store.IDs() {
+		if !exists[id] {
+			store.Delete(id)
+		}
+	}
+	store.Compact()
+
+	// Hash new images.
+	jobs := make(chan duplo.ImageJob)
+	go func() {
+		for _, path := range paths {
+			if !store.Has(path) {
+				jobs <- duplo.ImageJob{ID: path, Path: path}
+			}
+		}
+		close(jobs)
+	}()
+	var done int
+	for result := range duplo.HashAll(context.Background(), jobs, 0) {
+		done++
+		if result.Err != nil {
+			fmt.Fprintf(output, "\nSkipping %s: %s\n", result.ID, result.Err)
+			continue
+		}
+		store.Add(result.ID, result.Hash)
+		fmt.Fprintf(output, "\rHashing new images: %d", done)
+	}
+	if done > 0 {
+		fmt.Fprintln(output)
+	}
+}
+
+// imageInfo returns the planner information of the image file with the given
+// path.
+func imageInfo(id interface{}) (duplo.ImageInfo, error) {
+	path := id.(string)
+	file, err := os.Open(path)
+	if err != nil {
+		return duplo.ImageInfo{}, err
+	}
+	defer file.Close()
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return duplo.ImageInfo{}, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return duplo.ImageInfo{}, err
+	}
+	return duplo.ImageInfo{Width: config.Width, Height: config.Height, Time: stat.ModTime()}, nil
+}
+
+// writeReport writes a JSON report with thumbnails of the given clusters to
+// the given file.
+func writeReport(file string, clusters [][]interface{}) error {
+	out, err := os.Create(file)
+	if err != nil {
+		return fmt.Errorf("Unable to create report: %s", err)
+	}
+	defer out.Close()
+	columns := []duplo.ReportColumn{
+		duplo.GroupColumn,
+		duplo.IDColumn,
+		duplo.ThumbnailColumn("thumbnail", 128, func(id interface{}) (image.Image, error) {
+			file, err := os.Open(id.(string))
+			if err != nil {
+				return nil, err
+			}
+			defer file.Close()
+			img, _, err := duplo.DecodeImage(file)
+			return img, err
+		}),
+	}
+	if err := duplo.WriteJSON(out, duplo.ClusterRows(clusters), columns); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// apply executes a step of the plan which removes an image.
+func apply(step duplo.PlanStep) error {
+	path := step.ID.(string)
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("Unable to remove %s: %s", path, err)
+	}
+	if step.Action == duplo.ActionLink {
+		target, err := filepath.Abs(step.Target.(string))
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, path); err != nil {
+			return fmt.Errorf("Unable to link %s to %s: %s", path, target, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rivo/duplo"
+)
+
+// writeImage writes a PNG image of the given size to the given file. The
+// image content only depends on the pattern number, not on the size.
+func writeImage(t *testing.T, path string, width, height, pattern int) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			u, v := x*256/width, y*256/height
+			switch pattern {
+			case 0:
+				img.Set(x, y, color.RGBA{uint8(u), uint8(v), 128, 255})
+			default:
+				if (u/32+v/32)%2 == 0 {
+					img.Set(x, y, color.RGBA{255, 255, 0, 255})
+				} else {
+					img.Set(x, y, color.RGBA{0, 0, 255, 255})
+				}
+			}
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test the deduplication of a small library.
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	library := filepath.Join(dir, "library")
+	original := filepath.Join(library, "a", "original.png")
+	copied := filepath.Join(library, "b", "copy.png")
+	other := filepath.Join(library, "other.png")
+	writeImage(t, original, 200, 150, 0)
+	writeImage(t, copied, 100, 75, 0)
+	writeImage(t, other, 200, 150, 1)
+	if err := os.WriteFile(filepath.Join(library, "notes.txt"), []byte("not an image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	opts := options{
+		dirs:       []string{library},
+		storeFile:  filepath.Join(dir, "store"),
+		threshold:  -80,
+		policy:     duplo.KeepLargest,
+		reportFile: filepath.Join(dir, "report.json"),
+		output:     &output,
+	}
+
+	// Dry run.
+	if err := run(opts); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), "Found 3 image files") ||
+		!strings.Contains(output.String(), "Found 1 clusters") ||
+		!strings.Contains(output.String(), "delete "+copied+" (duplicate of "+original+")") {
+		t.Errorf("Unexpected output:\n%s", output.String())
+	}
+	if _, err := os.Stat(copied); err != nil {
+		t.Error("Dry run removed a file")
+	}
+	report, err := os.ReadFile(opts.reportFile)
+	if err != nil || !strings.Contains(string(report), "data:image/png;base64,") {
+		t.Errorf("Report without thumbnails: %s", report)
+	}
+
+	// Second run uses the saved store and applies the plan.
+	output.Reset()
+	opts.apply, opts.link = true, true
+	if err := run(opts); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output.String(), "Hashing") {
+		t.Errorf("Images were hashed again:\n%s", output.String())
+	}
+	if target, err := os.Readlink(copied); err != nil || target != original && !strings.HasSuffix(target, filepath.Join("a", "original.png")) {
+		t.Errorf("Duplicate was not replaced with a link: %q, %v", target, err)
+	}
+
+	// The link is not considered again.
+	output.Reset()
+	opts.apply = false
+	if err := run(opts); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), "Found 2 image files") || !strings.Contains(output.String(), "Found 0 clusters") {
+		t.Errorf("Unexpected output:\n%s", output.String())
+	}
+}
@@ -0,0 +1,253 @@
+package duplo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SaveFile saves the store to the file at the given path, replacing it
+// atomically: The store is written to a temporary file in the same directory
+// (see WriteTo()) which is synced to disk and then renamed to the final path.
+// If anything fails, the original file remains unchanged. After a successful
+// save, Modified() returns false unless the store was modified during the
+// save.
+func (store *Store) SaveFile(path string) error {
+	_, err := store.saveFile(path)
+	return err
+}
+
+// saveFile implements SaveFile(). It also returns the store generation which
+// was saved.
+func (store *Store) saveFile(path string) (generation uint64, err error) {
+	if err := writeFile(path, func(w io.Writer) (err error) {
+		_, generation, err = store.writeTo(w)
+		return
+	}); err != nil {
+		return 0, err
+	}
+
+	store.Lock()
+	if store.generation == generation {
+		store.modified = false
+	}
+	store.Unlock()
+
+	return generation, nil
+}
+
+// writeFile atomically replaces the file at the given path with the data
+// written by the provided function (see SaveFile()).
+func writeFile(path string, write func(w io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("Unable to create temporary file: %s", err)
+	}
+	defer os.Remove(file.Name()) // Fails after the rename, which is fine.
+
+	// Keep the permissions of an existing file.
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	// Write the data.
+	writer := bufio.NewWriter(file)
+	err = write(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Chmod(mode)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write %s: %s", path, err)
+	}
+
+	// Replace the original file.
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("Unable to replace %s: %s", path, err)
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync() // Persist the rename. Not supported on all platforms.
+		dir.Close()
+	}
+
+	return nil
+}
+
+// LoadFile loads a store saved with Store.SaveFile() from the file at the
+// given path. The store is created with the given options (see New()). As
+// with Store.GobDecode(), the types of the image IDs must be registered with
+// the gob package first. If the file does not exist, the error returned by
+// os.Open() is returned.
+//
+// The file's header and size are checked before the store is decoded, so that
+// files which are truncated or which were created with different values of
+// ImageScale or TopCoefs fail quickly. The checksum of the file is verified
+// while it is decoded (see Store.ReadFrom()).
+func LoadFile(path string, options ...Option) (*Store, error) {
+	file, err := openStoreFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Decode the store.
+	store := New(options...)
+	if _, err := store.ReadFrom(bufio.NewReader(file)); err != nil {
+		return nil, fmt.Errorf("Unable to load %s: %w", path, err)
+	}
+	store.modified = false
+
+	return store, nil
+}
+
+// openStoreFile opens the store file at the given path for reading and checks
+// its header and size (see LoadFile()). Files written by earlier versions of
+// this package, which have no header, are not checked.
+func openStoreFile(path string) (*os.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStoreFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to load %s: %w", path, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to read %s: %s", path, err)
+	}
+	return file, nil
+}
+
+// checkStoreFile checks the header and the size of the given store file.
+func checkStoreFile(file *os.File) error {
+	_, _, err := readStoreHeader(file)
+	if errors.Is(err, errNoStoreHeader) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size() - storeHeaderSize - storeTrailerSize
+	if size < 0 {
+		return errors.New("File is truncated")
+	}
+	var trailer storeTrailer
+	if err := binary.Read(io.NewSectionReader(file, info.Size()-storeTrailerSize, storeTrailerSize), binary.BigEndian, &trailer); err != nil {
+		return err
+	}
+	if trailer.Length != uint64(size) {
+		return errors.New("File size does not match, it is truncated or corrupted")
+	}
+	return nil
+}
+
+// autoSaveCheck is the maximum interval at which AutoSave() checks the number
+// of changes.
+var autoSaveCheck = 100 * time.Millisecond
+
+// autoSaver saves a store periodically (see Store.AutoSave()).
+type autoSaver struct {
+	store      *Store
+	path       string
+	every      time.Duration
+	minChanges int
+
+	// The store generation which was last saved.
+	saved uint64
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// AutoSave starts a goroutine which saves the store to the file at the given
+// path (see SaveFile()) when it has been modified: After the given interval
+// has passed since the last save, or as soon as the store has been modified
+// at least minChanges times since the last save, whichever comes first. If
+// "every" is 0, the store is only saved based on the number of changes. If
+// minChanges is 0, it is only saved at the given interval. If both are 0, the
+// store is only saved when the auto-saver is closed. Each modification of the
+// store (see Generation()) counts as one change. A modification made after
+// the store was unchanged for longer than the interval is saved without
+// waiting for another interval.
+//
+// Call Close() on the returned value to stop saving. If there are unsaved
+// changes at that time, the store is saved one last time and the error of
+// that save is returned. Errors of earlier saves are ignored as these saves
+// are retried until they succeed.
+func (store *Store) AutoSave(path string, every time.Duration, minChanges int) io.Closer {
+	saver := &autoSaver{
+		store:      store,
+		path:       path,
+		every:      every,
+		minChanges: minChanges,
+		saved:      store.Generation(),
+		stop:       make(chan struct{}),
+	}
+	saver.done.Add(1)
+	go saver.run()
+	return saver
+}
+
+// run is the auto-saver's main loop.
+func (saver *autoSaver) run() {
+	defer saver.done.Done()
+
+	check := autoSaveCheck
+	if saver.every > 0 && saver.every < check {
+		check = saver.every
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+	last := time.Now()
+
+	for {
+		select {
+		case <-saver.stop:
+			return
+		case now := <-ticker.C:
+			changes := saver.store.Generation() - saver.saved
+			if changes == 0 {
+				continue
+			}
+			if (saver.every <= 0 || now.Sub(last) < saver.every) && (saver.minChanges <= 0 || changes < uint64(saver.minChanges)) {
+				continue
+			}
+			if generation, err := saver.store.saveFile(saver.path); err == nil {
+				saver.saved = generation
+				last = now
+			}
+		}
+	}
+}
+
+// Close stops the auto-saver and saves the store if it has unsaved changes.
+func (saver *autoSaver) Close() error {
+	close(saver.stop)
+	saver.done.Wait()
+
+	if saver.store.Generation() == saver.saved {
+		return nil
+	}
+	_, err := saver.store.saveFile(saver.path)
+	return err
+}
@@ -0,0 +1,83 @@
+package duplo
+
+import (
+	"time"
+
+	"github.com/rivo/duplo/haar"
+)
+
+// CandidateInfo contains the data which the store keeps about an image (see
+// ForEach()). The bit vectors are described in Hash.
+type CandidateInfo struct {
+	// The scaling function coefficient, the coefficient at index (0,0) of the
+	// Haar matrix.
+	ScaleCoef haar.Coef
+
+	// Image width / image height.
+	Ratio float64
+
+	// The dHash bit vector.
+	DHash [2]uint64
+
+	// The histogram bit vector and the histogram maxima.
+	Histogram uint64
+	HistoMax  [3]float32
+
+	// The quantized histogram counts or nil if they were not retained when
+	// the image was added (see RetainHistogramCounts).
+	HistogramCounts *[64]uint8
+
+	// The Blockhash bit vector.
+	Blockhash [4]uint64
+
+	// The wavelet hash bit vector.
+	WHash uint64
+
+	// The time the image was added to the store.
+	Added time.Time
+
+	// The store generation in which the image was added (see Generation()).
+	Generation uint64
+
+	// Whether the image's hash was created with padding (see Hash.Padded).
+	Padded bool
+}
+
+// ForEach calls the given function for each image contained in the store, in
+// the order of the store's candidate slots, until it returns false. This can
+// be used to export or audit the store's contents or to build secondary
+// indexes.
+//
+// The store is only locked while a snapshot of its state is taken, so the
+// function may modify the store. These modifications are not reflected in the
+// iteration.
+func (store *Store) ForEach(f func(id interface{}, info CandidateInfo) bool) {
+	candidates := store.candidateSnapshot()
+	defer store.releaseSnapshot()
+
+	for index := range candidates {
+		candidate := &candidates[index]
+		if candidate.id == nil {
+			continue
+		}
+		info := CandidateInfo{
+			ScaleCoef:  candidate.scaleCoef,
+			Ratio:      candidate.ratio,
+			DHash:      candidate.dHash,
+			Histogram:  candidate.histogram,
+			HistoMax:   candidate.histoMax,
+			Blockhash:  candidate.blockhash,
+			WHash:      candidate.wHash,
+			Added:      time.Unix(0, candidate.added),
+			Generation: candidate.generation,
+			Padded:     candidate.padded,
+		}
+		if candidate.histogramCounts != nil {
+			counts := *candidate.histogramCounts
+			info.HistogramCounts = &counts
+		}
+		if !f(candidate.id, info) {
+			return
+		}
+	}
+}
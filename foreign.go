@@ -0,0 +1,189 @@
+package duplo
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// The bit vectors of foreign hashes (Blockhash and wHash) are stored such that
+// their hexadecimal representation, as produced by the reference
+// implementations, can be read left to right: The first bit (the top left
+// block of the image) is the most significant bit of the first word.
+
+// ComputeBlockhash computes the 256 bit Blockhash of the given image, as
+// defined by the blockhash.io project (also used by ISCC). The result is
+// identical to that of the reference implementation's "quick" method: The image
+// is divided into 16x16 blocks of equal, whole-pixel size (remaining pixels at
+// the right and bottom edges are ignored) and the sum of the red, green, and
+// blue values of each block's pixels is compared to the median of its
+// horizontal band of four block rows. Blocks equal to the median are set if
+// the median is above half the maximum block value. Fully transparent pixels
+// count as white. Images smaller than 16x16 pixels result in a zero hash.
+func ComputeBlockhash(img image.Image) (bits [4]uint64) {
+	bounds := img.Bounds()
+	blockWidth, blockHeight := bounds.Dx()/16, bounds.Dy()/16
+	if blockWidth == 0 || blockHeight == 0 {
+		return
+	}
+
+	// Sum up the blocks.
+	var blocks [256]float64
+	for row := 0; row < 16; row++ {
+		for column := 0; column < 16; column++ {
+			var sum int
+			for y := 0; y < blockHeight; y++ {
+				for x := 0; x < blockWidth; x++ {
+					pixel := color.NRGBAModel.Convert(img.At(bounds.Min.X+column*blockWidth+x, bounds.Min.Y+row*blockHeight+y)).(color.NRGBA)
+					if pixel.A == 0 {
+						sum += 3 * 255
+					} else {
+						sum += int(pixel.R) + int(pixel.G) + int(pixel.B)
+					}
+				}
+			}
+			blocks[row*16+column] = float64(sum)
+		}
+	}
+
+	// Compare each band against its median.
+	half := float64(blockWidth*blockHeight*256*3) / 2
+	for band := 0; band < 4; band++ {
+		values := blocks[band*64 : band*64+64]
+		m := median(values)
+		for index, value := range values {
+			if value > m || math.Abs(value-m) < 1 && m > half {
+				bits[band] |= 1 << (63 - uint(index))
+			}
+		}
+	}
+
+	return
+}
+
+// ComputeWHash computes the 64 bit wavelet hash (wHash) of the given image,
+// following the whash() function of the ImageHash Python library with its
+// default parameters: The image is converted to 8 bit luminance (using the
+// same formula as the Python Imaging Library) and resized to a square whose
+// side is the largest power of two not exceeding its smaller dimension (but
+// at least 8). The Haar wavelet's lowest band (the mean) is removed and the
+// image is reduced to the 8x8 low-pass band of a Haar wavelet decomposition.
+// Each value of this band is compared to the band's median.
+//
+// The image is resized with DefaultScaler whereas ImageHash uses the Python
+// Imaging Library's Lanczos filter. The two implementations may therefore
+// disagree in a few bits for the same image, mostly for values close to the
+// median. Hashes imported from ImageHash should be compared with a Hamming
+// distance threshold rather than for equality.
+func ComputeWHash(img image.Image) uint64 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return 0
+	}
+
+	// Convert to luminance.
+	gray := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			gray.Pix[y*gray.Stride+x] = uint8(((r>>8)*19595 + (g>>8)*38470 + (b>>8)*7471 + 0x8000) >> 16)
+		}
+	}
+
+	// Resize to a power of two.
+	scale := 8
+	for scale*2 <= width && scale*2 <= height {
+		scale *= 2
+	}
+	resized := DefaultScaler.Resize(uint(scale), uint(scale), gray)
+	resizedBounds := resized.Bounds()
+	pixels := make([]float64, scale*scale)
+	var mean float64
+	for y := 0; y < scale; y++ {
+		for x := 0; x < scale; x++ {
+			r, _, _, _ := resized.At(resizedBounds.Min.X+x, resizedBounds.Min.Y+y).RGBA()
+			pixels[y*scale+x] = float64(r>>8) / 255
+			mean += pixels[y*scale+x]
+		}
+	}
+
+	// The Haar wavelet's lowest band is the image mean. Removing it subtracts
+	// the mean from all pixels. The 8x8 low-pass band is, up to a constant
+	// factor, the block average.
+	mean /= float64(scale * scale)
+	var blocks [64]float64
+	block := scale / 8
+	for y := 0; y < scale; y++ {
+		for x := 0; x < scale; x++ {
+			blocks[y/block*8+x/block] += pixels[y*scale+x] - mean
+		}
+	}
+
+	var bits [1]uint64
+	setBits(bits[:], blocks[:], median(blocks[:]))
+	return bits[0]
+}
+
+// ParseBlockhash parses the hexadecimal representation of a 256 bit Blockhash
+// (64 hexadecimal digits) as produced by blockhash.io implementations.
+func ParseBlockhash(hex string) (bits [4]uint64, err error) {
+	if len(hex) != 64 {
+		return bits, fmt.Errorf("Invalid Blockhash length %d, expected 64 hexadecimal digits", len(hex))
+	}
+	for index := range bits {
+		bits[index], err = strconv.ParseUint(hex[index*16:index*16+16], 16, 64)
+		if err != nil {
+			return bits, fmt.Errorf("Unable to parse Blockhash: %s", err)
+		}
+	}
+	return
+}
+
+// ParseWHash parses the hexadecimal representation of a 64 bit wavelet hash
+// (16 hexadecimal digits) as produced by the ImageHash Python library.
+func ParseWHash(hex string) (uint64, error) {
+	if len(hex) != 16 {
+		return 0, fmt.Errorf("Invalid wHash length %d, expected 16 hexadecimal digits", len(hex))
+	}
+	bits, err := strconv.ParseUint(hex, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse wHash: %s", err)
+	}
+	return bits, nil
+}
+
+// FormatBlockhash returns the hexadecimal representation of a Blockhash.
+func FormatBlockhash(bits [4]uint64) string {
+	return fmt.Sprintf("%016x%016x%016x%016x", bits[0], bits[1], bits[2], bits[3])
+}
+
+// FormatWHash returns the hexadecimal representation of a wavelet hash.
+func FormatWHash(bits uint64) string {
+	return fmt.Sprintf("%016x", bits)
+}
+
+// median returns the median of the given values.
+func median(values []float64) float64 {
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// setBits sets one bit per value which is larger than the threshold, starting
+// with the most significant bit of the first word.
+func setBits(bits []uint64, values []float64, threshold float64) {
+	for index, value := range values {
+		if value > threshold {
+			bits[index/64] |= 1 << (63 - uint(index%64))
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package duplo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"github.com/rivo/duplo/haar"
+)
+
+// ErrFrozen is returned when attempting to modify a FrozenStore.
+var ErrFrozen = errors.New("Store is frozen")
+
+// FrozenStore is an immutable, query-only image store created by
+// Store.Freeze(). Its index buckets are kept in one sorted, densely packed
+// array which is read without decoding. As it cannot be modified, its methods
+// do not need to acquire any locks, making it suitable for serving high query
+// loads. Deleted images are not carried over from the original store. A
+// FrozenStore implements the GobDecoder and GobEncoder interfaces, with a
+// more compact encoding than that of Store.
+type FrozenStore struct {
+	store *Store
+}
+
+// frozenIndex holds the index buckets of a frozen store. The candidate indices
+// of the bucket at location l are entries[offsets[l]:offsets[l+1]], in
+// ascending order.
+type frozenIndex struct {
+	offsets []uint64
+	entries []uint64
+}
+
+// newFrozenIndex returns the index buckets of the given candidates, none of
+// which may be deleted.
+func newFrozenIndex(candidates []candidate) *frozenIndex {
+	index := &frozenIndex{offsets: make([]uint64, 2*ImageScale*ImageScale*haar.ColourChannels+1)}
+
+	// Determine the bucket sizes.
+	for _, candidate := range candidates {
+		for _, location := range candidate.locations {
+			index.offsets[location+1]++
+		}
+	}
+	for location := 1; location < len(index.offsets); location++ {
+		index.offsets[location] += index.offsets[location-1]
+	}
+
+	// Fill the buckets.
+	index.entries = make([]uint64, index.offsets[len(index.offsets)-1])
+	next := append([]uint64(nil), index.offsets...)
+	for i, candidate := range candidates {
+		for _, location := range candidate.locations {
+			index.entries[next[location]] = uint64(i)
+			next[location]++
+		}
+	}
+
+	return index
+}
+
+// bucket returns the candidate indices of the index bucket at the given
+// location. The result must not be modified.
+func (index *frozenIndex) bucket(location int) []uint64 {
+	return index.entries[index.offsets[location]:index.offsets[location+1]:index.offsets[location+1]]
+}
+
+// Freeze returns an immutable copy of the store, optimized for queries. The
+// store itself remains unchanged and may still be modified. This does not
+// affect the returned FrozenStore.
+func (store *Store) Freeze() *FrozenStore {
+	store.RLock()
+	defer store.RUnlock()
+	store.distributing.Lock() // Wait for concurrent Add() calls to finish.
+	defer store.distributing.Unlock()
+
+	frozen := &Store{
+		ids:          make(map[interface{}]uint64, len(store.ids)),
+		weights:      store.weights,
+		weightSums:   store.weightSums,
+		scoreWeights: store.scoreWeights,
+		topCoefs:     store.topCoefs,
+		generation:   store.generation,
+		largeIndex:   store.largeIndex,
+		legacyHashes: store.legacyHashes,
+		negatives:    copyNegatives(store.negatives),
+		suppressed:   copySuppressed(store.suppressed),
+	}
+	frozen.candidates = make([]candidate, 0, len(store.ids))
+	for _, candidate := range store.candidates {
+		if candidate.id != nil {
+			frozen.ids[candidate.id] = uint64(len(frozen.candidates))
+			frozen.candidates = append(frozen.candidates, candidate)
+		}
+	}
+	frozen.frozen = newFrozenIndex(frozen.candidates)
+
+	return &FrozenStore{store: frozen}
+}
+
+// Add returns ErrFrozen as a frozen store cannot be modified.
+func (s *FrozenStore) Add(id interface{}, hash Hash) error {
+	return ErrFrozen
+}
+
+// Has checks if an image (via its ID) is contained in the store.
+func (s *FrozenStore) Has(id interface{}) bool {
+	_, ok := s.store.ids[id]
+	return ok
+}
+
+// IDs returns a list of IDs of all images contained in the store.
+func (s *FrozenStore) IDs() (ids []interface{}) {
+	for id := range s.store.ids {
+		ids = append(ids, id)
+	}
+	return
+}
+
+// Size returns the number of candidate slots in the store, like Store.Size().
+func (s *FrozenStore) Size() int {
+	return len(s.store.candidates)
+}
+
+// Generation returns the generation of the original store at the time it was
+// frozen.
+func (s *FrozenStore) Generation() uint64 {
+	return s.store.generation
+}
+
+// GetHash reconstructs the hash of the image with the given ID. See
+// Store.GetHash() for details.
+func (s *FrozenStore) GetHash(id interface{}) (Hash, bool) {
+	index, ok := s.store.ids[id]
+	if !ok {
+		return Hash{}, false
+	}
+	return s.store.candidateHash(index), true
+}
+
+// Query performs a similarity search on the given image hash. See
+// Store.Query() for details.
+func (s *FrozenStore) Query(hash Hash) Matches {
+	return s.store.query(hash)
+}
+
+// QueryWithOptions performs a similarity search with the given options. See
+// Store.QueryWithOptions() for details.
+func (s *FrozenStore) QueryWithOptions(hash Hash, options *QueryOptions) Matches {
+	return s.store.queryWithOptions(hash, options)
+}
+
+// QueryContext performs a similarity search which is aborted when the given
+// context is done. See Store.QueryContext() for details.
+func (s *FrozenStore) QueryContext(ctx context.Context, hash Hash) (Matches, error) {
+	return s.store.queryContext(ctx, hash, nil)
+}
+
+// QueryID performs a similarity search using the image with the given ID as
+// the query. See Store.QueryID() for details.
+func (s *FrozenStore) QueryID(id interface{}) Matches {
+	return s.store.queryID(id)
+}
+
+// GobEncode places a binary representation of the store in a byte slice. Only
+// the index buckets are stored, delta-encoded, while the candidates' bucket
+// locations are restored from them when decoding.
+func (s *FrozenStore) GobEncode() ([]byte, error) {
+	store := s.store
+	buffer := new(bytes.Buffer)
+	compressor := gzip.NewWriter(buffer)
+	encoder := gob.NewEncoder(compressor)
+
+	// Add a version number first.
+	if err := encoder.Encode(1); err != nil {
+		return nil, fmt.Errorf("Unable to encode frozen store version: %s", err)
+	}
+
+	// Candidates.
+	if err := encoder.Encode(len(store.candidates)); err != nil {
+		return nil, fmt.Errorf("Unable to encode candidate length: %s", err)
+	}
+	for _, candidate := range store.candidates {
+		if err := encoder.Encode(&candidate.id); err != nil {
+			return nil, fmt.Errorf("Unable to encode candidate ID: %s", err)
+		}
+		if err := encoder.Encode(candidate.encodeFields()); err != nil {
+			return nil, fmt.Errorf("Unable to encode candidate record: %s", err)
+		}
+	}
+
+	// Index buckets.
+	buckets := make([][]byte, len(store.frozen.offsets)-1)
+	for location := range buckets {
+		var previous uint64
+		for _, index := range store.frozen.bucket(location) {
+			buckets[location] = binary.AppendUvarint(buckets[location], index-previous)
+			previous = index
+		}
+	}
+	if err := encoder.Encode(buckets); err != nil {
+		return nil, fmt.Errorf("Unable to encode indices: %s", err)
+	}
+
+	// The scoring configuration.
+	if err := encoder.Encode(store.weights); err != nil {
+		return nil, fmt.Errorf("Unable to encode weights: %s", err)
+	}
+	if err := encoder.Encode(store.topCoefs); err != nil {
+		return nil, fmt.Errorf("Unable to encode number of top coefficients: %s", err)
+	}
+	if err := encoder.Encode(store.scoreWeights); err != nil {
+		return nil, fmt.Errorf("Unable to encode score weights: %s", err)
+	}
+
+	// The store generation and the index width.
+	if err := encoder.Encode(store.generation); err != nil {
+		return nil, fmt.Errorf("Unable to encode store generation: %s", err)
+	}
+	if err := encoder.Encode(store.largeIndex); err != nil {
+		return nil, fmt.Errorf("Unable to encode index width: %s", err)
+	}
+
+	// The negative list.
+	if err := encodeNegatives(encoder, store.negatives); err != nil {
+		return nil, fmt.Errorf("Unable to encode negative list: %s", err)
+	}
+
+	// The suppressed images.
+	suppressed := make([]interface{}, 0, len(store.suppressed))
+	for id := range store.suppressed {
+		suppressed = append(suppressed, id)
+	}
+	if err := encoder.Encode(suppressed); err != nil {
+		return nil, fmt.Errorf("Unable to encode suppressed images: %s", err)
+	}
+
+	// Finish up.
+	compressor.Close()
+
+	return buffer.Bytes(), nil
+}
+
+// GobDecode reconstructs the store from a binary representation created with
+// GobEncode(). As with Store.GobDecode(), the types of the image IDs must be
+// registered with the gob package first.
+func (s *FrozenStore) GobDecode(from []byte) error {
+	buffer := bytes.NewReader(from)
+	decompressor, err := gzip.NewReader(buffer)
+	if err != nil {
+		return fmt.Errorf("Unable to open decompressor: %s", err)
+	}
+	defer decompressor.Close()
+	decoder := gob.NewDecoder(decompressor)
+
+	// Do we have a version compatibility problem?
+	var version int
+	if err := decoder.Decode(&version); err != nil {
+		return fmt.Errorf("Unable to decode frozen store version: %s", err)
+	}
+	if version != 1 {
+		return fmt.Errorf("Unknown frozen store version %d", version)
+	}
+
+	// Candidates.
+	store := new(Store)
+	var size int
+	if err := decoder.Decode(&size); err != nil {
+		return fmt.Errorf("Unable to decode candidate length: %s", err)
+	}
+	store.candidates = make([]candidate, size)
+	store.ids = make(map[interface{}]uint64, size)
+	for index := range store.candidates {
+		if err := decoder.Decode(&store.candidates[index].id); err != nil {
+			return fmt.Errorf("Unable to decode candidate ID: %s", err)
+		}
+		var record []byte
+		if err := decoder.Decode(&record); err != nil {
+			return fmt.Errorf("Unable to decode candidate record: %s", err)
+		}
+		if err := store.candidates[index].decodeFields(record); err != nil {
+			return fmt.Errorf("Unable to decode candidate record: %s", err)
+		}
+		store.ids[store.candidates[index].id] = uint64(index)
+	}
+
+	// Index buckets. They also restore the candidates' bucket locations.
+	var buckets [][]byte
+	if err := decoder.Decode(&buckets); err != nil {
+		return fmt.Errorf("Unable to decode indices: %s", err)
+	}
+	if len(buckets) != 2*ImageScale*ImageScale*haar.ColourChannels {
+		return fmt.Errorf("Invalid number of index buckets: %d", len(buckets))
+	}
+	for location, encoded := range buckets {
+		var index uint64
+		for first := true; len(encoded) > 0; first = false {
+			delta, n := binary.Uvarint(encoded)
+			if n <= 0 || delta == 0 && !first || index+delta >= uint64(size) {
+				return fmt.Errorf("Invalid index bucket %d", location)
+			}
+			encoded = encoded[n:]
+			index += delta
+			store.candidates[index].locations = append(store.candidates[index].locations, uint32(location))
+		}
+	}
+	store.frozen = newFrozenIndex(store.candidates)
+
+	// The scoring configuration.
+	var weights Weights
+	if err := decoder.Decode(&weights); err != nil {
+		return fmt.Errorf("Unable to decode weights: %s", err)
+	}
+	store.setWeights(weights)
+	if err := decoder.Decode(&store.topCoefs); err != nil {
+		return fmt.Errorf("Unable to decode number of top coefficients: %s", err)
+	}
+	if err := decoder.Decode(&store.scoreWeights); err != nil {
+		return fmt.Errorf("Unable to decode score weights: %s", err)
+	}
+
+	// The store generation and the index width.
+	if err := decoder.Decode(&store.generation); err != nil {
+		return fmt.Errorf("Unable to decode store generation: %s", err)
+	}
+	if err := decoder.Decode(&store.largeIndex); err != nil {
+		return fmt.Errorf("Unable to decode index width: %s", err)
+	}
+
+	// The negative list.
+	if err := store.decodeNegatives(decoder); err != nil {
+		return fmt.Errorf("Unable to decode negative list: %s", err)
+	}
+
+	// The suppressed images.
+	var suppressed []interface{}
+	if err := decoder.Decode(&suppressed); err != nil {
+		return fmt.Errorf("Unable to decode suppressed images: %s", err)
+	}
+	for _, id := range suppressed {
+		if _, ok := store.ids[id]; ok {
+			store.suppress(id)
+		}
+	}
+
+	s.store = store
+	return nil
+}
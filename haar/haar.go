@@ -7,12 +7,26 @@ import (
 	"image"
 	"image/color"
 	"math"
+	"runtime"
+	"sync"
 )
 
 // ColourChannels is the number of channels for one color. We will be using
 // three colour channels per pixel at all times.
 const ColourChannels = 3
 
+// Parallelism is the maximum number of goroutines which Transform() uses for
+// the row and column passes of the Haar transform. If it is 0 or negative,
+// runtime.GOMAXPROCS(0) is used. Set it to 1 to transform images on the
+// calling goroutine only, e.g. if many images are hashed concurrently
+// anyway. The results do not depend on this value.
+var Parallelism = 0
+
+// ParallelMinSize is the minimum number of pixels an image must have for
+// Transform() to use multiple goroutines. For smaller images, the overhead of
+// starting goroutines outweighs the gain.
+var ParallelMinSize = 64 * 64
+
 // Coef is the union of coefficients for all channels of the original image.
 type Coef [ColourChannels]float64
 
@@ -52,23 +66,159 @@ type Matrix struct {
 	Height uint
 }
 
+// ColorConverter converts 8-bit RGB values (0 to 255) of a pixel into a
+// coefficient in the colour space in which the Haar transform is performed.
+// The first channel should hold the luminance, which has the largest weight
+// in duplo's scoring function.
+type ColorConverter func(r, g, b float64) Coef
+
+// The built-in colour spaces. YIQ is the default, used by Transform().
+var (
+	// YIQ converts into the YIQ colour space used by Jacobs et al., with all
+	// channels divided by 256.
+	YIQ ColorConverter = rgbToCoef
+
+	// YCbCr converts into the YCbCr colour space of JPEG images (ITU-R BT.601
+	// with full range), with all channels divided by 256 and the chrominance
+	// channels centred on 0.
+	YCbCr ColorConverter = rgbToYCbCr
+
+	// Lab converts into the perceptually uniform CIE L*a*b* colour space (D65
+	// white point), treating the RGB values as sRGB. L* is divided by 100 and
+	// a* and b* by 256 so the ranges are similar to those of YIQ.
+	Lab ColorConverter = rgbToLab
+)
+
 // colorToCoef converts a native Color type into a YIQ Coef. We are using
 // YIQ because we only have weights for them. (Apart from the score weights,
 // the store is built to handle different sized Coef's so any length may be
 // returned.)
 func colorToCoef(gen color.Color) Coef {
-	// Convert into YIQ. (We may want to convert from YCbCr directly one day.)
 	r32, g32, b32, _ := gen.RGBA()
-	r, g, b := float64(r32>>8), float64(g32>>8), float64(b32>>8)
+	return rgbToCoef(float64(r32>>8), float64(g32>>8), float64(b32>>8))
+}
+
+// rgbToCoef converts 8-bit RGB values into a YIQ Coef.
+func rgbToCoef(r, g, b float64) Coef {
 	return Coef{
 		(0.299900*r + 0.587000*g + 0.114000*b) / 0x100,
 		(0.595716*r - 0.274453*g - 0.321263*b) / 0x100,
 		(0.211456*r - 0.522591*g + 0.311135*b) / 0x100}
 }
 
+// rgbToYCbCr converts 8-bit RGB values into a YCbCr Coef (see YCbCr).
+func rgbToYCbCr(r, g, b float64) Coef {
+	return Coef{
+		(0.299000*r + 0.587000*g + 0.114000*b) / 0x100,
+		(-0.168736*r - 0.331264*g + 0.500000*b) / 0x100,
+		(0.500000*r - 0.418688*g - 0.081312*b) / 0x100}
+}
+
+// rgbToLab converts 8-bit sRGB values into a CIE L*a*b* Coef (see Lab).
+func rgbToLab(r, g, b float64) Coef {
+	// Linearize sRGB.
+	linear := func(value float64) float64 {
+		value /= 0xff
+		if value <= 0.04045 {
+			return value / 12.92
+		}
+		return math.Pow((value+0.055)/1.055, 2.4)
+	}
+	r, g, b = linear(r), linear(g), linear(b)
+
+	// Convert to XYZ, relative to the D65 white point.
+	x := (0.4124564*r + 0.3575761*g + 0.1804375*b) / 0.95047
+	y := 0.2126729*r + 0.7151522*g + 0.0721750*b
+	z := (0.0193339*r + 0.1191920*g + 0.9503041*b) / 1.08883
+
+	// Convert to L*a*b*.
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return Coef{
+		(116*fy - 16) / 100,
+		500 * (fx - fy) / 0x100,
+		200 * (fy - fz) / 0x100}
+}
+
+// convert fills the given coefficients with the colours of the image's pixels
+// in the given (width x height) rectangle, starting at the image's minimum
+// point, converted with the given converter. Common image types are read
+// directly from their pixel buffers, which is much faster than calling At()
+// for each pixel. For YIQ, the result is the same as calling colorToCoef() for
+// each pixel.
+func convert(img image.Image, coefs []Coef, width, height int, converter ColorConverter) {
+	bounds := img.Bounds()
+	switch img := img.(type) {
+	case *image.RGBA:
+		for row := 0; row < height; row++ {
+			offset := img.PixOffset(bounds.Min.X, bounds.Min.Y+row)
+			for column := 0; column < width; column++ {
+				pix := img.Pix[offset+4*column : offset+4*column+3]
+				coefs[row*width+column] = converter(float64(pix[0]), float64(pix[1]), float64(pix[2]))
+			}
+		}
+	case *image.Gray:
+		for row := 0; row < height; row++ {
+			offset := img.PixOffset(bounds.Min.X, bounds.Min.Y+row)
+			for column := 0; column < width; column++ {
+				y := float64(img.Pix[offset+column])
+				coefs[row*width+column] = converter(y, y, y)
+			}
+		}
+	case *image.YCbCr:
+		for row := 0; row < height; row++ {
+			for column := 0; column < width; column++ {
+				yOffset := img.YOffset(bounds.Min.X+column, bounds.Min.Y+row)
+				cOffset := img.COffset(bounds.Min.X+column, bounds.Min.Y+row)
+				r32, g32, b32, _ := color.YCbCr{Y: img.Y[yOffset], Cb: img.Cb[cOffset], Cr: img.Cr[cOffset]}.RGBA()
+				coefs[row*width+column] = converter(float64(r32>>8), float64(g32>>8), float64(b32>>8))
+			}
+		}
+	default:
+		for row := 0; row < height; row++ {
+			for column := 0; column < width; column++ {
+				r32, g32, b32, _ := img.At(bounds.Min.X+column, bounds.Min.Y+row).RGBA()
+				coefs[row*width+column] = converter(float64(r32>>8), float64(g32>>8), float64(b32>>8))
+			}
+		}
+	}
+}
+
 // Transform performs a forward 2D Haar transform on the provided image after
-// converting it to YIQ space.
+// converting it to YIQ space. Use a Transformer for other colour spaces.
 func Transform(img image.Image) Matrix {
+	var (
+		transformer Transformer
+		matrix      Matrix
+	)
+	transformer.Transform(img, &matrix)
+	return matrix
+}
+
+// Transformer performs Haar transforms like Transform() but reuses its
+// internal buffers and the destination matrix's coefficients across calls.
+// When images of the same size are transformed into the same matrix, and
+// Transform() does not use multiple goroutines (see Parallelism), no memory is
+// allocated. The zero value is ready to use. A Transformer must not be used
+// by multiple goroutines at the same time.
+type Transformer struct {
+	// Converter converts the image's pixels into coefficients before they
+	// are transformed. If it is nil, YIQ is used.
+	Converter ColorConverter
+
+	// Temporary rows and columns, one per goroutine.
+	temp [][]Coef
+}
+
+// Transform performs a forward 2D Haar transform on the provided image after
+// converting it with the transformer's Converter and stores the result in dst. The dst.Coefs
+// slice is reused if it has sufficient capacity.
+func (t *Transformer) Transform(img image.Image, dst *Matrix) {
 	bounds := img.Bounds()
 	width := bounds.Max.X - bounds.Min.X
 	height := bounds.Max.Y - bounds.Min.Y
@@ -80,26 +230,92 @@ func Transform(img image.Image) Matrix {
 		// We can't handle odd heights.
 		height = height &^ 1
 	}
-	matrix := Matrix{
-		Coefs:  make([]Coef, width*height),
-		Width:  uint(width),
-		Height: uint(height)}
+	if cap(dst.Coefs) < width*height {
+		dst.Coefs = make([]Coef, width*height)
+	}
+	dst.Coefs = dst.Coefs[:width*height]
+	dst.Width = uint(width)
+	dst.Height = uint(height)
 
-	// Convert colours to coefficients.
-	for row := bounds.Min.Y; row < bounds.Min.Y+height; row++ {
-		for column := bounds.Min.X; column < bounds.Min.X+width; column++ {
-			matrix.Coefs[(row-bounds.Min.Y)*width+(column-bounds.Min.X)] = colorToCoef(img.At(column, row))
+	// Prepare temporary buffers.
+	workers := workerCount(width * height)
+	if len(t.temp) < workers {
+		t.temp = append(t.temp, make([][]Coef, workers-len(t.temp))...)
+	}
+	size := width
+	if height > size {
+		size = height
+	}
+	for worker := 0; worker < workers; worker++ {
+		if len(t.temp[worker]) < size {
+			t.temp[worker] = make([]Coef, size)
 		}
 	}
 
-	// Apply 1D Haar transform on rows.
-	tempRow := make([]Coef, width)
-	for row := 0; row < height; row++ {
+	// Convert colours to coefficients.
+	converter := t.Converter
+	if converter == nil {
+		converter = YIQ
+	}
+	convert(img, dst.Coefs, width, height, converter)
+
+	// Apply 1D Haar transform on rows, then on columns.
+	if workers == 1 {
+		transformRows(dst.Coefs, width, 0, height, t.temp[0])
+		transformColumns(dst.Coefs, width, height, 0, width, t.temp[0])
+		return
+	}
+	coefs := dst.Coefs
+	parallelize(workers, height, func(worker, start, end int) {
+		transformRows(coefs, width, start, end, t.temp[worker])
+	})
+	parallelize(workers, width, func(worker, start, end int) {
+		transformColumns(coefs, width, height, start, end, t.temp[worker])
+	})
+}
+
+// workerCount returns the number of goroutines to be used for the transform
+// of a matrix of the given size (see Parallelism and ParallelMinSize).
+func workerCount(size int) int {
+	if size < ParallelMinSize {
+		return 1
+	}
+	workers := Parallelism
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// parallelize calls task for consecutive ranges [start, end) which together
+// cover [0, n), using the given number of goroutines. Each goroutine passes
+// its own worker number, starting at 0. The function returns when all ranges
+// have been processed.
+func parallelize(workers, n int, task func(worker, start, end int)) {
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker, start, end int) {
+			defer wg.Done()
+			task(worker, start, end)
+		}(worker, worker*n/workers, (worker+1)*n/workers)
+	}
+	wg.Wait()
+}
+
+// transformRows applies the 1D Haar transform on the rows [start, end) of the
+// given coefficients which form a matrix of the given width. The temporary
+// buffer must hold at least "width" coefficients.
+func transformRows(coefs []Coef, width, start, end int, tempRow []Coef) {
+	for row := start; row < end; row++ {
 		for step := width / 2; step >= 1; step /= 2 {
 			for column := 0; column < step; column++ {
-				high := matrix.Coefs[row*width+2*column]
+				high := coefs[row*width+2*column]
 				low := high
-				offset := matrix.Coefs[row*width+2*column+1]
+				offset := coefs[row*width+2*column+1]
 				high.Add(offset)
 				low.Subtract(offset)
 				high.Divide(math.Sqrt2)
@@ -108,19 +324,22 @@ func Transform(img image.Image) Matrix {
 				tempRow[column+step] = low
 			}
 			for column := 0; column < width; column++ {
-				matrix.Coefs[row*width+column] = tempRow[column]
+				coefs[row*width+column] = tempRow[column]
 			}
 		}
 	}
+}
 
-	// Apply 1D Haar transform on columns.
-	tempColumn := make([]Coef, height)
-	for column := 0; column < width; column++ {
+// transformColumns applies the 1D Haar transform on the columns [start, end)
+// of the given coefficients which form a matrix of the given width and height.
+// The temporary buffer must hold at least "height" coefficients.
+func transformColumns(coefs []Coef, width, height, start, end int, tempColumn []Coef) {
+	for column := start; column < end; column++ {
 		for step := height / 2; step >= 1; step /= 2 {
 			for row := 0; row < step; row++ {
-				high := matrix.Coefs[(2*row)*width+column]
+				high := coefs[(2*row)*width+column]
 				low := high
-				offset := matrix.Coefs[(2*row+1)*width+column]
+				offset := coefs[(2*row+1)*width+column]
 				high.Add(offset)
 				low.Subtract(offset)
 				high.Divide(math.Sqrt2)
@@ -129,10 +348,8 @@ func Transform(img image.Image) Matrix {
 				tempColumn[row+step] = low
 			}
 			for row := 0; row < height; row++ {
-				matrix.Coefs[row*width+column] = tempColumn[row]
+				coefs[row*width+column] = tempColumn[row]
 			}
 		}
 	}
-
-	return matrix
 }
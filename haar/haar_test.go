@@ -81,6 +81,36 @@ func TestColorConversion(t *testing.T) {
 	}
 }
 
+// Test the conversions into the other colour spaces.
+func TestColorConverters(t *testing.T) {
+	if coef := YCbCr(64, 0, 128); !equal(coef, Coef{0.13175, 0.207816, 0.084344}) {
+		t.Errorf("YCbCr conversion failed: %v", coef)
+	}
+
+	// Reference values of sRGB red in CIE L*a*b*: 53.24, 80.09, 67.20.
+	coef := Lab(255, 0, 0)
+	for channel, expected := range []float64{53.24 / 100, 80.09 / 0x100, 67.20 / 0x100} {
+		if math.Abs(coef[channel]-expected) > 0.001 {
+			t.Errorf("Lab conversion failed: %v", coef)
+		}
+	}
+	if coef := Lab(255, 255, 255); math.Abs(coef[0]-1) > 1e-4 || math.Abs(coef[1]) > 1e-4 || math.Abs(coef[2]) > 1e-4 {
+		t.Errorf("White was not converted to L*=100: %v", coef)
+	}
+
+	// The transformer must use the converter.
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	for index := range img.Pix {
+		img.Pix[index] = 0xff
+	}
+	transformer := Transformer{Converter: Lab}
+	var matrix Matrix
+	transformer.Transform(img, &matrix)
+	if math.Abs(matrix.Coefs[0][0]-2) > 1e-4 {
+		t.Errorf("Transformer did not use the converter: %v", matrix.Coefs[0])
+	}
+}
+
 // Essentially a 1D Haar Wavelet test.
 func TestSingleRow(t *testing.T) {
 	// This is a rough approximation to a 4px by 1px YIQ image with pixels
@@ -152,3 +182,124 @@ func TestMatrix4x4(t *testing.T) {
 		t.Errorf("Result not as expected. Result=%v, expected=%v", output, expected)
 	}
 }
+
+// genericImage hides the concrete type of an image so Transform() uses At().
+type genericImage struct {
+	image.Image
+}
+
+// The fast paths for common image types must give the same results as At().
+func TestFastPaths(t *testing.T) {
+	rect := image.Rect(3, 5, 19, 21)
+	rgba := image.NewRGBA(rect)
+	gray := image.NewGray(rect)
+	ycbcr := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			rgba.SetRGBA(x, y, color.RGBA{uint8(x * 13), uint8(y * 7), uint8(x * y), 255})
+			gray.SetGray(x, y, color.Gray{uint8(x*11 + y)})
+			ycbcr.Y[ycbcr.YOffset(x, y)] = uint8(x*17 + y*3)
+			ycbcr.Cb[ycbcr.COffset(x, y)] = uint8(x * 5)
+			ycbcr.Cr[ycbcr.COffset(x, y)] = uint8(255 - y*9)
+		}
+	}
+
+	for _, img := range []image.Image{rgba, gray, ycbcr, rgba.SubImage(image.Rect(5, 7, 13, 15))} {
+		fast, generic := Transform(img), Transform(genericImage{img})
+		for index := range fast.Coefs {
+			if fast.Coefs[index] != generic.Coefs[index] {
+				t.Errorf("%T: coefficient %d differs from generic conversion (%v vs %v)", img, index, fast.Coefs[index], generic.Coefs[index])
+				break
+			}
+		}
+	}
+}
+
+// The parallel transform must give the same results as the serial one.
+func TestParallel(t *testing.T) {
+	defer func(parallelism, minSize int) {
+		Parallelism, ParallelMinSize = parallelism, minSize
+	}(Parallelism, ParallelMinSize)
+
+	img := benchmarkImage(64)
+	Parallelism = 1
+	serial := Transform(img)
+	Parallelism, ParallelMinSize = 4, 0
+	parallel := Transform(img)
+	for index := range serial.Coefs {
+		if serial.Coefs[index] != parallel.Coefs[index] {
+			t.Fatalf("Coefficient %d differs (%v vs %v)", index, parallel.Coefs[index], serial.Coefs[index])
+		}
+	}
+}
+
+// Test that transformers reuse their buffers.
+func TestTransformer(t *testing.T) {
+	defer func(parallelism int) { Parallelism = parallelism }(Parallelism)
+	Parallelism = 1
+
+	var (
+		transformer Transformer
+		matrix      Matrix
+	)
+	small, large := benchmarkImage(16), benchmarkImage(64)
+	transformer.Transform(large, &matrix)
+	transformer.Transform(small, &matrix)
+	if !equalMatrices(matrix, Transform(small)) {
+		t.Error("Transformer result differs from Transform()")
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		transformer.Transform(large, &matrix)
+	})
+	if allocs != 0 {
+		t.Errorf("Transformer allocated memory %.0f times", allocs)
+	}
+	if !equalMatrices(matrix, Transform(large)) {
+		t.Error("Transformer result differs from Transform()")
+	}
+}
+
+// benchmarkImage returns a square image of the given size.
+func benchmarkImage(size int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for index := range img.Pix {
+		img.Pix[index] = uint8(index * 7)
+	}
+	return img
+}
+
+// Benchmark the serial Haar transform at the default duplo.ImageScale.
+func BenchmarkTransformSerial(b *testing.B) {
+	defer func(parallelism int) { Parallelism = parallelism }(Parallelism)
+	Parallelism = 1
+	img := benchmarkImage(128)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		Transform(img)
+	}
+}
+
+// Benchmark the parallel Haar transform at the default duplo.ImageScale.
+func BenchmarkTransformParallel(b *testing.B) {
+	defer func(parallelism int) { Parallelism = parallelism }(Parallelism)
+	Parallelism = 0
+	img := benchmarkImage(128)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		Transform(img)
+	}
+}
+
+// Benchmark a transformer which reuses its buffers.
+func BenchmarkTransformer(b *testing.B) {
+	var (
+		transformer Transformer
+		matrix      Matrix
+	)
+	img := benchmarkImage(128)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		transformer.Transform(img, &matrix)
+	}
+}
@@ -1,16 +1,44 @@
 package duplo
 
 import (
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"math"
 	"math/rand"
 	"sort"
 
-	"github.com/nfnt/resize"
 	"github.com/rivo/duplo/haar"
 )
 
+// HashVersion is the version of the hashing algorithm. It is incremented
+// whenever a change to this package causes CreateHash() to return a different
+// hash for the same image. Hashes of different versions should not be mixed in
+// the same store.
+const HashVersion = 1
+
+// Threshold modes (see ThresholdMode).
+const (
+	// ThresholdsPerChannel selects the TopCoefs largest coefficients for each
+	// colour channel independently.
+	ThresholdsPerChannel = iota
+
+	// ThresholdsJoint selects the 3*TopCoefs largest coefficients across all
+	// colour channels. All channels then share the same threshold.
+	ThresholdsJoint
+)
+
+// ThresholdMode determines how the coefficient thresholds of a hash are
+// computed. With ThresholdsPerChannel (the default), each colour channel keeps
+// its TopCoefs largest coefficients. But the I and Q channels' coefficients
+// are typically tiny so their buckets are often dominated by noise. With
+// ThresholdsJoint, only chroma coefficients which can compete with the
+// luminance coefficients are kept. Hashes created with different modes should
+// not be mixed in one store. Change this only once when the package is
+// initialized.
+var ThresholdMode = ThresholdsPerChannel
+
 // Hash represents the visual hash of an image.
 type Hash struct {
 	haar.Matrix
@@ -37,41 +65,156 @@ type Hash struct {
 	// HistoMax is the maximum value of the histogram (for each channel Y, Cb,
 	// and Cr).
 	HistoMax [3]float32
+
+	// HistogramCounts contains the relative counts of the histogram underlying
+	// the Histogram bit vector (32 bins for Y and 16 bins each for Cb and Cr),
+	// quantized into one byte each (see HistogramMetric). It allows for more
+	// accurate histogram comparisons than the bit vector.
+	HistogramCounts [64]uint8
+
+	// Blockhash is the 256 bit Blockhash of the image (see ComputeBlockhash()).
+	// It is only calculated with WithForeignHashes(). It may also be imported
+	// from other systems with ParseBlockhash().
+	Blockhash [4]uint64
+
+	// WHash is the 64 bit wavelet hash of the image (see ComputeWHash()). It is
+	// only calculated with WithForeignHashes(). It may also be imported from
+	// other systems with ParseWHash().
+	WHash uint64
+
+	// Padded indicates that the image was resized while keeping its aspect
+	// ratio, with padding around it (see WithPadding()), instead of being
+	// stretched. Hashes with different values are never matched.
+	Padded bool
 }
 
 // CreateHash calculates and returns the visual hash of the provided image as
 // well as a resized version of it (ImageScale x ImageScale) which may be
-// ignored if not needed anymore.
+// ignored if not needed anymore. If the image is nil or empty, an empty hash
+// and a nil image are returned. Use CreateHashOpts() to detect such cases and
+// to customize hashing.
 func CreateHash(img image.Image) (Hash, image.Image) {
+	hash, scaled, _ := CreateHashOpts(img)
+	return hash, scaled
+}
+
+// CreateHashOpts calculates and returns the visual hash of the provided image
+// as well as a resized version of it (ImageScale x ImageScale), like
+// CreateHash(), but with the given options applied. An error is returned if
+// the image is nil or has no pixels.
+func CreateHashOpts(img image.Image, options ...HashOption) (Hash, image.Image, error) {
+	config := hashConfig{scaler: DefaultScaler}
+	for _, option := range options {
+		option(&config)
+	}
+	if img == nil {
+		return Hash{}, nil, errors.New("Unable to hash nil image")
+	}
+	var mask image.Image
+	if config.mask != nil {
+		var ok bool
+		img, mask, ok = applyMask(img, config.mask)
+		if !ok {
+			return Hash{}, nil, errors.New("Unable to hash image without unmasked pixels")
+		}
+		mask = orient(mask, config.orientation)
+	}
+	img = orient(img, config.orientation)
+	if config.trimBorders {
+		img = TrimBorders(img, config.trimTolerance)
+	}
+	for _, preprocessor := range config.preprocessors {
+		img = preprocessor.Preprocess(img)
+		if img == nil {
+			return Hash{}, nil, errors.New("Preprocessor returned no image")
+		}
+	}
+
 	// Determine image ratio.
 	bounds := img.Bounds()
 	width := bounds.Max.X - bounds.Min.X
 	height := bounds.Max.Y - bounds.Min.Y
-	var ratio float64
-	if height > 0 {
-		ratio = float64(width) / float64(height)
+	if width <= 0 || height <= 0 {
+		return Hash{}, nil, fmt.Errorf("Unable to hash empty image (%dx%d)", width, height)
 	}
+	ratio := float64(width) / float64(height)
 
 	// Resize the image for the Wavelet transform.
-	scaled := resize.Resize(ImageScale, ImageScale, img, resize.Bicubic)
+	scaledWidth, scaledHeight := ImageScale, ImageScale
+	if config.padding {
+		scaledWidth, scaledHeight = paddedSize(ratio)
+	}
+	var scaled image.Image
+	if config.linearLight {
+		scaled = linearToSRGB(config.scaler.Resize(uint(scaledWidth), uint(scaledHeight), sRGBToLinear(img)))
+	} else {
+		scaled = config.scaler.Resize(uint(scaledWidth), uint(scaledHeight), img)
+	}
+	if mask != nil {
+		mask = config.scaler.Resize(uint(scaledWidth), uint(scaledHeight), mask)
+	}
+	if config.padding {
+		scaled = letterbox(scaled, nil)
+		if mask != nil {
+			mask = letterbox(mask, color.Transparent) // Exclude the padding.
+		}
+	}
+	if config.captionTop > 0 || config.captionBottom > 0 {
+		scaled = maskRows(scaled, config.captionTop, config.captionBottom)
+	}
+	if config.preBlur > 0 {
+		scaled = gaussianBlur(scaled, config.preBlur)
+	}
 
 	// Then perform a 2D Haar Wavelet transform.
-	matrix := haar.Transform(scaled)
+	transformer := haar.Transformer{Converter: config.colorConverter}
+	if config.linearLight {
+		transformer.Converter = linearConverter(config.colorConverter)
+	}
+	var matrix haar.Matrix
+	transformer.Transform(scaled, &matrix)
 
 	// Find the kth largest coefficients for each colour channel.
-	thresholds := coefThresholds(matrix.Coefs, TopCoefs)
+	thresholds := hashThresholds(matrix.Coefs, TopCoefs)
 
-	// Create the dHash bit vector.
-	d := dHash(img)
+	hash := Hash{
+		Matrix: haar.Matrix{
+			Coefs:  matrix.Coefs,
+			Width:  ImageScale,
+			Height: ImageScale,
+		},
+		Thresholds: thresholds,
+		Ratio:      ratio,
+		Padded:     config.padding,
+	}
+
+	// Create the dHash bit vector. Like the histogram, it is derived from the
+	// scaled image so the original is only resampled once.
+	if !config.skipDHash {
+		hash.DHash = dHash(scaled, config.scaler, mask)
+	}
 
 	// Create histogram bit vector.
-	h, hm := histogram(img)
+	if !config.skipHistogram {
+		hash.Histogram, hash.HistoMax, hash.HistogramCounts = histogram(scaled, mask)
+	}
+
+	// Create the foreign hashes.
+	if config.foreignHashes {
+		hash.Blockhash = ComputeBlockhash(img)
+		hash.WHash = ComputeWHash(img)
+	}
+
+	return hash, scaled, nil
+}
 
-	return Hash{haar.Matrix{
-		Coefs:  matrix.Coefs,
-		Width:  ImageScale,
-		Height: ImageScale,
-	}, thresholds, ratio, d, h, hm}, scaled
+// hashThresholds returns the thresholds for the given coefficients such that
+// k coefficients per colour channel are retained, according to ThresholdMode.
+func hashThresholds(coefs []haar.Coef, k int) haar.Coef {
+	if ThresholdMode == ThresholdsJoint {
+		return jointCoefThresholds(coefs, k)
+	}
+	return coefThresholds(coefs, k)
 }
 
 // coefThreshold returns, for the given coefficients, the kth largest absolute
@@ -119,6 +262,33 @@ func coefThresholds(coefs []haar.Coef, k int) haar.Coef {
 	return thresholds
 }
 
+// jointCoefThresholds returns, for the given coefficients, the
+// (k*haar.ColourChannels)th largest absolute value across all colour channels,
+// as the threshold for each channel.
+func jointCoefThresholds(coefs []haar.Coef, k int) haar.Coef {
+	// No data, no thresholds.
+	if len(coefs) == 0 {
+		return haar.Coef{}
+	}
+
+	// Put all values into the first channel.
+	values := make([]haar.Coef, 0, len(coefs)*haar.ColourChannels)
+	for _, coef := range coefs {
+		for _, value := range coef {
+			values = append(values, haar.Coef{value})
+		}
+	}
+
+	// Select thresholds.
+	threshold := coefThreshold(values, k*haar.ColourChannels, 0)
+	var thresholds haar.Coef
+	for index := range thresholds {
+		thresholds[index] = threshold
+	}
+
+	return thresholds
+}
+
 // ycbcr returns the YCbCr values for the given colour, converting to them if
 // necessary.
 func ycbcr(colour color.Color) (y, cb, cr uint8) {
@@ -136,10 +306,16 @@ func ycbcr(colour color.Color) (y, cb, cr uint8) {
 // channel. A bit is set to 1 if a pixel value is higher than that of its left
 // neighbour (the first bit is 1 if its colour value is > 0.5). The other two 32
 // bits correspond to the Cb and Cr colour channels, based on a 8x4 version
-// each.
-func dHash(img image.Image) (bits [2]uint64) {
-	// Resize the image to 9x8.
-	scaled := resize.Resize(8, 8, img, resize.Bicubic)
+// each. If a mask is provided (of the same size as img), bits involving
+// pixels which are mostly masked out remain 0.
+func dHash(img image.Image, scaler Scaler, mask image.Image) (bits [2]uint64) {
+	// Resize the image to 8x8.
+	scaled := scaler.Resize(8, 8, img)
+	masked := func(x, y int) bool { return false }
+	if mask != nil {
+		scaledMask := scaler.Resize(8, 8, mask)
+		masked = func(x, y int) bool { return !unmasked(scaledMask.At(x, y)) }
+	}
 
 	// Scan it.
 	yPos := uint(0)
@@ -148,13 +324,15 @@ func dHash(img image.Image) (bits [2]uint64) {
 	for y := 0; y < 8; y++ {
 		for x := 0; x < 8; x++ {
 			yTR, cbTR, crTR := ycbcr(scaled.At(x, y))
+			skipY := masked(x, y) || x > 0 && masked(x-1, y)
+			skipC := skipY || masked(x, y+1) || x > 0 && masked(x-1, y+1)
 			if x == 0 {
 				// The first bit is a rough approximation of the colour value.
-				if yTR&0x80 > 0 {
+				if !skipY && yTR&0x80 > 0 {
 					bits[0] |= 1 << yPos
 					yPos++
 				}
-				if y&1 == 0 {
+				if y&1 == 0 && !skipC {
 					_, cbBR, crBR := ycbcr(scaled.At(x, y+1))
 					if (cbBR+cbTR)>>1&0x80 > 0 {
 						bits[1] |= 1 << cbPos
@@ -168,11 +346,11 @@ func dHash(img image.Image) (bits [2]uint64) {
 			} else {
 				// Use a rough first derivative for the other bits.
 				yTL, cbTL, crTL := ycbcr(scaled.At(x-1, y))
-				if yTR > yTL {
+				if !skipY && yTR > yTL {
 					bits[0] |= 1 << yPos
 					yPos++
 				}
-				if y&1 == 0 {
+				if y&1 == 0 && !skipC {
 					_, cbBR, crBR := ycbcr(scaled.At(x, y+1))
 					_, cbBL, crBL := ycbcr(scaled.At(x-1, y+1))
 					if (cbBR+cbTR)>>1 > (cbBL+cbTL)>>1 {
@@ -194,14 +372,25 @@ func dHash(img image.Image) (bits [2]uint64) {
 // histogram calculates a histogram based on the YCbCr values of img and returns
 // a rough approximation of it in 64 bits. For each colour channel, a bit is
 // set if a histogram value is greater than the median. The Y channel gets 32
-// bits, the Cb and Cr values each get 16 bits.
-func histogram(img image.Image) (bits uint64, histoMax [3]float32) {
+// bits, the Cb and Cr values each get 16 bits. The quantized histogram counts
+// are also returned (see Hash.HistogramCounts). If a mask is provided (of the
+// same size as img), pixels which are mostly masked out are not counted.
+func histogram(img image.Image, mask image.Image) (bits uint64, histoMax [3]float32, counts [64]uint8) {
 	h := new([64]int)
 
 	// Create histogram.
 	bounds := img.Bounds()
+	var maskOffset image.Point
+	if mask != nil {
+		maskOffset = mask.Bounds().Min.Sub(bounds.Min)
+	}
+	var total int
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if mask != nil && !unmasked(mask.At(x+maskOffset.X, y+maskOffset.Y)) {
+				continue
+			}
+			total++
 			y, cb, cr := ycbcr(img.At(x, y))
 			h[y>>3]++
 			h[32+cb>>4]++
@@ -209,13 +398,16 @@ func histogram(img image.Image) (bits uint64, histoMax [3]float32) {
 		}
 	}
 
+	if total == 0 {
+		return
+	}
+
 	// Calculate medians and maximums.
 	median := func(v []int) (int, float32) {
 		sorted := make([]int, len(v))
 		copy(sorted, v)
 		sort.Ints(sorted)
-		return sorted[len(v)/2], float32(sorted[len(v)-1]) /
-			float32((bounds.Max.X-bounds.Min.X)*(bounds.Max.Y-bounds.Min.Y))
+		return sorted[len(v)/2], float32(sorted[len(v)-1]) / float32(total)
 	}
 	my, yMax := median(h[:32])
 	mcb, cbMax := median(h[32:48])
@@ -223,6 +415,9 @@ func histogram(img image.Image) (bits uint64, histoMax [3]float32) {
 	histoMax[0] = yMax
 	histoMax[1] = cbMax
 	histoMax[2] = crMax
+	for index, value := range h {
+		counts[index] = quantizeHistogramCount(float64(value) / float64(total))
+	}
 
 	// Quantize histogram.
 	for index, value := range h {
@@ -0,0 +1,103 @@
+package duplo
+
+import (
+	"context"
+	"image"
+	"runtime"
+	"sync"
+)
+
+// ImageJob is an image to be hashed by HashAll().
+type ImageJob struct {
+	// The ID of the image. It is passed on to the result.
+	ID interface{}
+
+	// The image to be hashed. If it is nil, the image is decoded from the file
+	// at Path (see CreateHashFromFile()).
+	Image image.Image
+
+	// The path of the image file, if Image is nil.
+	Path string
+}
+
+// HashResult is the result of hashing an image with HashAll().
+type HashResult struct {
+	// The ID of the image, as provided in the job.
+	ID interface{}
+
+	// The image's hash.
+	Hash Hash
+
+	// Err is not nil if the image could not be decoded or hashed.
+	Err error
+}
+
+// HashAll hashes the images received from the given channel concurrently,
+// using the given number of worker goroutines (GOMAXPROCS if workers is
+// smaller than 1), and sends the results to the returned channel. Results are
+// sent in the order in which they are completed, which may differ from the
+// order of the jobs. The returned channel is closed after the jobs channel was
+// closed and all jobs were processed, or when the context is done. In the
+// latter case, some jobs may remain unprocessed. The hash options are applied
+// to all images (see CreateHashOpts()). A typical use is:
+//
+//	jobs := make(chan duplo.ImageJob)
+//	go func() {
+//		for _, path := range paths {
+//			jobs <- duplo.ImageJob{ID: path, Path: path}
+//		}
+//		close(jobs)
+//	}()
+//	for result := range duplo.HashAll(ctx, jobs, 0) {
+//		if result.Err == nil {
+//			store.Add(result.ID, result.Hash)
+//		}
+//	}
+func HashAll(ctx context.Context, jobs <-chan ImageJob, workers int, options ...HashOption) <-chan HashResult {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	results := make(chan HashResult, workers)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var (
+					job ImageJob
+					ok  bool
+				)
+				select {
+				case <-ctx.Done():
+					return
+				case job, ok = <-jobs:
+					if !ok {
+						return
+					}
+				}
+
+				result := HashResult{ID: job.ID}
+				if job.Image != nil {
+					result.Hash, _, result.Err = CreateHashOpts(job.Image, options...)
+				} else {
+					result.Hash, _, result.Err = CreateHashFromFile(job.Path, options...)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case results <- result:
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
@@ -0,0 +1,124 @@
+package duplo
+
+import (
+	"image"
+
+	"github.com/nfnt/resize"
+	"github.com/rivo/duplo/haar"
+)
+
+// hashConfig contains the configuration of CreateHashOpts().
+type hashConfig struct {
+	skipDHash      bool
+	skipHistogram  bool
+	foreignHashes  bool
+	scaler         Scaler
+	colorConverter haar.ColorConverter
+	linearLight    bool
+	orientation    int
+	trimBorders    bool
+	trimTolerance  float64
+	preprocessors  []Preprocessor
+	preBlur        float64
+	captionTop     float64
+	captionBottom  float64
+	mask           image.Image
+	padding        bool
+}
+
+// HashOption is an option for CreateHashOpts().
+type HashOption func(config *hashConfig)
+
+// SkipDHash causes the dHash bit vector not to be calculated. It will be
+// zero in the resulting hash.
+func SkipDHash() HashOption {
+	return func(config *hashConfig) {
+		config.skipDHash = true
+	}
+}
+
+// SkipHistogram causes the histogram not to be calculated. The Histogram,
+// HistoMax, and HistogramCounts fields will be zero in the resulting hash.
+func SkipHistogram() HashOption {
+	return func(config *hashConfig) {
+		config.skipHistogram = true
+	}
+}
+
+// WithForeignHashes causes the Blockhash and the wavelet hash to be calculated
+// (see ComputeBlockhash() and ComputeWHash()). They are computed from the
+// original image, not the scaled one, and therefore add noticeably to the
+// hashing time of large images. By default, they are zero in the resulting
+// hash.
+func WithForeignHashes() HashOption {
+	return func(config *hashConfig) {
+		config.foreignHashes = true
+	}
+}
+
+// SkipForeignHashes causes the Blockhash and the wavelet hash not to be
+// calculated, undoing a previous WithForeignHashes(). They will be zero in the
+// resulting hash. This is the default.
+func SkipForeignHashes() HashOption {
+	return func(config *hashConfig) {
+		config.foreignHashes = false
+	}
+}
+
+// WithScaler sets the scaler used to resize the image before it is hashed.
+// The default is DefaultScaler. Hashes created with different scalers should
+// not be mixed in the same store.
+func WithScaler(scaler Scaler) HashOption {
+	return func(config *hashConfig) {
+		config.scaler = scaler
+	}
+}
+
+// WithColorSpace sets the colour space in which the Haar transform is
+// performed, e.g. haar.Lab which improves the matching of duplicates whose
+// brightness was changed. The default is haar.YIQ. Hashes created in different
+// colour spaces must not be mixed in the same store, and the store's weights
+// should match the colour space (see WeightsYCbCr and WeightsLab).
+func WithColorSpace(converter haar.ColorConverter) HashOption {
+	return func(config *hashConfig) {
+		config.colorConverter = converter
+	}
+}
+
+// WithLinearLight causes the image to be processed in linear light: Its
+// sRGB values are linearized before it is resized, so that the resizing
+// averages light intensities instead of gamma-encoded values, and the Haar
+// transform is applied to the linearized values. This makes hashes more
+// robust against exposure changes between duplicates but hashing becomes
+// slower. The resized image returned by CreateHashOpts(), from which the dHash
+// and the histogram are calculated, is converted back to sRGB. Hashes created
+// with and without this option must not be mixed in the same store.
+func WithLinearLight() HashOption {
+	return func(config *hashConfig) {
+		config.linearLight = true
+	}
+}
+
+// WithPreBlur applies a Gaussian blur with the given standard deviation (in
+// pixels of the resized ImageScale x ImageScale image) before the Haar
+// transform, the dHash, and the histogram are calculated. This suppresses the
+// high-frequency noise of heavily recompressed or resized copies which
+// otherwise perturbs the top coefficients, improving the recall of
+// low-quality duplicates. As the image has already been resized, the blur is
+// cheap. Values around 1 are a good start. The resized image returned by
+// CreateHashOpts() is blurred, too. Hashes created with different values
+// should not be mixed in the same store.
+func WithPreBlur(sigma float64) HashOption {
+	return func(config *hashConfig) {
+		config.preBlur = sigma
+	}
+}
+
+// WithInterpolation sets the interpolation function of the nfnt/resize
+// package used to resize the image before it is hashed. It is the same as
+// WithScaler(NfntScaler{interpolation}).
+//
+// Deprecated: Use WithScaler() instead.
+func WithInterpolation(interpolation resize.InterpolationFunction) HashOption {
+	return WithScaler(NfntScaler{Interpolation: interpolation})
+}
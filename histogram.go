@@ -0,0 +1,111 @@
+package duplo
+
+import (
+	"math"
+)
+
+// RetainHistogramCounts determines whether stores keep the histogram counts
+// of added images (see Hash.HistogramCounts), at a cost of 64 bytes per
+// image. They are needed for histogram metrics other than HistogramHamming.
+// Change this only once when the package is initialized.
+var RetainHistogramCounts = false
+
+// HistogramMetric determines how the colour histograms of two images are
+// compared.
+type HistogramMetric int
+
+// The available histogram metrics.
+const (
+	// HistogramHamming uses the hamming distance between the histogram bit
+	// vectors, divided by 64.
+	HistogramHamming HistogramMetric = iota
+
+	// HistogramIntersection uses 1 minus the histogram intersection, i.e. the
+	// sum of the minimum relative counts of each bin, averaged over all colour
+	// channels.
+	HistogramIntersection
+
+	// HistogramChiSquare uses the symmetric chi-square distance between the
+	// relative counts, averaged over all colour channels.
+	HistogramChiSquare
+)
+
+// histogramChannels contains the first bin and the number of bins of each
+// colour channel in the histogram counts.
+var histogramChannels = [3][2]int{{0, 32}, {32, 16}, {48, 16}}
+
+// quantizeHistogramCount quantizes a relative histogram count (between 0 and
+// 1) into one byte. A square root companding is used so that the small counts
+// which make up most of a histogram retain some precision.
+func quantizeHistogramCount(fraction float64) uint8 {
+	if !(fraction > 0) {
+		return 0
+	}
+	if fraction >= 1 {
+		return 255
+	}
+	return uint8(math.Round(255 * math.Sqrt(fraction)))
+}
+
+// dequantizeHistogramCount is the inverse of quantizeHistogramCount().
+func dequantizeHistogramCount(quantized uint8) float64 {
+	value := float64(quantized) / 255
+	return value * value
+}
+
+// histogramDistance returns the distance between two quantized histograms,
+// between 0 (identical) and 1, according to the given metric. Metrics other
+// than HistogramHamming are only supported if both count slices are non-nil,
+// otherwise the Hamming distance between the given bit vectors is used.
+func histogramDistance(metric HistogramMetric, bitsA, bitsB uint64, countsA, countsB *[64]uint8) float64 {
+	if metric == HistogramHamming || countsA == nil || countsB == nil {
+		return float64(HammingDistance(bitsA, bitsB)) / 64
+	}
+
+	var distance float64
+	for _, channel := range histogramChannels {
+		// Quantization errors are compensated by normalizing the counts.
+		var sumA, sumB float64
+		for bin := channel[0]; bin < channel[0]+channel[1]; bin++ {
+			sumA += dequantizeHistogramCount(countsA[bin])
+			sumB += dequantizeHistogramCount(countsB[bin])
+		}
+		if sumA == 0 || sumB == 0 {
+			distance++
+			continue
+		}
+
+		var channelDistance float64
+		for bin := channel[0]; bin < channel[0]+channel[1]; bin++ {
+			a, b := dequantizeHistogramCount(countsA[bin])/sumA, dequantizeHistogramCount(countsB[bin])/sumB
+			switch metric {
+			case HistogramIntersection:
+				channelDistance += math.Min(a, b)
+			case HistogramChiSquare:
+				if a+b > 0 {
+					channelDistance += (a - b) * (a - b) / (a + b)
+				}
+			}
+		}
+		if metric == HistogramIntersection {
+			channelDistance = 1 - channelDistance
+		} else {
+			channelDistance /= 2
+		}
+		distance += clamp(channelDistance)
+	}
+
+	return distance / float64(len(histogramChannels))
+}
+
+// hashHistogramCounts returns a copy of the hash's histogram counts or nil if
+// the hash has none (e.g. because it was decoded from an older format).
+func hashHistogramCounts(hash Hash) *[64]uint8 {
+	for _, count := range hash.HistogramCounts {
+		if count > 0 {
+			counts := hash.HistogramCounts
+			return &counts
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package duplo
+
+import (
+	"math"
+)
+
+// Hit is a lightweight result of a similarity query. It only contains the
+// store-internal index of the matched image and its score. Use Store.Hydrate()
+// to turn hits into full matches.
+type Hit struct {
+	// Index is the store-internal index of the matched image. It is only valid
+	// for the store that produced it and only until that store is modified.
+	Index uint64
+
+	// The Haar score calculated during the similarity query (see
+	// Match.HaarScore). The lower, the better the match.
+	Score float64
+}
+
+// QueryHits performs the same similarity search as Query() but returns
+// lightweight results. This avoids resolving IDs and calculating the
+// additional metrics for matches which may be discarded anyway, e.g. because
+// their score is too high. Like with Query(), suppressed images, images on the
+// negative list of the hash (see MarkFalsePositive()), and images hashed in a
+// different padding mode (see Hash.Padded) are not returned. The returned
+// slice is not sorted.
+func (store *Store) QueryHits(hash Hash) []Hit {
+	store.RLock()
+	defer store.RUnlock()
+
+	scores, numMatches := store.scores(hash)
+	negatives := store.negatives[keyOf(hash)]
+	hits := make([]Hit, 0, numMatches)
+	for index, score := range scores {
+		if !math.IsNaN(score) && !store.excludes(&store.candidates[index], hash, negatives) {
+			hits = append(hits, Hit{Index: uint64(index), Score: score})
+		}
+	}
+
+	return hits
+}
+
+// Hydrate turns the given hits, which resulted from a call to QueryHits() with
+// the same hash, into full matches. Hits whose images have been removed from
+// the store in the meantime are skipped. Note that a hit whose image was
+// removed may resolve to an image added later, as Add() reuses the slots of
+// deleted images. Hits which QueryHits() would not return (anymore), e.g.
+// because their images were suppressed in the meantime, are skipped, too. The
+// matches are returned in the order of the hits.
+func (store *Store) Hydrate(hash Hash, hits []Hit) Matches {
+	store.RLock()
+	defer store.RUnlock()
+
+	matches := make(Matches, 0, len(hits))
+	bestScore := store.bestScore(hash)
+	negatives := store.negatives[keyOf(hash)]
+	for _, hit := range hits {
+		if int(hit.Index) >= len(store.candidates) || store.candidates[hit.Index].id == nil || store.excludes(&store.candidates[hit.Index], hash, negatives) {
+			continue
+		}
+		matches = append(matches, store.match(hit.Index, hit.Score, hash, bestScore))
+	}
+
+	return matches
+}
@@ -0,0 +1,68 @@
+package duplo
+
+import (
+	"unique"
+)
+
+// WithIDInterning reduces the memory held by string IDs, e.g. file paths. IDs
+// are then replaced by their canonical copies from a process-wide table of
+// strings (see the standard library's "unique" package), so that equal IDs
+// share their memory: Within the store, the IDs of the negative list (see
+// MarkFalsePositive()) and of the suppressed images (see Suppress()) share
+// their memory with the IDs of the images, including when they are decoded
+// from a serialized store, where they are otherwise held as separate copies.
+// And stores with interned IDs share the memory of their equal IDs, e.g. the
+// shards of a ShardedStore or stores loaded from the same file. Canonical
+// copies do not keep larger strings they were sliced from (e.g. the contents
+// of a file listing) from being garbage collected.
+//
+// The table entry of an ID and the store's reference to it, which is released
+// when the ID is removed from the store, take about 200 bytes per string ID.
+// Interning therefore only saves memory for long IDs, mainly when equal IDs
+// are held by more than one store, or when the IDs are sliced from larger
+// strings.
+//
+// The option does not change the serialization format and is not kept when
+// the store is serialized.
+func WithIDInterning() Option {
+	return func(store *Store) {
+		store.internIDs = true
+	}
+}
+
+// internID returns the value under which the given ID is to be kept by the
+// store. If ID interning is enabled (see WithIDInterning()), this is the
+// canonical copy of the ID if it is a string, which is then referenced by the
+// store until releaseID() is called for it, or the ID of the image with an
+// equal ID, if the store contains one. Otherwise, the ID is returned
+// unchanged. The store must be write-locked when calling this function.
+func (store *Store) internID(id interface{}) interface{} {
+	if !store.internIDs {
+		return id
+	}
+	if s, ok := id.(string); ok {
+		handle := unique.Make(s)
+		if store.interned == nil {
+			store.interned = make(map[unique.Handle[string]]int)
+		}
+		store.interned[handle]++
+		return handle.Value()
+	}
+	if index, ok := store.ids[id]; ok {
+		return store.candidates[index].id
+	}
+	return id
+}
+
+// releaseID releases a reference to an ID returned by internID(). The store
+// must be write-locked when calling this function.
+func (store *Store) releaseID(id interface{}) {
+	s, ok := id.(string)
+	if !ok || store.interned == nil {
+		return
+	}
+	handle := unique.Make(s)
+	if store.interned[handle]--; store.interned[handle] <= 0 {
+		delete(store.interned, handle)
+	}
+}
@@ -0,0 +1,326 @@
+package duplo
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/rivo/duplo/haar"
+)
+
+// jsonHash is the JSON representation of a Hash. Bit vectors are encoded as
+// hexadecimal strings because JSON numbers cannot represent 64 bit integers
+// reliably.
+type jsonHash struct {
+	Version    int        `json:"version"`
+	Width      uint       `json:"width"`
+	Height     uint       `json:"height"`
+	Coefs      string     `json:"coefs"`
+	Thresholds haar.Coef  `json:"thresholds"`
+	Ratio      float64    `json:"ratio"`
+	DHash      string     `json:"dHash"`
+	Histogram  string     `json:"histogram"`
+	HistoMax   [3]float32 `json:"histoMax"`
+	Counts     string     `json:"histogramCounts,omitempty"`
+	Blockhash  string     `json:"blockhash"`
+	WHash      string     `json:"wHash"`
+	Padded     bool       `json:"padded,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. The coefficient matrix is encoded as
+// a base64 string of the packed little-endian float64 values, bit vectors are
+// encoded as hexadecimal strings. The hash's HashVersion is included in the
+// "version" field.
+func (hash Hash) MarshalJSON() ([]byte, error) {
+	if uint(len(hash.Coefs)) != hash.Width*hash.Height {
+		return nil, fmt.Errorf("Number of coefficients (%d) does not match matrix dimensions %dx%d", len(hash.Coefs), hash.Width, hash.Height)
+	}
+
+	packed := make([]byte, 0, len(hash.Coefs)*haar.ColourChannels*8)
+	for _, coef := range hash.Coefs {
+		for _, value := range coef {
+			packed = binary.LittleEndian.AppendUint64(packed, math.Float64bits(value))
+		}
+	}
+
+	return json.Marshal(jsonHash{
+		Version:    HashVersion,
+		Width:      hash.Width,
+		Height:     hash.Height,
+		Coefs:      base64.StdEncoding.EncodeToString(packed),
+		Thresholds: hash.Thresholds,
+		Ratio:      hash.Ratio,
+		DHash:      formatDHash(hash.DHash),
+		Histogram:  fmt.Sprintf("%016x", hash.Histogram),
+		HistoMax:   hash.HistoMax,
+		Counts:     base64.StdEncoding.EncodeToString(hash.HistogramCounts[:]),
+		Blockhash:  FormatBlockhash(hash.Blockhash),
+		WHash:      FormatWHash(hash.WHash),
+		Padded:     hash.Padded,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It decodes hashes encoded with
+// Hash.MarshalJSON(). If the hash was created with a different HashVersion,
+// ErrHashVersion is returned.
+func (hash *Hash) UnmarshalJSON(data []byte) error {
+	var decoded jsonHash
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if decoded.Version != HashVersion {
+		return ErrHashVersion
+	}
+
+	packed, err := base64.StdEncoding.DecodeString(decoded.Coefs)
+	if err != nil {
+		return fmt.Errorf("Unable to decode coefficients: %s", err)
+	}
+	if uint64(decoded.Width)*uint64(decoded.Height) > maxHashCoefs ||
+		uint64(len(packed)) != uint64(decoded.Width)*uint64(decoded.Height)*haar.ColourChannels*8 {
+		return fmt.Errorf("Invalid coefficients for matrix dimensions %dx%d", decoded.Width, decoded.Height)
+	}
+	coefs := make([]haar.Coef, decoded.Width*decoded.Height)
+	for index := range coefs {
+		for colour := range coefs[index] {
+			coefs[index][colour] = math.Float64frombits(binary.LittleEndian.Uint64(packed))
+			packed = packed[8:]
+		}
+	}
+
+	// Bit vectors.
+	dHash, err := parseDHash(decoded.DHash)
+	if err != nil {
+		return err
+	}
+	histogram, err := strconv.ParseUint(decoded.Histogram, 16, 64)
+	if err != nil {
+		return fmt.Errorf("Unable to decode histogram: %s", err)
+	}
+	var counts [64]uint8
+	if decoded.Counts != "" {
+		packed, err := base64.StdEncoding.DecodeString(decoded.Counts)
+		if err != nil || len(packed) != len(counts) {
+			return errors.New("Invalid histogram counts")
+		}
+		copy(counts[:], packed)
+	}
+	blockhash, err := ParseBlockhash(decoded.Blockhash)
+	if err != nil {
+		return err
+	}
+	wHash, err := ParseWHash(decoded.WHash)
+	if err != nil {
+		return err
+	}
+
+	*hash = Hash{haar.Matrix{
+		Coefs:  coefs,
+		Width:  decoded.Width,
+		Height: decoded.Height,
+	}, decoded.Thresholds, decoded.Ratio, dHash, histogram, decoded.HistoMax, counts, blockhash, wHash, decoded.Padded}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler. Matches are encoded as a JSON array
+// of match objects. Nil matches are omitted.
+func (m Matches) MarshalJSON() ([]byte, error) {
+	matches := make([]*Match, 0, len(m))
+	for _, match := range m {
+		if match != nil {
+			matches = append(matches, match)
+		}
+	}
+	return json.Marshal(matches)
+}
+
+// formatDHash returns the hexadecimal representation of a dHash.
+func formatDHash(bits [2]uint64) string {
+	return fmt.Sprintf("%016x%016x", bits[0], bits[1])
+}
+
+// parseDHash parses the hexadecimal representation of a dHash (see
+// formatDHash()).
+func parseDHash(hex string) (bits [2]uint64, err error) {
+	if len(hex) != 32 {
+		return bits, fmt.Errorf("Invalid dHash length %d", len(hex))
+	}
+	for index := range bits {
+		if bits[index], err = strconv.ParseUint(hex[index*16:index*16+16], 16, 64); err != nil {
+			return bits, fmt.Errorf("Unable to decode dHash: %s", err)
+		}
+	}
+	return
+}
+
+// jsonImage is the JSON representation of an image contained in a store, as
+// written by Store.ExportNDJSON().
+type jsonImage struct {
+	ID         interface{}     `json:"id"`
+	ScaleCoef  haar.Coef       `json:"scaleCoef"`
+	Ratio      float64         `json:"ratio"`
+	DHash      string          `json:"dHash"`
+	Histogram  string          `json:"histogram"`
+	HistoMax   [3]float32      `json:"histoMax"`
+	Counts     string          `json:"histogramCounts,omitempty"`
+	Blockhash  string          `json:"blockhash"`
+	WHash      string          `json:"wHash"`
+	Locations  SignificanceMap `json:"locations"`
+	Added      int64           `json:"added"`
+	Generation uint64          `json:"generation"`
+	Padded     bool            `json:"padded,omitempty"`
+}
+
+// ExportNDJSON writes the images contained in the store to the given writer as
+// newline-delimited JSON, one JSON object per line and image, in the order of
+// their candidate slots. This makes stores diffable, greppable, and loadable
+// into data pipelines. Each object contains the image's ID ("id"), its scaling
+// function coefficient ("scaleCoef"), its ratio, its bit vectors as
+// hexadecimal strings (see Hash.MarshalJSON()), the positions of its top
+// coefficients ("locations", see SignificanceMap), the time it was added (in
+// nanoseconds since the Unix epoch), and the store generation in which it was
+// added. The latter two are informational and not imported (see
+// ImportNDJSON()). The store's configuration, e.g. its weights, is not exported.
+//
+// Like WriteTo(), the images are written from a snapshot of the store so the
+// store is only locked briefly.
+func (store *Store) ExportNDJSON(w io.Writer) error {
+	store.RLock()
+	store.distributing.Lock() // Wait for concurrent Add() calls to finish.
+	snapshot := store.takeSnapshot()
+	store.distributing.Unlock()
+	store.RUnlock()
+	defer store.releaseSnapshot()
+
+	encoder := json.NewEncoder(w)
+	for _, candidate := range snapshot.candidates {
+		if candidate.id == nil {
+			continue // Deleted.
+		}
+		image := jsonImage{
+			ID:         candidate.id,
+			ScaleCoef:  candidate.scaleCoef,
+			Ratio:      candidate.ratio,
+			DHash:      formatDHash(candidate.dHash),
+			Histogram:  fmt.Sprintf("%016x", candidate.histogram),
+			HistoMax:   candidate.histoMax,
+			Blockhash:  FormatBlockhash(candidate.blockhash),
+			WHash:      FormatWHash(candidate.wHash),
+			Locations:  candidate.locations,
+			Added:      candidate.added,
+			Generation: candidate.generation,
+			Padded:     candidate.padded,
+		}
+		if candidate.histogramCounts != nil {
+			image.Counts = base64.StdEncoding.EncodeToString(candidate.histogramCounts[:])
+		}
+		if err := encoder.Encode(image); err != nil {
+			return fmt.Errorf("Unable to export image %v: %s", candidate.id, err)
+		}
+	}
+
+	return nil
+}
+
+// ImportNDJSON reads images in the format written by ExportNDJSON() from the
+// given reader, until its end, and adds them to the store. Images whose IDs
+// are already contained in the store are skipped. The number of added images
+// is returned. IDs must be JSON strings or integers. They are imported as
+// string or int values. The images must have been exported from a store with
+// the same values of ImageScale and TopCoefs. Like images added with Add(),
+// imported images are added in a new store generation at the current time (see
+// Generation()). The exported times and generations, which refer to the
+// exporting store, are ignored.
+//
+// If an error occurs, e.g. because a line cannot be parsed, the images of the
+// preceding lines remain in the store.
+func (store *Store) ImportNDJSON(r io.Reader) (int, error) {
+	store.lockBuckets()
+	defer store.unlockBuckets()
+
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var added int
+	for line := 1; ; line++ {
+		var image jsonImage
+		if err := decoder.Decode(&image); err == io.EOF {
+			return added, nil
+		} else if err != nil {
+			return added, fmt.Errorf("Unable to parse image %d: %s", line, err)
+		}
+		entry, err := image.candidate(len(store.indices))
+		if err != nil {
+			return added, fmt.Errorf("Unable to import image %d: %s", line, err)
+		}
+		if _, ok := store.ids[entry.id]; ok {
+			continue
+		}
+		if len(store.free) == 0 && uint64(len(store.candidates)) >= store.capacity() {
+			return added, fmt.Errorf("Unable to import image %d: Store is full", line)
+		}
+		entry.added = time.Now().UnixNano()
+		entry.generation = store.generation + 1
+		store.distribute(store.place(entry), entry.locations)
+		store.logAdd(&entry)
+		added++
+	}
+}
+
+// candidate converts the image to a candidate, checking its values. "buckets"
+// is the number of index buckets.
+func (image *jsonImage) candidate(buckets int) (entry candidate, err error) {
+	// The ID.
+	switch id := image.ID.(type) {
+	case string:
+		entry.id = id
+	case json.Number:
+		value, err := strconv.ParseInt(string(id), 10, 0)
+		if err != nil {
+			return entry, fmt.Errorf("Invalid ID %s, only strings and integers are supported", id)
+		}
+		entry.id = int(value)
+	default:
+		return entry, fmt.Errorf("Invalid ID %v, only strings and integers are supported", id)
+	}
+
+	// The bit vectors.
+	if entry.dHash, err = parseDHash(image.DHash); err != nil {
+		return
+	}
+	if entry.histogram, err = strconv.ParseUint(image.Histogram, 16, 64); err != nil {
+		return entry, fmt.Errorf("Unable to decode histogram: %s", err)
+	}
+	if image.Counts != "" {
+		counts, err := base64.StdEncoding.DecodeString(image.Counts)
+		if err != nil || len(counts) != 64 {
+			return entry, errors.New("Invalid histogram counts")
+		}
+		entry.histogramCounts = (*[64]uint8)(counts)
+	}
+	if entry.blockhash, err = ParseBlockhash(image.Blockhash); err != nil {
+		return
+	}
+	if entry.wHash, err = ParseWHash(image.WHash); err != nil {
+		return
+	}
+
+	// The locations.
+	for index, location := range image.Locations {
+		if int(location) >= buckets || index > 0 && location <= image.Locations[index-1] {
+			return entry, errors.New("Invalid locations")
+		}
+	}
+
+	entry.scaleCoef = image.ScaleCoef
+	entry.ratio = image.Ratio
+	entry.histoMax = image.HistoMax
+	entry.locations = image.Locations
+	entry.padded = image.Padded
+	return entry, nil
+}
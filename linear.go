@@ -0,0 +1,75 @@
+package duplo
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/rivo/duplo/haar"
+)
+
+// linearize converts a gamma-encoded sRGB value into linear light. Both
+// values are between 0 and 1.
+func linearize(value float64) float64 {
+	if value <= 0.04045 {
+		return value / 12.92
+	}
+	return math.Pow((value+0.055)/1.055, 2.4)
+}
+
+// delinearize is the inverse of linearize().
+func delinearize(value float64) float64 {
+	if value <= 0.0031308 {
+		return value * 12.92
+	}
+	return 1.055*math.Pow(value, 1/2.4) - 0.055
+}
+
+// sRGBToLinear returns a copy of the given sRGB image in linear light (see
+// WithLinearLight()). The result has 16 bits per channel as 8 bits are not
+// enough for dark values in linear light. Alpha is ignored.
+func sRGBToLinear(img image.Image) *image.RGBA64 {
+	var table [256]uint16
+	for value := range table {
+		table[value] = uint16(math.Round(linearize(float64(value)/0xff) * 0xffff))
+	}
+
+	bounds := img.Bounds()
+	linear := image.NewRGBA64(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			linear.SetRGBA64(x, y, color.RGBA64{table[r>>8], table[g>>8], table[b>>8], 0xffff})
+		}
+	}
+	return linear
+}
+
+// linearToSRGB returns a copy of the given linear light image, converted back
+// to 8-bit sRGB.
+func linearToSRGB(img image.Image) *image.RGBA {
+	convert := func(value uint32) uint8 {
+		return uint8(math.Round(delinearize(float64(value)/0xffff) * 0xff))
+	}
+	bounds := img.Bounds()
+	encoded := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			encoded.SetRGBA(x, y, color.RGBA{convert(r), convert(g), convert(b), 0xff})
+		}
+	}
+	return encoded
+}
+
+// linearConverter returns a colour converter which linearizes the 8-bit sRGB
+// values it receives before passing them to the given converter, scaled to the
+// same range. If the given converter is nil, haar.YIQ is used.
+func linearConverter(converter haar.ColorConverter) haar.ColorConverter {
+	if converter == nil {
+		converter = haar.YIQ
+	}
+	return func(r, g, b float64) haar.Coef {
+		return converter(linearize(r/0xff)*0xff, linearize(g/0xff)*0xff, linearize(b/0xff)*0xff)
+	}
+}
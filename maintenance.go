@@ -0,0 +1,280 @@
+package duplo
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats contains statistics about a store.
+type Stats struct {
+	// The number of images in the store.
+	Images int
+
+	// The number of candidate slots, including the slots of deleted images
+	// (see Delete()).
+	Slots int
+
+	// The total number of entries in all index buckets.
+	IndexEntries int
+
+	// The number of index buckets which are not empty.
+	UsedBuckets int
+
+	// The number of entries in the largest index bucket.
+	LargestBucket int
+
+	// The number of queries performed on the store since it was created or
+	// loaded.
+	Queries uint64
+}
+
+// Stats returns statistics about the store. This walks all index buckets.
+func (store *Store) Stats() Stats {
+	store.RLock()
+	defer store.RUnlock()
+
+	stats := Stats{
+		Images:  len(store.ids),
+		Slots:   len(store.candidates),
+		Queries: store.queries.Load(),
+	}
+	for location := range store.indices {
+		size := store.bucketLen(location)
+		if size == 0 {
+			continue
+		}
+		stats.UsedBuckets++
+		stats.IndexEntries += size
+		if size > stats.LargestBucket {
+			stats.LargestBucket = size
+		}
+	}
+
+	return stats
+}
+
+// Compact removes the slots of deleted images (see Delete()) from the store,
+// thus reducing its memory footprint. This renumbers the images' internal
+// indices, invalidating all hits returned by QueryHits(). The number of
+// removed slots is returned.
+func (store *Store) Compact() (removed int) {
+	defer func() {
+		if removed > 0 {
+			store.persistUnlogged() // After unlocking the store.
+		}
+	}()
+	store.lockBuckets()
+	defer store.unlockBuckets()
+
+	// Map old indices to new ones.
+	if len(store.ids) == len(store.candidates) {
+		return 0 // Nothing to compact.
+	}
+	newIndices := make([]uint64, len(store.candidates))
+	candidates := make([]candidate, 0, len(store.ids))
+	for index, candidate := range store.candidates {
+		if candidate.id == nil {
+			continue
+		}
+		newIndices[index] = uint64(len(candidates))
+		store.ids[candidate.id] = uint64(len(candidates))
+		candidates = append(candidates, candidate)
+	}
+	removed = len(store.candidates) - len(candidates)
+	store.candidates = candidates
+	store.candidatesShared.Store(false)
+	store.free = nil
+	store.dHashes = nil // Rebuilt when needed.
+
+	// Renumber the index buckets. Deleted images are not in any bucket.
+	for location, list := range store.indices {
+		store.indices[location] = list.filter(nil, func(index uint64) uint64 {
+			return newIndices[index]
+		})
+	}
+
+	store.markModified()
+	return removed
+}
+
+// MaintenanceTask is a job which is run periodically by Maintenance.
+type MaintenanceTask func(store *Store) error
+
+// CompactTask returns a maintenance task which compacts the store (see
+// Compact()) when the fraction of deleted image slots exceeds the given value.
+func CompactTask(maxDeleted float64) MaintenanceTask {
+	return func(store *Store) error {
+		stats := store.Stats()
+		if stats.Slots > 0 && float64(stats.Slots-stats.Images)/float64(stats.Slots) > maxDeleted {
+			store.Compact()
+		}
+		return nil
+	}
+}
+
+// PruneTask returns a maintenance task which removes images that were added
+// longer ago than the given age (see DeleteOlderThan()).
+func PruneTask(maxAge time.Duration) MaintenanceTask {
+	return func(store *Store) error {
+		store.DeleteOlderThan(time.Now().Add(-maxAge))
+		return nil
+	}
+}
+
+// SaveTask returns a maintenance task which calls the given function to save
+// the store whenever it was modified since the last save.
+func SaveTask(save func(store *Store) error) MaintenanceTask {
+	var saved uint64
+	return func(store *Store) error {
+		generation := store.Generation()
+		if generation == saved {
+			return nil
+		}
+		if err := save(store); err != nil {
+			return err
+		}
+		saved = generation
+		return nil
+	}
+}
+
+// StatsTask returns a maintenance task which collects the store's statistics
+// (see Stats()) and passes them to the given function.
+func StatsTask(report func(stats Stats)) MaintenanceTask {
+	return func(store *Store) error {
+		report(store.Stats())
+		return nil
+	}
+}
+
+// Maintenance runs maintenance tasks on a store in the background, e.g. to
+// compact, prune, or save it. Tasks are only run while the store is idle,
+// i.e. while the rate of queries stays below a limit, and only for a limited
+// fraction of the time.
+type Maintenance struct {
+	// Interval is the time between checks whether tasks are due. It must be
+	// set before calling Start().
+	Interval time.Duration
+
+	// MaxQueryRate is the number of queries per second above which maintenance
+	// is paused. A value of 0 means that maintenance is never paused.
+	MaxQueryRate float64
+
+	// CPUBudget is the fraction (between 0 and 1) of time that may be spent
+	// running tasks. After a task has run, maintenance pauses long enough to
+	// not exceed this budget. Values of 0 or 1 mean that there are no pauses.
+	CPUBudget float64
+
+	// ErrorHandler, if not nil, is called with the errors returned by tasks.
+	ErrorHandler func(err error)
+
+	store *Store
+	tasks []*scheduledTask
+	stop  chan struct{}
+	done  sync.WaitGroup
+}
+
+// scheduledTask is a task which is run at a fixed period.
+type scheduledTask struct {
+	task   MaintenanceTask
+	period time.Duration
+	next   time.Time
+}
+
+// NewMaintenance returns a new maintenance scheduler for the given store which
+// checks every second for due tasks. Add tasks with Schedule() and then call
+// Start().
+func NewMaintenance(store *Store) *Maintenance {
+	return &Maintenance{
+		Interval: time.Second,
+		store:    store,
+	}
+}
+
+// Schedule adds a task which is to be run every "period". The first run is
+// due one period after Start() was called. Tasks must be scheduled before
+// calling Start().
+func (m *Maintenance) Schedule(period time.Duration, task MaintenanceTask) {
+	m.tasks = append(m.tasks, &scheduledTask{task: task, period: period})
+}
+
+// Start starts running the scheduled tasks in a separate goroutine.
+func (m *Maintenance) Start() {
+	m.stop = make(chan struct{})
+	now := time.Now()
+	for _, task := range m.tasks {
+		task.next = now.Add(task.period)
+	}
+	m.done.Add(1)
+	go m.run()
+}
+
+// Stop stops the scheduler and waits for a running task to finish.
+func (m *Maintenance) Stop() {
+	close(m.stop)
+	m.done.Wait()
+}
+
+// run is the scheduler's main loop.
+func (m *Maintenance) run() {
+	defer m.done.Done()
+
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	lastQueries, lastCheck := m.store.queries.Load(), time.Now()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+
+		// Pause if the store is busy.
+		now := time.Now()
+		queries := m.store.queries.Load()
+		rate := float64(queries-lastQueries) / now.Sub(lastCheck).Seconds()
+		lastQueries, lastCheck = queries, now
+		if m.MaxQueryRate > 0 && rate > m.MaxQueryRate {
+			continue
+		}
+
+		for _, task := range m.tasks {
+			started := time.Now()
+			if started.Before(task.next) {
+				continue
+			}
+
+			// Run the task.
+			if err := task.task(m.store); err != nil && m.ErrorHandler != nil {
+				m.ErrorHandler(err)
+			}
+			finished := time.Now()
+			task.next = finished.Add(task.period)
+
+			// Stay within our CPU budget.
+			if m.CPUBudget > 0 && m.CPUBudget < 1 {
+				pause := time.Duration(float64(finished.Sub(started)) * (1 - m.CPUBudget) / m.CPUBudget)
+				select {
+				case <-m.stop:
+					return
+				case <-time.After(pause):
+				}
+			}
+		}
+	}
+}
+
+// BucketSizes returns the number of entries of each index bucket. The bucket
+// of a location (see SignificanceMap) is found at that index. This may be used
+// to visualize the occupancy of the index.
+func (store *Store) BucketSizes() []int {
+	store.RLock()
+	defer store.RUnlock()
+
+	sizes := make([]int, len(store.indices))
+	for location := range store.indices {
+		sizes[location] = store.bucketLen(location)
+	}
+	return sizes
+}
@@ -0,0 +1,134 @@
+package duplo
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// WithCaptionMask masks the given fractions (between 0 and 1) of the image's
+// height at its top and bottom before it is hashed, e.g. 0.2 and 0.2 for
+// memes, which are the same base image with different caption bars. The
+// masked rows are filled with the average colour of the remaining image, so
+// that only the remaining image determines the Haar coefficients and the
+// dHash. The ratio of the hash is still that of the whole image. Hashes
+// created with different masks should not be mixed in the same store.
+func WithCaptionMask(top, bottom float64) HashOption {
+	return func(config *hashConfig) {
+		config.captionTop, config.captionBottom = top, bottom
+	}
+}
+
+// CreateHashMasked calculates the visual hash of the provided image, like
+// CreateHashOpts(), but ignores the pixels which are masked out, e.g. to
+// ignore watermarks, timestamps, or user interface elements at known
+// positions. A pixel is masked out if the alpha value of the corresponding
+// mask pixel is less than half. The mask is aligned with the image, i.e. the
+// mask's pixel at mask.Bounds().Min corresponds to the image's pixel at
+// img.Bounds().Min, and pixels not covered by the mask are masked out.
+//
+// Masked-out pixels are filled with the average colour of the remaining
+// pixels before the image is processed further. They are also excluded from
+// the dHash and the histogram. The mask refers to the image as provided, it is
+// oriented along with the image (see WithOrientation()) but options which crop
+// the image, such as WithTrimBorders(), should not be combined with it. An
+// error is returned if all pixels are masked out.
+func CreateHashMasked(img, mask image.Image, options ...HashOption) (Hash, image.Image, error) {
+	if mask == nil {
+		return Hash{}, nil, errors.New("Unable to hash image with nil mask")
+	}
+	options = append(options[:len(options):len(options)], func(config *hashConfig) {
+		config.mask = mask
+	})
+	return CreateHashOpts(img, options...)
+}
+
+// applyMask returns a copy of the given image in which the pixels masked out
+// by the given mask (see CreateHashMasked()) are filled with the average
+// colour of the other pixels, as well as the normalized mask, an opaque image
+// of the same bounds where the masked-out pixels are transparent. If all
+// pixels are masked out, false is returned.
+func applyMask(img, mask image.Image) (image.Image, image.Image, bool) {
+	bounds := img.Bounds()
+	offset := mask.Bounds().Min.Sub(bounds.Min)
+	filled := image.NewRGBA(bounds)
+	draw.Draw(filled, bounds, img, bounds.Min, draw.Src)
+	normalized := image.NewAlpha(bounds)
+	var sum [3]uint64
+	var count uint64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if !unmasked(mask.At(x+offset.X, y+offset.Y)) {
+				continue
+			}
+			normalized.SetAlpha(x, y, color.Alpha{0xff})
+			pixel := filled.RGBAAt(x, y)
+			sum[0], sum[1], sum[2] = sum[0]+uint64(pixel.R), sum[1]+uint64(pixel.G), sum[2]+uint64(pixel.B)
+			count++
+		}
+	}
+	if count == 0 {
+		return img, nil, false
+	}
+
+	fill := color.RGBA{uint8(sum[0] / count), uint8(sum[1] / count), uint8(sum[2] / count), 0xff}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if normalized.AlphaAt(x, y).A == 0 {
+				filled.SetRGBA(x, y, fill)
+			}
+		}
+	}
+	return filled, normalized, true
+}
+
+// unmasked returns whether the given mask colour keeps its pixel, i.e. whether
+// its alpha value is at least half.
+func unmasked(colour color.Color) bool {
+	_, _, _, a := colour.RGBA()
+	return a >= 0x8000
+}
+
+// maskRows returns a copy of the given image in which the given fractions of
+// the rows at the top and at the bottom are filled with the average colour of
+// the other rows. If no rows would remain, the image is returned unchanged.
+func maskRows(img image.Image, top, bottom float64) image.Image {
+	bounds := img.Bounds()
+	height := bounds.Dy()
+	topRows, bottomRows := int(top*float64(height)+0.5), int(bottom*float64(height)+0.5)
+	if topRows < 0 {
+		topRows = 0
+	}
+	if bottomRows < 0 {
+		bottomRows = 0
+	}
+	if topRows+bottomRows >= height || topRows+bottomRows == 0 {
+		return img
+	}
+
+	masked := image.NewRGBA(bounds)
+	draw.Draw(masked, bounds, img, bounds.Min, draw.Src)
+	keep := image.Rect(bounds.Min.X, bounds.Min.Y+topRows, bounds.Max.X, bounds.Max.Y-bottomRows)
+	fill := image.NewUniform(averageColour(masked, keep))
+	draw.Draw(masked, image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X, keep.Min.Y), fill, image.Point{}, draw.Src)
+	draw.Draw(masked, image.Rect(bounds.Min.X, keep.Max.Y, bounds.Max.X, bounds.Max.Y), fill, image.Point{}, draw.Src)
+	return masked
+}
+
+// averageColour returns the average colour of the given rectangle of the
+// given image.
+func averageColour(img *image.RGBA, rect image.Rectangle) color.RGBA {
+	var sum [3]uint64
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			pixel := img.RGBAAt(x, y)
+			sum[0], sum[1], sum[2] = sum[0]+uint64(pixel.R), sum[1]+uint64(pixel.G), sum[2]+uint64(pixel.B)
+		}
+	}
+	count := uint64(rect.Dx() * rect.Dy())
+	if count == 0 {
+		return color.RGBA{A: 0xff}
+	}
+	return color.RGBA{uint8(sum[0] / count), uint8(sum[1] / count), uint8(sum[2] / count), 0xff}
+}
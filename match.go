@@ -2,25 +2,74 @@ package duplo
 
 import (
 	"fmt"
+	"math"
 )
 
-// Match represents an image matched by a similarity query.
+// Match represents an image matched by a similarity query. It can be encoded
+// to JSON (with camel-cased field names).
 type Match struct {
 	// The ID of the matched image, as specified in the pool.Add() function.
-	ID interface{}
+	ID interface{} `json:"id"`
 
 	// The score calculated during the similarity query. The lower, the better
-	// the match.
-	Score float64
+	// the match. This is the composite score (see Store.SetScoreWeights()),
+	// which is the same as HaarScore unless configured otherwise.
+	Score float64 `json:"score"`
+
+	// The score resulting from the comparison of the images' Haar wavelet
+	// coefficients. The lower, the better the match.
+	HaarScore float64 `json:"haarScore"`
 
 	// The absolute difference between the two image ratios' log values.
-	RatioDiff float64
+	RatioDiff float64 `json:"ratioDiff"`
 
 	// The hamming distance between the two dHash bit vectors.
-	DHashDistance int
+	DHashDistance int `json:"dHashDistance"`
 
 	// The hamming distance between the two histogram bit vectors.
-	HistogramDistance int
+	HistogramDistance int `json:"histogramDistance"`
+
+	// The distance between the two colour histograms, between 0 (identical)
+	// and 1, according to the HistogramMetric of the query's options. It
+	// defaults to HistogramDistance / 64.
+	ColourDistance float64 `json:"colourDistance"`
+
+	// The hamming distance between the two Blockhash bit vectors. Hashes
+	// created without WithForeignHashes() have zero Blockhashes.
+	BlockhashDistance int `json:"blockhashDistance"`
+
+	// The hamming distance between the two wavelet hash bit vectors. Hashes
+	// created without WithForeignHashes() have zero wavelet hashes.
+	WHashDistance int `json:"wHashDistance"`
+
+	// Similarity combines all of the above metrics into a single value between
+	// 0 (completely different) and 1 (identical). It is a heuristic which
+	// relates the score to the best possible score for the query image and the
+	// distances to the distances expected between unrelated images. It is
+	// useful as a single threshold but you may achieve better results by
+	// filtering on the individual metrics. The contributions of the metrics
+	// are configured with MatchSimilarityWeights.
+	Similarity float64 `json:"similarity"`
+
+	// SignAgreement is the number of significant coefficients which both
+	// images share, including their signs. It is only set by sign-only queries
+	// (see QueryOptions.SignOnly).
+	SignAgreement int `json:"signAgreement,omitempty"`
+
+	// Components contains the terms which make up HaarScore. It is only set
+	// if requested with QueryOptions.ScoreComponents.
+	Components *ScoreComponents `json:"components,omitempty"`
+
+	// Rotation is the clockwise rotation in degrees (0, 90, 180, or 270)
+	// which was applied to the query image to match the stored image. It is
+	// only set by Store.QueryVariants().
+	Rotation int `json:"rotation,omitempty"`
+
+	// Flipped indicates that the query image was flipped horizontally (before
+	// it was rotated, see Rotation) to match the stored image, i.e. that the
+	// stored image is a mirror image of the query image. It is only set by
+	// Store.QueryVariants().
+	Flipped bool `json:"flipped,omitempty"`
 }
 
 // Matches is a slice of match results.
@@ -31,6 +80,22 @@ func (m Matches) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
 func (m Matches) Less(i, j int) bool { return m[j] == nil || (m[i] != nil && m[i].Score < m[j].Score) }
 
 func (m *Match) String() string {
-	return fmt.Sprintf("%s: score=%.4f, ratio-diff=%.1f, dHash-dist=%d, histDist=%d",
-		m.ID, m.Score, m.RatioDiff, m.DHashDistance, m.HistogramDistance)
+	return fmt.Sprintf("%s: score=%.4f, ratio-diff=%.1f, dHash-dist=%d, histDist=%d, similarity=%.2f",
+		m.ID, m.Score, m.RatioDiff, m.DHashDistance, m.HistogramDistance, m.Similarity)
+}
+
+// setMetrics calculates the match's additional metrics and its similarity
+// from the matched candidate, the query hash, and the score the query hash
+// would achieve against itself. The match's Haar score must already be set.
+func (m *Match) setMetrics(c *candidate, query Hash, bestScore float64) {
+	m.RatioDiff = math.Abs(math.Log(c.ratio) - math.Log(query.Ratio))
+	m.DHashDistance = HammingDistance(c.dHash[0], query.DHash[0]) +
+		HammingDistance(c.dHash[1], query.DHash[1])
+	m.HistogramDistance = HammingDistance(c.histogram, query.Histogram)
+	m.ColourDistance = float64(m.HistogramDistance) / 64
+	for index := range c.blockhash {
+		m.BlockhashDistance += HammingDistance(c.blockhash[index], query.Blockhash[index])
+	}
+	m.WHashDistance = HammingDistance(c.wHash, query.WHash)
+	m.Similarity = similarity(m.HaarScore, bestScore, m.RatioDiff, m.DHashDistance, m.HistogramDistance)
 }
@@ -0,0 +1,178 @@
+/*
+Package mobile provides a facade to the duplo package which only uses types
+supported by gomobile. It allows iOS and Android apps to compute hashes on the
+device which are identical to the ones computed by a Go server, e.g. to prompt
+users about duplicates before uploading images. Generate the bindings with:
+
+	gomobile bind github.com/rivo/duplo/mobile
+
+Hashes are exchanged as byte slices. They can be decoded on the server with
+duplo.Hash.UnmarshalBinary().
+*/
+package mobile
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/rivo/duplo"
+)
+
+// CreateHash decodes the given image (JPEG, PNG, GIF, WebP, or any format
+// registered with duplo.RegisterDecoder()) and returns its encoded hash.
+func CreateHash(data []byte) ([]byte, error) {
+	hash, _, err := duplo.CreateHashFromReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeHash(hash)
+}
+
+// encodeHash encodes a hash into a byte slice.
+func encodeHash(hash duplo.Hash) ([]byte, error) {
+	encoded, err := hash.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encode hash: %s", err)
+	}
+	return encoded, nil
+}
+
+// decodeHash decodes a hash created with CreateHash().
+func decodeHash(data []byte) (hash duplo.Hash, err error) {
+	if err = hash.UnmarshalBinary(data); err != nil {
+		err = fmt.Errorf("Unable to decode hash: %s", err)
+	}
+	return
+}
+
+// Store is an image store with string IDs (see duplo.Store).
+type Store struct {
+	store *duplo.Store
+}
+
+// NewStore returns a new, empty image store.
+func NewStore() *Store {
+	return &Store{store: duplo.New()}
+}
+
+// Add adds an image, via its encoded hash, to the store. If the ID is already
+// in the store, it is not added again.
+func (s *Store) Add(id string, hash []byte) error {
+	decoded, err := decodeHash(hash)
+	if err != nil {
+		return err
+	}
+	s.store.Add(id, decoded)
+	return nil
+}
+
+// Has checks if an image with the given ID is contained in the store.
+func (s *Store) Has(id string) bool {
+	return s.store.Has(id)
+}
+
+// Delete removes an image from the store.
+func (s *Store) Delete(id string) {
+	s.store.Delete(id)
+}
+
+// Size returns the number of images currently in the store.
+func (s *Store) Size() int {
+	return len(s.store.IDs())
+}
+
+// Query performs a similarity search on the given encoded hash. The returned
+// matches are sorted so the best match comes first.
+func (s *Store) Query(hash []byte) (*Matches, error) {
+	decoded, err := decodeHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	matches := s.store.Query(decoded)
+	sort.Sort(matches)
+	return &Matches{matches: matches}, nil
+}
+
+// Encode returns a binary representation of the store, e.g. to save it to a
+// file.
+func (s *Store) Encode() ([]byte, error) {
+	return s.store.GobEncode()
+}
+
+// Decode replaces the store's contents with the given binary representation
+// created with Encode().
+func (s *Store) Decode(data []byte) error {
+	store := duplo.New()
+	if err := store.GobDecode(data); err != nil {
+		return err
+	}
+	s.store = store
+	return nil
+}
+
+// Matches is a list of query results, sorted by score. Accessors called with
+// an index which is out of range return zero values.
+type Matches struct {
+	matches duplo.Matches
+}
+
+// Len returns the number of matches.
+func (m *Matches) Len() int {
+	return len(m.matches)
+}
+
+// match returns the ith match. If there is no such match, a zero match is
+// returned so that out-of-range indices don't crash the host app.
+func (m *Matches) match(i int) *duplo.Match {
+	if i < 0 || i >= len(m.matches) {
+		return &duplo.Match{}
+	}
+	return m.matches[i]
+}
+
+// ID returns the ID of the ith match or an empty string if there is no such
+// match.
+func (m *Matches) ID(i int) string {
+	match := m.match(i)
+	if match.ID == nil {
+		return ""
+	}
+	return fmt.Sprint(match.ID)
+}
+
+// Score returns the score of the ith match. The lower, the better the match.
+func (m *Matches) Score(i int) float64 {
+	return m.match(i).Score
+}
+
+// RatioDiff returns the absolute difference between the two image ratios' log
+// values of the ith match.
+func (m *Matches) RatioDiff(i int) float64 {
+	return m.match(i).RatioDiff
+}
+
+// DHashDistance returns the hamming distance between the two dHash bit
+// vectors of the ith match.
+func (m *Matches) DHashDistance(i int) int {
+	return m.match(i).DHashDistance
+}
+
+// HistogramDistance returns the hamming distance between the two histogram
+// bit vectors of the ith match.
+func (m *Matches) HistogramDistance(i int) int {
+	return m.match(i).HistogramDistance
+}
+
+// BlockhashDistance returns the hamming distance between the two Blockhash
+// bit vectors of the ith match.
+func (m *Matches) BlockhashDistance(i int) int {
+	return m.match(i).BlockhashDistance
+}
+
+// WHashDistance returns the hamming distance between the two wavelet hash bit
+// vectors of the ith match.
+func (m *Matches) WHashDistance(i int) int {
+	return m.match(i).WHashDistance
+}
@@ -0,0 +1,51 @@
+package mobile
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+
+	"github.com/rivo/duplo/duplotest"
+)
+
+// Test hashing and querying through the facade.
+func TestStore(t *testing.T) {
+	store := NewStore()
+	for _, name := range duplotest.FixtureNames {
+		var encoded bytes.Buffer
+		if err := png.Encode(&encoded, duplotest.Fixture(name)); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := CreateHash(encoded.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Add(name, hash); err != nil {
+			t.Fatal(err)
+		}
+		matches, err := store.Query(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matches.Len() == 0 || matches.ID(0) != name {
+			t.Errorf("Query for %s did not return it as the best match", name)
+		}
+	}
+	if store.Size() != len(duplotest.FixtureNames) {
+		t.Errorf("Store has %d images, expected %d", store.Size(), len(duplotest.FixtureNames))
+	}
+	store.Delete(duplotest.FixtureNames[0])
+	if store.Size() != len(duplotest.FixtureNames)-1 {
+		t.Errorf("Store has %d images after a deletion, expected %d", store.Size(), len(duplotest.FixtureNames)-1)
+	}
+
+	// Out-of-range matches are zero values.
+	matches := &Matches{}
+	if matches.ID(0) != "" || matches.Score(-1) != 0 || matches.DHashDistance(1) != 0 {
+		t.Error("Out-of-range match accessors returned non-zero values")
+	}
+
+	if _, err := CreateHash([]byte("no image")); err == nil {
+		t.Error("Hashing invalid data did not fail")
+	}
+}
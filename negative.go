@@ -0,0 +1,291 @@
+package duplo
+
+import (
+	"encoding/gob"
+	"fmt"
+
+	"github.com/rivo/duplo/haar"
+)
+
+// hashKey identifies the image a hash was created from, for the purpose of the
+// negative list. It consists of the parts of a hash which the store keeps
+// exactly (see GetHash()), so a query with an image's original hash and a
+// query by the image's ID (see QueryID()) have the same key.
+type hashKey struct {
+	scaleCoef haar.Coef
+	ratio     float64
+	dHash     [2]uint64
+	histogram uint64
+}
+
+// keyOf returns the negative list key of the given hash.
+func keyOf(hash Hash) hashKey {
+	key := hashKey{ratio: hash.Ratio, dHash: hash.DHash, histogram: hash.Histogram}
+	if len(hash.Coefs) > 0 {
+		key.scaleCoef = hash.Coefs[0]
+	}
+	return key
+}
+
+// candidateKey returns the negative list key of the given candidate.
+func candidateKey(c *candidate) hashKey {
+	return hashKey{scaleCoef: c.scaleCoef, ratio: c.ratio, dHash: c.dHash, histogram: c.histogram}
+}
+
+// MarkFalsePositive adds the pair of images with the given IDs, which are both
+// contained in the store, to the store's negative list. Queries with the hash
+// of one of the images will then not return the other image (see
+// QueryOptions.FalsePositivePenalty). This is useful for pairs of images which
+// are similar but were confirmed by a user not to be duplicates. The negative
+// list is saved with the store. When an image is deleted, it is also removed
+// from the negative list. When its hash is replaced (see Update()), its
+// entries are moved to the new hash. An error is returned if one of the IDs
+// cannot be found.
+func (store *Store) MarkFalsePositive(a, b interface{}) error {
+	store.Lock()
+	defer store.Unlock()
+
+	indexA, ok := store.ids[a]
+	if !ok {
+		return fmt.Errorf("Image %v not found", a)
+	}
+	indexB, ok := store.ids[b]
+	if !ok {
+		return fmt.Errorf("Image %v not found", b)
+	}
+	keyA, keyB := candidateKey(&store.candidates[indexA]), candidateKey(&store.candidates[indexB])
+	store.markNegative(keyA, b)
+	store.markNegative(keyB, a)
+	store.markModified()
+	store.logNegative(keyA, b, true)
+	store.logNegative(keyB, a, true)
+	return nil
+}
+
+// MarkFalsePositiveHash adds the pairing of the given query hash and the image
+// with the given ID to the store's negative list, like MarkFalsePositive(), for
+// query images which are not contained in the store.
+func (store *Store) MarkFalsePositiveHash(hash Hash, id interface{}) {
+	store.Lock()
+	defer store.Unlock()
+
+	store.markNegative(keyOf(hash), id)
+	store.markModified()
+	store.logNegative(keyOf(hash), id, true)
+
+	// We need this for when we serialize the store.
+	gob.Register(id)
+}
+
+// UnmarkFalsePositive removes the pair of images with the given IDs from the
+// store's negative list. Pairs which are not on the negative list are ignored
+// and leave the store unmodified.
+func (store *Store) UnmarkFalsePositive(a, b interface{}) {
+	store.Lock()
+	defer store.Unlock()
+
+	var keyA, keyB *hashKey
+	if index, ok := store.ids[a]; ok {
+		if key := candidateKey(&store.candidates[index]); store.unmarkNegative(key, b) {
+			keyA = &key
+		}
+	}
+	if index, ok := store.ids[b]; ok {
+		if key := candidateKey(&store.candidates[index]); store.unmarkNegative(key, a) {
+			keyB = &key
+		}
+	}
+	if keyA == nil && keyB == nil {
+		return
+	}
+	store.markModified()
+	if keyA != nil {
+		store.logNegative(*keyA, b, false)
+	}
+	if keyB != nil {
+		store.logNegative(*keyB, a, false)
+	}
+}
+
+// markNegative adds the given ID to the negative list of the given key. The
+// store must be locked when calling this function.
+func (store *Store) markNegative(key hashKey, id interface{}) {
+	if store.negatives == nil {
+		store.negatives = make(map[hashKey]map[interface{}]bool)
+		store.negativeIDs = make(map[interface{}]map[hashKey]bool)
+		store.countKeys()
+	}
+	if store.negatives[key] == nil {
+		store.negatives[key] = make(map[interface{}]bool)
+	}
+	id = store.internID(id)
+	store.negatives[key][id] = true
+	if store.negativeIDs[id] == nil {
+		store.negativeIDs[id] = make(map[hashKey]bool)
+	} else {
+		store.releaseID(id) // The negative list already references it.
+	}
+	store.negativeIDs[id][key] = true
+}
+
+// unmarkNegative removes the given ID from the negative list of the given key
+// and returns true. If the ID was not on that list, nothing happens and false
+// is returned. The store must be locked when calling this function.
+func (store *Store) unmarkNegative(key hashKey, id interface{}) bool {
+	if !store.negatives[key][id] {
+		return false
+	}
+	delete(store.negatives[key], id)
+	if len(store.negatives[key]) == 0 {
+		delete(store.negatives, key)
+	}
+	delete(store.negativeIDs[id], key)
+	if len(store.negativeIDs[id]) == 0 {
+		delete(store.negativeIDs, id)
+		store.releaseID(id)
+	}
+	if len(store.negatives) == 0 {
+		store.negatives, store.negativeIDs, store.keyCounts = nil, nil, nil
+	}
+	return true
+}
+
+// countKeys counts the images in the store per negative list key (see
+// countKey()). The store must be locked when calling this function.
+func (store *Store) countKeys() {
+	store.keyCounts = make(map[hashKey]int)
+	for index := range store.candidates {
+		if candidate := &store.candidates[index]; candidate.id != nil {
+			store.keyCounts[candidateKey(candidate)]++
+		}
+	}
+}
+
+// countKey adds delta to the number of images in the store which have the key
+// of the given candidate. The counts are only kept while the negative list is
+// not empty. The store must be locked when calling this function.
+func (store *Store) countKey(c *candidate, delta int) {
+	if store.keyCounts == nil {
+		return
+	}
+	key := candidateKey(c)
+	if store.keyCounts[key] += delta; store.keyCounts[key] <= 0 {
+		delete(store.keyCounts, key)
+	}
+}
+
+// pruneNegatives removes the given candidate, which was just deleted from the
+// store and whose key was already uncounted (see countKey()), from the
+// negative list: Its ID is removed from all lists and its own list is dropped
+// (see dropNegatives()). The store must be locked with lockBuckets() when
+// calling this function.
+func (store *Store) pruneNegatives(deleted *candidate) {
+	if len(store.negatives) == 0 {
+		return
+	}
+	for key := range store.negativeIDs[deleted.id] {
+		store.unmarkNegative(key, deleted.id)
+	}
+	store.dropNegatives(candidateKey(deleted))
+}
+
+// migrateNegatives moves the negative list of a candidate whose hash was
+// replaced (see update()) from the old candidate's key to the key of the
+// updated candidate, which must already be in the store and counted (see
+// countKey()). The write-ahead log records an update as a deletion followed by
+// an addition and a replayed deletion prunes the negative list (see
+// pruneNegatives()), so the entries which the deletion would remove are
+// recorded again. The store must be locked with lockBuckets() when calling
+// this function.
+func (store *Store) migrateNegatives(old, updated *candidate) {
+	if len(store.negatives) == 0 {
+		return
+	}
+	oldKey, newKey := candidateKey(old), candidateKey(updated)
+	if list := store.negatives[oldKey]; oldKey != newKey && list != nil {
+		for id := range list {
+			store.markNegative(newKey, id)
+		}
+		store.dropNegatives(oldKey)
+	}
+	if store.wal != nil {
+		for id := range store.negatives[newKey] {
+			store.logNegative(newKey, id, true)
+		}
+		for key := range store.negativeIDs[updated.id] {
+			if key != newKey {
+				store.logNegative(key, updated.id, true)
+			}
+		}
+	}
+}
+
+// dropNegatives removes the negative list of the given key unless an image in
+// the store still has that key. The store must be locked with lockBuckets()
+// when calling this function.
+func (store *Store) dropNegatives(key hashKey) {
+	if store.keyCounts[key] > 0 {
+		return
+	}
+	for id := range store.negatives[key] {
+		store.unmarkNegative(key, id)
+	}
+}
+
+// copyNegatives returns a deep copy of the given negative list.
+func copyNegatives(negatives map[hashKey]map[interface{}]bool) map[hashKey]map[interface{}]bool {
+	if negatives == nil {
+		return nil
+	}
+	copied := make(map[hashKey]map[interface{}]bool, len(negatives))
+	for key, ids := range negatives {
+		copied[key] = make(map[interface{}]bool, len(ids))
+		for id := range ids {
+			copied[key][id] = true
+		}
+	}
+	return copied
+}
+
+// encodeNegatives encodes the given negative list.
+func encodeNegatives(encoder *gob.Encoder, negatives map[hashKey]map[interface{}]bool) error {
+	if err := encoder.Encode(len(negatives)); err != nil {
+		return err
+	}
+	for key, ids := range negatives {
+		list := make([]interface{}, 0, len(ids))
+		for id := range ids {
+			list = append(list, id)
+		}
+		for _, value := range []interface{}{key.scaleCoef, key.ratio, key.dHash, key.histogram, list} {
+			if err := encoder.Encode(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// decodeNegatives decodes the negative list.
+func (store *Store) decodeNegatives(decoder *gob.Decoder) error {
+	var size int
+	if err := decoder.Decode(&size); err != nil {
+		return err
+	}
+	store.negatives, store.negativeIDs, store.keyCounts = nil, nil, nil
+	for ; size > 0; size-- {
+		var (
+			key  hashKey
+			list []interface{}
+		)
+		for _, value := range []interface{}{&key.scaleCoef, &key.ratio, &key.dHash, &key.histogram, &list} {
+			if err := decoder.Decode(value); err != nil {
+				return err
+			}
+		}
+		for _, id := range list {
+			store.markNegative(key, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package duplo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// The EXIF orientation values. They describe how an image must be transformed
+// to be displayed correctly.
+const (
+	OrientationNormal     = 1 // No transformation.
+	OrientationFlipH      = 2 // Flip horizontally.
+	OrientationRotate180  = 3 // Rotate by 180°.
+	OrientationFlipV      = 4 // Flip vertically.
+	OrientationTranspose  = 5 // Flip along the top-left to bottom-right diagonal.
+	OrientationRotate90   = 6 // Rotate by 90° clockwise.
+	OrientationTransverse = 7 // Flip along the top-right to bottom-left diagonal.
+	OrientationRotate270  = 8 // Rotate by 270° clockwise.
+)
+
+// WithOrientation causes the image to be transformed according to the given
+// EXIF orientation value (see OrientationNormal and the following constants)
+// before it is hashed, so that photos whose pixels are stored rotated or
+// flipped match their correctly oriented copies. Invalid values are ignored.
+// See also CreateHashAutoOrient().
+func WithOrientation(orientation int) HashOption {
+	return func(config *hashConfig) {
+		config.orientation = orientation
+	}
+}
+
+// CreateHashAutoOrient decodes an image from the given reader, like
+// CreateHashFromReader(), but first reads its EXIF orientation (see
+// ExifOrientation()) and transforms the image accordingly before it is
+// hashed (see WithOrientation()). The returned resized image is oriented
+// correctly.
+func CreateHashAutoOrient(r io.Reader, options ...HashOption) (Hash, image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Hash{}, nil, fmt.Errorf("Unable to read image: %s", err)
+	}
+	img, _, err := DecodeImage(bytes.NewReader(data))
+	if err != nil {
+		return Hash{}, nil, err
+	}
+	options = append(options[:len(options):len(options)], WithOrientation(ExifOrientation(data)))
+	return CreateHashOpts(img, options...)
+}
+
+// ExifOrientation returns the orientation value of the EXIF data embedded in
+// the given JPEG file (see OrientationNormal and the following constants). If
+// the file is not a JPEG file or does not contain an orientation value,
+// OrientationNormal is returned.
+func ExifOrientation(data []byte) int {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return OrientationNormal // Not a JPEG file.
+	}
+
+	// Find the APP1 segment with the EXIF data.
+	for position := 2; position+4 <= len(data); {
+		if data[position] != 0xff {
+			return OrientationNormal
+		}
+		marker := data[position+1]
+		if marker == 0xd8 || marker >= 0xd0 && marker <= 0xd7 || marker == 0x01 || marker == 0xff {
+			position++ // Markers without a length, or fill bytes.
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			return OrientationNormal // Start of the image data.
+		}
+		length := int(binary.BigEndian.Uint16(data[position+2:]))
+		if length < 2 || position+2+length > len(data) {
+			return OrientationNormal
+		}
+		segment := data[position+4 : position+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		position += 2 + length
+	}
+
+	return OrientationNormal
+}
+
+// tiffOrientation returns the orientation value found in the first image file
+// directory of the given TIFF data (the payload of an EXIF segment).
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return OrientationNormal
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return OrientationNormal
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return OrientationNormal
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for entry := 0; entry < entries; entry++ {
+		position := offset + 2 + 12*entry
+		if position+12 > len(tiff) {
+			break
+		}
+		const tagOrientation, typeShort = 0x0112, 3
+		if order.Uint16(tiff[position:]) != tagOrientation || order.Uint16(tiff[position+2:]) != typeShort {
+			continue
+		}
+		orientation := int(order.Uint16(tiff[position+8:]))
+		if orientation < OrientationNormal || orientation > OrientationRotate270 {
+			return OrientationNormal
+		}
+		return orientation
+	}
+	return OrientationNormal
+}
+
+// orient returns a copy of the given image, transformed according to the
+// given EXIF orientation value. For OrientationNormal and invalid values, the
+// image is returned unchanged.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= OrientationNormal || orientation > OrientationRotate270 {
+		return img
+	}
+
+	// Work on RGBA pixels.
+	bounds := img.Bounds()
+	source, ok := img.(*image.RGBA)
+	if !ok {
+		source = image.NewRGBA(bounds)
+		draw.Draw(source, bounds, img, bounds.Min, draw.Src)
+	}
+	width, height := bounds.Dx(), bounds.Dy()
+	if orientation >= OrientationTranspose {
+		width, height = height, width
+	}
+	result := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	// Map each target pixel to its source pixel.
+	w, h := bounds.Dx(), bounds.Dy()
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var sx, sy int
+			switch orientation {
+			case OrientationFlipH:
+				sx, sy = w-1-x, y
+			case OrientationRotate180:
+				sx, sy = w-1-x, h-1-y
+			case OrientationFlipV:
+				sx, sy = x, h-1-y
+			case OrientationTranspose:
+				sx, sy = y, x
+			case OrientationRotate90:
+				sx, sy = y, h-1-x
+			case OrientationTransverse:
+				sx, sy = w-1-y, h-1-x
+			case OrientationRotate270:
+				sx, sy = w-1-y, x
+			}
+			from := source.PixOffset(bounds.Min.X+sx, bounds.Min.Y+sy)
+			to := result.PixOffset(x, y)
+			copy(result.Pix[to:to+4], source.Pix[from:from+4])
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,60 @@
+package duplo
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// WithPadding causes the image to be resized to fit into ImageScale x
+// ImageScale pixels while keeping its aspect ratio, instead of being stretched
+// to that size. The remaining area is filled with the image's average colour.
+// This keeps the shapes of images with extreme aspect ratios, e.g. panoramas,
+// intact. The resulting hash's Padded field is set. Stores only match hashes
+// against images whose hashes were created in the same mode.
+func WithPadding() HashOption {
+	return func(config *hashConfig) {
+		config.padding = true
+	}
+}
+
+// paddedSize returns the size to which an image with the given ratio (width
+// divided by height) is resized so that it fits into ImageScale x ImageScale
+// pixels while keeping its ratio.
+func paddedSize(ratio float64) (width, height int) {
+	width, height = ImageScale, ImageScale
+	if ratio > 1 {
+		height = int(math.Round(ImageScale / ratio))
+	} else if ratio < 1 {
+		width = int(math.Round(ImageScale * ratio))
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return
+}
+
+// letterbox returns an ImageScale x ImageScale image with the given image,
+// which must not be larger, in its centre. The remaining area is filled with
+// the given colour or, if it is nil, with the given image's average colour.
+func letterbox(img image.Image, fill color.Color) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() == ImageScale && bounds.Dy() == ImageScale {
+		return img
+	}
+	content := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(content, content.Bounds(), img, bounds.Min, draw.Src)
+
+	if fill == nil {
+		fill = averageColour(content, content.Bounds())
+	}
+	padded := image.NewRGBA(image.Rect(0, 0, ImageScale, ImageScale))
+	draw.Draw(padded, padded.Bounds(), image.NewUniform(fill), image.Point{}, draw.Src)
+	offset := image.Pt((ImageScale-bounds.Dx())/2, (ImageScale-bounds.Dy())/2)
+	draw.Draw(padded, content.Bounds().Add(offset), content, image.Point{}, draw.Src)
+	return padded
+}
@@ -0,0 +1,145 @@
+package duplo
+
+import (
+	"fmt"
+	"time"
+)
+
+// Action is the action a deduplication plan proposes for an image.
+type Action int
+
+// The actions of a deduplication plan.
+const (
+	ActionKeep   Action = iota // Keep the image.
+	ActionDelete               // Delete the image.
+	ActionLink                 // Replace the image with a link to the kept image.
+)
+
+// String returns a textual representation of the action.
+func (action Action) String() string {
+	switch action {
+	case ActionKeep:
+		return "keep"
+	case ActionDelete:
+		return "delete"
+	case ActionLink:
+		return "link"
+	}
+	return fmt.Sprintf("Action(%d)", int(action))
+}
+
+// KeepPolicy determines which image of a cluster of duplicates is kept.
+type KeepPolicy int
+
+// The available keep policies.
+const (
+	KeepLargest  KeepPolicy = iota // Keep the image with the highest resolution.
+	KeepEarliest                   // Keep the image with the earliest timestamp.
+)
+
+// ImageInfo contains information about an image which is needed to decide
+// which image of a cluster to keep.
+type ImageInfo struct {
+	// The dimensions of the original image.
+	Width, Height int
+
+	// The time the image was taken or created.
+	Time time.Time
+}
+
+// Planner creates deduplication plans from clusters of duplicate images. A
+// plan only describes what should happen to each image; the planner itself
+// never touches any images, so plans can be reviewed before being executed.
+type Planner struct {
+	// Policy determines which image of a cluster is kept.
+	Policy KeepPolicy
+
+	// Pinned contains the IDs of images which must always be kept. If a
+	// cluster contains pinned images, the first of them is the image that
+	// replaces all other images of the cluster.
+	Pinned map[interface{}]bool
+
+	// Link causes the removed images to be replaced with links to the kept
+	// image (ActionLink) instead of being deleted (ActionDelete).
+	Link bool
+
+	// Info returns information about the image with the given ID. It is
+	// required for all policies.
+	Info func(id interface{}) (ImageInfo, error)
+}
+
+// PlanStep is the proposed action for one image.
+type PlanStep struct {
+	// The index of the cluster the image belongs to.
+	Cluster int
+
+	// The ID of the image.
+	ID interface{}
+
+	// The proposed action.
+	Action Action
+
+	// The ID of the image which is kept in place of this image. This is nil
+	// for images which are kept.
+	Target interface{}
+}
+
+// Plan returns a deduplication plan for the given clusters of duplicate
+// images. Every cluster results in exactly one image being kept (more if
+// multiple images are pinned) while all other images are deleted or linked.
+// Steps are returned in the order of the clusters and their images. Clusters
+// with less than two images are ignored.
+func (planner *Planner) Plan(clusters [][]interface{}) ([]PlanStep, error) {
+	var steps []PlanStep
+	for clusterIndex, cluster := range clusters {
+		if len(cluster) < 2 {
+			continue
+		}
+
+		// Determine the image to keep.
+		keep := -1
+		for index, id := range cluster {
+			if planner.Pinned[id] {
+				keep = index
+				break
+			}
+		}
+		if keep < 0 {
+			var (
+				best     ImageInfo
+				bestArea int
+			)
+			for index, id := range cluster {
+				if planner.Info == nil {
+					return nil, fmt.Errorf("No image information available for %v", id)
+				}
+				info, err := planner.Info(id)
+				if err != nil {
+					return nil, fmt.Errorf("Unable to get information for %v: %s", id, err)
+				}
+				area := info.Width * info.Height
+				switch {
+				case keep < 0,
+					planner.Policy == KeepLargest && area > bestArea,
+					planner.Policy == KeepEarliest && info.Time.Before(best.Time):
+					keep, best, bestArea = index, info, area
+				}
+			}
+		}
+
+		// Create the steps.
+		remove := ActionDelete
+		if planner.Link {
+			remove = ActionLink
+		}
+		for index, id := range cluster {
+			if index == keep || planner.Pinned[id] {
+				steps = append(steps, PlanStep{clusterIndex, id, ActionKeep, nil})
+			} else {
+				steps = append(steps, PlanStep{clusterIndex, id, remove, cluster[keep]})
+			}
+		}
+	}
+
+	return steps, nil
+}
@@ -0,0 +1,126 @@
+package duplo
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// postingsTail is the number of appended candidate indices after which they
+// are merged into the encoded part of a postings list.
+const postingsTail = 32
+
+// postings is the list of candidate indices of one index bucket, stored in a
+// compressed form: Most indices are sorted in ascending order and encoded as
+// the varint differences between consecutive indices. Indices are usually
+// spread evenly over the store, so buckets with many entries need only one
+// or two bytes per index instead of four. Indices appended to the bucket are
+// first kept in an uncompressed tail which is merged into the encoded part
+// when it becomes full.
+//
+// A postings value is never modified below its current lengths. New values
+// are created for changes other than appends. A copy of a postings value may
+// therefore be read while the original is appended to.
+type postings struct {
+	// The encoded, sorted indices.
+	encoded []byte
+
+	// The number of indices in "encoded".
+	count uint64
+
+	// The last (largest) index in "encoded".
+	last uint64
+
+	// Appended indices, in the order in which they were appended.
+	tail []uint64
+}
+
+// newPostings returns a postings list containing the given indices. The
+// provided slice is not modified.
+func newPostings(indices []uint64) postings {
+	sorted := make([]uint64, len(indices))
+	copy(sorted, indices)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var p postings
+	p.encode(sorted)
+	return p
+}
+
+// encode appends the given indices, which must be sorted and larger than all
+// encoded indices, to the encoded part.
+func (p *postings) encode(sorted []uint64) {
+	for _, index := range sorted {
+		if p.count == 0 {
+			p.encoded = binary.AppendUvarint(p.encoded, uint64(index))
+		} else {
+			p.encoded = binary.AppendUvarint(p.encoded, uint64(index-p.last))
+		}
+		p.last = index
+		p.count++
+	}
+}
+
+// len returns the number of indices in the list.
+func (p postings) len() int {
+	return int(p.count) + len(p.tail)
+}
+
+// append adds an index to the list. If the tail is full, it is merged into
+// the encoded part.
+func (p *postings) append(index uint64) {
+	p.tail = append(p.tail, index)
+	if len(p.tail) < postingsTail {
+		return
+	}
+
+	// Merge the tail.
+	sorted := make([]uint64, len(p.tail))
+	copy(sorted, p.tail)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	if p.count == 0 || sorted[0] > p.last {
+		// The usual case: Newer candidates have larger indices. The encoded
+		// part can be extended.
+		p.encode(sorted)
+		p.tail = nil
+		return
+	}
+	*p = newPostings(p.decode(nil))
+}
+
+// decode appends all indices of the list to the given buffer and returns the
+// result. The encoded indices come first, in ascending order, followed by the
+// tail.
+func (p postings) decode(buffer []uint64) []uint64 {
+	var index uint64
+	encoded := p.encoded
+	for position := uint64(0); position < p.count; position++ {
+		delta, n := binary.Uvarint(encoded)
+		encoded = encoded[n:]
+		if position == 0 {
+			index = uint64(delta)
+		} else {
+			index += uint64(delta)
+		}
+		buffer = append(buffer, index)
+	}
+	return append(buffer, p.tail...)
+}
+
+// filter returns a new postings list containing the indices of this list for
+// which "keep" returns true, mapped by "renumber" if it is not nil. If no
+// index is removed or renumbered, the list itself is returned.
+func (p postings) filter(keep func(index uint64) bool, renumber func(index uint64) uint64) postings {
+	indices := p.decode(nil)
+	filtered := indices[:0]
+	for _, index := range indices {
+		if keep == nil || keep(index) {
+			if renumber != nil {
+				index = renumber(index)
+			}
+			filtered = append(filtered, index)
+		}
+	}
+	if len(filtered) == len(indices) && renumber == nil {
+		return p
+	}
+	return newPostings(filtered)
+}
@@ -0,0 +1,180 @@
+package duplo
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// Preprocessor transforms an image before it is hashed, e.g. to make hashes
+// more robust against specific modifications (see WithPreprocessors()).
+type Preprocessor interface {
+	// Preprocess returns the transformed image. It may return the given
+	// image itself but it must not modify it.
+	Preprocess(img image.Image) image.Image
+}
+
+// PreprocessorFunc is a function which implements the Preprocessor interface.
+type PreprocessorFunc func(img image.Image) image.Image
+
+// Preprocess implements the Preprocessor interface.
+func (f PreprocessorFunc) Preprocess(img image.Image) image.Image {
+	return f(img)
+}
+
+// WithPreprocessors adds the given preprocessors to the preprocessing chain.
+// They are applied in the order in which they were added, after the options
+// WithOrientation() and WithTrimBorders(), before the image is resized and
+// hashed. Hashes created with different preprocessors should not be mixed in
+// the same store.
+func WithPreprocessors(preprocessors ...Preprocessor) HashOption {
+	return func(config *hashConfig) {
+		config.preprocessors = append(config.preprocessors, preprocessors...)
+	}
+}
+
+// OrientPreprocessor transforms images according to the given EXIF
+// orientation value, like WithOrientation().
+func OrientPreprocessor(orientation int) Preprocessor {
+	return PreprocessorFunc(func(img image.Image) image.Image {
+		return orient(img, orientation)
+	})
+}
+
+// TrimPreprocessor removes uniform borders from images, like
+// WithTrimBorders().
+func TrimPreprocessor(tolerance float64) Preprocessor {
+	return PreprocessorFunc(func(img image.Image) image.Image {
+		return TrimBorders(img, tolerance)
+	})
+}
+
+// CropPreprocessor keeps the centre of images, the given fraction (between 0
+// and 1) of their width and height, e.g. to ignore frames or watermarks close
+// to the edges.
+func CropPreprocessor(fraction float64) Preprocessor {
+	return PreprocessorFunc(func(img image.Image) image.Image {
+		if fraction <= 0 || fraction >= 1 {
+			return img
+		}
+		bounds := img.Bounds()
+		dx := int(float64(bounds.Dx()) * (1 - fraction) / 2)
+		dy := int(float64(bounds.Dy()) * (1 - fraction) / 2)
+		rect := image.Rect(bounds.Min.X+dx, bounds.Min.Y+dy, bounds.Max.X-dx, bounds.Max.Y-dy)
+		cropped, err := cropImage(img, rect)
+		if err != nil {
+			return img
+		}
+		return cropped
+	})
+}
+
+// GrayscalePreprocessor converts images to grayscale, e.g. so colourized or
+// desaturated copies match their originals. The chrominance channels of the
+// resulting hashes are constant.
+func GrayscalePreprocessor() Preprocessor {
+	return PreprocessorFunc(func(img image.Image) image.Image {
+		if _, ok := img.(*image.Gray); ok {
+			return img
+		}
+		bounds := img.Bounds()
+		gray := image.NewGray(bounds)
+		draw.Draw(gray, bounds, img, bounds.Min, draw.Src)
+		return gray
+	})
+}
+
+// BlurPreprocessor applies a Gaussian blur with the given standard deviation
+// (in pixels) to images. As images are processed at their original size, this
+// is slow for large images. See WithPreBlur() for a cheaper alternative.
+func BlurPreprocessor(sigma float64) Preprocessor {
+	return PreprocessorFunc(func(img image.Image) image.Image {
+		return gaussianBlur(img, sigma)
+	})
+}
+
+// GammaPreprocessor applies a gamma correction to images, mapping each colour
+// value v (between 0 and 1) to v^gamma. Values larger than 1 darken the image,
+// values smaller than 1 brighten it.
+func GammaPreprocessor(gamma float64) Preprocessor {
+	var table [256]uint8
+	for value := range table {
+		table[value] = uint8(math.Round(math.Pow(float64(value)/0xff, gamma) * 0xff))
+	}
+	return PreprocessorFunc(func(img image.Image) image.Image {
+		bounds := img.Bounds()
+		corrected := image.NewRGBA(bounds)
+		draw.Draw(corrected, bounds, img, bounds.Min, draw.Src)
+		for index := 0; index < len(corrected.Pix); index += 4 {
+			pixel := corrected.Pix[index : index+3]
+			pixel[0], pixel[1], pixel[2] = table[pixel[0]], table[pixel[1]], table[pixel[2]]
+		}
+		return corrected
+	})
+}
+
+// gaussianBlur returns a copy of the given image, blurred with a Gaussian
+// kernel of the given standard deviation (in pixels). The kernel is applied to
+// rows and columns separately, extending the image's edges. If sigma is not
+// positive, the image is only copied.
+func gaussianBlur(img image.Image, sigma float64) *image.RGBA {
+	bounds := img.Bounds()
+	source := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(source, source.Bounds(), img, bounds.Min, draw.Src)
+	if sigma <= 0 {
+		return source
+	}
+
+	// Calculate the kernel.
+	radius := int(math.Ceil(3 * sigma))
+	kernel := make([]float64, 2*radius+1)
+	var sum float64
+	for index := range kernel {
+		offset := float64(index - radius)
+		kernel[index] = math.Exp(-offset * offset / (2 * sigma * sigma))
+		sum += kernel[index]
+	}
+	for index := range kernel {
+		kernel[index] /= sum
+	}
+
+	// Blur along one axis.
+	width, height := bounds.Dx(), bounds.Dy()
+	pass := func(src, dst *image.RGBA, horizontal bool) {
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				var r, g, b float64
+				for index, weight := range kernel {
+					sx, sy := x, y
+					if horizontal {
+						sx = clampCoordinate(x+index-radius, width)
+					} else {
+						sy = clampCoordinate(y+index-radius, height)
+					}
+					pixel := src.Pix[src.PixOffset(sx, sy):]
+					r += weight * float64(pixel[0])
+					g += weight * float64(pixel[1])
+					b += weight * float64(pixel[2])
+				}
+				dst.SetRGBA(x, y, color.RGBA{uint8(math.Round(r)), uint8(math.Round(g)), uint8(math.Round(b)), 0xff})
+			}
+		}
+	}
+	temp := image.NewRGBA(source.Bounds())
+	pass(source, temp, true)
+	pass(temp, source, false)
+
+	return source
+}
+
+// clampCoordinate restricts the given coordinate to the interval [0,size).
+func clampCoordinate(coordinate, size int) int {
+	if coordinate < 0 {
+		return 0
+	}
+	if coordinate >= size {
+		return size - 1
+	}
+	return coordinate
+}
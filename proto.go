@@ -0,0 +1,761 @@
+package duplo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/rivo/duplo/haar"
+)
+
+// protoVersion is the version of the protocol buffers store format written by
+// Store.ExportProto().
+const protoVersion = 1
+
+// maxProtoField is the maximum length of a length-delimited protocol buffers
+// field accepted when decoding. It protects against allocating huge amounts of
+// memory for corrupt data.
+const maxProtoField = 1 << 28
+
+// Protocol buffers wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// MarshalProto encodes the hash as a protocol buffers "Hash" message as
+// defined in duplo.proto, which is part of this package. Unlike the other
+// encodings, this allows services written in other languages to read hashes
+// created by this package.
+func (hash Hash) MarshalProto() ([]byte, error) {
+	if uint(len(hash.Coefs)) != hash.Width*hash.Height {
+		return nil, fmt.Errorf("Number of coefficients (%d) does not match matrix dimensions %dx%d", len(hash.Coefs), hash.Width, hash.Height)
+	}
+
+	coefs := make([]float64, 0, len(hash.Coefs)*haar.ColourChannels)
+	for _, coef := range hash.Coefs {
+		coefs = append(coefs, coef[:]...)
+	}
+	message := appendProtoVarint(nil, 1, HashVersion)
+	message = appendProtoVarint(message, 2, uint64(hash.Width))
+	message = appendProtoVarint(message, 3, uint64(hash.Height))
+	message = appendProtoDoubles(message, 4, coefs)
+	message = appendProtoDoubles(message, 5, hash.Thresholds[:])
+	message = appendProtoFixed64(message, 6, math.Float64bits(hash.Ratio))
+	message = appendProtoFixed64s(message, 7, hash.DHash[:])
+	message = appendProtoFixed64(message, 8, hash.Histogram)
+	message = appendProtoFloats(message, 9, hash.HistoMax[:])
+	message = appendProtoBytes(message, 10, hash.HistogramCounts[:])
+	message = appendProtoFixed64s(message, 11, hash.Blockhash[:])
+	message = appendProtoFixed64(message, 12, hash.WHash)
+	if hash.Padded {
+		message = appendProtoVarint(message, 13, 1)
+	}
+
+	return message, nil
+}
+
+// UnmarshalProto decodes a protocol buffers "Hash" message (see
+// MarshalProto()). If the hash was created with a different HashVersion,
+// ErrHashVersion is returned.
+func (hash *Hash) UnmarshalProto(data []byte) error {
+	var (
+		decoded    Hash
+		version    uint64
+		width      uint64
+		height     uint64
+		coefs      []float64
+		thresholds []float64
+		dHash      []uint64
+		histoMax   []float32
+		blockhash  []uint64
+		ratio      uint64
+	)
+	if err := parseProto(bytes.NewReader(data), func(field int, wire int, value uint64, data []byte) (err error) {
+		switch field {
+		case 1:
+			version = value
+		case 2:
+			width = value
+		case 3:
+			height = value
+		case 4:
+			coefs, err = appendProtoDoubleValues(coefs, wire, value, data)
+		case 5:
+			thresholds, err = appendProtoDoubleValues(thresholds, wire, value, data)
+		case 6:
+			ratio, err = protoFixed64(wire, value)
+		case 7:
+			dHash, err = appendProtoFixed64Values(dHash, wire, value, data)
+		case 8:
+			decoded.Histogram, err = protoFixed64(wire, value)
+		case 9:
+			histoMax, err = appendProtoFloatValues(histoMax, wire, value, data)
+		case 10:
+			if len(data) != len(decoded.HistogramCounts) {
+				return errors.New("Invalid length of histogram counts")
+			}
+			copy(decoded.HistogramCounts[:], data)
+		case 11:
+			blockhash, err = appendProtoFixed64Values(blockhash, wire, value, data)
+		case 12:
+			decoded.WHash, err = protoFixed64(wire, value)
+		case 13:
+			decoded.Padded = value != 0
+		}
+		return
+	}); err != nil {
+		return fmt.Errorf("Unable to decode hash: %s", err)
+	}
+	if version != HashVersion {
+		return ErrHashVersion
+	}
+
+	// Check and copy the values.
+	if width*height != uint64(len(coefs)/haar.ColourChannels) || len(coefs)%haar.ColourChannels != 0 || len(coefs) > maxHashCoefs*haar.ColourChannels {
+		return fmt.Errorf("Number of coefficients (%d) does not match matrix dimensions %dx%d", len(coefs)/haar.ColourChannels, width, height)
+	}
+	decoded.Width, decoded.Height = uint(width), uint(height)
+	decoded.Coefs = make([]haar.Coef, len(coefs)/haar.ColourChannels)
+	for index := range decoded.Coefs {
+		copy(decoded.Coefs[index][:], coefs[index*haar.ColourChannels:])
+	}
+	if !copyProtoValues(decoded.Thresholds[:], thresholds) ||
+		!copyProtoValues(decoded.DHash[:], dHash) ||
+		!copyProtoValues(decoded.HistoMax[:], histoMax) ||
+		!copyProtoValues(decoded.Blockhash[:], blockhash) {
+		return errors.New("Unable to decode hash: Invalid number of values")
+	}
+	decoded.Ratio = math.Float64frombits(ratio)
+
+	*hash = decoded
+	return nil
+}
+
+// ExportProto writes the store to the given writer as a protocol buffers
+// "Store" message as defined in duplo.proto, which is part of this package.
+// This allows services written in other languages to read stores created by
+// this package. Only IDs which are strings or integers can be exported. Other
+// ID types cause an error. This also applies to the IDs on the negative list
+// (see MarkFalsePositive()) and the suppressed images (see Suppress()), which
+// are exported along with the images.
+//
+// Like WriteTo(), the images are written incrementally from a snapshot of the
+// store so the store is only locked briefly.
+func (store *Store) ExportProto(w io.Writer) error {
+	store.RLock()
+	store.distributing.Lock() // Wait for concurrent Add() calls to finish.
+	snapshot := store.takeSnapshot()
+	store.distributing.Unlock()
+	store.RUnlock()
+	defer store.releaseSnapshot()
+
+	// The header.
+	message := appendProtoVarint(nil, 1, protoVersion)
+	message = appendProtoVarint(message, 2, ImageScale)
+	message = appendProtoVarint(message, 3, uint64(TopCoefs))
+	if _, err := w.Write(message); err != nil {
+		return fmt.Errorf("Unable to write store: %s", err)
+	}
+
+	// The images.
+	var image []byte
+	for _, candidate := range snapshot.candidates {
+		if candidate.id == nil {
+			continue // Deleted.
+		}
+		var err error
+		if image, err = appendProtoID(image[:0], candidate.id); err != nil {
+			return err
+		}
+		image = appendProtoDoubles(image, 4, candidate.scaleCoef[:])
+		image = appendProtoFixed64(image, 5, math.Float64bits(candidate.ratio))
+		image = appendProtoFixed64s(image, 6, candidate.dHash[:])
+		image = appendProtoFixed64(image, 7, candidate.histogram)
+		image = appendProtoFloats(image, 8, candidate.histoMax[:])
+		if candidate.histogramCounts != nil {
+			image = appendProtoBytes(image, 9, candidate.histogramCounts[:])
+		}
+		image = appendProtoFixed64s(image, 10, candidate.blockhash[:])
+		image = appendProtoFixed64(image, 11, candidate.wHash)
+		image = appendProtoUint32s(image, 12, candidate.locations)
+		image = appendProtoVarint(image, 13, uint64(candidate.added))
+		image = appendProtoVarint(image, 14, candidate.generation)
+		if candidate.padded {
+			image = appendProtoVarint(image, 15, 1)
+		}
+
+		message = appendProtoBytes(message[:0], 4, image)
+		if _, err := w.Write(message); err != nil {
+			return fmt.Errorf("Unable to write store: %s", err)
+		}
+	}
+
+	// The negative list.
+	var negatives, id []byte
+	for key, ids := range snapshot.negatives {
+		negatives = appendProtoDoubles(negatives[:0], 1, key.scaleCoef[:])
+		negatives = appendProtoFixed64(negatives, 2, math.Float64bits(key.ratio))
+		negatives = appendProtoFixed64s(negatives, 3, key.dHash[:])
+		negatives = appendProtoFixed64(negatives, 4, key.histogram)
+		for negative := range ids {
+			var err error
+			if id, err = appendProtoID(id[:0], negative); err != nil {
+				return err
+			}
+			negatives = appendProtoBytes(negatives, 5, id)
+		}
+		message = appendProtoBytes(message[:0], 10, negatives)
+		if _, err := w.Write(message); err != nil {
+			return fmt.Errorf("Unable to write store: %s", err)
+		}
+	}
+
+	// The suppressed images and the configuration.
+	message = message[:0]
+	for suppressed := range snapshot.suppressed {
+		var err error
+		if id, err = appendProtoID(id[:0], suppressed); err != nil {
+			return err
+		}
+		message = appendProtoBytes(message, 11, id)
+	}
+	var weights []float64
+	for _, channel := range snapshot.weights {
+		weights = append(weights, channel[:]...)
+	}
+	message = appendProtoDoubles(message, 5, weights)
+	message = appendProtoDoubles(message, 6, snapshot.scoreWeights[:])
+	message = appendProtoVarint(message, 7, uint64(snapshot.topCoefs))
+	message = appendProtoVarint(message, 8, snapshot.generation)
+	if snapshot.largeIndex {
+		message = appendProtoVarint(message, 9, 1)
+	}
+	if _, err := w.Write(message); err != nil {
+		return fmt.Errorf("Unable to write store: %s", err)
+	}
+
+	return nil
+}
+
+// ImportProto reads a protocol buffers "Store" message (see ExportProto())
+// from the given reader, until its end, and replaces the store's contents with
+// it. Integer IDs are imported as int (signed) or uint (unsigned) values. An
+// error is returned if the store was created with different values of
+// ImageScale or TopCoefs. The store's contents are undefined in this case.
+func (store *Store) ImportProto(r io.Reader) error {
+	store.lockBuckets()
+	err := store.importProto(r)
+	store.unlockBuckets()
+
+	store.persistUnlogged()
+	return err
+}
+
+// importProto implements ImportProto(). The store must be locked with
+// lockBuckets() when calling this function.
+func (store *Store) importProto(r io.Reader) error {
+	store.clear()
+	var (
+		header       bool
+		weights      []float64
+		scoreWeights []float64
+		generation   uint64
+		suppressed   []interface{}
+	)
+	reader, ok := r.(protoReader)
+	if !ok {
+		reader = bufio.NewReader(r)
+	}
+	if err := parseProto(reader, func(field int, wire int, value uint64, data []byte) (err error) {
+		switch field {
+		case 1:
+			if value != protoVersion {
+				return fmt.Errorf("Store format version %d is not supported", value)
+			}
+		case 2:
+			if value != ImageScale {
+				return fmt.Errorf("Store was created with ImageScale %d, expected %d", value, ImageScale)
+			}
+			header = true
+		case 3:
+			if value != uint64(TopCoefs) {
+				return fmt.Errorf("Store was created with TopCoefs %d, expected %d", value, TopCoefs)
+			}
+		case 4:
+			if !header {
+				return errors.New("Images precede the store header")
+			}
+			return store.importProtoImage(data)
+		case 5:
+			weights, err = appendProtoDoubleValues(weights, wire, value, data)
+		case 6:
+			scoreWeights, err = appendProtoDoubleValues(scoreWeights, wire, value, data)
+		case 7:
+			store.topCoefs = int(value)
+		case 8:
+			generation = value
+		case 9:
+			store.largeIndex = store.largeIndex || value != 0
+		case 10:
+			return store.importProtoNegatives(data)
+		case 11:
+			id, err := parseProtoID(data)
+			if err != nil {
+				return err
+			}
+			suppressed = append(suppressed, id)
+		}
+		return
+	}); err != nil {
+		return fmt.Errorf("Unable to import store: %s", err)
+	}
+
+	// The suppressed images, which may precede the images.
+	for _, id := range suppressed {
+		if _, ok := store.ids[id]; ok {
+			store.suppress(id)
+		}
+	}
+
+	// The configuration.
+	if len(weights) > 0 {
+		var w Weights
+		if len(weights) != len(w)*len(w[0]) {
+			return errors.New("Unable to import store: Invalid number of weights")
+		}
+		for channel := range w {
+			copy(w[channel][:], weights[channel*len(w[0]):])
+		}
+		store.setWeights(w)
+	}
+	if len(scoreWeights) > 0 && !copyProtoValues(store.scoreWeights[:], scoreWeights) {
+		return errors.New("Unable to import store: Invalid number of score weights")
+	}
+	store.generation = generation
+	store.modified = false
+
+	return nil
+}
+
+// importProtoImage adds an "Image" message to the store. The store must be
+// locked with lockBuckets() when calling this function.
+func (store *Store) importProtoImage(data []byte) error {
+	var (
+		entry     candidate
+		scaleCoef []float64
+		dHash     []uint64
+		histoMax  []float32
+		blockhash []uint64
+		locations []uint32
+		ratio     uint64
+	)
+	if err := parseProto(bytes.NewReader(data), func(field int, wire int, value uint64, data []byte) (err error) {
+		switch field {
+		case 1, 2, 3:
+			entry.id = protoID(field, value, data)
+		case 4:
+			scaleCoef, err = appendProtoDoubleValues(scaleCoef, wire, value, data)
+		case 5:
+			ratio, err = protoFixed64(wire, value)
+		case 6:
+			dHash, err = appendProtoFixed64Values(dHash, wire, value, data)
+		case 7:
+			entry.histogram, err = protoFixed64(wire, value)
+		case 8:
+			histoMax, err = appendProtoFloatValues(histoMax, wire, value, data)
+		case 9:
+			if len(data) != 64 {
+				return errors.New("Invalid length of histogram counts")
+			}
+			entry.histogramCounts = new([64]uint8)
+			copy(entry.histogramCounts[:], data)
+		case 10:
+			blockhash, err = appendProtoFixed64Values(blockhash, wire, value, data)
+		case 11:
+			entry.wHash, err = protoFixed64(wire, value)
+		case 12:
+			locations, err = appendProtoUint32Values(locations, wire, value, data)
+		case 13:
+			entry.added = int64(value)
+		case 14:
+			entry.generation = value
+		case 15:
+			entry.padded = value != 0
+		}
+		return
+	}); err != nil {
+		return err
+	}
+
+	// Check and copy the values.
+	if entry.id == nil {
+		return errors.New("Image without ID")
+	}
+	if _, ok := store.ids[entry.id]; ok {
+		return fmt.Errorf("Image ID %v occurs more than once", entry.id)
+	}
+	if !copyProtoValues(entry.scaleCoef[:], scaleCoef) ||
+		!copyProtoValues(entry.dHash[:], dHash) ||
+		!copyProtoValues(entry.histoMax[:], histoMax) ||
+		!copyProtoValues(entry.blockhash[:], blockhash) {
+		return fmt.Errorf("Invalid number of values for image %v", entry.id)
+	}
+	entry.ratio = math.Float64frombits(ratio)
+	for index, location := range locations {
+		if int(location) >= len(store.indices) || index > 0 && location <= locations[index-1] {
+			return fmt.Errorf("Invalid bucket locations for image %v", entry.id)
+		}
+	}
+	entry.locations = locations
+
+	store.distribute(store.place(entry), entry.locations)
+	return nil
+}
+
+// importProtoNegatives adds a "Negatives" message to the store's negative
+// list. The store must be locked with lockBuckets() when calling this
+// function.
+func (store *Store) importProtoNegatives(data []byte) error {
+	var (
+		key       hashKey
+		scaleCoef []float64
+		dHash     []uint64
+		ratio     uint64
+		ids       []interface{}
+	)
+	if err := parseProto(bytes.NewReader(data), func(field int, wire int, value uint64, data []byte) (err error) {
+		switch field {
+		case 1:
+			scaleCoef, err = appendProtoDoubleValues(scaleCoef, wire, value, data)
+		case 2:
+			ratio, err = protoFixed64(wire, value)
+		case 3:
+			dHash, err = appendProtoFixed64Values(dHash, wire, value, data)
+		case 4:
+			key.histogram, err = protoFixed64(wire, value)
+		case 5:
+			var id interface{}
+			id, err = parseProtoID(data)
+			ids = append(ids, id)
+		}
+		return
+	}); err != nil {
+		return err
+	}
+	if !copyProtoValues(key.scaleCoef[:], scaleCoef) || !copyProtoValues(key.dHash[:], dHash) {
+		return errors.New("Invalid number of values for negative list")
+	}
+	key.ratio = math.Float64frombits(ratio)
+	for _, id := range ids {
+		store.markNegative(key, id)
+	}
+	return nil
+}
+
+// appendProtoID appends the "id" field of an "Image" or "ID" message to a
+// protocol buffers message. An error is returned for IDs which are neither
+// strings nor integers.
+func appendProtoID(message []byte, id interface{}) ([]byte, error) {
+	switch id := id.(type) {
+	case string:
+		return appendProtoBytes(message, 1, []byte(id)), nil
+	case int, int8, int16, int32, int64:
+		value := protoInt(id)
+		message = appendProtoTag(message, 2, wireVarint)
+		return binary.AppendUvarint(message, uint64(value<<1)^uint64(value>>63)), nil // Zigzag encoding.
+	case uint, uint8, uint16, uint32, uint64:
+		message = appendProtoTag(message, 3, wireVarint)
+		return binary.AppendUvarint(message, protoUint(id)), nil
+	default:
+		return nil, fmt.Errorf("Image ID %v of type %T cannot be exported", id, id)
+	}
+}
+
+// protoID returns the ID encoded in the given field of the "id" field (see
+// appendProtoID()).
+func protoID(field int, value uint64, data []byte) interface{} {
+	switch field {
+	case 1:
+		return string(data)
+	case 2:
+		return int(int64(value>>1) ^ -int64(value&1)) // Zigzag encoding.
+	default:
+		return uint(value)
+	}
+}
+
+// parseProtoID decodes an "ID" message.
+func parseProtoID(data []byte) (id interface{}, err error) {
+	if err := parseProto(bytes.NewReader(data), func(field int, wire int, value uint64, data []byte) error {
+		if field >= 1 && field <= 3 {
+			id = protoID(field, value, data)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if id == nil {
+		return nil, errors.New("Missing ID")
+	}
+	return id, nil
+}
+
+// protoInt returns the value of a signed integer of any size.
+func protoInt(value interface{}) int64 {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	default:
+		return v.(int64)
+	}
+}
+
+// protoUint returns the value of an unsigned integer of any size.
+func protoUint(value interface{}) uint64 {
+	switch v := value.(type) {
+	case uint:
+		return uint64(v)
+	case uint8:
+		return uint64(v)
+	case uint16:
+		return uint64(v)
+	case uint32:
+		return uint64(v)
+	default:
+		return v.(uint64)
+	}
+}
+
+// appendProtoTag appends a field's tag to a protocol buffers message.
+func appendProtoTag(message []byte, field, wire int) []byte {
+	return binary.AppendUvarint(message, uint64(field<<3|wire))
+}
+
+// appendProtoVarint appends a varint field to a protocol buffers message. As
+// in proto3, nothing is appended for 0.
+func appendProtoVarint(message []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return message
+	}
+	return binary.AppendUvarint(appendProtoTag(message, field, wireVarint), value)
+}
+
+// appendProtoFixed64 appends a fixed64 or double field to a protocol buffers
+// message. As in proto3, nothing is appended for 0.
+func appendProtoFixed64(message []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return message
+	}
+	return binary.LittleEndian.AppendUint64(appendProtoTag(message, field, wireFixed64), value)
+}
+
+// appendProtoBytes appends a length-delimited field to a protocol buffers
+// message.
+func appendProtoBytes(message []byte, field int, data []byte) []byte {
+	message = binary.AppendUvarint(appendProtoTag(message, field, wireBytes), uint64(len(data)))
+	return append(message, data...)
+}
+
+// appendProtoPacked appends a packed repeated field of "size" values, each
+// encoded by the given function, to a protocol buffers message.
+func appendProtoPacked(message []byte, field, size int, encode func(data []byte, index int) []byte) []byte {
+	var data []byte
+	for index := 0; index < size; index++ {
+		data = encode(data, index)
+	}
+	return appendProtoBytes(message, field, data)
+}
+
+// appendProtoDoubles appends a packed repeated double field to a protocol
+// buffers message.
+func appendProtoDoubles(message []byte, field int, values []float64) []byte {
+	return appendProtoPacked(message, field, len(values), func(data []byte, index int) []byte {
+		return binary.LittleEndian.AppendUint64(data, math.Float64bits(values[index]))
+	})
+}
+
+// appendProtoFloats appends a packed repeated float field to a protocol
+// buffers message.
+func appendProtoFloats(message []byte, field int, values []float32) []byte {
+	return appendProtoPacked(message, field, len(values), func(data []byte, index int) []byte {
+		return binary.LittleEndian.AppendUint32(data, math.Float32bits(values[index]))
+	})
+}
+
+// appendProtoFixed64s appends a packed repeated fixed64 field to a protocol
+// buffers message.
+func appendProtoFixed64s(message []byte, field int, values []uint64) []byte {
+	return appendProtoPacked(message, field, len(values), func(data []byte, index int) []byte {
+		return binary.LittleEndian.AppendUint64(data, values[index])
+	})
+}
+
+// appendProtoUint32s appends a packed repeated uint32 field to a protocol
+// buffers message.
+func appendProtoUint32s(message []byte, field int, values []uint32) []byte {
+	return appendProtoPacked(message, field, len(values), func(data []byte, index int) []byte {
+		return binary.AppendUvarint(data, uint64(values[index]))
+	})
+}
+
+// protoReader is the reader type that protocol buffers messages are parsed
+// from.
+type protoReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// parseProto parses the fields of a protocol buffers message read from the
+// given reader until its end and calls "handle" for each of them with the
+// field number, the wire type, and the field's value: For varint and fixed
+// size fields, "value" holds the number, for length-delimited fields, "data"
+// holds the bytes. Group fields are not supported.
+func parseProto(r protoReader, handle func(field int, wire int, value uint64, data []byte) error) error {
+	for {
+		tag, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		field, wire := int(tag>>3), int(tag&7)
+		var (
+			value uint64
+			data  []byte
+		)
+		switch wire {
+		case wireVarint:
+			value, err = binary.ReadUvarint(r)
+		case wireFixed64:
+			var fixed [8]byte
+			_, err = io.ReadFull(r, fixed[:])
+			value = binary.LittleEndian.Uint64(fixed[:])
+		case wireFixed32:
+			var fixed [4]byte
+			_, err = io.ReadFull(r, fixed[:])
+			value = uint64(binary.LittleEndian.Uint32(fixed[:]))
+		case wireBytes:
+			var length uint64
+			length, err = binary.ReadUvarint(r)
+			if err == nil && length > maxProtoField {
+				err = fmt.Errorf("Field %d is too long", field)
+			}
+			if err == nil {
+				data = make([]byte, length)
+				_, err = io.ReadFull(r, data)
+			}
+		default:
+			err = fmt.Errorf("Unsupported wire type %d of field %d", wire, field)
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		if err := handle(field, wire, value, data); err != nil {
+			return err
+		}
+	}
+}
+
+// wireFixed64 returns the value of a fixed64 or double field.
+func protoFixed64(wire int, value uint64) (uint64, error) {
+	if wire != wireFixed64 {
+		return 0, errors.New("Invalid fixed64 field")
+	}
+	return value, nil
+}
+
+// appendProtoDoubleValues appends the values of a repeated double field,
+// packed or not, to the given slice.
+func appendProtoDoubleValues(values []float64, wire int, value uint64, data []byte) ([]float64, error) {
+	switch {
+	case wire == wireFixed64:
+		return append(values, math.Float64frombits(value)), nil
+	case wire == wireBytes && len(data)%8 == 0:
+		for ; len(data) > 0; data = data[8:] {
+			values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(data)))
+		}
+		return values, nil
+	}
+	return nil, errors.New("Invalid double field")
+}
+
+// appendProtoFloatValues appends the values of a repeated float field, packed
+// or not, to the given slice.
+func appendProtoFloatValues(values []float32, wire int, value uint64, data []byte) ([]float32, error) {
+	switch {
+	case wire == wireFixed32:
+		return append(values, math.Float32frombits(uint32(value))), nil
+	case wire == wireBytes && len(data)%4 == 0:
+		for ; len(data) > 0; data = data[4:] {
+			values = append(values, math.Float32frombits(binary.LittleEndian.Uint32(data)))
+		}
+		return values, nil
+	}
+	return nil, errors.New("Invalid float field")
+}
+
+// appendProtoFixed64Values appends the values of a repeated fixed64 field,
+// packed or not, to the given slice.
+func appendProtoFixed64Values(values []uint64, wire int, value uint64, data []byte) ([]uint64, error) {
+	switch {
+	case wire == wireFixed64:
+		return append(values, value), nil
+	case wire == wireBytes && len(data)%8 == 0:
+		for ; len(data) > 0; data = data[8:] {
+			values = append(values, binary.LittleEndian.Uint64(data))
+		}
+		return values, nil
+	}
+	return nil, errors.New("Invalid fixed64 field")
+}
+
+// appendProtoUint32Values appends the values of a repeated uint32 field,
+// packed or not, to the given slice.
+func appendProtoUint32Values(values []uint32, wire int, value uint64, data []byte) ([]uint32, error) {
+	switch wire {
+	case wireVarint:
+		return append(values, uint32(value)), nil
+	case wireBytes:
+		for len(data) > 0 {
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, errors.New("Invalid uint32 field")
+			}
+			values = append(values, uint32(value))
+			data = data[n:]
+		}
+		return values, nil
+	}
+	return nil, errors.New("Invalid uint32 field")
+}
+
+// copyProtoValues copies the decoded values of a repeated field into the given
+// array slice and returns true if their numbers match or if there were no
+// values.
+func copyProtoValues[T any](array []T, values []T) bool {
+	if len(values) == 0 {
+		return true
+	}
+	if len(values) != len(array) {
+		return false
+	}
+	copy(array, values)
+	return true
+}
@@ -0,0 +1,223 @@
+package duplo
+
+import (
+	"encoding/gob"
+	"errors"
+)
+
+var (
+	// ErrIDExists is returned by AddStrict() and by Put() when the
+	// RejectDuplicates policy is used and the ID is already contained in the
+	// store.
+	ErrIDExists = errors.New("Image ID is already contained in the store")
+
+	// ErrIDNotFound is returned by DeleteStrict() when the ID is not
+	// contained in the store.
+	ErrIDNotFound = errors.New("Image ID is not contained in the store")
+
+	// ErrStoreFull is returned by AddStrict() and Put() when the store has
+	// reached its capacity (see WithLargeIndex()).
+	ErrStoreFull = errors.New("Store is full")
+)
+
+// DuplicatePolicy decides what happens when Put() is called with an ID which
+// is already contained in the store. It receives the ID, the hash of the
+// stored image as reconstructed by GetHash() (which is lossy), and the hash
+// which was passed to Put(). If it returns true, the stored image is replaced.
+// If it returns an error, Put() returns that error. A custom policy may be
+// used, e.g., to log modified files.
+type DuplicatePolicy func(id interface{}, stored, added Hash) (replace bool, err error)
+
+var (
+	// IgnoreDuplicates keeps the stored image. This is what Add() does.
+	IgnoreDuplicates DuplicatePolicy = func(id interface{}, stored, added Hash) (bool, error) {
+		return false, nil
+	}
+
+	// ReplaceDuplicates always replaces the stored image.
+	ReplaceDuplicates DuplicatePolicy = func(id interface{}, stored, added Hash) (bool, error) {
+		return true, nil
+	}
+
+	// ReplaceChanged replaces the stored image if its hash differs from the
+	// added one, e.g. because the file was modified. The hashes are compared
+	// by their scaling function coefficient, ratio, dHash, histogram,
+	// Blockhash, and wHash.
+	ReplaceChanged DuplicatePolicy = func(id interface{}, stored, added Hash) (bool, error) {
+		return len(added.Coefs) == 0 ||
+			stored.Coefs[0] != added.Coefs[0] ||
+			stored.Ratio != added.Ratio ||
+			stored.DHash != added.DHash ||
+			stored.Histogram != added.Histogram ||
+			stored.Blockhash != added.Blockhash ||
+			stored.WHash != added.WHash, nil
+	}
+
+	// RejectDuplicates keeps the stored image and causes Put() to return
+	// ErrIDExists.
+	RejectDuplicates DuplicatePolicy = func(id interface{}, stored, added Hash) (bool, error) {
+		return false, ErrIDExists
+	}
+)
+
+// Put adds an image to the store, like Add(), but if the ID is already
+// contained in the store, the given policy decides whether the stored image is
+// kept or replaced by the new one, or whether an error is returned. A nil
+// policy is the same as IgnoreDuplicates. The policy is not called while the
+// store is locked. If the stored image is modified by another goroutine while
+// the policy is deciding, the policy is called again. If a new image cannot be
+// added because the store is full, ErrStoreFull is returned.
+func (store *Store) Put(id interface{}, hash Hash, policy DuplicatePolicy) error {
+	if policy == nil {
+		policy = IgnoreDuplicates
+	}
+
+	for {
+		// Get the stored image, if any.
+		store.RLock()
+		index, ok := store.ids[id]
+		var (
+			stored     Hash
+			generation uint64
+		)
+		if ok {
+			stored = store.candidateHash(index)
+			generation = store.candidates[index].generation
+		}
+		store.RUnlock()
+
+		// A new image.
+		if !ok {
+			err := store.addConcurrently(id, hash)
+			if err == ErrIDExists {
+				continue // Someone else added it in the meantime.
+			}
+			if err == nil {
+				// We need this for when we serialize the store.
+				gob.Register(id)
+			}
+			return err
+		}
+
+		// An existing image.
+		replace, err := policy(id, stored, hash)
+		if err != nil || !replace {
+			return err
+		}
+		store.lockBuckets()
+		if current, ok := store.ids[id]; !ok || current != index || store.candidates[index].generation != generation {
+			store.unlockBuckets()
+			continue // Someone else modified it in the meantime.
+		}
+		store.update(index, hash)
+		store.unlockBuckets()
+		return nil
+	}
+}
+
+// AddStrict is like Add() but it returns ErrIDExists if the ID is already
+// contained in the store and ErrStoreFull if the store is full, instead of
+// silently ignoring the image.
+func (store *Store) AddStrict(id interface{}, hash Hash) error {
+	if err := store.addConcurrently(id, hash); err != nil {
+		return err
+	}
+
+	// We need this for when we serialize the store.
+	gob.Register(id)
+	return nil
+}
+
+// DeleteStrict is like Delete() but it returns ErrIDNotFound if the ID is not
+// contained in the store.
+func (store *Store) DeleteStrict(id interface{}) error {
+	// Check for the ID without blocking queries.
+	if !store.Has(id) {
+		return ErrIDNotFound
+	}
+
+	store.lockBuckets()
+	defer store.unlockBuckets()
+
+	if !store.delete(id) {
+		return ErrIDNotFound // Someone else deleted it in the meantime.
+	}
+	return nil
+}
+
+// Update replaces the hash of the image with the given ID, e.g. after the
+// image file was edited, and returns true. Unlike Delete() followed by Add(),
+// the image keeps its candidate slot and only the index lists which differ
+// between the old and the new hash are rewritten. The image is treated as if
+// it had been added in the new store generation (see Generation()). If the ID
+// is not contained in the store, nothing happens and false is returned.
+func (store *Store) Update(id interface{}, hash Hash) bool {
+	// Check for the ID without blocking queries.
+	if !store.Has(id) {
+		return false
+	}
+
+	store.lockBuckets()
+	defer store.unlockBuckets()
+
+	index, ok := store.ids[id]
+	if !ok {
+		return false // Someone else deleted it in the meantime.
+	}
+	store.update(index, hash)
+	return true
+}
+
+// Upsert replaces the hash of the image with the given ID (see Update()) or
+// adds the image if the ID is not contained in the store yet. It is the same
+// as calling Put() with the ReplaceDuplicates policy.
+func (store *Store) Upsert(id interface{}, hash Hash) {
+	store.Put(id, hash, ReplaceDuplicates)
+}
+
+// update replaces the hash of the image in the candidate slot with the given
+// index. The store must be locked with lockBuckets() when calling this
+// function.
+func (store *Store) update(index uint64, hash Hash) {
+	hash.Thresholds = store.thresholds(hash)
+	locations := hash.SignificanceMap()
+	store.ownCandidates()
+	old := store.candidates[index]
+	entry := store.newCandidate(old.id, hash, locations)
+	store.markModified()
+	store.logDelete(old.id)
+	store.logAdd(&entry)
+	if store.suppressed[old.id] {
+		store.logSuppress(old.id, true) // A replayed deletion unsuppresses it.
+	}
+
+	// Fix up the index lists. Both location lists are sorted.
+	var added SignificanceMap
+	i, j := 0, 0
+	for i < len(old.locations) || j < len(locations) {
+		switch {
+		case j == len(locations) || i < len(old.locations) && old.locations[i] < locations[j]:
+			store.indices[old.locations[i]] = store.indices[old.locations[i]].filter(func(other uint64) bool {
+				return other != index
+			}, nil)
+			i++
+		case i == len(old.locations) || locations[j] < old.locations[i]:
+			added = append(added, locations[j])
+			j++
+		default:
+			i++ // In both lists, keep it.
+			j++
+		}
+	}
+	store.distribute(index, added)
+
+	// Replace the candidate.
+	if store.dHashes != nil {
+		store.dHashes.remove(index, old.dHash)
+		store.dHashes.add(index, entry.dHash)
+	}
+	store.countKey(&old, -1)
+	store.candidates[index] = entry
+	store.countKey(&store.candidates[index], 1)
+	store.migrateNegatives(&old, &store.candidates[index])
+}
@@ -0,0 +1,204 @@
+package duplo
+
+import (
+	"container/heap"
+	"math"
+)
+
+// QueryOptions customize a similarity query (see Store.QueryWithOptions()).
+// Zero values disable the respective option.
+type QueryOptions struct {
+	// MaxResults is the maximum number of matches returned. If it is not 0,
+	// only the best MaxResults matches are returned, sorted by their score
+	// (best first).
+	MaxResults int
+
+	// ScoreThreshold, if not 0, causes only matches with a score lower than
+	// this threshold to be returned.
+	ScoreThreshold float64
+
+	// MaxDHashDistance, if not 0, causes only matches with a dHash distance
+	// of at most this value to be returned.
+	MaxDHashDistance int
+
+	// MaxRatioDiff, if not 0, causes only matches with a ratio difference of
+	// at most this value to be returned.
+	MaxRatioDiff float64
+
+	// SignOnly selects a fast query mode which scores candidates purely by the
+	// number of significant coefficients they share with the query image,
+	// including their signs, using integer arithmetic only. The score of the
+	// resulting matches is the negative Match.SignAgreement. Only the matches'
+	// IDs are resolved, their other metrics are not calculated. This mode is
+	// useful as a cheap first stage on constrained devices. HistogramMetric
+	// and the composite score (see Store.SetScoreWeights()) are ignored.
+	SignOnly bool
+
+	// ScoreComponents causes the terms which make up the matches' Haar scores
+	// to be returned in Match.Components, e.g. as features for a learned
+	// re-ranking of the results. It is ignored for sign-only queries.
+	ScoreComponents bool
+
+	// FalsePositivePenalty determines how matches on the store's negative list
+	// (see Store.MarkFalsePositive()) are treated. If it is 0, they are not
+	// returned. Otherwise, it is added to their score so they are ranked lower.
+	// The negative list is ignored for sign-only queries.
+	FalsePositivePenalty float64
+
+	// DHashPrescreen selects a two-stage query if MaxDHashDistance is not 0:
+	// Candidates are first selected by their dHash distance alone, using the
+	// store's dHash index (see Store.QueryDHash()), and only those are scored
+	// and turned into matches. The index buckets are not scanned. This is
+	// much faster on large stores and returns the same matches as a query
+	// without prescreening. It is ignored for sign-only queries. The dHash
+	// index is built by the first query with this option (when called with
+	// Store.QueryWithOptions()) or by Store.QueryDHash(). Without it, the
+	// dHashes of all candidates are compared, which is still faster than
+	// scanning the index buckets.
+	DHashPrescreen bool
+
+	// HistogramMetric determines how Match.ColourDistance is calculated.
+	// Metrics other than HistogramHamming require histogram counts to be
+	// retained (see RetainHistogramCounts). For images without histogram
+	// counts, HistogramHamming is used.
+	HistogramMetric HistogramMetric
+
+	// MaxBucketFraction, if not 0, causes index buckets which contain more
+	// than this fraction of the store's images to be skipped when scoring
+	// candidates. Such buckets, typically those of common low-frequency
+	// coefficients, act like stop words in text search: They dominate the
+	// query time but hardly discriminate between images. A value of 0.1 skips
+	// buckets shared by more than 10% of the images. Candidates which only
+	// share skipped buckets with the query image are not returned. As stores
+	// with few images have relatively large buckets, this is mostly useful
+	// for large stores. It is ignored for sign-only and prescreened queries.
+	MaxBucketFraction float64
+
+	// NormalizeScores causes the Haar scores of the matches to be divided by
+	// the number of significant coefficients of the query image, i.e. by the
+	// number of weight subtractions which an identical image would receive.
+	// Raw Haar scores grow with the number of index buckets the query image
+	// occupies, which depends on the image's content. Normalized scores are
+	// comparable across query images so a single ScoreThreshold can be used
+	// for all of them. The ranking of the matches of a query does not change.
+	// The score components (see ScoreComponents) are normalized as well.
+	NormalizeScores bool
+}
+
+// maxBucket returns the maximum number of entries of the index buckets which
+// are scanned by a query in a store with the given number of images (see
+// MaxBucketFraction), or 0 if there is no maximum.
+func (options *QueryOptions) maxBucket(images int) int {
+	if options.MaxBucketFraction <= 0 {
+		return 0
+	}
+	return int(math.Max(1, options.MaxBucketFraction*float64(images)))
+}
+
+// defaultQueryOptions are the query options used when none are provided.
+var defaultQueryOptions QueryOptions
+
+// excludes returns whether the given candidate is never returned for the given
+// hash, regardless of query options: Because it is suppressed (see
+// Suppress()), because it is on the hash's negative list (provided as
+// "negatives", see MarkFalsePositive()), or because it was hashed in a
+// different padding mode (see Hash.Padded). The store must be at least
+// read-locked when calling this function.
+func (store *Store) excludes(candidate *candidate, hash Hash, negatives map[interface{}]bool) bool {
+	return store.suppressed[candidate.id] || negatives[candidate.id] || candidate.padded != hash.Padded
+}
+
+// accepts returns whether a candidate with the given score passes the filters
+// of the query options when queried with the given hash. Candidates whose
+// hashes were created in a different padding mode (see Hash.Padded) are never
+// accepted.
+func (options *QueryOptions) accepts(candidate *candidate, score float64, hash Hash) bool {
+	if candidate.padded != hash.Padded {
+		return false
+	}
+	if options.ScoreThreshold != 0 && score >= options.ScoreThreshold {
+		return false
+	}
+	if options.MaxRatioDiff != 0 && math.Abs(math.Log(candidate.ratio)-math.Log(hash.Ratio)) > options.MaxRatioDiff {
+		return false
+	}
+	if options.MaxDHashDistance != 0 && HammingDistance(candidate.dHash[0], hash.DHash[0])+
+		HammingDistance(candidate.dHash[1], hash.DHash[1]) > options.MaxDHashDistance {
+		return false
+	}
+	return true
+}
+
+// matchHeap is a max-heap of matches, the match with the worst (highest)
+// score being at the top. It is used to keep the best matches of a query.
+type matchHeap Matches
+
+func (h matchHeap) Len() int            { return len(h) }
+func (h matchHeap) Less(i, j int) bool  { return h[i].Score > h[j].Score }
+func (h matchHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *matchHeap) Push(x interface{}) { *h = append(*h, x.(*Match)) }
+func (h *matchHeap) Pop() interface{} {
+	old := *h
+	match := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return match
+}
+
+// matchCollector collects the matches of a query, keeping only the best
+// matches if the number of results is limited.
+type matchCollector struct {
+	maxResults int
+	matches    Matches
+	top        matchHeap
+}
+
+// newMatchCollector returns a new collector for the given maximum number of
+// results (0 for no limit) and the given expected number of matches.
+func newMatchCollector(maxResults, numMatches int) *matchCollector {
+	collector := &matchCollector{maxResults: maxResults}
+	if maxResults > 0 {
+		if maxResults < numMatches {
+			numMatches = maxResults
+		}
+		collector.top = make(matchHeap, 0, numMatches)
+	} else {
+		collector.matches = make(Matches, 0, numMatches)
+	}
+	return collector
+}
+
+// rejects returns true if a match with the given score would not be kept
+// because there are already enough better matches.
+func (c *matchCollector) rejects(score float64) bool {
+	return c.maxResults > 0 && len(c.top) == c.maxResults && score >= c.top[0].Score
+}
+
+// add adds a match to the collector.
+func (c *matchCollector) add(match *Match) {
+	if c.maxResults <= 0 {
+		c.matches = append(c.matches, match)
+	} else if len(c.top) < c.maxResults {
+		heap.Push(&c.top, match)
+	} else if match.Score < c.top[0].Score {
+		c.top[0] = match
+		heap.Fix(&c.top, 0)
+	}
+}
+
+// result returns the collected matches. If the number of results is limited,
+// they are sorted by score (best first).
+func (c *matchCollector) result() Matches {
+	if c.maxResults > 0 {
+		return c.top.topMatches()
+	}
+	return c.matches
+}
+
+// topMatches returns the matches in the heap, sorted by score (best first).
+func (h *matchHeap) topMatches() Matches {
+	matches := make(Matches, h.Len())
+	for index := len(matches) - 1; index >= 0; index-- {
+		matches[index] = heap.Pop(h).(*Match)
+	}
+	return matches
+}
@@ -0,0 +1,119 @@
+package duplo
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Tile identifies a part of an image which was added to a store with
+// AddTiled(). Queries return it as the ID of matching tiles.
+type Tile struct {
+	// The ID of the image which contains the tile.
+	ID interface{}
+
+	// The tile's region within the image.
+	Rect image.Rectangle
+}
+
+// regionImage restricts an image to a region.
+type regionImage struct {
+	image.Image
+	rect image.Rectangle
+}
+
+// Bounds returns the region.
+func (r regionImage) Bounds() image.Rectangle {
+	return r.rect
+}
+
+// At returns the colour of the pixel at (x,y) which must be inside the region.
+func (r regionImage) At(x, y int) color.Color {
+	return r.Image.At(x, y)
+}
+
+// cropImage returns the part of the image inside the given rectangle. The
+// rectangle is clipped to the image bounds. An error is returned if it does
+// not overlap the image.
+func cropImage(img image.Image, rect image.Rectangle) (image.Image, error) {
+	if img == nil {
+		return nil, errors.New("Unable to crop nil image")
+	}
+	clipped := rect.Intersect(img.Bounds())
+	if clipped.Empty() {
+		return nil, fmt.Errorf("Region %s is outside of the image bounds %s", rect, img.Bounds())
+	}
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(clipped), nil
+	}
+	return regionImage{img, clipped}, nil
+}
+
+// QueryRegion hashes the given region of an image and queries the store with
+// the resulting hash (see QueryWithOptions()). The region is clipped to the
+// image bounds and scaled like any other image. Its ratio is that of the
+// region, not of the image. This allows finding images which contain the
+// region's content, e.g. a logo, in stores which contain tiles of images (see
+// AddTiled()). Hash options may be provided to customize the hashing (see
+// CreateHashOpts()).
+func (store *Store) QueryRegion(img image.Image, rect image.Rectangle, options *QueryOptions, hashOptions ...HashOption) (Matches, error) {
+	region, err := cropImage(img, rect)
+	if err != nil {
+		return nil, err
+	}
+	hash, _, err := CreateHashOpts(region, hashOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return store.QueryWithOptions(hash, options), nil
+}
+
+// AddTiled adds the tiles of an image to the store, so that queries for parts
+// of the image (see QueryRegion()) find it. The image is divided into a grid of
+// grid x grid tiles. Additional tiles of the same size are placed between
+// them, with an overlap of 50%, resulting in (2*grid-1)^2 tiles. Each tile is
+// added with a Tile as its ID. The image itself is not added. The number of
+// tiles which were added is returned. Tiles which are already contained in the
+// store are skipped.
+func (store *Store) AddTiled(id interface{}, img image.Image, grid int, options ...HashOption) (int, error) {
+	if img == nil {
+		return 0, errors.New("Unable to tile nil image")
+	}
+	if grid < 1 {
+		return 0, fmt.Errorf("Invalid tile grid size %d", grid)
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx()/grid, bounds.Dy()/grid
+	if width < 1 || height < 1 {
+		return 0, fmt.Errorf("Image of size %s is too small for a %dx%d tile grid", bounds.Size(), grid, grid)
+	}
+
+	// We need these for when we serialize the store.
+	gob.Register(id)
+	gob.Register(Tile{})
+
+	var count int
+	for y := 0; y < 2*grid-1; y++ {
+		for x := 0; x < 2*grid-1; x++ {
+			min := bounds.Min.Add(image.Pt(x*width/2, y*height/2))
+			rect := image.Rectangle{Min: min, Max: min.Add(image.Pt(width, height))}
+			tile, err := cropImage(img, rect)
+			if err != nil {
+				return count, err
+			}
+			hash, _, err := CreateHashOpts(tile, options...)
+			if err != nil {
+				return count, err
+			}
+			if store.addConcurrently(Tile{ID: id, Rect: rect}, hash) == nil {
+				count++
+			}
+		}
+	}
+
+	return count, nil
+}
@@ -0,0 +1,173 @@
+package duplo
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+)
+
+// ReportRow is one row of a report, i.e. one matched image.
+type ReportRow struct {
+	// Group identifies the group of images this row belongs to, e.g. the ID
+	// of the query image or the number of a duplicate cluster.
+	Group interface{}
+
+	// Match is the matched image. For duplicate clusters, only its ID may be
+	// set.
+	Match *Match
+}
+
+// QueryRows returns report rows for the results of a query with the given ID.
+func QueryRows(query interface{}, matches Matches) []ReportRow {
+	rows := make([]ReportRow, 0, len(matches))
+	for _, match := range matches {
+		if match != nil {
+			rows = append(rows, ReportRow{Group: query, Match: match})
+		}
+	}
+	return rows
+}
+
+// ClusterRows returns report rows for clusters of duplicate images. The group
+// of each row is the index of its cluster.
+func ClusterRows(clusters [][]interface{}) (rows []ReportRow) {
+	for index, cluster := range clusters {
+		for _, id := range cluster {
+			rows = append(rows, ReportRow{Group: index, Match: &Match{ID: id}})
+		}
+	}
+	return
+}
+
+// ReportColumn is a column of a report.
+type ReportColumn struct {
+	// Name is the column header (CSV) or the field name (JSON).
+	Name string
+
+	// Value returns the column's value for the given row.
+	Value func(row ReportRow) (interface{}, error)
+}
+
+// Built-in report columns.
+var (
+	GroupColumn = ReportColumn{"group", func(row ReportRow) (interface{}, error) {
+		return row.Group, nil
+	}}
+	IDColumn = ReportColumn{"id", func(row ReportRow) (interface{}, error) {
+		return row.Match.ID, nil
+	}}
+	ScoreColumn = ReportColumn{"score", func(row ReportRow) (interface{}, error) {
+		return row.Match.Score, nil
+	}}
+	HaarScoreColumn = ReportColumn{"haarScore", func(row ReportRow) (interface{}, error) {
+		return row.Match.HaarScore, nil
+	}}
+	RatioDiffColumn = ReportColumn{"ratioDiff", func(row ReportRow) (interface{}, error) {
+		return row.Match.RatioDiff, nil
+	}}
+	DHashDistanceColumn = ReportColumn{"dHashDistance", func(row ReportRow) (interface{}, error) {
+		return row.Match.DHashDistance, nil
+	}}
+	HistogramDistanceColumn = ReportColumn{"histogramDistance", func(row ReportRow) (interface{}, error) {
+		return row.Match.HistogramDistance, nil
+	}}
+	ColourDistanceColumn = ReportColumn{"colourDistance", func(row ReportRow) (interface{}, error) {
+		return row.Match.ColourDistance, nil
+	}}
+	BlockhashDistanceColumn = ReportColumn{"blockhashDistance", func(row ReportRow) (interface{}, error) {
+		return row.Match.BlockhashDistance, nil
+	}}
+	WHashDistanceColumn = ReportColumn{"wHashDistance", func(row ReportRow) (interface{}, error) {
+		return row.Match.WHashDistance, nil
+	}}
+	SimilarityColumn = ReportColumn{"similarity", func(row ReportRow) (interface{}, error) {
+		return row.Match.Similarity, nil
+	}}
+)
+
+// DefaultReportColumns contains all built-in columns.
+var DefaultReportColumns = []ReportColumn{GroupColumn, IDColumn, ScoreColumn, HaarScoreColumn, RatioDiffColumn, DHashDistanceColumn, HistogramDistanceColumn, ColourDistanceColumn, BlockhashDistanceColumn, WHashDistanceColumn, SimilarityColumn}
+
+// MetadataColumn returns a report column which contains metadata about the
+// matched images (e.g. file sizes or dates), as returned by the provided
+// function.
+func MetadataColumn(name string, metadata func(id interface{}) (interface{}, error)) ReportColumn {
+	return ReportColumn{name, func(row ReportRow) (interface{}, error) {
+		return metadata(row.Match.ID)
+	}}
+}
+
+// ThumbnailColumn returns a report column which contains thumbnails of the
+// matched images as "data:" URIs of PNG images, which can be used directly as
+// the source of HTML image elements. The images are provided by the "load"
+// function and scaled down to fit into a square of the given size.
+func ThumbnailColumn(name string, size uint, load func(id interface{}) (image.Image, error)) ReportColumn {
+	return ReportColumn{name, func(row ReportRow) (interface{}, error) {
+		img, err := load(row.Match.ID)
+		if err != nil {
+			return nil, err
+		}
+		var encoded bytes.Buffer
+		if err := png.Encode(&encoded, thumbnail(size, size, img, DefaultScaler)); err != nil {
+			return nil, fmt.Errorf("Unable to encode thumbnail: %s", err)
+		}
+		return "data:image/png;base64," + base64.StdEncoding.EncodeToString(encoded.Bytes()), nil
+	}}
+}
+
+// WriteCSV writes the given rows as CSV to the writer. The first line contains
+// the column names. Values are formatted with the fmt package.
+func WriteCSV(w io.Writer, rows []ReportRow, columns []ReportColumn) error {
+	writer := csv.NewWriter(w)
+
+	record := make([]string, len(columns))
+	for index, column := range columns {
+		record[index] = column.Name
+	}
+	if err := writer.Write(record); err != nil {
+		return fmt.Errorf("Unable to write CSV header: %s", err)
+	}
+
+	for _, row := range rows {
+		for index, column := range columns {
+			value, err := column.Value(row)
+			if err != nil {
+				return fmt.Errorf("Unable to get value of column %s: %s", column.Name, err)
+			}
+			record[index] = fmt.Sprint(value)
+		}
+		if err := writer.Write(record); err != nil {
+			return fmt.Errorf("Unable to write CSV record: %s", err)
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteJSON writes the given rows as a JSON array to the writer. Each row is
+// a JSON object whose fields are the columns.
+func WriteJSON(w io.Writer, rows []ReportRow, columns []ReportColumn) error {
+	objects := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		object := make(map[string]interface{}, len(columns))
+		for _, column := range columns {
+			value, err := column.Value(row)
+			if err != nil {
+				return fmt.Errorf("Unable to get value of column %s: %s", column.Name, err)
+			}
+			object[column.Name] = value
+		}
+		objects = append(objects, object)
+	}
+
+	if err := json.NewEncoder(w).Encode(objects); err != nil {
+		return fmt.Errorf("Unable to write JSON: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package duplo
+
+// SampleDiverse returns the IDs of up to n stored images which are as
+// dissimilar to each other as possible. This is useful to build
+// representative preview or training sets from large collections which
+// contain many near-duplicates.
+//
+// The sample is selected greedily: Starting with the first image in the
+// store, the image whose maximum similarity to all previously selected images
+// is the lowest is added next (max-min selection). The similarity between two
+// images is the weight of the index buckets they share, relative to the
+// total weight of the image's own buckets. It is determined using the index,
+// so only images which share buckets with the selected images are visited.
+func (store *Store) SampleDiverse(n int) []interface{} {
+	store.RLock()
+	defer store.RUnlock()
+
+	// Relative weights of all candidates' buckets.
+	selfWeights := make([]float64, len(store.candidates))
+	var live int
+	for index, candidate := range store.candidates {
+		if candidate.id == nil {
+			continue
+		}
+		live++
+		selfWeights[index] = -mapScore(candidate.locations, store.weightSums)
+	}
+	if n > live {
+		n = live
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	// maxSimilarity contains the maximum similarity of each candidate to the
+	// selected images. Selected and deleted images are marked with -1.
+	maxSimilarity := make([]float64, len(store.candidates))
+	for index, candidate := range store.candidates {
+		if candidate.id == nil {
+			maxSimilarity[index] = -1
+		}
+	}
+	shared := make([]float64, len(store.candidates))
+	var buffer []uint64
+
+	sample := make([]interface{}, 0, n)
+	for len(sample) < n {
+		// Select the next candidate.
+		next := -1
+		for index, similarity := range maxSimilarity {
+			if similarity >= 0 && (next < 0 || similarity < maxSimilarity[next]) {
+				next = index
+			}
+		}
+		selected := &store.candidates[next]
+		sample = append(sample, selected.id)
+		maxSimilarity[next] = -1
+
+		// Update the similarities of all candidates which share buckets with
+		// it.
+		var touched []uint64
+		for _, location := range selected.locations {
+			weight := store.weightSums[locationBin(location)]
+			buffer = store.bucket(int(location), buffer)
+			for _, index := range buffer {
+				if shared[index] == 0 {
+					touched = append(touched, index)
+				}
+				shared[index] += weight
+			}
+		}
+		for _, index := range touched {
+			if maxSimilarity[index] >= 0 && selfWeights[index] > 0 {
+				if similarity := shared[index] / selfWeights[index]; similarity > maxSimilarity[index] {
+					maxSimilarity[index] = similarity
+				}
+			}
+			shared[index] = 0
+		}
+	}
+
+	return sample
+}
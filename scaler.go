@@ -0,0 +1,85 @@
+package duplo
+
+import (
+	"image"
+
+	"github.com/nfnt/resize"
+	"golang.org/x/image/draw"
+)
+
+// Scaler resizes images. It is used to scale images down before they are
+// hashed (see WithScaler()).
+type Scaler interface {
+	// Resize returns a copy of the given image, resized to the given width and
+	// height.
+	Resize(width, height uint, img image.Image) image.Image
+}
+
+// ScalerFunc is a function which implements the Scaler interface.
+type ScalerFunc func(width, height uint, img image.Image) image.Image
+
+// Resize implements the Scaler interface.
+func (f ScalerFunc) Resize(width, height uint, img image.Image) image.Image {
+	return f(width, height, img)
+}
+
+// DrawScaler is a Scaler based on an interpolator of the
+// golang.org/x/image/draw package, e.g. draw.CatmullRom.
+type DrawScaler struct {
+	Interpolator draw.Interpolator
+}
+
+// Resize implements the Scaler interface. The result is an *image.RGBA, or an
+// *image.RGBA64 if the given image is one, to keep its precision.
+func (s DrawScaler) Resize(width, height uint, img image.Image) image.Image {
+	var scaled draw.Image
+	if _, ok := img.(*image.RGBA64); ok {
+		scaled = image.NewRGBA64(image.Rect(0, 0, int(width), int(height)))
+	} else {
+		scaled = image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+	}
+	s.Interpolator.Scale(scaled, scaled.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return scaled
+}
+
+// NfntScaler is a Scaler based on an interpolation function of the
+// github.com/nfnt/resize package, which was used by versions of this package
+// before hashes were versioned (see HashVersion).
+type NfntScaler struct {
+	Interpolation resize.InterpolationFunction
+}
+
+// Resize implements the Scaler interface.
+func (s NfntScaler) Resize(width, height uint, img image.Image) image.Image {
+	return resize.Resize(width, height, img, s.Interpolation)
+}
+
+// DefaultScaler is the scaler used by CreateHash(), a Catmull-Rom (bicubic)
+// interpolation. Earlier versions of this package used
+// NfntScaler{Interpolation: resize.Bicubic} instead, so stores they wrote
+// contain hashes which do not match hashes created with this scaler (see
+// Store.HashVersion()).
+var DefaultScaler Scaler = DrawScaler{Interpolator: draw.CatmullRom}
+
+// thumbnail resizes the given image with the given scaler such that it fits
+// into a box of the given size, preserving its aspect ratio. Images which
+// already fit are returned unchanged.
+func thumbnail(maxWidth, maxHeight uint, img image.Image, scaler Scaler) image.Image {
+	bounds := img.Bounds()
+	width, height := uint(bounds.Dx()), uint(bounds.Dy())
+	if width <= maxWidth && height <= maxHeight {
+		return img
+	}
+	if width*maxHeight > height*maxWidth {
+		width, height = maxWidth, height*maxWidth/width
+	} else {
+		width, height = width*maxHeight/height, maxHeight
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return scaler.Resize(width, height, img)
+}
@@ -0,0 +1,124 @@
+package duplo
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// ShardedStore distributes images over multiple stores (shards) to index more
+// images than fit comfortably into a single store, e.g. across machines. Each
+// image is routed to one shard, determined by its ID only (see Shard()). Queries
+// are performed on all shards in parallel and their results are merged.
+//
+// The shards are regular stores. They may be serialized individually with
+// Store.GobEncode() and later be reassembled with NewShardedFrom(). All shards
+// should be configured identically (e.g. with Store.SetWeights() or
+// Store.Tune()) so that their scores are comparable.
+//
+// ShardedStore's methods are concurrency safe.
+type ShardedStore struct {
+	shards []*Store
+}
+
+// NewSharded returns a new, empty sharded store with n shards, each created
+// with New() and the given options. If n is less than 1, one shard is used.
+func NewSharded(n int, options ...Option) *ShardedStore {
+	if n < 1 {
+		n = 1
+	}
+	shards := make([]*Store, n)
+	for index := range shards {
+		shards[index] = New(options...)
+	}
+	return &ShardedStore{shards: shards}
+}
+
+// NewShardedFrom returns a sharded store made up of the given shards, e.g.
+// after they were decoded individually. The shards must be provided in the
+// same order as returned by Shards(). Otherwise, images will be routed to the
+// wrong shards. If no shards are provided, one new shard is used.
+func NewShardedFrom(shards ...*Store) *ShardedStore {
+	if len(shards) == 0 {
+		return NewSharded(1)
+	}
+	return &ShardedStore{shards: append([]*Store(nil), shards...)}
+}
+
+// Shards returns the shards of this store.
+func (s *ShardedStore) Shards() []*Store {
+	return append([]*Store(nil), s.shards...)
+}
+
+// Shard returns the index of the shard that the image with the given ID is
+// routed to. The routing is deterministic, i.e. it is the same across
+// processes and machines as long as the number of shards stays the same, so it
+// may be used to send images to remote shards. It is based on the FNV-1a hash
+// of the ID's type and its default formatting ("%v") so IDs should be of types
+// whose formatting identifies them, e.g. strings or integers.
+func (s *ShardedStore) Shard(id interface{}) int {
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%T:%v", id, id)
+	return int(hash.Sum64() % uint64(len(s.shards)))
+}
+
+// Has checks if an image (via its ID) is already contained in the store.
+func (s *ShardedStore) Has(id interface{}) bool {
+	return s.shards[s.Shard(id)].Has(id)
+}
+
+// Add adds an image (via its hash) to its shard. See Store.Add() for details.
+func (s *ShardedStore) Add(id interface{}, hash Hash) {
+	s.shards[s.Shard(id)].Add(id, hash)
+}
+
+// Delete removes an image from its shard. See Store.Delete() for details.
+func (s *ShardedStore) Delete(id interface{}) {
+	s.shards[s.Shard(id)].Delete(id)
+}
+
+// IDs returns a list of IDs of all images contained in all shards.
+func (s *ShardedStore) IDs() (ids []interface{}) {
+	for _, shard := range s.shards {
+		ids = append(ids, shard.IDs()...)
+	}
+	return
+}
+
+// Query performs a similarity search on all shards. See Store.Query() for
+// details.
+func (s *ShardedStore) Query(hash Hash) Matches {
+	return s.QueryWithOptions(hash, nil)
+}
+
+// QueryWithOptions performs a similarity search on all shards, in parallel,
+// with the given options. See Store.QueryWithOptions() for details. If
+// options.MaxResults is not 0, the best MaxResults matches of all shards are
+// returned, sorted by their score.
+func (s *ShardedStore) QueryWithOptions(hash Hash, options *QueryOptions) Matches {
+	results := make([]Matches, len(s.shards))
+	var wg sync.WaitGroup
+	for index, shard := range s.shards {
+		wg.Add(1)
+		go func(index int, shard *Store) {
+			defer wg.Done()
+			results[index] = shard.QueryWithOptions(hash, options)
+		}(index, shard)
+	}
+	wg.Wait()
+
+	// Merge the results.
+	var matches Matches
+	for _, result := range results {
+		matches = append(matches, result...)
+	}
+	if options != nil && options.MaxResults > 0 {
+		sort.Sort(matches)
+		if len(matches) > options.MaxResults {
+			matches = matches[:options.MaxResults]
+		}
+	}
+
+	return matches
+}
@@ -0,0 +1,126 @@
+package duplo
+
+import (
+	"math"
+	"sort"
+
+	"github.com/rivo/duplo/haar"
+)
+
+// SignificanceMap is a compact representation of the Haar coefficients that
+// were retained for an image, i.e. the coefficients whose absolute value is at
+// least the hash's threshold for their colour channel, together with their
+// signs. These are the coefficients that make up the index buckets of a store.
+//
+// The map is stored sparsely as a list of bucket locations in ascending
+// order. A location is calculated as follows:
+//
+//	sign*ImageScale*ImageScale*haar.ColourChannels + coefIdx*haar.ColourChannels + channel
+//
+// where "sign" is 0 for positive and 1 for negative coefficients. The scaling
+// function coefficient (coefIdx 0) is never part of the map.
+type SignificanceMap []uint32
+
+// SignificanceMap returns the significance map of this hash, i.e. the
+// positions of the coefficients that will be used for the index buckets when
+// the hash is added to a store.
+func (hash Hash) SignificanceMap() SignificanceMap {
+	var locations SignificanceMap
+	for coefIndex, coef := range hash.Coefs {
+		if coefIndex == 0 {
+			// This is the scaling function coefficient. Ignore.
+			continue
+		}
+
+		for colourIndex, colourCoef := range coef {
+			if math.Abs(colourCoef) < hash.Thresholds[colourIndex] {
+				// Coef is too small. Ignore.
+				continue
+			}
+
+			sign := 0
+			if colourCoef < 0 {
+				sign = 1
+			}
+
+			locations = append(locations, uint32(sign*ImageScale*ImageScale*haar.ColourChannels+coefIndex*haar.ColourChannels+colourIndex))
+		}
+	}
+
+	sort.Slice(locations, func(i, j int) bool {
+		return locations[i] < locations[j]
+	})
+
+	return locations
+}
+
+// Position decomposes the map's ith location into the coefficient index (the
+// position in Hash.Coefs), the colour channel, and the coefficient's sign
+// (1 for positive and -1 for negative values).
+func (m SignificanceMap) Position(i int) (coefIndex, channel, sign int) {
+	location := int(m[i])
+	sign = 1
+	if location >= ImageScale*ImageScale*haar.ColourChannels {
+		sign = -1
+		location -= ImageScale * ImageScale * haar.ColourChannels
+	}
+	return location / haar.ColourChannels, location % haar.ColourChannels, sign
+}
+
+// Overlap returns the number of coefficient positions, including their signs,
+// which are retained in both maps. Images with a large overlap share many
+// index buckets and are therefore likely to score well against each other.
+func (m SignificanceMap) Overlap(other SignificanceMap) int {
+	var count, i, j int
+	for i < len(m) && j < len(other) {
+		switch {
+		case m[i] < other[j]:
+			i++
+		case m[i] > other[j]:
+			j++
+		default:
+			count++
+			i++
+			j++
+		}
+	}
+	return count
+}
+
+// contains returns whether the map contains the given location.
+func (m SignificanceMap) contains(location uint32) bool {
+	i := sort.Search(len(m), func(i int) bool { return m[i] >= location })
+	return i < len(m) && m[i] == location
+}
+
+// locationBin returns the weight bin of the coefficient at the given bucket
+// location.
+func locationBin(location uint32) int {
+	coefIndex := int(location) % (ImageScale * ImageScale * haar.ColourChannels) / haar.ColourChannels
+	y := coefIndex / ImageScale
+	x := coefIndex % ImageScale
+	bin := y
+	if x > y {
+		bin = x
+	}
+	if bin > 5 {
+		bin = 5
+	}
+	return bin
+}
+
+// SignificanceMap returns the significance map of the image with the given
+// ID. The returned map is a copy which may be modified freely. If the ID is
+// not contained in the store, false is returned.
+func (store *Store) SignificanceMap(id interface{}) (SignificanceMap, bool) {
+	store.RLock()
+	defer store.RUnlock()
+
+	index, ok := store.ids[id]
+	if !ok {
+		return nil, false
+	}
+
+	locations := store.candidates[index].locations
+	return append(SignificanceMap(nil), locations...), true
+}
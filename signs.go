@@ -0,0 +1,53 @@
+package duplo
+
+// querySigns performs a sign-only similarity search (see
+// QueryOptions.SignOnly). The store must be at least read-locked when calling
+// this function.
+func (store *Store) querySigns(hash Hash, options *QueryOptions) Matches {
+	store.queries.Add(1)
+
+	// Empty store, empty result set.
+	if len(store.candidates) == 0 {
+		return nil
+	}
+	hash.Thresholds = store.thresholds(hash)
+
+	// Count the shared buckets.
+	agreements := make([]int32, len(store.candidates))
+	var (
+		numMatches int
+		buffer     []uint64
+	)
+	for _, location := range hash.SignificanceMap() {
+		buffer = store.bucket(int(location), buffer)
+		for _, index := range buffer {
+			if agreements[index] == 0 {
+				numMatches++
+			}
+			agreements[index]++
+		}
+	}
+
+	// Create matches.
+	collector := newMatchCollector(options.MaxResults, numMatches)
+	for index, agreement := range agreements {
+		if agreement == 0 {
+			continue
+		}
+		candidate := &store.candidates[index]
+		if store.suppressed[candidate.id] {
+			continue
+		}
+		score := -float64(agreement)
+		if !options.accepts(candidate, score, hash) || collector.rejects(score) {
+			continue
+		}
+		collector.add(&Match{
+			ID:            candidate.id,
+			Score:         score,
+			SignAgreement: int(agreement),
+		})
+	}
+
+	return collector.result()
+}
@@ -0,0 +1,92 @@
+package duplo
+
+import (
+	"math"
+)
+
+// SimilarityWeights are the contributions of the individual metrics to a
+// match's similarity (see Match.Similarity). They should add up to 1 so that
+// similarities range from 0 to 1.
+type SimilarityWeights struct {
+	Haar, DHash, Histogram, Ratio float64
+}
+
+// MatchSimilarityWeights are the weights used to calculate Match.Similarity.
+// The defaults were chosen by hand, not derived from a corpus: The Haar score
+// is the primary metric and contributes about half, followed by the dHash
+// distance as it captures structure, then the histogram distance and the ratio
+// difference. Change them to suit your content, e.g. to weights fitted to
+// labeled duplicate and non-duplicate pairs. They must not be changed while
+// queries are running.
+var MatchSimilarityWeights = SimilarityWeights{
+	Haar:      0.55,
+	DHash:     0.2,
+	Histogram: 0.15,
+	Ratio:     0.1,
+}
+
+// similarity maps the metrics of a match to a single value between 0
+// (completely different) and 1 (identical), weighted with
+// MatchSimilarityWeights. "bestScore" is the score the query image would
+// achieve against itself.
+//
+// The Haar score is related to the best possible score. The hamming distances
+// are related to half their bit vectors' lengths, which is the expected
+// distance between two unrelated images. The ratio difference decays
+// exponentially.
+func similarity(score, bestScore, ratioDiff float64, dHashDistance, histogramDistance int) float64 {
+	var haarSimilarity float64
+	if bestScore < 0 {
+		haarSimilarity = clamp(score / bestScore)
+	}
+	dHashSimilarity := clamp(1 - float64(dHashDistance)/64)
+	histogramSimilarity := clamp(1 - float64(histogramDistance)/32)
+	ratioSimilarity := 0.0
+	if !math.IsNaN(ratioDiff) {
+		ratioSimilarity = math.Exp(-10 * ratioDiff)
+	}
+
+	weights := MatchSimilarityWeights
+	return weights.Haar*haarSimilarity +
+		weights.DHash*dHashSimilarity +
+		weights.Histogram*histogramSimilarity +
+		weights.Ratio*ratioSimilarity
+}
+
+// clamp restricts the given value to the interval [0,1].
+func clamp(value float64) float64 {
+	if value < 0 {
+		return 0
+	}
+	if value > 1 {
+		return 1
+	}
+	return value
+}
+
+// bestScore returns the score that the given hash would achieve if it was
+// queried against itself. The store must be at least read-locked when calling
+// this function.
+func (store *Store) bestScore(hash Hash) float64 {
+	hash.Thresholds = store.thresholds(hash)
+	return mapScore(hash.SignificanceMap(), store.weightSums)
+}
+
+// scoreNormalization returns the value by which the Haar scores of the given
+// query hash are divided when they are normalized (see
+// QueryOptions.NormalizeScores). The store must be at least read-locked when
+// calling this function.
+func (store *Store) scoreNormalization(hash Hash) float64 {
+	hash.Thresholds = store.thresholds(hash)
+	return math.Max(1, float64(len(hash.SignificanceMap())))
+}
+
+// mapScore returns the sum of the negative weights of all locations in the
+// given significance map, given the weights totalled over all colour
+// channels.
+func mapScore(locations SignificanceMap, weightSums [6]float64) (score float64) {
+	for _, location := range locations {
+		score -= weightSums[locationBin(location)]
+	}
+	return
+}
@@ -0,0 +1,65 @@
+package duplo
+
+import (
+	"time"
+)
+
+// slowQueryLogSize is the number of slow queries kept by a store.
+const slowQueryLogSize = 100
+
+// SlowQuery describes a query which took longer than the store's slow query
+// threshold (see SetSlowQueryThreshold()).
+type SlowQuery struct {
+	// The time the query started.
+	Time time.Time
+
+	// The duration of the query.
+	Duration time.Duration
+
+	// The number of matches returned by the query.
+	Matches int
+}
+
+// SetSlowQueryThreshold causes queries which take longer than the given
+// duration to be logged by the store (see SlowQueries()). A threshold of 0
+// (the default) disables the log. The threshold is not saved with the store.
+func (store *Store) SetSlowQueryThreshold(threshold time.Duration) {
+	store.slowThreshold.Store(int64(threshold))
+}
+
+// SlowQueries returns the most recent slow queries (up to 100), the most
+// recent one first.
+func (store *Store) SlowQueries() []SlowQuery {
+	store.slowMutex.Lock()
+	defer store.slowMutex.Unlock()
+
+	queries := make([]SlowQuery, 0, len(store.slowQueries))
+	for index := len(store.slowQueries) - 1; index >= 0; index-- {
+		queries = append(queries, store.slowQueries[(store.slowNext+index)%len(store.slowQueries)])
+	}
+	return queries
+}
+
+// logQuery adds a query which started at the given time and returned the
+// given number of matches to the slow query log if it took longer than the
+// slow query threshold. This function may be called concurrently.
+func (store *Store) logQuery(start time.Time, matches int) {
+	threshold := time.Duration(store.slowThreshold.Load())
+	if threshold <= 0 {
+		return
+	}
+	duration := time.Since(start)
+	if duration <= threshold {
+		return
+	}
+
+	store.slowMutex.Lock()
+	defer store.slowMutex.Unlock()
+	query := SlowQuery{Time: start, Duration: duration, Matches: matches}
+	if len(store.slowQueries) < slowQueryLogSize {
+		store.slowQueries = append(store.slowQueries, query)
+		return
+	}
+	store.slowQueries[store.slowNext] = query
+	store.slowNext = (store.slowNext + 1) % slowQueryLogSize
+}
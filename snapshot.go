@@ -0,0 +1,277 @@
+package duplo
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// storeVersion is the version of the serialization format of stores.
+const storeVersion = 4
+
+// snapshot is the serializable state of a store at one point in time. Taking a
+// snapshot does not copy the candidates or the index buckets. Instead, the
+// store copies the candidates before modifying them in place while snapshots
+// are in use (copy-on-write, see ownCandidates()). Appending to them is fine
+// as snapshots don't look beyond their own slice lengths. Index buckets are
+// never modified in place (see postings).
+type snapshot struct {
+	candidates   []candidate
+	indices      []postings
+	weights      Weights
+	topCoefs     int
+	generation   uint64
+	scoreWeights [4]float64
+	negatives    map[hashKey]map[interface{}]bool
+	largeIndex   bool
+	legacyHashes bool
+	suppressed   map[interface{}]bool
+	free         []uint64
+}
+
+// takeSnapshot returns a snapshot of the store's current state. The store must
+// be at least read-locked and "distributing" must be write-locked when calling
+// this function. releaseSnapshot() must be called when the snapshot is not
+// used anymore.
+func (store *Store) takeSnapshot() *snapshot {
+	store.snapshots.Add(1)
+	store.candidatesShared.Store(true)
+
+	s := &snapshot{
+		candidates:   store.candidates,
+		indices:      make([]postings, len(store.indices)),
+		weights:      store.weights,
+		topCoefs:     store.topCoefs,
+		generation:   store.generation,
+		scoreWeights: store.scoreWeights,
+		largeIndex:   store.largeIndex,
+		legacyHashes: store.legacyHashes,
+		negatives:    copyNegatives(store.negatives), // Usually small.
+		suppressed:   copySuppressed(store.suppressed),
+		free:         append([]uint64(nil), store.free...),
+	}
+	copy(s.indices, store.indices)
+
+	return s
+}
+
+// releaseSnapshot signals that a snapshot taken with takeSnapshot() is not used
+// anymore. The store does not need to be locked when calling this function.
+func (store *Store) releaseSnapshot() {
+	store.snapshots.Add(-1)
+}
+
+// ownCandidates makes sure that the store's candidates are not shared with a
+// snapshot so they may be modified in place. The store must be write-locked
+// when calling this function.
+func (store *Store) ownCandidates() {
+	if store.snapshots.Load() > 0 && store.candidatesShared.Load() {
+		candidates := make([]candidate, len(store.candidates), cap(store.candidates))
+		copy(candidates, store.candidates)
+		store.candidates = candidates
+	}
+	store.candidatesShared.Store(false)
+}
+
+// writeTo writes a binary representation of the snapshot to the given writer
+// (see Store.WriteTo()).
+func (s *snapshot) writeTo(writer io.Writer) error {
+	compressor := gzip.NewWriter(writer)
+	encoder := gob.NewEncoder(compressor)
+
+	// Add a version number first.
+	if err := encoder.Encode(storeVersion); err != nil {
+		return fmt.Errorf("Unable to encode store version: %s", err)
+	}
+
+	// Candidates are encoded manually because the encoder does not have access
+	// to the candidate struct.
+	if err := encoder.Encode(len(s.candidates)); err != nil {
+		return fmt.Errorf("Unable to encode candidate length: %s", err)
+	}
+	for _, candidate := range s.candidates {
+		if err := encoder.Encode(&candidate.id); err != nil {
+			return fmt.Errorf("Unable to encode candidate ID: %s", err)
+		}
+		if err := encoder.Encode(candidate.encodeFields()); err != nil {
+			return fmt.Errorf("Unable to encode candidate record: %s", err)
+		}
+	}
+
+	// Indices, one bucket at a time.
+	if err := encoder.Encode(len(s.indices)); err != nil {
+		return fmt.Errorf("Unable to encode number of indices: %s", err)
+	}
+	var list []uint64
+	for _, bucket := range s.indices {
+		list = bucket.decode(list[:0])
+		if err := encoder.Encode(list); err != nil {
+			return fmt.Errorf("Unable to encode indices: %s", err)
+		}
+	}
+
+	// The scoring configuration.
+	if err := encoder.Encode(s.weights); err != nil {
+		return fmt.Errorf("Unable to encode weights: %s", err)
+	}
+	if err := encoder.Encode(s.topCoefs); err != nil {
+		return fmt.Errorf("Unable to encode number of top coefficients: %s", err)
+	}
+
+	// The store generation.
+	if err := encoder.Encode(s.generation); err != nil {
+		return fmt.Errorf("Unable to encode store generation: %s", err)
+	}
+
+	// The composite score weights.
+	if err := encoder.Encode(s.scoreWeights); err != nil {
+		return fmt.Errorf("Unable to encode score weights: %s", err)
+	}
+
+	// The negative list.
+	if err := encodeNegatives(encoder, s.negatives); err != nil {
+		return fmt.Errorf("Unable to encode negative list: %s", err)
+	}
+
+	// The index width.
+	if err := encoder.Encode(s.largeIndex); err != nil {
+		return fmt.Errorf("Unable to encode index width: %s", err)
+	}
+
+	// The suppressed images.
+	suppressed := make([]interface{}, 0, len(s.suppressed))
+	for id := range s.suppressed {
+		suppressed = append(suppressed, id)
+	}
+	if err := encoder.Encode(suppressed); err != nil {
+		return fmt.Errorf("Unable to encode suppressed images: %s", err)
+	}
+
+	// Finish up.
+	if err := compressor.Close(); err != nil {
+		return fmt.Errorf("Unable to finish compression: %s", err)
+	}
+
+	return nil
+}
+
+// Snapshot is a read-only view of a store at one point in time, created by
+// Store.Snapshot(). Queries against a snapshot do not acquire the store's
+// locks so they are not blocked by concurrent modifications of the store,
+// e.g. during a bulk ingest, and they always see the same, consistent state.
+//
+// Taking a snapshot is cheap as it shares the store's data. While snapshots
+// are in use, the store copies data before it modifies it in place, which
+// makes modifications more expensive. Release() must therefore be called when
+// the snapshot is not needed anymore.
+type Snapshot struct {
+	store    *Store      // The store from which the snapshot was taken.
+	view     *Store      // The snapshot's state.
+	idsOnce  sync.Once   // For the lazily built ID set.
+	released atomic.Bool // Whether Release() was called.
+}
+
+// Snapshot returns a read-only view of the store's current state. See
+// Snapshot for details.
+func (store *Store) Snapshot() *Snapshot {
+	store.RLock()
+	store.distributing.Lock() // Wait for concurrent Add() calls to finish.
+	s := store.takeSnapshot()
+	store.distributing.Unlock()
+	store.RUnlock()
+
+	view := &Store{
+		candidates:   s.candidates,
+		indices:      s.indices,
+		topCoefs:     s.topCoefs,
+		generation:   s.generation,
+		scoreWeights: s.scoreWeights,
+		negatives:    s.negatives,
+		largeIndex:   s.largeIndex,
+		legacyHashes: s.legacyHashes,
+		suppressed:   s.suppressed,
+		free:         s.free,
+	}
+	view.setWeights(s.weights)
+	return &Snapshot{store: store, view: view}
+}
+
+// Release signals that the snapshot is not used anymore. Its methods must not
+// be called afterwards. Calling Release() more than once has no effect.
+func (s *Snapshot) Release() {
+	if s.released.CompareAndSwap(false, true) {
+		s.store.releaseSnapshot()
+	}
+}
+
+// ids returns the snapshot's state with the ID set built. The ID set is not
+// shared with the store, so it is built from the candidates when first needed.
+func (s *Snapshot) ids() *Store {
+	s.idsOnce.Do(func() {
+		s.view.ids = make(map[interface{}]uint64)
+		for index, candidate := range s.view.candidates {
+			if candidate.id != nil {
+				s.view.ids[candidate.id] = uint64(index)
+			}
+		}
+	})
+	return s.view
+}
+
+// Has checks if an image (via its ID) was contained in the store when the
+// snapshot was taken.
+func (s *Snapshot) Has(id interface{}) bool {
+	_, ok := s.ids().ids[id]
+	return ok
+}
+
+// IDs returns a list of IDs of all images contained in the snapshot.
+func (s *Snapshot) IDs() (ids []interface{}) {
+	for id := range s.ids().ids {
+		ids = append(ids, id)
+	}
+	return
+}
+
+// Size returns the number of candidate slots in the snapshot, like
+// Store.Size(): Slots of deleted images which have not been reused or removed
+// by Compact() are included. Use len(IDs()) for the number of images.
+func (s *Snapshot) Size() int {
+	return len(s.view.candidates)
+}
+
+// Generation returns the store generation at the time the snapshot was taken.
+func (s *Snapshot) Generation() uint64 {
+	return s.view.generation
+}
+
+// Query performs a similarity search on the given image hash. See
+// Store.Query() for details.
+func (s *Snapshot) Query(hash Hash) Matches {
+	return s.view.query(hash)
+}
+
+// QueryWithOptions performs a similarity search with the given options. See
+// Store.QueryWithOptions() for details.
+func (s *Snapshot) QueryWithOptions(hash Hash, options *QueryOptions) Matches {
+	if options != nil && options.ScoreComponents {
+		return s.ids().queryWithOptions(hash, options)
+	}
+	return s.view.queryWithOptions(hash, options)
+}
+
+// QueryContext performs a similarity search which is aborted when the given
+// context is done. See Store.QueryContext() for details.
+func (s *Snapshot) QueryContext(ctx context.Context, hash Hash) (Matches, error) {
+	return s.view.queryContext(ctx, hash, nil)
+}
+
+// QueryID performs a similarity search using the image with the given ID as
+// the query. See Store.QueryID() for details.
+func (s *Snapshot) QueryID(id interface{}) Matches {
+	return s.ids().queryID(id)
+}
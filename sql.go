@@ -0,0 +1,28 @@
+package duplo
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+)
+
+// Value implements driver.Valuer so hashes can be stored directly in database
+// columns of a binary type (e.g. BYTEA or BLOB). The value is the hash's
+// binary representation (see Hash.MarshalBinary()), which is versioned.
+func (hash Hash) Value() (driver.Value, error) {
+	return hash.MarshalBinary()
+}
+
+// Scan implements sql.Scanner so hashes can be read directly from database
+// columns written with Hash.Value(). NULL values result in an error.
+func (hash *Hash) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case []byte:
+		return hash.UnmarshalBinary(value)
+	case string:
+		return hash.UnmarshalBinary([]byte(value))
+	case nil:
+		return errors.New("Unable to scan NULL into a hash")
+	}
+	return fmt.Errorf("Unable to scan %T into a hash", src)
+}
@@ -0,0 +1,154 @@
+package duplo
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+)
+
+// Perturbation is a modification of an image which should not change the
+// image's identity, e.g. re-encoding it or resizing it. Perturbations are used
+// to probe the robustness of hashes (see Stability()).
+type Perturbation struct {
+	// A human-readable description of the perturbation.
+	Name string
+
+	// Apply returns a perturbed copy of the given image.
+	Apply func(img image.Image) (image.Image, error)
+}
+
+// JPEGPerturbation re-encodes an image as a JPEG file with the given quality
+// (1-100).
+func JPEGPerturbation(quality int) Perturbation {
+	return Perturbation{
+		Name: fmt.Sprintf("jpeg %d", quality),
+		Apply: func(img image.Image) (image.Image, error) {
+			var buffer bytes.Buffer
+			if err := jpeg.Encode(&buffer, img, &jpeg.Options{Quality: quality}); err != nil {
+				return nil, fmt.Errorf("Unable to encode JPEG: %s", err)
+			}
+			return jpeg.Decode(&buffer)
+		},
+	}
+}
+
+// ResizePerturbation scales an image by the given factor, e.g. 0.5 for half
+// its width and height.
+func ResizePerturbation(factor float64) Perturbation {
+	return Perturbation{
+		Name: fmt.Sprintf("resize %g", factor),
+		Apply: func(img image.Image) (image.Image, error) {
+			bounds := img.Bounds()
+			width, height := uint(float64(bounds.Dx())*factor), uint(float64(bounds.Dy())*factor)
+			if width < 1 || height < 1 {
+				return nil, fmt.Errorf("Image of size %s cannot be resized by %g", bounds.Size(), factor)
+			}
+			return DefaultScaler.Resize(width, height, img), nil
+		},
+	}
+}
+
+// CropPerturbation removes the given fraction (e.g. 0.05 for 5%) of an image's
+// width and height, half of it on each side.
+func CropPerturbation(fraction float64) Perturbation {
+	return Perturbation{
+		Name: fmt.Sprintf("crop %g", fraction),
+		Apply: func(img image.Image) (image.Image, error) {
+			bounds := img.Bounds()
+			dx, dy := int(float64(bounds.Dx())*fraction/2), int(float64(bounds.Dy())*fraction/2)
+			return cropImage(img, image.Rect(bounds.Min.X+dx, bounds.Min.Y+dy, bounds.Max.X-dx, bounds.Max.Y-dy))
+		},
+	}
+}
+
+// BrightnessPerturbation adds the given value (between -1 and 1) to all
+// colour channels of an image.
+func BrightnessPerturbation(delta float64) Perturbation {
+	return Perturbation{
+		Name: fmt.Sprintf("brightness %+g", delta),
+		Apply: func(img image.Image) (image.Image, error) {
+			bounds := img.Bounds()
+			perturbed := image.NewRGBA(bounds)
+			draw.Draw(perturbed, bounds, img, bounds.Min, draw.Src)
+			shift := func(value uint8) uint8 {
+				shifted := float64(value) + delta*255
+				if shifted < 0 {
+					return 0
+				}
+				if shifted > 255 {
+					return 255
+				}
+				return uint8(shifted + 0.5)
+			}
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					c := perturbed.RGBAAt(x, y)
+					perturbed.SetRGBA(x, y, color.RGBA{shift(c.R), shift(c.G), shift(c.B), c.A})
+				}
+			}
+			return perturbed, nil
+		},
+	}
+}
+
+// DefaultPerturbations are the perturbations used by Stability() if none are
+// provided. They cover common operations applied to shared images.
+var DefaultPerturbations = []Perturbation{
+	JPEGPerturbation(90),
+	JPEGPerturbation(50),
+	ResizePerturbation(0.5),
+	ResizePerturbation(0.25),
+	CropPerturbation(0.05),
+	CropPerturbation(0.1),
+	BrightnessPerturbation(0.1),
+	BrightnessPerturbation(-0.1),
+}
+
+// StabilityResult is the comparison of an image with one of its perturbed
+// versions.
+type StabilityResult struct {
+	// The name of the perturbation.
+	Perturbation string
+
+	// The comparison of the perturbed image's hash with the original image's
+	// hash (see Compare()).
+	Match Match
+}
+
+// Stability applies each of the given perturbations (DefaultPerturbations if
+// nil) to the given image and compares the hashes of the perturbed images with
+// the hash of the original. The results show how much the score and the
+// metrics change for variants of the image which users would consider
+// duplicates. Running this on a few representative images helps choosing
+// thresholds for a specific type of content. Hash options are applied to all
+// hashes.
+func Stability(img image.Image, perturbations []Perturbation, options ...HashOption) ([]StabilityResult, error) {
+	if perturbations == nil {
+		perturbations = DefaultPerturbations
+	}
+	original, _, err := CreateHashOpts(img, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]StabilityResult, 0, len(perturbations))
+	for _, perturbation := range perturbations {
+		perturbed, err := perturbation.Apply(img)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to apply perturbation %q: %s", perturbation.Name, err)
+		}
+		hash, _, err := CreateHashOpts(perturbed, options...)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to hash perturbation %q: %s", perturbation.Name, err)
+		}
+		results = append(results, StabilityResult{
+			Perturbation: perturbation.Name,
+			Match:        Compare(original, hash),
+		})
+	}
+
+	return results, nil
+}
@@ -2,11 +2,14 @@ package duplo
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
 	"encoding/gob"
 	"fmt"
 	"math"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unique"
 
 	"github.com/rivo/duplo/haar"
 )
@@ -15,6 +18,13 @@ const (
 	// ImageScale is the width and height to which images are resized before they
 	// are being processed.
 	ImageScale = 128
+
+	// bucketStripes is the number of mutexes guarding the index buckets.
+	bucketStripes = 256
+
+	// contextInterval is the number of candidates processed between two
+	// checks of a query's context.
+	contextInterval = 4096
 )
 
 var (
@@ -22,28 +32,24 @@ var (
 	// by absolute value, that will be kept. Coefficients that rank lower will
 	// be discarded. Change this only once when the package is initialized.
 	TopCoefs = 40
-
-	// The weights for the scoring function (currently for the YIQ colour space).
-	weights = [3][6]float64{
-		{5.00, 0.83, 1.01, 0.52, 0.47, 0.30},
-		{19.21, 1.26, 0.44, 0.53, 0.28, 0.14},
-		{34.37, 0.36, 0.45, 0.14, 0.18, 0.27},
-	}
-
-	// The weights, totalled over all colour channels.
-	weightSums = [6]float64{58.58, 2.45, 1.9, 1.19, 0.93, 0.71}
 )
 
 // Store is a data structure that holds references to images. It holds visual
 // hashes and references to the images but the images themselves are not held
 // in the data structure.
 //
-// A general limit to the store is that it can hold no more than 4,294,967,295
-// images. This is to save RAM space but may be easy to extend by modifying its
-// data structures to hold uint64 indices instead of uint32 indices.
+// By default, the store can hold no more than 4,294,967,295 images. Further
+// images are not added. Use New(WithLargeIndex()) to lift this limit.
 //
-// Store's methods are concurrency safe. Store implements the GobDecoder and
-// GobEncoder interfaces.
+// Store's methods are concurrency safe. Read-only methods (e.g. Query(),
+// Has(), IDs()) only take a read lock and may run in parallel. Methods which
+// modify the store take the write lock. No method calls back into user code
+// while holding a lock so it is safe to call any method from anywhere, e.g.
+// while iterating over the results of IDs() or when receiving duplicate events.
+// For latency-sensitive callers, TryAdd() and TryDelete() never block. Queries
+// which must not wait for modifications, e.g. during a bulk ingest, may be run
+// against a Snapshot(). Store implements the GobDecoder and GobEncoder
+// interfaces.
 type Store struct {
 	sync.RWMutex
 
@@ -51,7 +57,11 @@ type Store struct {
 	candidates []candidate
 
 	// All IDs in the store, mapping to candidate indices.
-	ids map[interface{}]uint32
+	ids map[interface{}]uint64
+
+	// The indices of the candidate slots of deleted images, which are reused
+	// by Add().
+	free []uint64
 
 	// indices  contains references to the images in the store. It is a slice
 	// of slices which contains image indices (into the "candidates" slice).
@@ -64,24 +74,128 @@ type Store struct {
 	//		* sign: Either 0 (positive) or 1 (negative)
 	//		* coefIdx: The index of the coefficient (from 0 to (ImageScale*ImageScale)-1)
 	//		* channel: The colour channel (from 0 to haar.ColourChannels-1)
-	indices [][]uint32
+	//
+	// The index lists are compressed (see postings) and must be accessed with
+	// bucket() and distribute().
+	indices []postings
+
+	// Appends to the index buckets are guarded by these mutexes, bucket
+	// "location" being guarded by bucketLocks[location%bucketStripes]. This
+	// allows concurrent calls to Add() to distribute their candidates into the
+	// buckets in parallel. Readers of a bucket only read-lock its mutex so
+	// concurrent queries don't block each other, and an Add() only blocks
+	// queries which read one of the buckets it is appending to at the same
+	// time. Other modifications of the buckets require the write lock on
+	// "distributing" (see lockBuckets()), which in turn is read-locked by
+	// every Add() call while it distributes its candidate.
+	bucketLocks  [bucketStripes]sync.RWMutex
+	distributing sync.RWMutex
 
 	// Whether this store was modified since it was loaded/created.
 	modified bool
+
+	// The store generation, incremented with every modification.
+	generation uint64
+
+	// The weights for the scoring function and the weights totalled over all
+	// colour channels.
+	weights    Weights
+	weightSums [6]float64
+
+	// The weights of the composite score (see SetScoreWeights()).
+	scoreWeights [4]float64
+
+	// If not 0, the number of top coefficients to keep per colour channel,
+	// overriding the hashes' own thresholds (see Tune()).
+	topCoefs int
+
+	// The index of the candidates' dHashes. It is created by the first call
+	// to QueryDHash() and maintained from then on.
+	dHashes *dHashIndex
+
+	// The negative list, mapping query hashes to the IDs of images which are
+	// not duplicates of them (see MarkFalsePositive()). While it is not
+	// empty, negativeIDs maps the IDs on the negative list to the keys of the
+	// lists they are on, and keyCounts holds the number of images in the
+	// store per key, so deletions only touch the affected lists.
+	negatives   map[hashKey]map[interface{}]bool
+	negativeIDs map[interface{}]map[hashKey]bool
+	keyCounts   map[hashKey]int
+
+	// Whether the store may hold more than 4,294,967,295 images (see
+	// WithLargeIndex()).
+	largeIndex bool
+
+	// Whether the store's hashes were created by a version of this package
+	// before hashes were versioned (see HashVersion()).
+	legacyHashes bool
+
+	// Whether IDs are interned (see WithIDInterning()) and the number of
+	// references the store holds to each interned ID.
+	internIDs bool
+	interned  map[unique.Handle[string]]int
+
+	// If this store is the immutable store of a FrozenStore, its index
+	// buckets, replacing "indices".
+	frozen *frozenIndex
+
+	// While the store is loaded in the background (see LoadFileAsync()), its
+	// ID set, which may then be read without locking. "loaded" is closed when
+	// loading has finished, with "loadErr" holding its result.
+	loadingIDs atomic.Pointer[map[interface{}]uint64]
+	loaded     chan struct{}
+	loadErr    error
+
+	// The IDs of the images which are hidden from query results (see
+	// Suppress()).
+	suppressed map[interface{}]bool
+
+	// The write-ahead log which records modifications of the store, if any
+	// (see OpenWAL()).
+	wal *WAL
+
+	// The number of snapshots currently in use (see GobEncode()) and whether
+	// the candidates slice may be shared with one of them. While snapshots are
+	// in use, candidates are copied before they are modified in place.
+	snapshots        atomic.Int32
+	candidatesShared atomic.Bool
+
+	// The subscriptions to duplicate events (see Subscribe()).
+	subscriptions []*subscription
+
+	// The number of queries performed on this store.
+	queries atomic.Uint64
+
+	// The slow query log (see SetSlowQueryThreshold()). Once full,
+	// slowQueries is a ring buffer whose oldest entry is at slowNext.
+	slowThreshold atomic.Int64
+	slowMutex     sync.Mutex
+	slowQueries   []SlowQuery
+	slowNext      int
 }
 
-// New returns a new, empty image store.
-func New() *Store {
+// New returns a new, empty image store, configured with the given options.
+func New(options ...Option) *Store {
 	store := new(Store)
 
-	store.ids = make(map[interface{}]uint32)
-	store.indices = make([][]uint32, 2*ImageScale*ImageScale*haar.ColourChannels)
+	store.ids = make(map[interface{}]uint64)
+	store.indices = make([]postings, 2*ImageScale*ImageScale*haar.ColourChannels)
+	store.setWeights(DefaultWeights)
+	store.scoreWeights = defaultScoreWeights
+	for _, option := range options {
+		option(store)
+	}
 
 	return store
 }
 
 // Has checks if an image (via its ID) is already contained in the store.
 func (store *Store) Has(id interface{}) bool {
+	if ids := store.loadingIDs.Load(); ids != nil {
+		_, ok := (*ids)[id]
+		return ok
+	}
+
 	store.RLock()
 	defer store.RUnlock()
 
@@ -89,67 +203,293 @@ func (store *Store) Has(id interface{}) bool {
 	return ok
 }
 
+// GetHash reconstructs the hash of the image with the given ID from the data
+// kept by the store. If the ID is not contained in the store, false is
+// returned.
+//
+// The reconstruction is lossy because the store does not keep the full Haar
+// coefficients: The scaling function coefficient is exact but of all other
+// coefficients, only the signs of the retained ones are known. These are set
+// to 1 or -1 and all others to 0. The thresholds are therefore all 1, so that
+// the hash's significance map equals the stored one. The ratio, dHash,
+// histogram, Blockhash, and wHash are exact. HistogramCounts is only available
+// if RetainHistogramCounts was set when the image was added.
+func (store *Store) GetHash(id interface{}) (Hash, bool) {
+	store.RLock()
+	defer store.RUnlock()
+
+	index, ok := store.ids[id]
+	if !ok {
+		return Hash{}, false
+	}
+
+	return store.candidateHash(index), true
+}
+
+// candidateHash reconstructs the hash of the candidate with the given index
+// (see GetHash()). The store must be at least read-locked when calling this
+// function.
+func (store *Store) candidateHash(index uint64) Hash {
+	candidate := &store.candidates[index]
+	hash := Hash{
+		Matrix: haar.Matrix{
+			Coefs:  make([]haar.Coef, ImageScale*ImageScale),
+			Width:  ImageScale,
+			Height: ImageScale,
+		},
+		Ratio:     candidate.ratio,
+		DHash:     candidate.dHash,
+		Histogram: candidate.histogram,
+		HistoMax:  candidate.histoMax,
+		Blockhash: candidate.blockhash,
+		WHash:     candidate.wHash,
+		Padded:    candidate.padded,
+	}
+	for channel := range hash.Thresholds {
+		hash.Thresholds[channel] = 1
+	}
+	hash.Coefs[0] = candidate.scaleCoef
+	for location := range candidate.locations {
+		coefIndex, channel, sign := candidate.locations.Position(location)
+		hash.Coefs[coefIndex][channel] = float64(sign)
+	}
+	if candidate.histogramCounts != nil {
+		hash.HistogramCounts = *candidate.histogramCounts
+	}
+
+	return hash
+}
+
 // Add adds an image (via its hash) to the store. The provided ID is the value
 // that will be returned as the result of a similarity query. If an ID is
-// already in the store, it is not added again.
+// already in the store, it is not added again. Neither is it if the store is
+// full (see WithLargeIndex()).
+//
+// Only a small part of Add() holds the store's write lock. The distribution of
+// the image into the index buckets happens under fine-grained locks so that
+// multiple Add() calls can proceed concurrently. During this time, queries may
+// already return the image, with an incomplete score.
 func (store *Store) Add(id interface{}, hash Hash) {
+	if store.addConcurrently(id, hash) == nil {
+		// We need this for when we serialize the store.
+		gob.Register(id)
+	}
+}
+
+// addConcurrently adds an image to the store, holding the write lock only
+// while reserving the candidate slot. If the ID is already in the store or if
+// the store is full, nothing happens and ErrIDExists or ErrStoreFull is
+// returned. The store must not be locked when calling this function.
+func (store *Store) addConcurrently(id interface{}, hash Hash) error {
+	// Check for existing images without blocking queries.
+	if store.Has(id) {
+		return ErrIDExists
+	}
+
+	// Calculate the bucket locations outside of the lock.
+	store.RLock()
+	hash.Thresholds = store.thresholds(hash)
+	store.RUnlock()
+	locations := hash.SignificanceMap()
+
+	// Reserve a candidate slot.
 	store.Lock()
-	defer store.Unlock()
+	index, err := store.reserve(id, hash, locations)
+	if err != nil {
+		store.Unlock()
+		return err
+	}
+	store.distributing.RLock()
+	store.Unlock()
+
+	// Distribute candidate index into the buckets.
+	store.distribute(index, locations)
+	store.distributing.RUnlock()
+
+	store.notifyAdded(id, hash)
+	return nil
+}
 
+// TryAdd is like Add() but it does not block if the store is currently locked
+// by another goroutine. In that case, nothing happens and false is returned.
+// Otherwise, true is returned, regardless of whether the image was added or
+// was already contained in the store.
+func (store *Store) TryAdd(id interface{}, hash Hash) bool {
+	if !store.TryLock() {
+		return false
+	}
+	added := store.add(id, hash)
+	store.Unlock()
+
+	if added {
+		gob.Register(id)
+		store.notifyAdded(id, hash)
+	}
+	return true
+}
+
+// add adds an image to the store and returns true. If the ID is already in the
+// store, nothing happens and false is returned. The store must be write-locked
+// when calling this function.
+func (store *Store) add(id interface{}, hash Hash) bool {
+	if _, ok := store.ids[id]; ok {
+		return false
+	}
+	hash.Thresholds = store.thresholds(hash)
+	locations := hash.SignificanceMap()
+	index, err := store.reserve(id, hash, locations)
+	if err != nil {
+		return false
+	}
+	store.distribute(index, locations)
+	return true
+}
+
+// reserve adds a candidate for the given image, whose hash thresholds must
+// already be adjusted to the store, and returns its index. The candidate is
+// not yet added to the index buckets (see distribute()). If the ID is already
+// in the store or if the store is full, nothing happens and ErrIDExists or
+// ErrStoreFull is returned. The store must be write-locked when calling this
+// function.
+func (store *Store) reserve(id interface{}, hash Hash, locations SignificanceMap) (uint64, error) {
 	// Do we already manage this image?
 	_, ok := store.ids[id]
 	if ok {
 		// Yes, we do. Don't add it again.
-		return
+		return 0, ErrIDExists
+	}
+	if len(store.free) == 0 && uint64(len(store.candidates)) >= store.capacity() {
+		return 0, ErrStoreFull
 	}
-
-	// We need this for when we serialize the store.
-	gob.Register(id)
 
 	// Make this image a candidate.
-	index := len(store.candidates)
-	store.candidates = append(store.candidates, candidate{
+	entry := store.newCandidate(id, hash, locations)
+	index := store.place(entry)
+	store.logAdd(&entry)
+
+	// Image was successfully added.
+	return index, nil
+}
+
+// newCandidate returns a candidate for the given image, to be added in the
+// next store generation. The store must be write-locked when calling this
+// function.
+func (store *Store) newCandidate(id interface{}, hash Hash, locations SignificanceMap) candidate {
+	var histogramCounts *[64]uint8
+	if RetainHistogramCounts {
+		histogramCounts = hashHistogramCounts(hash)
+	}
+	return candidate{
 		id,
 		hash.Coefs[0],
 		hash.Ratio,
 		hash.DHash,
 		hash.Histogram,
-		hash.HistoMax})
-	store.ids[id] = uint32(index)
+		hash.HistoMax,
+		histogramCounts,
+		hash.Blockhash,
+		hash.WHash,
+		locations,
+		time.Now().UnixNano(),
+		store.generation + 1,
+		hash.Padded}
+}
 
-	// Distribute candidate index into the buckets.
-	for coefIndex, coef := range hash.Coefs {
-		if coefIndex == 0 {
-			// This is the scaling function coefficient. Ignore.
-			continue
-		}
+// place stores the given candidate in a free candidate slot and returns its
+// index. The candidate is not yet added to the index buckets. The store must be
+// write-locked when calling this function.
+func (store *Store) place(entry candidate) uint64 {
+	entry.id = store.internID(entry.id)
+
+	// Reuse the slot of a deleted image, if possible.
+	var index int
+	if len(store.free) > 0 {
+		index = int(store.free[len(store.free)-1])
+		store.free = store.free[:len(store.free)-1]
+		store.ownCandidates()
+		store.candidates[index] = entry
+	} else {
+		index = len(store.candidates)
+		store.candidates = append(store.candidates, entry)
+	}
+	store.ids[entry.id] = uint64(index)
+	if store.dHashes != nil {
+		store.dHashes.add(uint64(index), entry.dHash)
+	}
+	store.countKey(&entry, 1)
 
-		for colourIndex, colourCoef := range coef {
-			if math.Abs(colourCoef) < hash.Thresholds[colourIndex] {
-				// Coef is too small. Ignore.
-				continue
-			}
+	store.markModified()
+	return uint64(index)
+}
 
-			sign := 0
-			if colourCoef < 0 {
-				sign = 1
-			}
+// distribute adds the candidate index to the buckets at the given locations.
+// The store must be at least read-locked, or "distributing" must be
+// read-locked, when calling this function.
+func (store *Store) distribute(index uint64, locations SignificanceMap) {
+	for _, location := range locations {
+		lock := &store.bucketLocks[location%bucketStripes]
+		lock.Lock()
+		store.indices[location].append(index)
+		lock.Unlock()
+	}
+}
 
-			// Add this image's index to the bucket.
-			location := sign*ImageScale*ImageScale*haar.ColourChannels + coefIndex*haar.ColourChannels + colourIndex
-			store.indices[location] = append(store.indices[location], uint32(index))
-		}
+// bucket returns the candidate indices of the index bucket at the given
+// location. They are decoded into the given buffer, whose contents are
+// replaced, and the resulting slice is returned. Callers should pass the
+// result of the previous call as the buffer to avoid allocations. The result
+// must not be modified as frozen stores return their index arrays directly.
+// The store must be at least read-locked when calling this function.
+func (store *Store) bucket(location int, buffer []uint64) []uint64 {
+	if store.frozen != nil {
+		return store.frozen.bucket(location)
 	}
+	lock := &store.bucketLocks[location%bucketStripes]
+	lock.RLock()
+	list := store.indices[location]
+	lock.RUnlock()
+	return list.decode(buffer[:0])
+}
 
-	// Image was successfully added.
-	store.modified = true
+// bucketLen returns the number of entries of the index bucket at the given
+// location. The store must be at least read-locked when calling this
+// function.
+func (store *Store) bucketLen(location int) int {
+	if store.frozen != nil {
+		return len(store.frozen.bucket(location))
+	}
+	lock := &store.bucketLocks[location%bucketStripes]
+	lock.RLock()
+	defer lock.RUnlock()
+	return store.indices[location].len()
+}
+
+// lockBuckets write-locks the store and waits for all concurrent Add() calls
+// to finish distributing their candidates. It must be called instead of
+// Lock() by functions which modify existing index buckets.
+func (store *Store) lockBuckets() {
+	store.Lock()
+	store.distributing.Lock()
+}
+
+// unlockBuckets reverses lockBuckets().
+func (store *Store) unlockBuckets() {
+	store.distributing.Unlock()
+	store.Unlock()
 }
 
 // IDs returns a list of IDs of all images contained in the store. This list is
 // created during the call so it may be modified without affecting the store.
 func (store *Store) IDs() (ids []interface{}) {
-	store.Lock()
-	defer store.Unlock()
+	if loading := store.loadingIDs.Load(); loading != nil {
+		for id := range *loading {
+			ids = append(ids, id)
+		}
+		return
+	}
+
+	store.RLock()
+	defer store.RUnlock()
 
 	for id := range store.ids {
 		ids = append(ids, id)
@@ -159,34 +499,188 @@ func (store *Store) IDs() (ids []interface{}) {
 }
 
 // Delete removes an image from the store so it will not be returned during a
-// query anymore. Note that the candidate slot still remains occupied but its
-// index will be removed from all index lists. This also means that Size() will
-// not decrease. This is an expensive operation. If the provided ID could not be
-// found, nothing happens.
+// query anymore. Note that the candidate slot still remains occupied until it
+// is reused by a subsequent Add() but its index will be removed from all index
+// lists. This also means that Size() will not decrease. Only the index lists
+// the image was added to are rewritten, so the cost of a deletion depends on
+// the number of the image's coefficients (see TopCoefs) and the sizes of their
+// lists, not on the total number of index lists. If the provided ID could not
+// be found, nothing happens.
 func (store *Store) Delete(id interface{}) {
-	store.Lock()
+	// Check for the ID without blocking queries.
+	if !store.Has(id) {
+		return
+	}
+
+	store.lockBuckets()
+	defer store.unlockBuckets()
+
+	store.delete(id)
+}
+
+// TryDelete is like Delete() but it does not block if the store is currently
+// locked by another goroutine. In that case, nothing happens and false is
+// returned. Otherwise, true is returned, regardless of whether the image was
+// found in the store.
+func (store *Store) TryDelete(id interface{}) bool {
+	if !store.TryLock() {
+		return false
+	}
 	defer store.Unlock()
+	if !store.distributing.TryLock() {
+		return false
+	}
+	defer store.distributing.Unlock()
+
+	store.delete(id)
+	return true
+}
 
+// delete removes an image from the store and returns true. If the ID was not
+// found, nothing happens and false is returned. The store must be locked with
+// lockBuckets() when calling this function.
+func (store *Store) delete(id interface{}) bool {
 	// Get the index.
 	index, ok := store.ids[id]
 	if !ok {
-		return // ID was not found.
+		return false // ID was not found.
 	}
-	store.modified = true
+	store.markModified()
+	store.logDelete(id)
 
 	// Clear the candidate.
+	store.ownCandidates()
+	deleted := store.candidates[index]
+	locations := deleted.locations
 	store.candidates[index].id = nil
+	store.candidates[index].locations = nil
 	delete(store.ids, id)
+	delete(store.suppressed, id)
+	store.releaseID(deleted.id)
+	store.free = append(store.free, index)
+	if store.dHashes != nil {
+		store.dHashes.remove(index, store.candidates[index].dHash)
+	}
+	store.countKey(&deleted, -1)
+	store.pruneNegatives(&deleted)
+
+	// Remove from the index lists the image was added to.
+	for _, location := range locations {
+		store.indices[location] = store.indices[location].filter(func(other uint64) bool {
+			return other != index
+		}, nil)
+	}
+	return true
+}
+
+// DeleteOlderThan removes all images from the store which were added before
+// the given time. Unlike calling Delete() for each image, each affected index
+// list is only rewritten once. The same caveats as for Delete() apply. The
+// number of removed images is returned.
+func (store *Store) DeleteOlderThan(t time.Time) int {
+	store.lockBuckets()
+	defer store.unlockBuckets()
+
+	added := t.UnixNano()
+	return store.deleteWhere(func(candidate *candidate) bool {
+		return candidate.added < added
+	})
+}
+
+// DeleteBeforeGeneration removes all images from the store which were added
+// in a store generation before the given one (see Generation()). This
+// performs a single pass over the index. The same caveats as for Delete()
+// apply. The number of removed images is returned.
+func (store *Store) DeleteBeforeGeneration(generation uint64) int {
+	store.lockBuckets()
+	defer store.unlockBuckets()
+
+	return store.deleteWhere(func(candidate *candidate) bool {
+		return candidate.generation < generation
+	})
+}
+
+// deleteWhere removes all images from the store for which the provided
+// function returns true, in a single pass over the index lists they were added
+// to. The store must be
+// locked with lockBuckets() when calling this function. The number of removed
+// images is returned.
+func (store *Store) deleteWhere(remove func(candidate *candidate) bool) int {
+	var indices []uint64
+	for index := range store.candidates {
+		candidate := &store.candidates[index]
+		if candidate.id != nil && remove(candidate) {
+			indices = append(indices, uint64(index))
+		}
+	}
+	return store.deleteSlots(indices)
+}
+
+// deleteSlots removes the images in the candidate slots with the given
+// indices, which must be distinct and occupied, from the store, rewriting
+// each affected index list only once. The store must be locked with
+// lockBuckets() when calling this function. The number of removed images is
+// returned.
+func (store *Store) deleteSlots(indices []uint64) int {
+	if len(indices) == 0 {
+		return 0
+	}
+	store.markModified()
+
+	// Clear the candidates.
+	store.ownCandidates()
+	deleted := make([]bool, len(store.candidates))
+	affected := make([]bool, len(store.indices))
+	for _, index := range indices {
+		candidate := &store.candidates[index]
+		deleted[index] = true
+		store.countKey(candidate, -1)
+		store.pruneNegatives(candidate)
+		for _, location := range candidate.locations {
+			affected[location] = true
+		}
+		store.logDelete(candidate.id)
+		delete(store.ids, candidate.id)
+		delete(store.suppressed, candidate.id)
+		store.releaseID(candidate.id)
+		candidate.id = nil
+		candidate.locations = nil
+		store.free = append(store.free, index)
+		if store.dHashes != nil {
+			store.dHashes.remove(index, candidate.dHash)
+		}
+	}
 
-	// Remove from all index lists.
+	// Remove from the index lists the images were added to.
 	for location, list := range store.indices {
-		for indexIndex := range list {
-			if list[indexIndex] == index {
-				store.indices[location] = append(list[:indexIndex], list[indexIndex+1:]...)
-				break
-			}
+		if affected[location] {
+			store.indices[location] = list.filter(func(index uint64) bool {
+				return !deleted[index]
+			}, nil)
+		}
+	}
+
+	return len(indices)
+}
+
+// DeleteMany removes the images with the given IDs from the store. Unlike
+// calling Delete() for each image, each affected index list is only rewritten
+// once, which makes this function considerably faster when removing many
+// images. IDs which cannot be found are ignored. The number of removed images
+// is returned.
+func (store *Store) DeleteMany(ids []interface{}) int {
+	store.lockBuckets()
+	defer store.unlockBuckets()
+
+	indices := make([]uint64, 0, len(ids))
+	seen := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		if index, ok := store.ids[id]; ok && !seen[index] {
+			seen[index] = true
+			indices = append(indices, index)
 		}
 	}
+	return store.deleteSlots(indices)
 }
 
 // Exchange exchanges the ID of an image for a new one. If the old ID could not
@@ -196,6 +690,12 @@ func (store *Store) Exchange(oldID, newID interface{}) error {
 	store.Lock()
 	defer store.Unlock()
 
+	return store.exchange(oldID, newID)
+}
+
+// exchange implements Exchange(). The store must be write-locked when calling
+// this function.
+func (store *Store) exchange(oldID, newID interface{}) error {
 	// Get the old index.
 	index, ok := store.ids[oldID]
 	if !ok {
@@ -209,12 +709,20 @@ func (store *Store) Exchange(oldID, newID interface{}) error {
 
 	// Update the map.
 	delete(store.ids, oldID)
+	newID = store.internID(newID)
 	store.ids[newID] = index
+	if store.suppressed[oldID] {
+		delete(store.suppressed, oldID)
+		store.suppressed[newID] = true
+	}
 
 	// Update the candidate.
+	store.ownCandidates()
+	store.releaseID(store.candidates[index].id)
 	store.candidates[index].id = newID
 
-	store.modified = true
+	store.markModified()
+	store.logExchange(oldID, newID)
 	return nil
 }
 
@@ -226,19 +734,245 @@ func (store *Store) Query(hash Hash) Matches {
 	store.RLock()
 	defer store.RUnlock()
 
+	return store.query(hash)
+}
+
+// QueryGeneration performs the same similarity search as Query() but also
+// returns the store generation (see Generation()) the query ran against. The
+// generation can later be passed to StaleMatches() to check if the results are
+// still valid.
+func (store *Store) QueryGeneration(hash Hash) (Matches, uint64) {
+	store.RLock()
+	defer store.RUnlock()
+
+	return store.query(hash), store.generation
+}
+
+// StaleMatches checks the given matches, which resulted from a query against
+// the given store generation, against the current state of the store. It
+// returns the matches whose images have since been removed from the store,
+// whose IDs have changed, or whose hashes have been replaced. If the returned
+// slice is empty, the matches are still valid.
+func (store *Store) StaleMatches(matches Matches, generation uint64) (stale Matches) {
+	store.RLock()
+	defer store.RUnlock()
+
+	for _, match := range matches {
+		if match == nil {
+			continue
+		}
+		index, ok := store.ids[match.ID]
+		if !ok || store.candidates[index].generation > generation {
+			stale = append(stale, match)
+		}
+	}
+
+	return
+}
+
+// QueryWithOptions performs the same similarity search as Query() but
+// allows to customize the query with the given options. If options is nil,
+// this is the same as Query().
+func (store *Store) QueryWithOptions(hash Hash, options *QueryOptions) Matches {
+	if options != nil && options.DHashPrescreen && options.MaxDHashDistance != 0 {
+		store.rLockDHashes()
+	} else {
+		store.RLock()
+	}
+	defer store.RUnlock()
+
+	return store.queryWithOptions(hash, options)
+}
+
+// QueryContext performs the same similarity search as Query() but aborts it
+// when the given context is cancelled or its deadline expires. In that case,
+// no matches and the context's error are returned. The context is checked
+// periodically while the index buckets (or, with QueryOptions.DHashPrescreen,
+// the prescreened candidates) are scanned and while the matches are created.
+func (store *Store) QueryContext(ctx context.Context, hash Hash) (Matches, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	return store.queryContext(ctx, hash, nil)
+}
+
+// QueryID performs a similarity search using the image with the given ID,
+// which is already contained in the store, as the query. The image itself is
+// not part of the results. The query uses the data kept by the store (see
+// GetHash()) which yields the same Haar scores as querying with the image's
+// original hash. If the ID is not contained in the store, nil is returned.
+func (store *Store) QueryID(id interface{}) Matches {
+	store.RLock()
+	defer store.RUnlock()
+
+	return store.queryID(id)
+}
+
+// queryID implements QueryID(). The store must be at least read-locked when
+// calling this function.
+func (store *Store) queryID(id interface{}) Matches {
+	index, ok := store.ids[id]
+	if !ok {
+		return nil
+	}
+
+	matches := store.query(store.candidateHash(index))
+	for i := 0; i < len(matches); i++ {
+		if matches[i].ID == id {
+			matches = append(matches[:i], matches[i+1:]...)
+			break
+		}
+	}
+	return matches
+}
+
+// query performs a similarity search on the given image hash. The store must
+// be at least read-locked when calling this function.
+func (store *Store) query(hash Hash) Matches {
+	return store.queryWithOptions(hash, nil)
+}
+
+// queryWithOptions performs a similarity search on the given image hash with
+// the given options, which may be nil. The store must be at least read-locked
+// when calling this function.
+func (store *Store) queryWithOptions(hash Hash, options *QueryOptions) Matches {
+	matches, _ := store.queryContext(context.Background(), hash, options)
+	return matches
+}
+
+// queryContext performs a similarity search on the given image hash with the
+// given options, which may be nil, until the given context is done. The store
+// must be at least read-locked when calling this function.
+func (store *Store) queryContext(ctx context.Context, hash Hash, options *QueryOptions) (matches Matches, err error) {
+	start := time.Now()
+	defer func() {
+		store.logQuery(start, len(matches))
+	}()
+	if options == nil {
+		options = &defaultQueryOptions
+	}
+	if options.SignOnly {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return store.querySigns(hash, options), nil
+	}
+	var (
+		scores      []float64
+		numMatches  int
+		prescreened []uint64
+	)
+	if options.DHashPrescreen && options.MaxDHashDistance != 0 {
+		store.queries.Add(1)
+		if prescreened, scores, err = store.prescreen(ctx, hash, options.MaxDHashDistance); err != nil {
+			return nil, err
+		}
+		numMatches = len(prescreened)
+	} else if scores, numMatches, err = store.scoresContext(ctx, hash, options.maxBucket(store.numImages())); err != nil {
+		return nil, err
+	}
+	bestScore := store.bestScore(hash)
+	normalization := 1.0
+	if options.NormalizeScores {
+		normalization = store.scoreNormalization(hash)
+		bestScore /= normalization
+	}
+	var queryCounts *[64]uint8
+	if options.HistogramMetric != HistogramHamming {
+		queryCounts = hashHistogramCounts(hash)
+	}
+
+	// Create matches.
+	negatives := store.negatives[keyOf(hash)]
+	collector := newMatchCollector(options.MaxResults, numMatches)
+	for index, score := range scores {
+		if index%contextInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		if math.IsNaN(score) {
+			continue
+		}
+		if prescreened != nil {
+			index = int(prescreened[index])
+		}
+		candidate := &store.candidates[index]
+		if store.suppressed[candidate.id] {
+			continue
+		}
+		score /= normalization
+		composite := store.compositeScore(candidate, score, hash)
+		if negatives[candidate.id] {
+			if options.FalsePositivePenalty == 0 {
+				continue
+			}
+			composite += options.FalsePositivePenalty
+		}
+		if !options.accepts(candidate, composite, hash) || collector.rejects(composite) {
+			continue
+		}
+		match := store.match(uint64(index), score, hash, bestScore)
+		match.Score = composite
+		if queryCounts != nil {
+			match.ColourDistance = histogramDistance(options.HistogramMetric, candidate.histogram, hash.Histogram, candidate.histogramCounts, queryCounts)
+		}
+		collector.add(match)
+	}
+	matches = collector.result()
+
+	// Break down the scores, if requested.
+	if options.ScoreComponents {
+		hash.Thresholds = store.thresholds(hash)
+		locations := hash.SignificanceMap()
+		for _, match := range matches {
+			match.Components = store.scoreComponents(&store.candidates[store.ids[match.ID]], hash, locations)
+			for component := range match.Components {
+				match.Components[component] /= normalization
+			}
+		}
+	}
+
+	return matches, nil
+}
+
+// scores calculates the scores of all candidates for the given image hash.
+// Candidates which do not share any bucket with the hash have a NaN score.
+// The number of candidates with a score is also returned. The store must be at
+// least read-locked when calling this function.
+func (store *Store) scores(hash Hash) (scores []float64, numMatches int) {
+	scores, numMatches, _ = store.scoresContext(context.Background(), hash, 0)
+	return
+}
+
+// numImages returns the number of images in the store, i.e. the number of
+// occupied candidate slots. Unlike len(store.ids), this also works for the
+// views of snapshots, whose ID maps are only created when needed. The store
+// must be at least read-locked when calling this function.
+func (store *Store) numImages() int {
+	return len(store.candidates) - len(store.free)
+}
+
+// scoresContext is like scores() but stops with the context's error when the
+// given context is done. If maxBucket is not 0, index buckets with more
+// entries are skipped (see QueryOptions.MaxBucketFraction).
+func (store *Store) scoresContext(ctx context.Context, hash Hash, maxBucket int) (scores []float64, numMatches int, err error) {
+	store.queries.Add(1)
+
 	// Empty store, empty result set.
 	if len(store.candidates) == 0 {
-		return nil
+		return nil, 0, ctx.Err()
 	}
+	hash.Thresholds = store.thresholds(hash)
 
 	// We're often touching all candidates at some point.
-	scores := make([]float64, len(store.candidates))
+	scores = make([]float64, len(store.candidates))
 	for index := range scores {
 		scores[index] = math.NaN()
 	}
-	var numMatches int
 
 	// Examine hash buckets.
+	var buffer []uint64
 	for coefIndex, coef := range hash.Coefs {
 		if coefIndex == 0 {
 			// Ignore scaling function coefficient for now.
@@ -270,45 +1004,72 @@ func (store *Store) Query(hash Hash) Matches {
 				sign = 1
 			}
 
+			if err = ctx.Err(); err != nil {
+				return nil, 0, err
+			}
+
 			location := sign*ImageScale*ImageScale*haar.ColourChannels + coefIndex*haar.ColourChannels + colourIndex
-			for _, index := range store.indices[location] {
+			if maxBucket > 0 && store.bucketLen(location) > maxBucket {
+				continue // A stop bucket.
+			}
+			buffer = store.bucket(location, buffer)
+			for _, index := range buffer {
 				// Do we know this index already?
 				if math.IsNaN(scores[index]) {
 					// No. Calculate initial score.
 					score := 0.0
 					for colour := range coef {
-						score += weights[colour][0] *
+						score += store.weights[colour][0] *
 							math.Abs(store.candidates[index].scaleCoef[colour]-hash.Coefs[0][colour])
 					}
 					scores[index] = score
+					numMatches++
 				}
 
 				// At this point, we have an entry in matches. Simply subtract the
 				// corresponding weight.
-				scores[index] -= weightSums[bin]
+				scores[index] -= store.weightSums[bin]
 			}
 		}
 	}
 
-	// Create matches.
-	matches := make([]*Match, 0, numMatches)
-	for index, score := range scores {
-		if !math.IsNaN(score) {
-			matches = append(matches, &Match{
-				ID:        store.candidates[index].id,
-				Score:     score,
-				RatioDiff: math.Abs(math.Log(store.candidates[index].ratio) - math.Log(hash.Ratio)),
-				DHashDistance: hammingDistance(store.candidates[index].dHash[0], hash.DHash[0]) +
-					hammingDistance(store.candidates[index].dHash[1], hash.DHash[1]),
-				HistogramDistance: hammingDistance(store.candidates[index].histogram, hash.Histogram),
-			})
-		}
+	return
+}
+
+// match creates a match for the candidate with the given index and Haar score,
+// matched against the given query hash whose score against itself is
+// "bestScore". The store must be at least read-locked when calling this
+// function.
+func (store *Store) match(index uint64, score float64, hash Hash, bestScore float64) *Match {
+	candidate := &store.candidates[index]
+	match := &Match{
+		ID:        candidate.id,
+		HaarScore: score,
 	}
+	match.setMetrics(candidate, hash, bestScore)
+	match.Score = store.compositeScore(candidate, score, hash)
+	return match
+}
 
-	return matches
+// thresholds returns the coefficient thresholds to be used for the given hash
+// in this store.
+func (store *Store) thresholds(hash Hash) haar.Coef {
+	if store.topCoefs == 0 {
+		return hash.Thresholds
+	}
+	return hashThresholds(hash.Coefs, store.topCoefs)
 }
 
-// Size returns the number of images currently in the store.
+// setWeights sets the weights for the scoring function. The store must be
+// locked when calling this function.
+func (store *Store) setWeights(weights Weights) {
+	store.weights = weights
+	store.weightSums = weights.sums()
+}
+
+// Size returns the number of candidate slots currently in the store. This
+// includes the slots of deleted images until they are reused or removed by
+// Compact(). Use len(IDs()) for the number of images.
 func (store *Store) Size() int {
 	store.RLock()
 	defer store.RUnlock()
@@ -316,6 +1077,39 @@ func (store *Store) Size() int {
 	return len(store.candidates)
 }
 
+// Generation returns the store's generation. It starts at 0 for a new store
+// and is incremented with every modification of the store.
+func (store *Store) Generation() uint64 {
+	store.RLock()
+	defer store.RUnlock()
+
+	return store.generation
+}
+
+// HashVersion returns the HashVersion of the hashes in the store. It is 0 if
+// the store was loaded from data written by a version of this package before
+// hashes were versioned. These hashes were created with
+// NfntScaler{Interpolation: resize.Bicubic} and do not match hashes created
+// with DefaultScaler. Query such stores with hashes created with
+// WithScaler(NfntScaler{Interpolation: resize.Bicubic}) or add the images to a
+// new store.
+func (store *Store) HashVersion() int {
+	store.RLock()
+	defer store.RUnlock()
+
+	if store.legacyHashes {
+		return 0
+	}
+	return HashVersion
+}
+
+// markModified flags the store as modified and starts a new generation. The
+// store must be locked when calling this function.
+func (store *Store) markModified() {
+	store.modified = true
+	store.generation++
+}
+
 // Modified indicates whether this store has been modified since it was loaded
 // or created.
 func (store *Store) Modified() bool {
@@ -330,25 +1124,148 @@ func (store *Store) Modified() bool {
 // decoded successfully. Example:
 //
 //     gob.Register(YourType{})
+//
+// This is a wrapper around ReadFrom().
 func (store *Store) GobDecode(from []byte) error {
-	store.Lock()
-	defer store.Unlock()
-
-	buffer := bytes.NewReader(from)
-	decompressor, err := gzip.NewReader(buffer)
-	if err != nil {
-		return fmt.Errorf("Unable to open decompressor: %s", err)
-	}
-	defer decompressor.Close()
-	decoder := gob.NewDecoder(decompressor)
+	_, err := store.ReadFrom(bytes.NewReader(from))
+	return err
+}
 
+// decode reconstructs the store from the given decoder (see ReadFrom()). If
+// "expected" is not 0, it is the version announced by the store header, which
+// the encoded version must match. If "decoded" is not nil, it is called as
+// soon as the candidates and the ID set have been decoded. The store must be
+// locked with lockBuckets() when calling this function.
+func (store *Store) decode(decoder *gob.Decoder, expected int, decoded func()) error {
 	// Do we have a version compatibility problem?
 	var version int
 	if err := decoder.Decode(&version); err != nil {
 		return fmt.Errorf("Unable to decode store version: %s", err)
 	}
+	if expected != 0 && version != expected {
+		return fmt.Errorf("Store version %d does not match header version %d", version, expected)
+	}
+	if version > storeVersion {
+		return fmt.Errorf("Store version %d is not supported, upgrade to a newer version of this package", version)
+	}
 	// So far, all previous versions accepted.
 
+	// Start from an empty store.
+	store.clear()
+	if version < 4 {
+		store.legacyHashes = true
+		if err := store.decodeLegacy(decoder, version, decoded); err != nil {
+			return err
+		}
+		store.restoreFreeList()
+		return nil
+	}
+
+	// Candidates.
+	var size int
+	if err := decoder.Decode(&size); err != nil {
+		return fmt.Errorf("Unable to decode candidate length: %s", err)
+	}
+	store.candidates = make([]candidate, size)
+	for index := 0; index < size; index++ {
+		if err := decoder.Decode(&store.candidates[index].id); err != nil {
+			return fmt.Errorf("Unable to decode candidate ID: %s", err)
+		}
+		var record []byte
+		if err := decoder.Decode(&record); err != nil {
+			return fmt.Errorf("Unable to decode candidate record: %s", err)
+		}
+		if err := store.candidates[index].decodeFields(record); err != nil {
+			return fmt.Errorf("Unable to decode candidate record: %s", err)
+		}
+	}
+
+	// The ID set is derived from the candidates.
+	store.ids = make(map[interface{}]uint64, size)
+	for index := range store.candidates {
+		if id := store.candidates[index].id; id != nil {
+			store.candidates[index].id = store.internID(id)
+			store.ids[store.candidates[index].id] = uint64(index)
+		}
+	}
+	if decoded != nil {
+		decoded()
+	}
+
+	// Indices, encoded bucket by bucket. They also restore the candidates'
+	// bucket locations.
+	store.indices = make([]postings, 2*ImageScale*ImageScale*haar.ColourChannels)
+	var (
+		count int
+		list  []uint64
+	)
+	if err := decoder.Decode(&count); err != nil {
+		return fmt.Errorf("Unable to decode number of indices: %s", err)
+	}
+	if count != len(store.indices) {
+		return fmt.Errorf("Invalid number of indices: %d", count)
+	}
+	for location := range store.indices {
+		list = list[:0]
+		if err := decoder.Decode(&list); err != nil {
+			return fmt.Errorf("Unable to decode indices: %s", err)
+		}
+		if err := store.restoreBucket(location, list); err != nil {
+			return err
+		}
+	}
+
+	// The scoring configuration.
+	var weights Weights
+	if err := decoder.Decode(&weights); err != nil {
+		return fmt.Errorf("Unable to decode weights: %s", err)
+	}
+	store.setWeights(weights)
+	if err := decoder.Decode(&store.topCoefs); err != nil {
+		return fmt.Errorf("Unable to decode number of top coefficients: %s", err)
+	}
+
+	// The store generation.
+	if err := decoder.Decode(&store.generation); err != nil {
+		return fmt.Errorf("Unable to decode store generation: %s", err)
+	}
+
+	// The composite score weights.
+	if err := decoder.Decode(&store.scoreWeights); err != nil {
+		return fmt.Errorf("Unable to decode score weights: %s", err)
+	}
+
+	// The negative list.
+	if err := store.decodeNegatives(decoder); err != nil {
+		return fmt.Errorf("Unable to decode negative list: %s", err)
+	}
+
+	// The index width.
+	var largeIndex bool
+	if err := decoder.Decode(&largeIndex); err != nil {
+		return fmt.Errorf("Unable to decode index width: %s", err)
+	}
+	store.largeIndex = store.largeIndex || largeIndex
+
+	// The suppressed images.
+	var suppressed []interface{}
+	if err := decoder.Decode(&suppressed); err != nil {
+		return fmt.Errorf("Unable to decode suppressed images: %s", err)
+	}
+	for _, id := range suppressed {
+		if _, ok := store.ids[id]; ok {
+			store.suppress(id)
+		}
+	}
+
+	store.restoreFreeList()
+	return nil
+}
+
+// decodeLegacy decodes the candidates, the ID set, and the index buckets of
+// store versions 1 to 3, which had no further data. See decode() for the
+// "decoded" function.
+func (store *Store) decodeLegacy(decoder *gob.Decoder, version int, decoded func()) error {
 	// Candidates.
 	var size int
 	if err := decoder.Decode(&size); err != nil {
@@ -388,6 +1305,7 @@ func (store *Store) GobDecode(from []byte) error {
 	}
 
 	// The ID set.
+	store.ids = make(map[interface{}]uint64, size)
 	if version < 3 {
 		// Versions 1 and 2 used "int" indices. We need to convert.
 		ids := make(map[interface{}]int)
@@ -395,13 +1313,34 @@ func (store *Store) GobDecode(from []byte) error {
 			return fmt.Errorf("Unable to decode ID set: %s", err)
 		}
 		for key, value := range ids {
-			store.ids[key] = uint32(value)
+			store.ids[key] = uint64(value)
 		}
 	} else {
 		if err := decoder.Decode(&store.ids); err != nil {
 			return fmt.Errorf("Unable to decode ID set: %s", err)
 		}
 	}
+	for id, index := range store.ids {
+		if index >= uint64(len(store.candidates)) {
+			return fmt.Errorf("Invalid index %d of ID %v", index, id)
+		}
+
+		// Let the candidates share the IDs of the ID set so that they are not
+		// held in memory twice.
+		store.candidates[index].id = id
+	}
+	if store.internIDs {
+		store.ids = make(map[interface{}]uint64, len(store.ids))
+		for index := range store.candidates {
+			if id := store.candidates[index].id; id != nil {
+				store.candidates[index].id = store.internID(id)
+				store.ids[store.candidates[index].id] = uint64(index)
+			}
+		}
+	}
+	if decoded != nil {
+		decoded()
+	}
 
 	// The coefficient size.
 	if version < 2 {
@@ -412,86 +1351,80 @@ func (store *Store) GobDecode(from []byte) error {
 		}
 	}
 
-	// Indices.
+	// Indices. They also restore the candidates' bucket locations.
+	store.indices = make([]postings, 2*ImageScale*ImageScale*haar.ColourChannels)
+	indices := make([][]uint64, len(store.indices))
 	if version < 3 {
 		// Versions 1 and 2 used "int" indices and a 4D matrix. We need to convert.
-		var indices [][][][]int
-		if err := decoder.Decode(&indices); err != nil {
+		var oldIndices [][][][]int
+		if err := decoder.Decode(&oldIndices); err != nil {
 			return fmt.Errorf("Unable to decode indices: %s", err)
 		}
-		for sign, s1 := range indices {
+		for sign, s1 := range oldIndices {
 			for coefIndex, s2 := range s1 {
 				for colourIndex, indexSlice := range s2 {
 					location := sign*ImageScale*ImageScale*haar.ColourChannels + coefIndex*haar.ColourChannels + colourIndex
-					store.indices[location] = make([]uint32, len(indexSlice))
+					if location >= len(indices) {
+						return fmt.Errorf("Invalid bucket location %d", location)
+					}
+					indices[location] = make([]uint64, len(indexSlice))
 					for i, index := range indexSlice {
-						store.indices[location][i] = uint32(index)
+						indices[location][i] = uint64(index)
 					}
 				}
 			}
 		}
 		store.modified = true
 	} else {
-		if err := decoder.Decode(&store.indices); err != nil {
+		if err := decoder.Decode(&indices); err != nil {
 			return fmt.Errorf("Unable to decode indices: %s", err)
 		}
+		if len(indices) != len(store.indices) {
+			return fmt.Errorf("Invalid number of indices: %d", len(indices))
+		}
+	}
+	for location, list := range indices {
+		if err := store.restoreBucket(location, list); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// GobEncode places a binary representation of the store in a byte slice.
-func (store *Store) GobEncode() ([]byte, error) {
-	store.RLock()
-	defer store.RUnlock()
-
-	buffer := new(bytes.Buffer)
-	compressor := gzip.NewWriter(buffer)
-	encoder := gob.NewEncoder(compressor)
-
-	// Add a version number first.
-	if err := encoder.Encode(3); err != nil {
-		return nil, fmt.Errorf("Unable to encode store version: %s", err)
-	}
-
-	// Candidates are encoded manually because the encoder does not have access
-	// to the candidate struct.
-	if err := encoder.Encode(len(store.candidates)); err != nil {
-		return nil, fmt.Errorf("Unable to encode candidate length: %s", err)
-	}
-	for _, candidate := range store.candidates {
-		if err := encoder.Encode(&candidate.id); err != nil {
-			return nil, fmt.Errorf("Unable to encode candidate ID: %s", err)
-		}
-		if err := encoder.Encode(candidate.scaleCoef); err != nil {
-			return nil, fmt.Errorf("Unable to encode candidate scaling function coefficient: %s", err)
-		}
-		if err := encoder.Encode(candidate.ratio); err != nil {
-			return nil, fmt.Errorf("Unable to encode candidate ratio: %s", err)
-		}
-		if err := encoder.Encode(candidate.dHash); err != nil {
-			return nil, fmt.Errorf("Unable to encode dHash: %s", err)
-		}
-		if err := encoder.Encode(candidate.histogram); err != nil {
-			return nil, fmt.Errorf("Unable to encode histogram bit vector: %s", err)
-		}
-		if err := encoder.Encode(candidate.histoMax); err != nil {
-			return nil, fmt.Errorf("Unable to encode histogram maximum: %s", err)
+// restoreBucket sets the index bucket at the given location to the given
+// candidate indices and adds the location to these candidates. An error is
+// returned if an index is out of range.
+func (store *Store) restoreBucket(location int, list []uint64) error {
+	for _, index := range list {
+		if index >= uint64(len(store.candidates)) {
+			return fmt.Errorf("Invalid index %d in bucket %d", index, location)
 		}
+		store.candidates[index].locations = append(store.candidates[index].locations, uint32(location))
 	}
+	store.indices[location] = newPostings(list)
+	return nil
+}
 
-	// The ID set.
-	if err := encoder.Encode(store.ids); err != nil {
-		return nil, fmt.Errorf("Unable to encode ID set: %s", err)
+// restoreFreeList drops the dHash index, which is rebuilt when needed, and
+// restores the free list from the decoded candidates.
+func (store *Store) restoreFreeList() {
+	store.dHashes = nil
+	store.free = nil
+	for index, candidate := range store.candidates {
+		if candidate.id == nil {
+			store.free = append(store.free, uint64(index))
+		}
 	}
+}
 
-	// Indices.
-	if err := encoder.Encode(store.indices); err != nil {
-		return nil, fmt.Errorf("Unable to encode indices: %s", err)
+// GobEncode places a binary representation of the store in a byte slice. This
+// is a wrapper around WriteTo(). Use WriteTo() directly for large stores to
+// avoid holding the entire representation in memory.
+func (store *Store) GobEncode() ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	if _, err := store.WriteTo(buffer); err != nil {
+		return nil, err
 	}
-
-	// Finish up.
-	compressor.Close()
-
 	return buffer.Bytes(), nil
 }
@@ -0,0 +1,32 @@
+package duplo
+
+import (
+	"math"
+)
+
+// smallIndexCapacity is the number of images a store created without
+// WithLargeIndex() can hold.
+var smallIndexCapacity uint64 = math.MaxUint32
+
+// Option is an option for New().
+type Option func(store *Store)
+
+// WithLargeIndex lifts the store's limit of 4,294,967,295 images. Internally,
+// candidate indices are always 64 bit wide and index buckets are varint
+// encoded so this does not increase the store's memory footprint. The option
+// is kept when the store is serialized (see GobEncode()). A store decoded from
+// such a serialization has a large index, regardless of the options passed to
+// New().
+func WithLargeIndex() Option {
+	return func(store *Store) {
+		store.largeIndex = true
+	}
+}
+
+// capacity returns the maximum number of candidate slots of the store.
+func (store *Store) capacity() uint64 {
+	if store.largeIndex {
+		return math.MaxUint64
+	}
+	return smallIndexCapacity
+}
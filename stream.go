@@ -0,0 +1,290 @@
+package duplo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// storeMagic are the first bytes of a serialized store.
+const storeMagic = "DUPLO\x00ST"
+
+// storeHeader is the header of a serialized store, following the magic bytes.
+// It is followed by the compressed store data (the payload) and a
+// storeTrailer. All fields are encoded in big-endian byte order.
+type storeHeader struct {
+	// The format version, the same as the version in the payload.
+	Version uint32
+
+	// The values of ImageScale and TopCoefs with which the store was
+	// created. Stores can only be read with the same values.
+	ImageScale uint32
+	TopCoefs   uint32
+
+	// The HashVersion of the hashes in the store, or 0 if they were created
+	// by a version of this package before hashes were versioned (see
+	// Store.HashVersion()).
+	HashVersion uint32
+
+	// The number of candidate slots in the store.
+	Candidates uint64
+}
+
+// storeTrailer follows the payload of a serialized store. As stores are
+// written incrementally, these values are not known when the header is
+// written.
+type storeTrailer struct {
+	// The length of the payload in bytes.
+	Length uint64
+
+	// The CRC-32 (IEEE) checksum of the magic bytes, the header, and the
+	// payload.
+	Checksum uint32
+}
+
+// Sizes of the magic bytes and header, and of the trailer.
+var (
+	storeHeaderSize  = int64(len(storeMagic) + binary.Size(storeHeader{}))
+	storeTrailerSize = int64(binary.Size(storeTrailer{}))
+)
+
+// WriteTo writes a binary representation of the store to the given writer. It
+// implements the io.WriterTo interface. Unlike GobEncode(), the store is
+// written incrementally so the representation is never held in memory in its
+// entirety. The representation starts with a header which identifies it as a
+// store and ends with a checksum so that ReadFrom() detects corrupted data.
+//
+// The store is only locked while a snapshot of its state is taken, which is
+// fast because the snapshot shares the store's data. The encoding happens
+// afterwards, without holding any locks, so the store may be modified during
+// the encoding. These modifications are not included in the result. While an
+// encoding is in progress, modifications copy the data they change instead of
+// changing it in place.
+func (store *Store) WriteTo(w io.Writer) (int64, error) {
+	n, _, err := store.writeTo(w)
+	return n, err
+}
+
+// writeTo implements WriteTo(). It also returns the store generation which was
+// written. The store must not be locked when calling this function.
+func (store *Store) writeTo(w io.Writer) (n int64, generation uint64, err error) {
+	store.RLock()
+	store.distributing.Lock() // Wait for concurrent Add() calls to finish.
+	snapshot := store.takeSnapshot()
+	store.distributing.Unlock()
+	store.RUnlock()
+	defer store.releaseSnapshot()
+
+	n, err = snapshot.writeStore(w)
+	return n, snapshot.generation, err
+}
+
+// writeStore writes the snapshot to the given writer, framed by the store
+// header and trailer (see WriteTo()), and returns the number of bytes written.
+func (s *snapshot) writeStore(w io.Writer) (int64, error) {
+	counter := &countingWriter{Writer: w}
+	checksum := crc32.NewIEEE()
+	writer := io.MultiWriter(counter, checksum)
+
+	// The header.
+	header := storeHeader{
+		Version:     storeVersion,
+		ImageScale:  ImageScale,
+		TopCoefs:    uint32(TopCoefs),
+		HashVersion: HashVersion,
+		Candidates:  uint64(len(s.candidates)),
+	}
+	if s.legacyHashes {
+		header.HashVersion = 0
+	}
+	if _, err := io.WriteString(writer, storeMagic); err != nil {
+		return counter.n, fmt.Errorf("Unable to write store header: %s", err)
+	}
+	if err := binary.Write(writer, binary.BigEndian, header); err != nil {
+		return counter.n, fmt.Errorf("Unable to write store header: %s", err)
+	}
+
+	// The payload.
+	if err := s.writeTo(writer); err != nil {
+		return counter.n, err
+	}
+
+	// The trailer.
+	trailer := storeTrailer{
+		Length:   uint64(counter.n - storeHeaderSize),
+		Checksum: checksum.Sum32(),
+	}
+	if err := binary.Write(counter, binary.BigEndian, trailer); err != nil {
+		return counter.n, fmt.Errorf("Unable to write store trailer: %s", err)
+	}
+
+	return counter.n, nil
+}
+
+// ReadFrom reconstructs the store from a binary representation read from the
+// given reader, replacing the store's contents. It implements the
+// io.ReaderFrom interface. See GobDecode() for the registration of ID types.
+// If the reader implements io.ByteReader (e.g. a bufio.Reader), no data beyond
+// the end of the store's representation is read from it.
+//
+// An error is returned if the data is corrupted, i.e. if its checksum does not
+// match, or if the store was created with different values of ImageScale or
+// TopCoefs. If its hashes were created with a different HashVersion, the
+// error wraps ErrHashVersion. The store's contents are undefined in these
+// cases. Stores written by earlier versions of this package, which did not
+// have a header and a checksum, are still accepted. Their hashes predate
+// HashVersion, see Store.HashVersion().
+func (store *Store) ReadFrom(r io.Reader) (int64, error) {
+	store.lockBuckets()
+	defer store.unlockBuckets()
+
+	return store.readFrom(r, nil)
+}
+
+// readFrom implements ReadFrom(). If "decoded" is not nil, it is called as
+// soon as the candidates and the ID set have been decoded. The store must be
+// locked with lockBuckets() when calling this function.
+func (store *Store) readFrom(r io.Reader, decoded func()) (int64, error) {
+	byteReader, ok := r.(interface {
+		io.Reader
+		io.ByteReader
+	})
+	if !ok {
+		byteReader = bufio.NewReader(r)
+	}
+	reader := &checksumReader{r: byteReader, checksum: crc32.NewIEEE()}
+
+	// The header.
+	header, magic, err := readStoreHeader(reader)
+	if errors.Is(err, errNoStoreHeader) {
+		// Earlier versions only wrote the payload.
+		return reader.n, store.decodePayload(io.MultiReader(bytes.NewReader(magic), reader), 0, decoded)
+	}
+	if err != nil {
+		return reader.n, err
+	}
+
+	// The payload.
+	if err := store.decodePayload(reader, int(header.Version), decoded); err != nil {
+		return reader.n, fmt.Errorf("%s (data may be corrupted)", err)
+	}
+	store.legacyHashes = header.HashVersion == 0
+
+	// The trailer.
+	length, checksum := reader.n-storeHeaderSize, reader.checksum.Sum32()
+	var trailer storeTrailer
+	if err := binary.Read(reader, binary.BigEndian, &trailer); err != nil {
+		return reader.n, fmt.Errorf("Unable to read store trailer, data may be truncated: %s", err)
+	}
+	if trailer.Length != uint64(length) || trailer.Checksum != checksum {
+		return reader.n, errors.New("Store checksum mismatch, data is corrupted")
+	}
+	if uint64(len(store.candidates)) != header.Candidates {
+		return reader.n, fmt.Errorf("Store contains %d candidates, header announced %d", len(store.candidates), header.Candidates)
+	}
+
+	return reader.n, nil
+}
+
+// errNoStoreHeader is returned by readStoreHeader() if the data does not
+// start with the store magic bytes.
+var errNoStoreHeader = errors.New("Data does not start with a store header")
+
+// readStoreHeader reads the magic bytes and the store header and checks them.
+// If the data does not start with the magic bytes, errNoStoreHeader is
+// returned, along with the bytes read.
+func readStoreHeader(r io.Reader) (header storeHeader, magic []byte, err error) {
+	magic = make([]byte, len(storeMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return header, nil, fmt.Errorf("Unable to read store header, data may be truncated: %s", err)
+	}
+	if string(magic) != storeMagic {
+		return header, magic, errNoStoreHeader
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return header, nil, fmt.Errorf("Unable to read store header, data may be truncated: %s", err)
+	}
+	if header.Version > storeVersion {
+		return header, nil, fmt.Errorf("Store version %d is not supported, upgrade to a newer version of this package", header.Version)
+	}
+	if header.ImageScale != ImageScale || header.TopCoefs != uint32(TopCoefs) {
+		return header, nil, fmt.Errorf("Store was created with ImageScale %d and TopCoefs %d, expected %d and %d", header.ImageScale, header.TopCoefs, ImageScale, TopCoefs)
+	}
+	if header.HashVersion != 0 && header.HashVersion != HashVersion {
+		return header, nil, fmt.Errorf("Store contains hashes of hash version %d, expected %d: %w", header.HashVersion, HashVersion, ErrHashVersion)
+	}
+	return header, nil, nil
+}
+
+// decodePayload decodes the compressed store data read from the given reader.
+// See decode() for the "expected" version and the "decoded" function. The
+// store must be locked with lockBuckets() when calling this function.
+func (store *Store) decodePayload(r io.Reader, expected int, decoded func()) error {
+	decompressor, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("Unable to open decompressor: %s", err)
+	}
+	defer decompressor.Close()
+	decompressor.Multistream(false)
+	if err := store.decode(gob.NewDecoder(decompressor), expected, decoded); err != nil {
+		return err
+	}
+
+	// Consume the rest of the compressed data, which also verifies it.
+	if _, err := io.Copy(io.Discard, decompressor); err != nil {
+		return fmt.Errorf("Unable to decompress store: %s", err)
+	}
+	return nil
+}
+
+// countingWriter is a writer which counts the bytes written to it.
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+// Write writes to the underlying writer.
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// checksumReader is a reader which counts the bytes read from it and
+// calculates their checksum. Because it implements io.ByteReader, the
+// decompressor does not read ahead from it.
+type checksumReader struct {
+	r interface {
+		io.Reader
+		io.ByteReader
+	}
+	checksum hash.Hash32
+	n        int64
+	single   [1]byte
+}
+
+// Read reads from the underlying reader.
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.checksum.Write(p[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+// ReadByte reads a byte from the underlying reader.
+func (r *checksumReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.single[0] = b
+		r.checksum.Write(r.single[:])
+		r.n++
+	}
+	return b, err
+}
@@ -0,0 +1,101 @@
+package duplo
+
+// subscriptionBuffer is the capacity of the channels returned by
+// Store.Subscribe().
+const subscriptionBuffer = 64
+
+// DuplicateEvent is sent to subscribers when an image is added to the store
+// which is similar to an image already contained in the store.
+type DuplicateEvent struct {
+	// The ID of the image that was just added.
+	ID interface{}
+
+	// The existing image that the new image matched.
+	Match *Match
+}
+
+// subscription is a subscriber's channel and the score threshold for which
+// events are sent.
+type subscription struct {
+	threshold float64
+	events    chan DuplicateEvent
+}
+
+// Subscribe returns a channel which receives an event every time an image is
+// added to the store (via Add()) which matches an existing image with a score
+// lower than the given threshold. While there are subscriptions, each Add()
+// therefore also performs a query, after the image was added and without
+// holding the write lock. Add() does not wait for subscribers. If the
+// channel's buffer is full, events are dropped, so subscribers should receive
+// from the channel promptly. Call Unsubscribe() when events are not needed
+// anymore.
+func (store *Store) Subscribe(threshold float64) <-chan DuplicateEvent {
+	store.Lock()
+	defer store.Unlock()
+
+	sub := &subscription{
+		threshold: threshold,
+		events:    make(chan DuplicateEvent, subscriptionBuffer),
+	}
+	store.subscriptions = append(store.subscriptions, sub)
+
+	return sub.events
+}
+
+// Unsubscribe removes a subscription created with Subscribe() and closes its
+// channel. If the channel is unknown, nothing happens.
+func (store *Store) Unsubscribe(events <-chan DuplicateEvent) {
+	store.Lock()
+	defer store.Unlock()
+
+	for index, sub := range store.subscriptions {
+		if (<-chan DuplicateEvent)(sub.events) == events {
+			close(sub.events)
+			store.subscriptions = append(store.subscriptions[:index], store.subscriptions[index+1:]...)
+			return
+		}
+	}
+}
+
+// notifyAdded queries the store for the image with the given ID and hash,
+// which was just added, and sends events for its matches to all subscribers.
+// Only images which were added before it are reported. The query only holds
+// the read lock so it does not block other queries. The store must not be
+// locked when calling this function.
+func (store *Store) notifyAdded(id interface{}, hash Hash) {
+	store.RLock()
+	defer store.RUnlock()
+	if len(store.subscriptions) == 0 {
+		return
+	}
+	index, ok := store.ids[id]
+	if !ok {
+		return // Deleted in the meantime.
+	}
+	generation := store.candidates[index].generation
+	var existing Matches
+	for _, match := range store.query(hash) {
+		if other, ok := store.ids[match.ID]; ok && store.candidates[other].generation < generation {
+			existing = append(existing, match)
+		}
+	}
+	store.notify(id, existing)
+}
+
+// notify sends events for the given matches of the image with the given ID to
+// all subscribers. The store must be at least read-locked when calling this
+// function.
+func (store *Store) notify(id interface{}, matches Matches) {
+	for _, sub := range store.subscriptions {
+		for _, match := range matches {
+			if match.Score >= sub.threshold {
+				continue
+			}
+			select {
+			case sub.events <- DuplicateEvent{ID: id, Match: match}:
+			default:
+				// Subscriber is not keeping up. Drop the event.
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package duplo
+
+import "fmt"
+
+// Suppress hides the image with the given ID from query results without
+// removing it from the store or touching the index. This is useful for
+// "quarantine then confirm" workflows: Suppressed images can later be removed
+// with Delete() or DeleteMany() (see Suppressed()) or be restored with
+// Unsuppress(). Suppressed images are still reported by Has() and IDs() and
+// they are saved with the store. An error is returned if the ID cannot be
+// found.
+func (store *Store) Suppress(id interface{}) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.ids[id]; !ok {
+		return fmt.Errorf("Image %v not found", id)
+	}
+	if store.suppressed[id] {
+		return nil
+	}
+	store.suppress(id)
+	store.markModified()
+	store.logSuppress(id, true)
+	return nil
+}
+
+// suppress adds the given ID to the suppressed images. The store must be
+// write-locked when calling this function.
+func (store *Store) suppress(id interface{}) {
+	if store.suppressed == nil {
+		store.suppressed = make(map[interface{}]bool)
+	}
+	if index, ok := store.ids[id]; ok && store.internIDs {
+		id = store.candidates[index].id // Share the image's ID.
+	}
+	store.suppressed[id] = true
+}
+
+// Unsuppress makes an image hidden with Suppress() visible in query results
+// again. IDs which are not suppressed are ignored.
+func (store *Store) Unsuppress(id interface{}) {
+	store.Lock()
+	defer store.Unlock()
+
+	if store.suppressed[id] {
+		delete(store.suppressed, id)
+		store.markModified()
+		store.logSuppress(id, false)
+	}
+}
+
+// Suppressed returns the IDs of all images hidden with Suppress().
+func (store *Store) Suppressed() (ids []interface{}) {
+	store.RLock()
+	defer store.RUnlock()
+
+	for id := range store.suppressed {
+		ids = append(ids, id)
+	}
+	return
+}
+
+// copySuppressed returns a copy of the given set of suppressed images.
+func copySuppressed(suppressed map[interface{}]bool) map[interface{}]bool {
+	if len(suppressed) == 0 {
+		return nil
+	}
+	copied := make(map[interface{}]bool, len(suppressed))
+	for id := range suppressed {
+		copied[id] = true
+	}
+	return copied
+}
@@ -0,0 +1,107 @@
+package duplo
+
+import (
+	"image"
+)
+
+// WithTrimBorders causes uniform borders, e.g. the black bars of letterboxed
+// video stills or the white frames of thumbnails, to be removed from the image
+// before it is hashed (see TrimBorders()), so that such images match their
+// borderless originals. The ratio of the resulting hash is that of the
+// trimmed image.
+func WithTrimBorders(tolerance float64) HashOption {
+	return func(config *hashConfig) {
+		config.trimBorders = true
+		config.trimTolerance = tolerance
+	}
+}
+
+// minTrimmed is the minimum fraction of an image's width and height which
+// TrimBorders() keeps. Images which are more uniform than that are not trimmed
+// in that direction.
+const minTrimmed = 0.125
+
+// TrimBorders returns the part of the given image which is enclosed by
+// uniform borders on any of its four sides. A row or column of pixels belongs
+// to a border if none of its colour channels differs from the average colour
+// of the image's outermost row or column on that side by more than the given
+// tolerance, a value between 0 and 1 (e.g. 0.1 for JPEG images). If the image
+// has no borders, or if it is so uniform that less than 1/8 of its width or
+// height would remain, it is returned unchanged in that direction.
+func TrimBorders(img image.Image, tolerance float64) image.Image {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return img
+	}
+	limit := uint32(tolerance * 0xffff)
+
+	// line returns whether the pixels (x0+i*dx, y0+i*dy) for i < n all
+	// have the given colour, within the tolerance.
+	line := func(x0, y0, dx, dy, n int, reference [3]uint32) bool {
+		step := n/256 + 1
+		for i := 0; i < n; i += step {
+			r, g, b, _ := img.At(x0+i*dx, y0+i*dy).RGBA()
+			for channel, value := range [3]uint32{r, g, b} {
+				if value > reference[channel]+limit || value+limit < reference[channel] {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	// average returns the average colour of the same pixels.
+	average := func(x0, y0, dx, dy, n int) (colour [3]uint32) {
+		var sum [3]uint64
+		var count uint64
+		step := n/256 + 1
+		for i := 0; i < n; i += step {
+			r, g, b, _ := img.At(x0+i*dx, y0+i*dy).RGBA()
+			sum[0], sum[1], sum[2] = sum[0]+uint64(r), sum[1]+uint64(g), sum[2]+uint64(b)
+			count++
+		}
+		for channel := range colour {
+			colour[channel] = uint32(sum[channel] / count)
+		}
+		return
+	}
+
+	// Rows.
+	rect := bounds
+	width, height := bounds.Dx(), bounds.Dy()
+	minHeight := int(float64(height)*minTrimmed) + 1
+	top := average(rect.Min.X, rect.Min.Y, 1, 0, width)
+	for rect.Dy() > minHeight && line(rect.Min.X, rect.Min.Y, 1, 0, width, top) {
+		rect.Min.Y++
+	}
+	bottom := average(rect.Min.X, bounds.Max.Y-1, 1, 0, width)
+	for rect.Dy() > minHeight && line(rect.Min.X, rect.Max.Y-1, 1, 0, width, bottom) {
+		rect.Max.Y--
+	}
+	if rect.Dy() <= minHeight {
+		rect.Min.Y, rect.Max.Y = bounds.Min.Y, bounds.Max.Y
+	}
+
+	// Columns, within the remaining rows.
+	minWidth := int(float64(width)*minTrimmed) + 1
+	left := average(rect.Min.X, rect.Min.Y, 0, 1, rect.Dy())
+	for rect.Dx() > minWidth && line(rect.Min.X, rect.Min.Y, 0, 1, rect.Dy(), left) {
+		rect.Min.X++
+	}
+	right := average(bounds.Max.X-1, rect.Min.Y, 0, 1, rect.Dy())
+	for rect.Dx() > minWidth && line(rect.Max.X-1, rect.Min.Y, 0, 1, rect.Dy(), right) {
+		rect.Max.X--
+	}
+	if rect.Dx() <= minWidth {
+		rect.Min.X, rect.Max.X = bounds.Min.X, bounds.Max.X
+	}
+
+	if rect == bounds {
+		return img
+	}
+	trimmed, err := cropImage(img, rect)
+	if err != nil {
+		return img
+	}
+	return trimmed
+}
@@ -0,0 +1,216 @@
+package duplo
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+)
+
+// TuneOptions define the configurations which are evaluated by Store.Tune().
+// Every combination of the provided values is tried.
+type TuneOptions struct {
+	// TopCoefs contains the numbers of top coefficients (per colour channel)
+	// to try.
+	TopCoefs []int
+
+	// Weights contains the weight profiles to try.
+	Weights []Weights
+
+	// HashOptions contains the sets of hash options to try, e.g. different
+	// preprocessing chains (see WithPreprocessors()) or WithPreBlur(). The
+	// sample images are hashed once per set (see CreateHashOpts()). If it is
+	// empty, the images are hashed without options.
+	HashOptions [][]HashOption
+}
+
+// DefaultTuneOptions are the tune options used when none are provided.
+var DefaultTuneOptions = TuneOptions{
+	TopCoefs: []int{20, 30, 40, 60, 80},
+	Weights:  []Weights{WeightsPhotos, WeightsLineArt, WeightsScreenshots, WeightsScannedDocuments},
+}
+
+// TuneResult is the evaluation of one store configuration.
+type TuneResult struct {
+	// The number of top coefficients (per colour channel) that were kept.
+	TopCoefs int
+
+	// The weights of the scoring function.
+	Weights Weights
+
+	// The hash options with which the sample images were hashed, one of
+	// TuneOptions.HashOptions. As the store cannot apply them itself, images
+	// must be hashed with these options before they are added to or queried
+	// against the tuned store.
+	HashOptions []HashOption
+
+	// The score threshold at which the best trade-off between precision and
+	// recall was achieved. Matches with a score lower than this threshold are
+	// considered duplicates.
+	Threshold float64
+
+	// Precision is the fraction of matches below the threshold which are
+	// known duplicates.
+	Precision float64
+
+	// Recall is the fraction of known duplicates which were found below the
+	// threshold.
+	Recall float64
+
+	// F1 is the harmonic mean of precision and recall.
+	F1 float64
+}
+
+// TuneReport is the result of Store.Tune().
+type TuneReport struct {
+	// The evaluations of all configurations, in the order they were tried.
+	Results []TuneResult
+
+	// The configuration with the highest F1 value. This is the configuration
+	// that was applied to the store.
+	Best TuneResult
+}
+
+// Tune evaluates a number of configurations (see TuneOptions) on the given
+// sample images and configures the store with the one that gives the best
+// trade-off between precision and recall. The hash options of the best
+// configuration are returned in the report's Best field and must be used
+// for all images of the store. Each pair in knownPairs contains
+// the indices (into "sample") of two images which are known to be duplicates.
+// All other pairs of images are assumed to be different. The sample should
+// contain representative images of the content that will be stored.
+//
+// If options is nil, DefaultTuneOptions are used. The store must be empty when
+// calling this function, as its configuration affects the index buckets.
+func (store *Store) Tune(sample []image.Image, knownPairs [][2]int, options *TuneOptions) (*TuneReport, error) {
+	if store.Size() > 0 {
+		return nil, errors.New("Unable to tune a store which is not empty")
+	}
+	if options == nil {
+		options = &DefaultTuneOptions
+	}
+	if len(options.TopCoefs) == 0 || len(options.Weights) == 0 {
+		return nil, errors.New("No configurations to tune")
+	}
+
+	// Check the known pairs.
+	duplicates := make(map[[2]int]bool)
+	for _, pair := range knownPairs {
+		if pair[0] < 0 || pair[0] >= len(sample) || pair[1] < 0 || pair[1] >= len(sample) {
+			return nil, fmt.Errorf("Invalid pair %v for %d sample images", pair, len(sample))
+		}
+		if pair[0] == pair[1] {
+			continue
+		}
+		duplicates[pair] = true
+		duplicates[[2]int{pair[1], pair[0]}] = true
+	}
+	if len(duplicates) == 0 {
+		return nil, errors.New("No known duplicate pairs")
+	}
+
+	// Evaluate all configurations, hashing the sample once per set of hash
+	// options. The store configurations only need the coefficients.
+	hashOptions := options.HashOptions
+	if len(hashOptions) == 0 {
+		hashOptions = [][]HashOption{nil}
+	}
+	report := new(TuneReport)
+	hashes := make([]Hash, len(sample))
+	for _, hashOptionSet := range hashOptions {
+		for index, img := range sample {
+			var err error
+			if hashes[index], _, err = CreateHashOpts(img, hashOptionSet...); err != nil {
+				return nil, fmt.Errorf("Unable to hash sample image %d: %s", index, err)
+			}
+		}
+		for _, topCoefs := range options.TopCoefs {
+			for _, weights := range options.Weights {
+				result := evaluateConfig(hashes, duplicates, topCoefs, weights)
+				result.HashOptions = hashOptionSet
+				report.Results = append(report.Results, result)
+				if len(report.Results) == 1 || result.F1 > report.Best.F1 {
+					report.Best = result
+				}
+			}
+		}
+	}
+
+	// Apply the best configuration.
+	store.Lock()
+	if len(store.candidates) > 0 {
+		store.Unlock()
+		return nil, errors.New("Store was modified during tuning")
+	}
+	store.topCoefs = report.Best.TopCoefs
+	store.setWeights(report.Best.Weights)
+	store.markModified()
+	store.Unlock()
+
+	store.persistUnlogged()
+	return report, nil
+}
+
+// evaluateConfig builds a store with the given configuration from the given
+// hashes and determines the best precision/recall trade-off when querying the
+// store with the same hashes. "duplicates" contains all known duplicate pairs
+// in both directions.
+func evaluateConfig(hashes []Hash, duplicates map[[2]int]bool, topCoefs int, weights Weights) TuneResult {
+	result := TuneResult{TopCoefs: topCoefs, Weights: weights}
+
+	store := New()
+	store.topCoefs = topCoefs
+	store.setWeights(weights)
+	for index, hash := range hashes {
+		store.Add(index, hash)
+	}
+
+	// Collect all query results.
+	type scoredPair struct {
+		score     float64
+		duplicate bool
+	}
+	var pairs []scoredPair
+	for index, hash := range hashes {
+		for _, match := range store.Query(hash) {
+			if match.ID.(int) == index {
+				continue
+			}
+			pairs = append(pairs, scoredPair{match.Score, duplicates[[2]int{index, match.ID.(int)}]})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].score < pairs[j].score
+	})
+
+	// Find the threshold with the best F1 value.
+	var truePositives, falsePositives int
+	for index, pair := range pairs {
+		if pair.duplicate {
+			truePositives++
+		} else {
+			falsePositives++
+		}
+		if index < len(pairs)-1 && pairs[index+1].score == pair.score {
+			continue // We can only cut between different scores.
+		}
+		precision := float64(truePositives) / float64(truePositives+falsePositives)
+		recall := float64(truePositives) / float64(len(duplicates))
+		if precision+recall == 0 {
+			continue
+		}
+		f1 := 2 * precision * recall / (precision + recall)
+		if f1 > result.F1 {
+			result.F1 = f1
+			result.Precision = precision
+			result.Recall = recall
+			if index < len(pairs)-1 {
+				result.Threshold = (pair.score + pairs[index+1].score) / 2
+			} else {
+				result.Threshold = pair.score + 1
+			}
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,150 @@
+package duplo
+
+import (
+	"encoding/gob"
+)
+
+// TypedStore is an image store whose image IDs are of a static type T. Unlike
+// Store.Add(), TypedStore.Add() does not register the ID type with the gob
+// package. This is done only once for T, when the store is created with
+// NewTyped() (or decoded), so the wrapped store (see Store()) can also be
+// serialized directly, e.g. with Store.SaveFile(). Otherwise, a TypedStore
+// behaves exactly like a Store (which it wraps).
+type TypedStore[T comparable] struct {
+	store *Store
+}
+
+// NewTyped returns a new, empty image store with IDs of type T. The options
+// are those of New().
+func NewTyped[T comparable](options ...Option) *TypedStore[T] {
+	registerType[T]()
+	return &TypedStore[T]{store: New(options...)}
+}
+
+// Store returns the untyped store wrapped by this store. It provides access
+// to functionality not mirrored by TypedStore. Images should only be added to
+// it with IDs of type T.
+func (s *TypedStore[T]) Store() *Store {
+	return s.store
+}
+
+// Has checks if an image (via its ID) is already contained in the store.
+func (s *TypedStore[T]) Has(id T) bool {
+	return s.store.Has(id)
+}
+
+// Add adds an image (via its hash) to the store. See Store.Add() for details.
+func (s *TypedStore[T]) Add(id T, hash Hash) {
+	s.store.addConcurrently(id, hash)
+}
+
+// IDs returns a list of IDs of all images contained in the store.
+func (s *TypedStore[T]) IDs() []T {
+	s.store.RLock()
+	defer s.store.RUnlock()
+
+	ids := make([]T, 0, len(s.store.ids))
+	for id := range s.store.ids {
+		ids = append(ids, id.(T))
+	}
+
+	return ids
+}
+
+// Delete removes an image from the store. See Store.Delete() for details.
+func (s *TypedStore[T]) Delete(id T) {
+	s.store.Delete(id)
+}
+
+// Exchange exchanges the ID of an image for a new one. See Store.Exchange()
+// for details.
+func (s *TypedStore[T]) Exchange(oldID, newID T) error {
+	return s.store.Exchange(oldID, newID)
+}
+
+// Query performs a similarity search on the given image hash. See
+// Store.Query() for details.
+func (s *TypedStore[T]) Query(hash Hash) TypedMatches[T] {
+	return typedMatches[T](s.store.Query(hash))
+}
+
+// TypedMatch is a match returned by a TypedStore. Its ID is of type T. All
+// other fields are those of the embedded Match, whose ID field holds the same
+// ID as an interface value.
+type TypedMatch[T comparable] struct {
+	Match
+
+	// The ID of the matched image.
+	ID T `json:"id"`
+}
+
+// TypedMatches is a slice of typed match results. Like Matches, it implements
+// sort.Interface, sorting the match with the best score first.
+type TypedMatches[T comparable] []*TypedMatch[T]
+
+func (m TypedMatches[T]) Len() int      { return len(m) }
+func (m TypedMatches[T]) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m TypedMatches[T]) Less(i, j int) bool {
+	return m[j] == nil || (m[i] != nil && m[i].Score < m[j].Score)
+}
+
+// Untyped returns the matches as untyped matches, e.g. to pass them to
+// functions which operate on Matches. The returned matches are copies.
+func (m TypedMatches[T]) Untyped() Matches {
+	matches := make(Matches, len(m))
+	for index, match := range m {
+		if match != nil {
+			untyped := match.Match
+			untyped.ID = match.ID
+			matches[index] = &untyped
+		}
+	}
+	return matches
+}
+
+// typedMatches converts untyped matches, whose IDs must be of type T, into
+// typed matches.
+func typedMatches[T comparable](matches Matches) TypedMatches[T] {
+	typed := make(TypedMatches[T], len(matches))
+	for index, match := range matches {
+		if match != nil {
+			typed[index] = &TypedMatch[T]{Match: *match, ID: match.ID.(T)}
+		}
+	}
+	return typed
+}
+
+// Size returns the number of images currently in the store.
+func (s *TypedStore[T]) Size() int {
+	return s.store.Size()
+}
+
+// Modified indicates whether this store has been modified since it was loaded
+// or created.
+func (s *TypedStore[T]) Modified() bool {
+	return s.store.Modified()
+}
+
+// GobEncode places a binary representation of the store in a byte slice.
+func (s *TypedStore[T]) GobEncode() ([]byte, error) {
+	registerType[T]()
+	return s.store.GobEncode()
+}
+
+// GobDecode reconstructs the store from a binary representation.
+func (s *TypedStore[T]) GobDecode(from []byte) error {
+	registerType[T]()
+	if s.store == nil {
+		s.store = New()
+	}
+	return s.store.GobDecode(from)
+}
+
+// registerType registers the type T with the gob package so values of type T
+// can be transmitted as interface values. Interface types are not registered.
+func registerType[T comparable]() {
+	var zero T
+	if interface{}(zero) != nil {
+		gob.Register(zero)
+	}
+}
@@ -0,0 +1,114 @@
+package duplo
+
+import (
+	"image"
+	"sort"
+)
+
+// HashVariant is the hash of an image which was transformed according to an
+// EXIF orientation value (see WithOrientation()), e.g. rotated, before it
+// was hashed.
+type HashVariant struct {
+	Hash        Hash
+	Orientation int
+}
+
+// Rotations are the orientations of the four rotational variants of an image:
+// unchanged and rotated clockwise by 90°, 180°, and 270°.
+var Rotations = []int{OrientationNormal, OrientationRotate90, OrientationRotate180, OrientationRotate270}
+
+// Flips are the orientations of an image and its mirrored variants: unchanged,
+// flipped horizontally, and flipped vertically.
+var Flips = []int{OrientationNormal, OrientationFlipH, OrientationFlipV}
+
+// AllOrientations are all eight orientations of an image, i.e. its
+// rotational variants and the rotational variants of its mirror image.
+var AllOrientations = []int{
+	OrientationNormal, OrientationFlipH, OrientationRotate180, OrientationFlipV,
+	OrientationTranspose, OrientationRotate90, OrientationTransverse, OrientationRotate270,
+}
+
+// CreateHashVariants hashes the given image once for each of the given
+// orientations (e.g. Rotations or Flips), with the given options applied (see
+// CreateHashOpts()). The variants can then be passed to
+// Store.QueryVariants() to find images which are rotated or mirrored versions
+// of the given image.
+func CreateHashVariants(img image.Image, orientations []int, options ...HashOption) ([]HashVariant, error) {
+	variants := make([]HashVariant, 0, len(orientations))
+	for _, orientation := range orientations {
+		hash, _, err := CreateHashOpts(img, append(options[:len(options):len(options)], WithOrientation(orientation))...)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, HashVariant{Hash: hash, Orientation: orientation})
+	}
+	return variants, nil
+}
+
+// QueryVariants performs a similarity search (see QueryWithOptions()) for each
+// of the given variants of a query image (see CreateHashVariants()) and
+// returns, for each matched image, the match of the variant with the best
+// score. The Rotation and Flipped fields of the matches report which variant
+// matched.
+// Images therefore need to be added to the store only once, in their original
+// orientation. If options.MaxResults is not 0, the best MaxResults matches
+// are returned, sorted by their score.
+func (store *Store) QueryVariants(variants []HashVariant, options *QueryOptions) Matches {
+	if options != nil && options.DHashPrescreen && options.MaxDHashDistance != 0 {
+		store.rLockDHashes()
+	} else {
+		store.RLock()
+	}
+	defer store.RUnlock()
+
+	best := make(map[interface{}]*Match)
+	for _, variant := range variants {
+		rotation, flipped := orientationTransform(variant.Orientation)
+		for _, match := range store.queryWithOptions(variant.Hash, options) {
+			if match == nil {
+				continue
+			}
+			if other, ok := best[match.ID]; ok && other.Score <= match.Score {
+				continue
+			}
+			match.Rotation = rotation
+			match.Flipped = flipped
+			best[match.ID] = match
+		}
+	}
+
+	matches := make(Matches, 0, len(best))
+	for _, match := range best {
+		matches = append(matches, match)
+	}
+	if options != nil && options.MaxResults > 0 {
+		sort.Sort(matches)
+		if len(matches) > options.MaxResults {
+			matches = matches[:options.MaxResults]
+		}
+	}
+	return matches
+}
+
+// orientationTransform returns the clockwise rotation in degrees and whether
+// the image is flipped horizontally (before it is rotated) for the given EXIF
+// orientation value.
+func orientationTransform(orientation int) (rotation int, flipped bool) {
+	switch orientation {
+	case OrientationFlipH:
+		return 0, true
+	case OrientationRotate180:
+		return 180, false
+	case OrientationFlipV:
+		return 180, true
+	case OrientationTranspose:
+		return 270, true
+	case OrientationRotate90:
+		return 90, false
+	case OrientationTransverse:
+		return 90, true
+	case OrientationRotate270:
+		return 270, false
+	}
+	return 0, false
+}
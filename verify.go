@@ -0,0 +1,152 @@
+package duplo
+
+import (
+	"fmt"
+)
+
+// Verify cross-checks the store's internal data structures: The ID set, the
+// candidate slots, the free list, and the contents of the index buckets. It
+// returns one error for each inconsistency found, e.g. bucket entries which
+// point to deleted or nonexistent images, images missing from buckets, or
+// images posted twice to the same bucket. If the store is consistent, nil is
+// returned. Inconsistencies should not occur during normal operation but
+// after a crash or a bug in an external storage backend, Verify() tells
+// whether the store can be trusted. Use Repair() to fix them.
+func (store *Store) Verify() []error {
+	store.RLock()
+	defer store.RUnlock()
+	store.distributing.Lock() // Wait for concurrent Add() calls to finish.
+	defer store.distributing.Unlock()
+
+	return store.verify()
+}
+
+// verify implements Verify(). The store must be read-locked and "distributing"
+// must be write-locked when calling this function.
+func (store *Store) verify() (errs []error) {
+	// The ID set.
+	for id, index := range store.ids {
+		if int(index) >= len(store.candidates) {
+			errs = append(errs, fmt.Errorf("ID %v points to nonexistent slot %d", id, index))
+		} else if store.candidates[index].id != id {
+			errs = append(errs, fmt.Errorf("ID %v points to slot %d which holds ID %v", id, index, store.candidates[index].id))
+		}
+	}
+	var deleted int
+	for index, candidate := range store.candidates {
+		if candidate.id == nil {
+			deleted++
+			continue
+		}
+		if current, ok := store.ids[candidate.id]; !ok {
+			errs = append(errs, fmt.Errorf("ID %v of slot %d is missing from the ID set", candidate.id, index))
+		} else if int(current) != index {
+			errs = append(errs, fmt.Errorf("ID %v of slot %d is also held by slot %d", candidate.id, index, current))
+		}
+	}
+
+	// The free list.
+	free := make(map[uint64]bool, len(store.free))
+	for _, index := range store.free {
+		switch {
+		case int(index) >= len(store.candidates):
+			errs = append(errs, fmt.Errorf("Free list contains nonexistent slot %d", index))
+		case store.candidates[index].id != nil:
+			errs = append(errs, fmt.Errorf("Free list contains occupied slot %d", index))
+		case free[index]:
+			errs = append(errs, fmt.Errorf("Free list contains slot %d more than once", index))
+		}
+		free[index] = true
+	}
+	if len(free) < deleted {
+		errs = append(errs, fmt.Errorf("Free list is missing %d deleted slots", deleted-len(free)))
+	}
+
+	// The index buckets.
+	postings := make([]int, len(store.candidates))
+	var list []uint64
+	for location := range store.indices {
+		list = store.indices[location].decode(list[:0])
+		seen := make(map[uint64]bool, len(list))
+		for _, index := range list {
+			switch {
+			case int(index) >= len(store.candidates):
+				errs = append(errs, fmt.Errorf("Bucket %d contains nonexistent slot %d", location, index))
+				continue
+			case store.candidates[index].id == nil:
+				errs = append(errs, fmt.Errorf("Bucket %d contains deleted slot %d", location, index))
+			case seen[index]:
+				errs = append(errs, fmt.Errorf("Bucket %d contains image %v more than once", location, store.candidates[index].id))
+			case !store.candidates[index].locations.contains(uint32(location)):
+				errs = append(errs, fmt.Errorf("Bucket %d contains image %v which does not belong there", location, store.candidates[index].id))
+			default:
+				postings[index]++
+			}
+			seen[index] = true
+		}
+	}
+	for index, candidate := range store.candidates {
+		if candidate.id != nil && postings[index] != len(candidate.locations) {
+			errs = append(errs, fmt.Errorf("Image %v is missing from %d of its buckets", candidate.id, len(candidate.locations)-postings[index]))
+		}
+	}
+
+	return
+}
+
+// Repair fixes all inconsistencies reported by Verify(). The candidate slots
+// are considered authoritative: The ID set, the free list, and all index
+// buckets are rebuilt from them. If the same ID is held by multiple slots,
+// only the first one is kept. The number of inconsistencies found before the
+// repair is returned. This is an expensive operation as all index buckets are
+// rebuilt.
+func (store *Store) Repair() (problems int) {
+	defer func() {
+		if problems > 0 {
+			store.persistUnlogged() // After unlocking the store.
+		}
+	}()
+	store.lockBuckets()
+	defer store.unlockBuckets()
+
+	problems = len(store.verify())
+	if problems == 0 {
+		return 0
+	}
+
+	// Rebuild the ID set and the free list.
+	store.ownCandidates()
+	store.ids = make(map[interface{}]uint64, len(store.candidates))
+	store.free = nil
+	for index := range store.candidates {
+		candidate := &store.candidates[index]
+		if candidate.id != nil {
+			if _, ok := store.ids[candidate.id]; !ok {
+				store.ids[candidate.id] = uint64(index)
+				continue
+			}
+			store.releaseID(candidate.id)
+			candidate.id = nil // Duplicate ID.
+			candidate.locations = nil
+		}
+		store.free = append(store.free, uint64(index))
+	}
+
+	// Rebuild the index buckets.
+	indices := make([][]uint64, len(store.indices))
+	for index, candidate := range store.candidates {
+		for _, location := range candidate.locations {
+			indices[location] = append(indices[location], uint64(index))
+		}
+	}
+	for location, list := range indices {
+		store.indices[location] = newPostings(list)
+	}
+	store.dHashes = nil // Rebuilt when needed.
+	if store.keyCounts != nil {
+		store.countKeys()
+	}
+
+	store.markModified()
+	return problems
+}
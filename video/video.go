@@ -0,0 +1,265 @@
+/*
+Package video fingerprints videos with the duplo package so that clips can be
+matched against the videos they were taken from, even if they were trimmed,
+re-encoded, or resized. Decoding is left to the user: Frames from any decoder
+are passed to a Fingerprinter, which hashes keyframes sampled at regular
+intervals. The resulting signature is a sequence of timestamped frame hashes.
+
+A duplo.Store serves as the frame index. Each keyframe is added under a
+duplo.FrameID whose Parent is the video's ID and whose Frame is the
+keyframe's time in milliseconds, so the store can be saved and loaded as
+usual. A query looks up each keyframe of the query clip in the store and
+reports the videos whose matched keyframes agree on a common time offset:
+
+	fingerprinter := video.NewFingerprinter(time.Second)
+	for frame := range decodedFrames {
+		if err := fingerprinter.AddFrame(frame.Image, frame.Time); err != nil {
+			panic(err)
+		}
+	}
+	signature := fingerprinter.Signature()
+
+	store := duplo.New()
+	video.Add(store, "movie.mp4", signature)
+	matches := video.QueryVideo(store, clipSignature, nil)
+
+Use the same sampling interval and hash options for all videos of a store.
+*/
+package video
+
+import (
+	"encoding/gob"
+	"fmt"
+	"image"
+	"sort"
+	"time"
+
+	"github.com/rivo/duplo"
+)
+
+// Keyframe is a hashed frame of a video.
+type Keyframe struct {
+	// The frame's presentation time, relative to the start of the video.
+	Time time.Duration
+
+	// The frame's hash.
+	Hash duplo.Hash
+}
+
+// Signature is the temporal signature of a video, its keyframes in the order
+// of their times.
+type Signature []Keyframe
+
+// Fingerprinter hashes the frames of a video, provided one at a time, into
+// its signature. Frames are sampled at a regular interval: A frame becomes a
+// keyframe if at least one interval has passed since the previous keyframe.
+type Fingerprinter struct {
+	interval  time.Duration
+	options   []duplo.HashOption
+	signature Signature
+}
+
+// NewFingerprinter returns a new fingerprinter which samples one keyframe per
+// given interval (all frames if it is 0) and hashes it with the given options
+// (see duplo.CreateHashOpts()).
+func NewFingerprinter(interval time.Duration, options ...duplo.HashOption) *Fingerprinter {
+	return &Fingerprinter{interval: interval, options: options}
+}
+
+// AddFrame adds the next frame of the video, which is shown at the given time
+// relative to the start of the video. Frames must be added in the order of
+// their times. An error is returned if a sampled frame could not be hashed.
+func (f *Fingerprinter) AddFrame(img image.Image, t time.Duration) error {
+	if len(f.signature) > 0 && t < f.signature[len(f.signature)-1].Time+f.interval {
+		return nil // Not sampled.
+	}
+	hash, _, err := duplo.CreateHashOpts(img, f.options...)
+	if err != nil {
+		return fmt.Errorf("Unable to hash frame at %s: %s", t, err)
+	}
+	f.signature = append(f.signature, Keyframe{Time: t, Hash: hash})
+	return nil
+}
+
+// Signature returns the signature of the frames added so far.
+func (f *Fingerprinter) Signature() Signature {
+	return f.signature
+}
+
+// Add adds the keyframes of the video with the given ID and signature to the
+// store (see package documentation).
+func Add(store *duplo.Store, id interface{}, signature Signature) {
+	gob.Register(id) // The frame IDs contain it.
+	for _, keyframe := range signature {
+		store.Add(duplo.FrameID{Parent: id, Frame: int(keyframe.Time / time.Millisecond)}, keyframe.Hash)
+	}
+}
+
+// Delete removes the keyframes of the video with the given ID from the store.
+// The number of removed keyframes is returned.
+func Delete(store *duplo.Store, id interface{}) int {
+	return store.DeleteAnimated(id)
+}
+
+// QueryOptions control how videos are matched.
+type QueryOptions struct {
+	// The options of the store queries performed for each keyframe of the
+	// query clip. If nil, the MaxResults best frames are considered per
+	// keyframe.
+	FrameOptions *duplo.QueryOptions
+
+	// The maximum number of store matches considered per keyframe if
+	// FrameOptions is nil.
+	MaxResults int
+
+	// The minimum similarity (see duplo.Match) of a keyframe match. Keyframe
+	// matches below it are ignored.
+	MinSimilarity float64
+
+	// The maximum deviation from the common time offset for a keyframe match
+	// to count towards it, typically the sampling interval.
+	Tolerance time.Duration
+
+	// The minimum number of keyframes of the query clip which must be matched
+	// at a common offset for a video to be reported.
+	MinKeyframes int
+}
+
+// DefaultQueryOptions are the query options used when none are provided.
+var DefaultQueryOptions = QueryOptions{
+	MaxResults:    10,
+	MinSimilarity: 0.5,
+	Tolerance:     time.Second,
+	MinKeyframes:  2,
+}
+
+// Match is a video matched by QueryVideo().
+type Match struct {
+	// The ID of the matched video.
+	ID interface{}
+
+	// The time in the matched video which corresponds to the start of the
+	// query clip.
+	Offset time.Duration
+
+	// The number of keyframes of the query clip which were matched at this
+	// offset.
+	Keyframes int
+
+	// The fraction of the query clip's keyframes which were matched, between
+	// 0 and 1.
+	Coverage float64
+
+	// The average score (see duplo.Match) of the matched keyframes. The
+	// lower, the better.
+	Score float64
+}
+
+// Matches are the results of QueryVideo(). Sorting them puts the best match
+// first: The match with the most matched keyframes or, for equal numbers,
+// with the lowest score.
+type Matches []*Match
+
+func (m Matches) Len() int      { return len(m) }
+func (m Matches) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m Matches) Less(i, j int) bool {
+	if m[i].Keyframes != m[j].Keyframes {
+		return m[i].Keyframes > m[j].Keyframes
+	}
+	return m[i].Score < m[j].Score
+}
+
+// frameMatch is the match of a query keyframe with a stored keyframe.
+type frameMatch struct {
+	keyframe int           // The index of the query keyframe.
+	offset   time.Duration // Stored time minus query time.
+	score    float64
+}
+
+// QueryVideo finds the videos in the store (see Add()) which contain the clip
+// with the given signature. Each keyframe of the clip is looked up in the
+// store. A video matches if enough of these keyframes match its keyframes at
+// a consistent time offset, which makes the search robust against trimming
+// and against frames which happen to look alike. Only the best offset is
+// reported per video. The matches are sorted, best first. If options is nil,
+// DefaultQueryOptions are used.
+func QueryVideo(store *duplo.Store, signature Signature, options *QueryOptions) Matches {
+	if options == nil {
+		options = &DefaultQueryOptions
+	}
+	frameOptions := options.FrameOptions
+	if frameOptions == nil {
+		frameOptions = &duplo.QueryOptions{MaxResults: options.MaxResults}
+	}
+
+	// Collect the keyframe matches per video.
+	videos := make(map[interface{}][]frameMatch)
+	for index, keyframe := range signature {
+		for _, match := range store.QueryWithOptions(keyframe.Hash, frameOptions) {
+			if match == nil || match.Similarity < options.MinSimilarity {
+				continue
+			}
+			frame, ok := match.ID.(duplo.FrameID)
+			if !ok {
+				continue // Not a video keyframe.
+			}
+			videos[frame.Parent] = append(videos[frame.Parent], frameMatch{
+				keyframe: index,
+				offset:   time.Duration(frame.Frame)*time.Millisecond - keyframe.Time,
+				score:    match.Score,
+			})
+		}
+	}
+
+	// Find the best offset per video.
+	var matches Matches
+	for id, frames := range videos {
+		if match := alignFrames(frames, options.Tolerance); match != nil && match.Keyframes >= options.MinKeyframes {
+			match.ID = id
+			match.Coverage = float64(match.Keyframes) / float64(len(signature))
+			matches = append(matches, match)
+		}
+	}
+	sort.Sort(matches)
+
+	return matches
+}
+
+// alignFrames returns the offset which the most query keyframes agree on,
+// within the given tolerance, as a match without ID and coverage. Each query
+// keyframe is counted once, with its best score.
+func alignFrames(frames []frameMatch, tolerance time.Duration) *Match {
+	sort.Slice(frames, func(i, j int) bool {
+		return frames[i].offset < frames[j].offset
+	})
+
+	var best *Match
+	for start := range frames {
+		// Collect the best frame per keyframe in the window starting at this
+		// offset.
+		keyframes := make(map[int]frameMatch)
+		for end := start; end < len(frames) && frames[end].offset-frames[start].offset <= tolerance; end++ {
+			if other, ok := keyframes[frames[end].keyframe]; !ok || frames[end].score < other.score {
+				keyframes[frames[end].keyframe] = frames[end]
+			}
+		}
+		var (
+			offset time.Duration
+			score  float64
+		)
+		for _, frame := range keyframes {
+			offset += frame.offset
+			score += frame.score
+		}
+		match := &Match{
+			Offset:    offset / time.Duration(len(keyframes)),
+			Keyframes: len(keyframes),
+			Score:     score / float64(len(keyframes)),
+		}
+		if best == nil || (Matches{match, best}).Less(0, 1) {
+			best = match
+		}
+	}
+
+	return best
+}
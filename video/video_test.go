@@ -0,0 +1,80 @@
+package video
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/nfnt/resize"
+	"github.com/rivo/duplo"
+)
+
+// scene returns a frame of the scene with the given number, a grid of random
+// colours.
+func scene(number int64) image.Image {
+	random := rand.New(rand.NewSource(number))
+	img := image.NewRGBA(image.Rect(0, 0, 96, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			if x%16 == 0 && y%16 == 0 {
+				img.Set(x, y, color.RGBA{uint8(random.Intn(256)), uint8(random.Intn(256)), uint8(random.Intn(256)), 0xff})
+			} else {
+				img.Set(x, y, img.At(x-x%16, y-y%16))
+			}
+		}
+	}
+	return img
+}
+
+// fingerprint returns the signature of a video at 10 frames per second whose
+// scene changes every second, starting with the given scene. The frames are
+// transformed with the given function before they are hashed. Only frames
+// between the given start and end times are included.
+func fingerprint(t *testing.T, firstScene int64, start, end time.Duration, transform func(image.Image) image.Image) Signature {
+	fingerprinter := NewFingerprinter(time.Second)
+	for frame := start; frame < end; frame += 100 * time.Millisecond {
+		img := transform(scene(firstScene + int64(frame/time.Second)))
+		if err := fingerprinter.AddFrame(img, frame-start); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fingerprinter.Signature()
+}
+
+// Test matching trimmed and re-encoded clips.
+func TestQueryVideo(t *testing.T) {
+	unchanged := func(img image.Image) image.Image { return img }
+	store := duplo.New()
+	movie := fingerprint(t, 0, 0, 10*time.Second, unchanged)
+	if len(movie) != 10 {
+		t.Fatalf("Expected 10 keyframes, got %d", len(movie))
+	}
+	Add(store, "movie", movie)
+	Add(store, "other", fingerprint(t, 100, 0, 10*time.Second, unchanged))
+
+	// A trimmed, downscaled clip.
+	clip := fingerprint(t, 0, 3500*time.Millisecond, 8500*time.Millisecond, func(img image.Image) image.Image {
+		return resize.Resize(48, 32, img, resize.Bilinear)
+	})
+	matches := QueryVideo(store, clip, nil)
+	if len(matches) == 0 || matches[0].ID != "movie" {
+		t.Fatalf("Clip did not match the movie: %v", matches)
+	}
+	if offset := matches[0].Offset; offset < 2500*time.Millisecond || offset > 4500*time.Millisecond {
+		t.Errorf("Unexpected offset %s", offset)
+	}
+	if matches[0].Keyframes < 4 {
+		t.Errorf("Only %d keyframes matched", matches[0].Keyframes)
+	}
+	for _, match := range matches {
+		if match.ID == "other" {
+			t.Error("Clip matched an unrelated video")
+		}
+	}
+
+	if removed := Delete(store, "movie"); removed != 10 {
+		t.Errorf("Removed %d keyframes, expected 10", removed)
+	}
+}
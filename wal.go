@@ -0,0 +1,735 @@
+package duplo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"sync"
+)
+
+// WALCompactionRecords is the number of records after which a write-ahead log
+// is compacted automatically, in the background (see WAL.Compact()). If it is
+// 0, logs are only compacted when WAL.Compact() is called.
+var WALCompactionRecords = 100000
+
+// walMagic are the first bytes of a write-ahead log file.
+const walMagic = "DUPLO\x00WL"
+
+// The operations recorded in a write-ahead log.
+const (
+	walAdd = iota + 1
+	walDelete
+	walExchange
+	walSuppress
+	walUnsuppress
+	walMarkNegative
+	walUnmarkNegative
+)
+
+// WAL is a write-ahead log which records every modification of a store made
+// via Add(), Delete(), Exchange(), Suppress(), Unsuppress(),
+// MarkFalsePositive(), MarkFalsePositiveHash(), or UnmarkFalsePositive()
+// (including variants like TryAdd(), AddAll(), or DeleteOlderThan()) as a
+// compact record appended to a log file.
+// Together with a full snapshot of the store, the log allows ReplayWAL() to
+// reconstruct the store without having to save the entire store after every
+// small change.
+//
+// For a path p, the snapshot is a regular store file at p (see
+// Store.SaveFile()) and the log is kept at p + ".wal". When the log grows too
+// large (see WALCompactionRecords), it is compacted: The current state of the
+// store is written to the snapshot and the log is emptied.
+//
+// Records are written to the operating system immediately but they are only
+// synced to disk by Sync() and Close(). The remaining modifications of the
+// store, made via Store.Compact(), SetScoreWeights(), SetWeights(), Tune(), or
+// Repair(), are not recorded. Instead, these functions compact the log before
+// they return. Errors which occur while writing records or compacting the log
+// are returned by the next call to Sync(), Compact(), or Close().
+type WAL struct {
+	store *Store
+	path  string
+
+	// Guards the log file and the fields below.
+	mutex sync.Mutex
+
+	// The log file, opened for appending, or nil if the log was closed.
+	file *os.File
+
+	// The number of records in the log file.
+	records int
+
+	// The first error which occurred while writing records.
+	err error
+
+	// Held during compaction. "compacting" is set while a compaction is
+	// running in the background.
+	compaction sync.Mutex
+	compacting bool
+	background sync.WaitGroup
+
+	// A buffer used to encode records.
+	buffer bytes.Buffer
+}
+
+// walRecord is a modification of the store recorded in a write-ahead log.
+type walRecord struct {
+	op         byte
+	generation uint64 // The store generation after the modification.
+	id         interface{}
+	newID      interface{}     // Exchange() only.
+	fields     []byte          // Add() only, see candidate.encodeFields().
+	locations  SignificanceMap // Add() only.
+	key        hashKey         // Negative list modifications only.
+}
+
+// OpenWAL starts recording modifications of the store in a write-ahead log at
+// the given path (see WAL for details). If the store was reconstructed from
+// the same path with ReplayWAL() and has not been modified since, the existing
+// log is continued. Otherwise, a snapshot of the store is written first,
+// replacing any existing snapshot and log. The store is locked during that
+// time. A store can only have one write-ahead log at a time.
+func (store *Store) OpenWAL(path string) (*WAL, error) {
+	wal := &WAL{store: store, path: path}
+	logPath := path + ".wal"
+
+	// Check the existing log.
+	base, end, records, last, err := scanWAL(logPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil && records == 0 {
+		last = base
+	}
+
+	store.lockBuckets()
+	defer store.unlockBuckets()
+	if store.wal != nil {
+		return nil, errors.New("Store already has a write-ahead log")
+	}
+
+	if err == nil && store.generation == last {
+		// Continue the log, dropping incomplete records.
+		wal.file, err = os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open write-ahead log: %s", err)
+		}
+		if err := wal.file.Truncate(end); err != nil {
+			wal.file.Close()
+			return nil, fmt.Errorf("Unable to truncate write-ahead log: %s", err)
+		}
+		wal.records = records
+	} else {
+		// Start with a new snapshot.
+		snapshot := store.takeSnapshot()
+		err := writeFile(path, func(w io.Writer) error {
+			_, err := snapshot.writeStore(w)
+			return err
+		})
+		store.releaseSnapshot()
+		if err != nil {
+			return nil, err
+		}
+		if err := wal.reset(snapshot.generation, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	store.wal = wal
+	return wal, nil
+}
+
+// ReplayWAL reconstructs a store from the snapshot and the write-ahead log at
+// the given path (see WAL), e.g. after a restart or a crash. The store is
+// created with the given options (see New()). As with Store.GobDecode(), the
+// types of the image IDs must be registered with the gob package first. If
+// neither a snapshot nor a log exist, an empty store is returned. An
+// incomplete record at the end of the log, e.g. because the process crashed
+// while writing it, is ignored.
+//
+// Call Store.OpenWAL() with the same path to continue logging.
+func ReplayWAL(path string, options ...Option) (*Store, error) {
+	store, err := LoadFile(path, options...)
+	if errors.Is(err, fs.ErrNotExist) {
+		store, err = New(options...), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Open the log.
+	file, err := os.Open(path + ".wal")
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open write-ahead log: %s", err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	base, err := readWALHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := store.generation
+	if base > snapshot {
+		return nil, fmt.Errorf("Write-ahead log starts at generation %d but snapshot only contains generation %d", base, snapshot)
+	}
+
+	// Apply the records which are not contained in the snapshot yet.
+	store.lockBuckets()
+	defer store.unlockBuckets()
+	for {
+		record, _, err := readWALRecord(reader)
+		if err == io.EOF || errors.Is(err, errWALIncomplete) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record.generation <= snapshot {
+			continue
+		}
+		if err := store.apply(record); err != nil {
+			return nil, err
+		}
+		store.generation = record.generation
+	}
+
+	return store, nil
+}
+
+// apply applies a record of a write-ahead log to the store. The store must be
+// locked with lockBuckets() when calling this function.
+func (store *Store) apply(record *walRecord) error {
+	switch record.op {
+	case walAdd:
+		if _, ok := store.ids[record.id]; ok {
+			return nil
+		}
+		for _, location := range record.locations {
+			if int(location) >= len(store.indices) {
+				return fmt.Errorf("Invalid bucket location %d in write-ahead log", location)
+			}
+		}
+		entry := candidate{id: record.id, locations: record.locations}
+		if err := entry.decodeFields(record.fields); err != nil {
+			return fmt.Errorf("Unable to decode write-ahead log record: %s", err)
+		}
+		store.distribute(store.place(entry), entry.locations)
+	case walDelete:
+		store.delete(record.id)
+	case walExchange:
+		return store.exchange(record.id, record.newID)
+	case walSuppress:
+		if _, ok := store.ids[record.id]; ok {
+			store.suppress(record.id)
+		}
+	case walUnsuppress:
+		delete(store.suppressed, record.id)
+	case walMarkNegative:
+		store.markNegative(record.key, record.id)
+	case walUnmarkNegative:
+		store.unmarkNegative(record.key, record.id)
+	default:
+		return fmt.Errorf("Unknown write-ahead log operation %d", record.op)
+	}
+	return nil
+}
+
+// logAdd records the addition of the given candidate in the store's
+// write-ahead log, if any. The store must be write-locked when calling this
+// function.
+func (store *Store) logAdd(entry *candidate) {
+	if store.wal != nil {
+		store.wal.append(&walRecord{
+			op:         walAdd,
+			generation: store.generation,
+			id:         entry.id,
+			fields:     entry.encodeFields(),
+			locations:  entry.locations,
+		})
+	}
+}
+
+// logDelete records the removal of the image with the given ID in the store's
+// write-ahead log, if any. The store must be write-locked when calling this
+// function.
+func (store *Store) logDelete(id interface{}) {
+	if store.wal != nil {
+		store.wal.append(&walRecord{op: walDelete, generation: store.generation, id: id})
+	}
+}
+
+// logExchange records the exchange of an image ID in the store's write-ahead
+// log, if any. The store must be write-locked when calling this function.
+func (store *Store) logExchange(oldID, newID interface{}) {
+	if store.wal != nil {
+		store.wal.append(&walRecord{op: walExchange, generation: store.generation, id: oldID, newID: newID})
+	}
+}
+
+// logSuppress records the suppression (see Suppress()) or, if suppressed is
+// false, the unsuppression of the image with the given ID in the store's
+// write-ahead log, if any. The store must be write-locked when calling this
+// function.
+func (store *Store) logSuppress(id interface{}, suppressed bool) {
+	if store.wal != nil {
+		op := byte(walUnsuppress)
+		if suppressed {
+			op = walSuppress
+		}
+		store.wal.append(&walRecord{op: op, generation: store.generation, id: id})
+	}
+}
+
+// logNegative records the addition of the given ID to the negative list of the
+// given key or, if marked is false, its removal from it, in the store's
+// write-ahead log, if any. The store must be write-locked when calling this
+// function.
+func (store *Store) logNegative(key hashKey, id interface{}, marked bool) {
+	if store.wal != nil {
+		op := byte(walUnmarkNegative)
+		if marked {
+			op = walMarkNegative
+		}
+		store.wal.append(&walRecord{op: op, generation: store.generation, id: id, key: key})
+	}
+}
+
+// persistUnlogged compacts the store's write-ahead log, if any, after a
+// modification which is not recorded in the log (see WAL). Errors are recorded
+// in wal.err. The store must not be locked when calling this function.
+func (store *Store) persistUnlogged() {
+	store.RLock()
+	wal := store.wal
+	store.RUnlock()
+	if wal == nil {
+		return
+	}
+	if err := wal.Compact(); err != nil {
+		wal.mutex.Lock()
+		if wal.err == nil {
+			wal.err = err
+		}
+		wal.mutex.Unlock()
+	}
+}
+
+// append writes a record to the log file. Errors are recorded in wal.err. The
+// store must be write-locked when calling this function.
+func (wal *WAL) append(record *walRecord) {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	if wal.file == nil || wal.err != nil {
+		return
+	}
+
+	wal.buffer.Reset()
+	if err := record.encode(&wal.buffer); err != nil {
+		wal.err = err
+		return
+	}
+	if _, err := wal.file.Write(wal.buffer.Bytes()); err != nil {
+		wal.err = fmt.Errorf("Unable to write write-ahead log: %s", err)
+		return
+	}
+	wal.records++
+
+	// Compact the log in the background, if necessary.
+	if WALCompactionRecords > 0 && wal.records >= WALCompactionRecords && !wal.compacting {
+		wal.compacting = true
+		wal.background.Add(1)
+		go func() {
+			defer wal.background.Done()
+			err := wal.Compact()
+			wal.mutex.Lock()
+			if err != nil && wal.err == nil {
+				wal.err = err
+			}
+			wal.compacting = false
+			wal.mutex.Unlock()
+		}()
+	}
+}
+
+// Compact writes the current state of the store to the snapshot file and
+// removes all records from the log which are contained in it. The store is
+// not locked while the snapshot is written, so it may still be modified.
+func (wal *WAL) Compact() error {
+	wal.compaction.Lock()
+	defer wal.compaction.Unlock()
+
+	// Write the snapshot.
+	store := wal.store
+	store.RLock()
+	store.distributing.Lock() // Wait for concurrent Add() calls to finish.
+	snapshot := store.takeSnapshot()
+	store.distributing.Unlock()
+	store.RUnlock()
+	err := writeFile(wal.path, func(w io.Writer) error {
+		_, err := snapshot.writeStore(w)
+		return err
+	})
+	store.releaseSnapshot()
+	if err != nil {
+		return err
+	}
+
+	// Keep only the records which were added since the snapshot was taken.
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	if wal.file == nil {
+		return nil // Closed in the meantime.
+	}
+	if wal.err != nil {
+		return wal.err
+	}
+	file, err := os.Open(wal.path + ".wal")
+	if err != nil {
+		return fmt.Errorf("Unable to open write-ahead log: %s", err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	if _, err := readWALHeader(reader); err != nil {
+		return err
+	}
+	var offset int64
+	for {
+		record, n, err := readWALRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if record.generation > snapshot.generation {
+			break
+		}
+		offset += n
+	}
+	if _, err := file.Seek(walHeaderSize+offset, io.SeekStart); err != nil {
+		return fmt.Errorf("Unable to read write-ahead log: %s", err)
+	}
+	return wal.reset(snapshot.generation, file)
+}
+
+// reset replaces the log file with a new one whose records start after the
+// given store generation, followed by the records read from the given reader
+// (which may be nil), and opens it for appending. wal.mutex must be locked,
+// or the WAL must not be in use yet, when calling this function.
+func (wal *WAL) reset(base uint64, records io.Reader) error {
+	logPath := wal.path + ".wal"
+	var count int
+	if err := writeFile(logPath, func(w io.Writer) error {
+		header := make([]byte, 0, walHeaderSize)
+		header = append(header, walMagic...)
+		header = binary.BigEndian.AppendUint64(header, base)
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if records == nil {
+			return nil
+		}
+		reader := bufio.NewReader(records)
+		for {
+			record, _, err := readWALRecord(reader)
+			if err == io.EOF || errors.Is(err, errWALIncomplete) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := record.encode(w); err != nil {
+				return err
+			}
+			count++
+		}
+	}); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return fmt.Errorf("Unable to open write-ahead log: %s", err)
+	}
+	if wal.file != nil {
+		wal.file.Close()
+	}
+	wal.file = file
+	wal.records = count
+	return nil
+}
+
+// Sync commits all records to disk.
+func (wal *WAL) Sync() error {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	if wal.err != nil {
+		return wal.err
+	}
+	if wal.file == nil {
+		return errors.New("Write-ahead log is closed")
+	}
+	if err := wal.file.Sync(); err != nil {
+		return fmt.Errorf("Unable to sync write-ahead log: %s", err)
+	}
+	return nil
+}
+
+// Close stops recording modifications of the store, waits for a running
+// background compaction to finish, and closes the log file after syncing it to
+// disk. The first error which occurred while writing records is returned.
+func (wal *WAL) Close() error {
+	wal.store.Lock()
+	if wal.store.wal == wal {
+		wal.store.wal = nil
+	}
+	wal.store.Unlock()
+	wal.background.Wait()
+
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	if wal.file == nil {
+		return wal.err
+	}
+	err := wal.file.Sync()
+	if closeErr := wal.file.Close(); err == nil {
+		err = closeErr
+	}
+	wal.file = nil
+	if wal.err != nil {
+		return wal.err
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to close write-ahead log: %s", err)
+	}
+	return nil
+}
+
+// walHeaderSize is the size of the header of a log file: the magic bytes
+// followed by the big-endian store generation after which the log's records
+// start.
+const walHeaderSize = int64(len(walMagic) + 8)
+
+// maxWALRecord is the maximum size of a record's payload. It protects against
+// allocating huge amounts of memory for corrupt data.
+const maxWALRecord = 1 << 24
+
+// errWALIncomplete is returned by readWALRecord() if the log ends with an
+// incomplete record.
+var errWALIncomplete = errors.New("Write-ahead log ends with an incomplete record")
+
+// readWALHeader reads the header of a log file and returns the store
+// generation after which its records start.
+func readWALHeader(r io.Reader) (uint64, error) {
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, fmt.Errorf("Unable to read write-ahead log header: %s", err)
+	}
+	if string(header[:len(walMagic)]) != walMagic {
+		return 0, errors.New("File is not a write-ahead log")
+	}
+	return binary.BigEndian.Uint64(header[len(walMagic):]), nil
+}
+
+// scanWAL reads the log file at the given path and returns the store
+// generation after which its records start, the offset after its last
+// complete record, the number of complete records, and the store generation
+// of the last record.
+func scanWAL(path string) (base uint64, end int64, records int, last uint64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	if base, err = readWALHeader(reader); err != nil {
+		return
+	}
+	end = walHeaderSize
+	for {
+		record, n, err := readWALRecord(reader)
+		if err == io.EOF || errors.Is(err, errWALIncomplete) {
+			return base, end, records, last, nil
+		}
+		if err != nil {
+			return base, end, records, last, err
+		}
+		end += n
+		records++
+		last = record.generation
+	}
+}
+
+// encode writes the record to the given writer. A record starts with the
+// length of its payload as an unsigned varint, followed by the payload and its
+// big-endian CRC-32 (IEEE) checksum. The payload consists of the operation,
+// the store generation, and the operation's arguments. IDs are gob-encoded,
+// the candidate's bucket locations are delta-encoded, and the values of
+// negative list keys are big-endian 64 bit words.
+func (record *walRecord) encode(w io.Writer) error {
+	payload := []byte{record.op}
+	payload = binary.AppendUvarint(payload, record.generation)
+	var err error
+	if payload, err = appendWALID(payload, record.id); err != nil {
+		return err
+	}
+	switch record.op {
+	case walAdd:
+		payload = binary.AppendUvarint(payload, uint64(len(record.fields)))
+		payload = append(payload, record.fields...)
+		payload = binary.AppendUvarint(payload, uint64(len(record.locations)))
+		var previous uint32
+		for _, location := range record.locations {
+			payload = binary.AppendUvarint(payload, uint64(location-previous))
+			previous = location
+		}
+	case walExchange:
+		if payload, err = appendWALID(payload, record.newID); err != nil {
+			return err
+		}
+	case walMarkNegative, walUnmarkNegative:
+		for _, value := range record.key.scaleCoef {
+			payload = binary.BigEndian.AppendUint64(payload, math.Float64bits(value))
+		}
+		payload = binary.BigEndian.AppendUint64(payload, math.Float64bits(record.key.ratio))
+		for _, value := range []uint64{record.key.dHash[0], record.key.dHash[1], record.key.histogram} {
+			payload = binary.BigEndian.AppendUint64(payload, value)
+		}
+	}
+
+	frame := binary.AppendUvarint(make([]byte, 0, len(payload)+binary.MaxVarintLen64+4), uint64(len(payload)))
+	frame = append(frame, payload...)
+	frame = binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(payload))
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("Unable to write write-ahead log: %s", err)
+	}
+	return nil
+}
+
+// appendWALID appends the gob-encoded ID, preceded by its length, to the
+// given record payload.
+func appendWALID(payload []byte, id interface{}) ([]byte, error) {
+	gob.Register(id)
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(&id); err != nil {
+		return nil, fmt.Errorf("Unable to encode image ID: %s", err)
+	}
+	payload = binary.AppendUvarint(payload, uint64(buffer.Len()))
+	return append(payload, buffer.Bytes()...), nil
+}
+
+// readWALRecord reads the next record from the given reader and returns it,
+// along with its size in bytes. If there are no more records, io.EOF is
+// returned. If the last record is incomplete or its checksum does not match,
+// errWALIncomplete is returned.
+func readWALRecord(r *bufio.Reader) (*walRecord, int64, error) {
+	length, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err != nil || length > maxWALRecord {
+		return nil, 0, errWALIncomplete
+	}
+	frame := make([]byte, length+4)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, 0, errWALIncomplete
+	}
+	payload := frame[:length]
+	if binary.BigEndian.Uint32(frame[length:]) != crc32.ChecksumIEEE(payload) {
+		return nil, 0, errWALIncomplete
+	}
+	size := int64(len(binary.AppendUvarint(nil, length))) + int64(len(frame))
+
+	// Decode the payload.
+	invalid := errors.New("Invalid write-ahead log record")
+	if len(payload) == 0 {
+		return nil, 0, invalid
+	}
+	record := &walRecord{op: payload[0]}
+	payload = payload[1:]
+	uvarint := func() (uint64, bool) {
+		value, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return 0, false
+		}
+		payload = payload[n:]
+		return value, true
+	}
+	field := func() ([]byte, bool) {
+		n, ok := uvarint()
+		if !ok || n > uint64(len(payload)) {
+			return nil, false
+		}
+		value := payload[:n]
+		payload = payload[n:]
+		return value, true
+	}
+	id := func() (interface{}, error) {
+		encoded, ok := field()
+		if !ok {
+			return nil, invalid
+		}
+		var id interface{}
+		if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&id); err != nil {
+			return nil, fmt.Errorf("Unable to decode image ID: %s", err)
+		}
+		return id, nil
+	}
+	var ok bool
+	if record.generation, ok = uvarint(); !ok {
+		return nil, 0, invalid
+	}
+	if record.id, err = id(); err != nil {
+		return nil, 0, err
+	}
+	switch record.op {
+	case walAdd:
+		if record.fields, ok = field(); !ok {
+			return nil, 0, invalid
+		}
+		count, ok := uvarint()
+		if !ok || count > uint64(len(payload)) {
+			return nil, 0, invalid
+		}
+		record.locations = make(SignificanceMap, count)
+		var previous uint64
+		for index := range record.locations {
+			delta, ok := uvarint()
+			if !ok {
+				return nil, 0, invalid
+			}
+			previous += delta
+			record.locations[index] = uint32(previous)
+		}
+	case walExchange:
+		if record.newID, err = id(); err != nil {
+			return nil, 0, err
+		}
+	case walMarkNegative, walUnmarkNegative:
+		if len(payload) < 8*(len(record.key.scaleCoef)+4) {
+			return nil, 0, invalid
+		}
+		word := func() uint64 {
+			value := binary.BigEndian.Uint64(payload)
+			payload = payload[8:]
+			return value
+		}
+		for index := range record.key.scaleCoef {
+			record.key.scaleCoef[index] = math.Float64frombits(word())
+		}
+		record.key.ratio = math.Float64frombits(word())
+		record.key.dHash[0], record.key.dHash[1], record.key.histogram = word(), word(), word()
+	}
+
+	return record, size, nil
+}
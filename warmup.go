@@ -0,0 +1,64 @@
+package duplo
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// warmupSink receives the checksums calculated by Warmup() so the memory
+// accesses are not optimized away.
+var warmupSink uint64
+
+// Warmup reads all candidate records and index buckets of the store once,
+// using the given number of goroutines (GOMAXPROCS if parallelism is smaller
+// than 1). Call it after loading a large store and before serving queries so
+// that the first queries don't have to absorb the cost of page faults and cold
+// caches. Queries may run concurrently but modifications of the store are
+// blocked until the function returns.
+func (store *Store) Warmup(parallelism int) {
+	if parallelism < 1 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+
+	store.RLock()
+	defer store.RUnlock()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < parallelism; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			var sum uint64
+
+			// Touch the candidates.
+			from, to := warmupChunk(len(store.candidates), worker, parallelism)
+			for index := from; index < to; index++ {
+				candidate := &store.candidates[index]
+				sum += candidate.dHash[0] ^ candidate.wHash ^ uint64(candidate.histogram)
+				for _, location := range candidate.locations {
+					sum += uint64(location)
+				}
+			}
+
+			// Touch the buckets.
+			from, to = warmupChunk(len(store.indices), worker, parallelism)
+			var buffer []uint64
+			for location := from; location < to; location++ {
+				buffer = store.bucket(location, buffer)
+				for _, index := range buffer {
+					sum += uint64(index)
+				}
+			}
+
+			atomic.AddUint64(&warmupSink, sum)
+		}(worker)
+	}
+	wg.Wait()
+}
+
+// warmupChunk returns the range of elements (out of "total") to be processed
+// by the given worker.
+func warmupChunk(total, worker, workers int) (from, to int) {
+	return total * worker / workers, total * (worker + 1) / workers
+}
@@ -0,0 +1,122 @@
+package duplo
+
+import (
+	"github.com/rivo/duplo/haar"
+)
+
+// Weights are the weights of the scoring function, for each colour channel
+// and for each of the six coefficient bins. Bin 0 contains the scaling
+// function coefficient. The other bins contain the coefficients (x,y) with
+// max(x,y) == bin, or max(x,y) >= 5 for bin 5.
+type Weights [haar.ColourChannels][6]float64
+
+// DefaultWeights are the weights for the YIQ colour space as determined by
+// Jacobs et al. for scanned query images.
+var DefaultWeights = Weights{
+	{5.00, 0.83, 1.01, 0.52, 0.47, 0.30},
+	{19.21, 1.26, 0.44, 0.53, 0.28, 0.14},
+	{34.37, 0.36, 0.45, 0.14, 0.18, 0.27},
+}
+
+// WeightsYCbCr are the weights for hashes created in the YCbCr colour space
+// (see WithColorSpace()). They are derived from DefaultWeights: As the
+// chrominance channels of YCbCr are rotated versions of those of YIQ, both
+// chrominance channels receive the average of the YIQ chrominance weights.
+var WeightsYCbCr = Weights{
+	{5.00, 0.83, 1.01, 0.52, 0.47, 0.30},
+	{26.79, 0.81, 0.45, 0.34, 0.23, 0.21},
+	{26.79, 0.81, 0.45, 0.34, 0.23, 0.21},
+}
+
+// WeightsLab are the weights for hashes created in the CIE L*a*b* colour
+// space (see WithColorSpace()). They are derived from DefaultWeights, with
+// the weights of the average chrominance adjusted to the smaller ranges of the
+// a* and b* channels.
+var WeightsLab = Weights{
+	{5.00, 0.83, 1.01, 0.52, 0.47, 0.30},
+	{37.50, 0.81, 0.45, 0.34, 0.23, 0.21},
+	{37.50, 0.81, 0.45, 0.34, 0.23, 0.21},
+}
+
+// Weight presets for common types of content, to be applied with
+// Store.SetWeights(). Only the totals of bins 1 to 5 over all colour channels
+// affect the scores (see Calibrate()). Use Calibrate() or Store.Tune() to
+// determine weights for other content from a sample of that content.
+var (
+	// WeightsPhotos are the weights for photographs, the same as
+	// DefaultWeights.
+	WeightsPhotos = DefaultWeights
+
+	// WeightsLineArt are the weights for drawings, paintings, and other
+	// images with large areas of uniform colour, as determined by Jacobs et
+	// al. for painted query images.
+	WeightsLineArt = Weights{
+		{4.04, 0.78, 0.46, 0.42, 0.41, 0.32},
+		{15.14, 0.92, 0.53, 0.26, 0.14, 0.07},
+		{22.62, 0.40, 0.63, 0.25, 0.15, 0.38},
+	}
+
+	// WeightsScreenshots are the weights for screenshots and other rendered
+	// user interfaces. They were determined with Calibrate() on all pairs of
+	// images of the "screenshots" sample corpus of the duplotest package,
+	// whose duplicates differ in text, accent colours, resolution, and
+	// overlays.
+	WeightsScreenshots = Weights{
+		{11.64, 1.39, 4.55, 0.03, 13.85, 4.06},
+		{1.69, 2.11, 1.98, 0.03, 8.25, 1.89},
+		{2.70, 0.60, 2.03, 0.01, 5.30, 3.65},
+	}
+
+	// WeightsScannedDocuments are the weights for scanned documents. They
+	// were determined with Calibrate() on all pairs of images of the
+	// "scanned-documents" sample corpus of the duplotest package, whose
+	// duplicates differ in brightness, colour cast, rotation, and offset. As
+	// these change the average colour of a page, it is ignored.
+	WeightsScannedDocuments = Weights{
+		{0, 10.38, 0, 14.14, 0, 1.17},
+		{0, 15.76, 0, 14.41, 0, 0.55},
+		{0, 4.50, 0, 3.81, 0, 1.05},
+	}
+)
+
+// WeightPresets maps the names of the weight presets to their weights, e.g.
+// to select them in configuration files.
+var WeightPresets = map[string]Weights{
+	"photos":            WeightsPhotos,
+	"lineart":           WeightsLineArt,
+	"screenshots":       WeightsScreenshots,
+	"scanned-documents": WeightsScannedDocuments,
+}
+
+// sums returns the weights, totalled over all colour channels.
+func (weights Weights) sums() (sums [6]float64) {
+	for _, channel := range weights {
+		for bin, weight := range channel {
+			sums[bin] += weight
+		}
+	}
+	return
+}
+
+// SetWeights replaces the weights of the scoring function. Weights are only
+// applied at query time, so the index does not need to be rebuilt and all
+// subsequent queries use the new weights. This allows switching between
+// scoring profiles (e.g. DefaultWeights for photographs) on a loaded store.
+// The weights are saved with the store.
+func (store *Store) SetWeights(weights Weights) {
+	store.Lock()
+	store.setWeights(weights)
+	store.markModified()
+	store.Unlock()
+
+	store.persistUnlogged()
+}
+
+// Weights returns the weights of the scoring function currently used by the
+// store (see SetWeights()).
+func (store *Store) Weights() Weights {
+	store.RLock()
+	defer store.RUnlock()
+
+	return store.weights
+}